@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+)
+
+type AccessApplicationRequest struct {
+	Name            string `json:"name"`
+	Domain          string `json:"domain"`
+	Type            string `json:"type"`
+	SessionDuration string `json:"session_duration,omitempty"`
+}
+
+type AccessPolicyRequest struct {
+	Name       string             `json:"name"`
+	Decision   string             `json:"decision"`
+	Precedence int                `json:"precedence"`
+	Include    []AccessPolicyRule `json:"include"`
+}
+
+// AccessPolicyRule is a single include rule of an Access policy. Exactly one
+// of the fields is set.
+type AccessPolicyRule struct {
+	EmailDomain  *AccessEmailDomainRule  `json:"email_domain,omitempty"`
+	Group        *AccessGroupRule        `json:"group,omitempty"`
+	ServiceToken *AccessServiceTokenRule `json:"service_token,omitempty"`
+}
+
+type AccessEmailDomainRule struct {
+	Domain string `json:"domain"`
+}
+
+type AccessGroupRule struct {
+	ID string `json:"id"`
+}
+
+type AccessServiceTokenRule struct {
+	TokenID string `json:"token_id"`
+}
+
+func accessApplicationsPath(accountId string) string {
+	return "accounts/" + accountId + "/access/apps"
+}
+
+func (api CloudflareAPI) CreateAccessApplication(accountId string, application AccessApplicationRequest) ([]byte, error) {
+	jsonBody, err := json.Marshal(application)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.doRequest("POST", accessApplicationsPath(accountId), jsonBody)
+}
+
+func (api CloudflareAPI) DeleteAccessApplication(accountId string, applicationId string) ([]byte, error) {
+	return api.doRequest("DELETE", accessApplicationsPath(accountId)+"/"+applicationId, nil)
+}
+
+func (api CloudflareAPI) CreateAccessPolicy(accountId string, applicationId string, policy AccessPolicyRequest) ([]byte, error) {
+	jsonBody, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.doRequest("POST", accessApplicationsPath(accountId)+"/"+applicationId+"/policies", jsonBody)
+}
+
+// GetAccessOrganization returns the Zero Trust organization of an account,
+// which holds the team domain (auth_domain) that issues Access JWTs.
+func (api CloudflareAPI) GetAccessOrganization(accountId string) ([]byte, error) {
+	return api.doRequest("GET", "accounts/"+accountId+"/access/organizations", nil)
+}
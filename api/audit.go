@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/audit"
+)
+
+// auditCall records a request that changes something in Cloudflare, with the
+// ID of the object it created or changed. Request bodies are not recorded:
+// some, like tunnel secrets, are credentials.
+func auditCall(ctx context.Context, method string, path string, status int, ray string, data []byte, err error) {
+	event := audit.Event{
+		Type:   audit.EVENT_CLOUDFLARE,
+		Method: method,
+		Path:   strings.SplitN(path, "?", 2)[0],
+		Status: status,
+		CFRay:  ray,
+		Result: audit.RESULT_SUCCESS,
+	}
+
+	var response struct {
+		Result struct {
+			ID string `json:"id"`
+		} `json:"result"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	json.Unmarshal(data, &response)
+	event.ResourceID = response.Result.ID
+
+	switch {
+	case err != nil:
+		event.Result = audit.RESULT_ERROR
+		event.Error = err.Error()
+	case status >= 400:
+		event.Result = audit.RESULT_ERROR
+		event.Error = http.StatusText(status)
+		if len(response.Errors) > 0 {
+			event.Error = response.Errors[0].Message
+		}
+	}
+
+	audit.Record(ctx, event)
+}
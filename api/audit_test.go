@@ -0,0 +1,49 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/api"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/audit"
+)
+
+type memorySink struct {
+	lines []string
+}
+
+func (s *memorySink) Write(line []byte) error {
+	s.lines = append(s.lines, string(line))
+	return nil
+}
+
+func TestMutatingCallsAreAudited(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("CF-Ray", "7d1a2b3c4d5e6f70-SJC")
+		w.Write([]byte(`{"success": true, "result": {"id": "023e105f4ecef8ad9ca31a8372d0c353"}}`))
+	}))
+	defer server.Close()
+
+	sink := &memorySink{}
+	log, _ := audit.NewLog(lager.NewLogger("cloudflare-broker"), sink)
+	audit.SetLog(log)
+	defer audit.SetLog(nil)
+
+	testApi := api.CloudflareAPI{Endpoint: server.URL + "/"}
+	testApi.GetZoneByName("domain.com")
+	testApi.AddZone("domain.com")
+
+	if len(sink.lines) != 1 {
+		t.Fatalf("Audit log has %d events", len(sink.lines))
+	}
+	var event audit.Event
+	json.Unmarshal([]byte(sink.lines[0]), &event)
+	if event.Type != audit.EVENT_CLOUDFLARE || event.Method != "POST" || event.Path != "zones/" || event.Status != http.StatusOK ||
+		event.CFRay != "7d1a2b3c4d5e6f70-SJC" || event.ResourceID != "023e105f4ecef8ad9ca31a8372d0c353" || event.Result != audit.RESULT_SUCCESS {
+		t.Errorf("AddZone was audited as %s", sink.lines[0])
+	}
+}
@@ -2,8 +2,16 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/tracing"
 )
 
 const CLOUDFLARE_CLIENT_API_ENDPOINT = "https://api.cloudflare.com/client/v4/"
@@ -13,12 +21,52 @@ const X_AUTH_KEY_HEADER = "X-Auth-Key"
 
 type CloudflareAPIInterface interface {
 	AddZone(domain string) ([]byte, error)
-	DeleteZone(zoneId string) error
-	SetAuthHeaders(authHeaders AuthHeaders)
+	DeleteZone(zoneId string) ([]byte, error)
+	GetZone(zoneId string) ([]byte, error)
+	GetZoneByName(domain string) ([]byte, error)
+	ListZones(page int) ([]byte, error)
+	SetZonePaused(zoneId string, paused bool) ([]byte, error)
+	ZoneActivationCheck(zoneId string) ([]byte, error)
+	// With returns a client that sends authHeaders and traces its requests
+	// as children of the span in ctx
+	With(ctx context.Context, authHeaders AuthHeaders) CloudflareAPIInterface
+
+	CreateR2Bucket(accountId string, bucket R2BucketRequest) ([]byte, error)
+	PutR2BucketCORS(accountId string, bucketName string, rules []byte) ([]byte, error)
+	PutR2BucketLifecycle(accountId string, bucketName string, rules []byte) ([]byte, error)
+	ListR2Objects(accountId string, bucketName string, cursor string) ([]byte, error)
+	DeleteR2Object(accountId string, bucketName string, key string) ([]byte, error)
+	DeleteR2Bucket(accountId string, bucketName string) ([]byte, error)
+	ListR2Buckets(accountId string) ([]byte, error)
+	CreateAccountToken(accountId string, token TokenRequest) ([]byte, error)
+	DeleteAccountToken(accountId string, tokenId string) ([]byte, error)
+
+	CreateAccessApplication(accountId string, application AccessApplicationRequest) ([]byte, error)
+	DeleteAccessApplication(accountId string, applicationId string) ([]byte, error)
+	CreateAccessPolicy(accountId string, applicationId string, policy AccessPolicyRequest) ([]byte, error)
+	GetAccessOrganization(accountId string) ([]byte, error)
+
+	CreateTunnel(accountId string, tunnel TunnelRequest) ([]byte, error)
+	GetTunnel(accountId string, tunnelId string) ([]byte, error)
+	DeleteTunnel(accountId string, tunnelId string) ([]byte, error)
+	ListTunnels(accountId string) ([]byte, error)
+	GetTunnelToken(accountId string, tunnelId string) ([]byte, error)
+	PutTunnelConfiguration(accountId string, tunnelId string, configuration TunnelConfiguration) ([]byte, error)
+	ListTunnelConnections(accountId string, tunnelId string) ([]byte, error)
+	CleanupTunnelConnections(accountId string, tunnelId string) ([]byte, error)
+
+	CreateDNSRecord(zoneId string, record DNSRecordRequest) ([]byte, error)
+	DeleteDNSRecord(zoneId string, recordId string) ([]byte, error)
 }
 
 type CloudflareAPI struct {
 	Auth AuthHeaders
+	// Endpoint overrides CLOUDFLARE_CLIENT_API_ENDPOINT when set.
+	Endpoint string
+	// Timeout limits each request when set.
+	Timeout time.Duration
+	// Context holds the span that requests are traced as children of.
+	Context context.Context
 }
 
 type AuthHeaders struct {
@@ -34,9 +82,86 @@ func (api *CloudflareAPI) SetAuthHeaders(authHeaders AuthHeaders) {
 	api.Auth = authHeaders
 }
 
-func (api CloudflareAPI) AddZone(domain string) ([]byte, error) {
-	var jsonBody = []byte(`{"name" : "` + domain + `"}`)
-	request, err := http.NewRequest("POST", CLOUDFLARE_CLIENT_API_ZONES, bytes.NewReader(jsonBody))
+// With returns a copy of the client for one operation, so that operations
+// with different credentials can run at once.
+func (api CloudflareAPI) With(ctx context.Context, authHeaders AuthHeaders) CloudflareAPIInterface {
+	api.Auth = authHeaders
+	api.Context = ctx
+
+	return api
+}
+
+func (api CloudflareAPI) getEndpoint() string {
+	if api.Endpoint != "" {
+		return api.Endpoint
+	}
+
+	return CLOUDFLARE_CLIENT_API_ENDPOINT
+}
+
+// doRequest sends an authenticated request to the Cloudflare client API and
+// returns the raw response body. path is relative to the API endpoint.
+// Requests that Cloudflare rate-limits, and idempotent requests that fail
+// with a gateway error, are retried up to MAX_RETRIES times. Requests that
+// change something are recorded in the audit log.
+func (api CloudflareAPI) doRequest(method string, path string, body []byte) (data []byte, err error) {
+	endpoint := endpointLabel(path)
+	_, span := tracing.StartSpan(api.Context, "cloudflare "+method+" "+endpoint, tracing.SPAN_KIND_CLIENT)
+	span.SetAttribute("http.method", method)
+	span.SetAttribute("cloudflare.endpoint", endpoint)
+	var status int
+	var ray string
+	defer func() {
+		span.Finish(err)
+		if method != "GET" {
+			auditCall(api.Context, method, path, status, ray, data, err)
+		}
+	}()
+
+	for attempt := 0; ; attempt++ {
+		startedAt := time.Now()
+		var response *http.Response
+		response, err = api.send(method, path, body)
+		statusLabel := "error"
+		if err == nil {
+			statusLabel = strconv.Itoa(response.StatusCode)
+		}
+		requestDuration.Observe(time.Since(startedAt).Seconds(), method, endpoint, statusLabel)
+		if err != nil {
+			return nil, err
+		}
+		status, ray = response.StatusCode, response.Header.Get("CF-Ray")
+		span.SetAttribute("http.status_code", strconv.Itoa(status))
+		span.SetAttribute("cloudflare.ray", ray)
+		if attempt > 0 {
+			span.SetAttribute("cloudflare.retries", strconv.Itoa(attempt))
+		}
+
+		data, err = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if response.StatusCode == http.StatusTooManyRequests {
+			rateLimited.Inc(method, endpoint)
+		}
+		wait, retry := retryAfter(method, response, attempt)
+		if !retry {
+			return data, nil
+		}
+		retries.Inc(method, endpoint)
+		sleep(wait)
+	}
+}
+
+func (api CloudflareAPI) send(method string, path string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	request, err := http.NewRequest(method, api.getEndpoint()+path, reader)
 	if err != nil {
 		return nil, err
 	}
@@ -44,37 +169,55 @@ func (api CloudflareAPI) AddZone(domain string) ([]byte, error) {
 	var authHeaders = api.GetAuthHeaders()
 	request.Header.Add(X_AUTH_EMAIL_HEADER, authHeaders.XAuthEmail)
 	request.Header.Add(X_AUTH_KEY_HEADER, authHeaders.XAuthKey)
-
-	var client = http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		return nil, err
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
 	}
-	defer response.Body.Close()
 
-	data, err := ioutil.ReadAll(response.Body)
+	var client = http.Client{Timeout: api.Timeout}
+	return client.Do(request)
+}
+
+func (api CloudflareAPI) AddZone(domain string) ([]byte, error) {
+	jsonBody, err := json.Marshal(map[string]string{"name": domain})
 	if err != nil {
 		return nil, err
 	}
 
-	return data, err
+	return api.doRequest("POST", "zones/", jsonBody)
 }
 
-func (api CloudflareAPI) DeleteZone(zoneId string) error {
-	request, err := http.NewRequest("DELETE", CLOUDFLARE_CLIENT_API_ZONES+zoneId, nil)
-	if err != nil {
-		return err
-	}
+func (api CloudflareAPI) DeleteZone(zoneId string) ([]byte, error) {
+	return api.doRequest("DELETE", "zones/"+zoneId, nil)
+}
 
-	var authHeaders = api.GetAuthHeaders()
-	request.Header.Add(X_AUTH_EMAIL_HEADER, authHeaders.XAuthEmail)
-	request.Header.Add(X_AUTH_KEY_HEADER, authHeaders.XAuthKey)
+func (api CloudflareAPI) GetZone(zoneId string) ([]byte, error) {
+	return api.doRequest("GET", "zones/"+zoneId, nil)
+}
+
+// GetZoneByName lists the zones named domain, of which there is at most one
+// per account.
+func (api CloudflareAPI) GetZoneByName(domain string) ([]byte, error) {
+	return api.doRequest("GET", "zones?name="+url.QueryEscape(domain), nil)
+}
+
+// ListZones returns one page of the zones the credentials can access.
+func (api CloudflareAPI) ListZones(page int) ([]byte, error) {
+	return api.doRequest("GET", "zones?per_page=50&page="+strconv.Itoa(page), nil)
+}
 
-	var client = http.Client{}
-	_, err = client.Do(request)
+// SetZonePaused pauses or resumes Cloudflare for a zone. A paused zone only
+// resolves DNS and no longer proxies traffic.
+func (api CloudflareAPI) SetZonePaused(zoneId string, paused bool) ([]byte, error) {
+	jsonBody, err := json.Marshal(map[string]bool{"paused": paused})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return api.doRequest("PATCH", "zones/"+zoneId, jsonBody)
+}
+
+// ZoneActivationCheck asks Cloudflare to check the nameservers of a pending
+// zone again instead of waiting for the next scheduled check.
+func (api CloudflareAPI) ZoneActivationCheck(zoneId string) ([]byte, error) {
+	return api.doRequest("PUT", "zones/"+zoneId+"/activation_check", nil)
 }
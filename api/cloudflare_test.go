@@ -1,8 +1,13 @@
 package api_test
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/api"
 )
@@ -31,3 +36,50 @@ func TestSetAuthHeaders(t *testing.T) {
 		t.Errorf("TestSetAuthHeaders failed")
 	}
 }
+
+func TestWith(t *testing.T) {
+	auth := api.AuthHeaders{XAuthEmail: "my@email.com", XAuthKey: "myKey"}
+	testApi := &api.CloudflareAPI{Timeout: time.Second}
+
+	client, ok := testApi.With(context.Background(), auth).(api.CloudflareAPI)
+	if !ok || client.Auth != auth || client.Timeout != time.Second || client.Context == nil {
+		t.Errorf("With returned %+v", client)
+	}
+	if testApi.Auth != (api.AuthHeaders{}) || testApi.Context != nil {
+		t.Errorf("With changed the client it was called on %+v", testApi)
+	}
+}
+
+func TestAddZoneEncodesName(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer server.Close()
+
+	testApi := api.CloudflareAPI{Endpoint: server.URL + "/"}
+	testApi.AddZone(`domain.com", "type": "partial`)
+
+	if len(body) != 1 || body["name"] != `domain.com", "type": "partial` {
+		t.Errorf("AddZone sent %v", body)
+	}
+}
+
+func TestDeleteZoneReturnsResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"success": false, "errors": [{"code": 1068, "message": "Permission denied"}]}`))
+	}))
+	defer server.Close()
+
+	testApi := api.CloudflareAPI{Endpoint: server.URL + "/"}
+	data, err := testApi.DeleteZone("zone")
+
+	var response struct {
+		Success bool `json:"success"`
+	}
+	if err != nil || json.Unmarshal(data, &response) != nil || response.Success {
+		t.Errorf("DeleteZone returned %s %v", data, err)
+	}
+}
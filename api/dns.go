@@ -0,0 +1,27 @@
+package api
+
+import (
+	"encoding/json"
+)
+
+type DNSRecordRequest struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Proxied bool   `json:"proxied"`
+	TTL     int    `json:"ttl,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+func (api CloudflareAPI) CreateDNSRecord(zoneId string, record DNSRecordRequest) ([]byte, error) {
+	jsonBody, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.doRequest("POST", "zones/"+zoneId+"/dns_records", jsonBody)
+}
+
+func (api CloudflareAPI) DeleteDNSRecord(zoneId string, recordId string) ([]byte, error) {
+	return api.doRequest("DELETE", "zones/"+zoneId+"/dns_records/"+recordId, nil)
+}
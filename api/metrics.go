@@ -0,0 +1,102 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/metrics"
+)
+
+// MAX_RETRIES is how often a rate-limited or failed request is sent again.
+const MAX_RETRIES = 2
+
+// MAX_RETRY_WAIT caps how long a request waits before it is retried, whatever
+// Retry-After says, since the operation that sent it waits meanwhile.
+const MAX_RETRY_WAIT = 10 * time.Second
+
+var requestDuration = metrics.NewHistogramVec(
+	"cloudflare_api_request_duration_seconds",
+	"Latency of Cloudflare API requests by method, endpoint and status code.",
+	metrics.DEFAULT_BUCKETS,
+	"method", "endpoint", "status",
+)
+
+var retries = metrics.NewCounterVec(
+	"cloudflare_api_retries_total",
+	"Cloudflare API requests sent again after a rate limit or gateway error.",
+	"method", "endpoint",
+)
+
+var rateLimited = metrics.NewCounterVec(
+	"cloudflare_api_rate_limited_total",
+	"Cloudflare API requests answered with 429 Too Many Requests.",
+	"method", "endpoint",
+)
+
+func init() {
+	metrics.MustRegister(requestDuration, retries, rateLimited)
+}
+
+// sleep waits before a retry; tests replace it.
+var sleep = time.Sleep
+
+// collections are the path segments followed by an identifier, which
+// endpointLabel replaces so that metrics do not get a series per zone.
+var collections = map[string]bool{
+	"zones":       true,
+	"accounts":    true,
+	"dns_records": true,
+	"buckets":     true,
+	"objects":     true,
+	"tokens":      true,
+	"apps":        true,
+	"cfd_tunnel":  true,
+}
+
+// endpointLabel turns a request path such as "zones/abc/dns_records/def" into
+// "zones/:id/dns_records/:id".
+func endpointLabel(path string) string {
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 1; i < len(segments); i++ {
+		if collections[segments[i-1]] {
+			segments[i] = ":id"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// retryAfter reports whether a request should be sent again after response,
+// and how long to wait first. Rate-limited requests were not processed and
+// are always retried; gateway errors only for idempotent methods.
+func retryAfter(method string, response *http.Response, attempt int) (time.Duration, bool) {
+	if attempt >= MAX_RETRIES {
+		return 0, false
+	}
+
+	switch response.StatusCode {
+	case http.StatusTooManyRequests:
+		wait := time.Second << uint(attempt)
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		if wait > MAX_RETRY_WAIT {
+			wait = MAX_RETRY_WAIT
+		}
+		return wait, true
+
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		if method == "POST" || method == "PATCH" {
+			return 0, false
+		}
+		return time.Second << uint(attempt), true
+	}
+
+	return 0, false
+}
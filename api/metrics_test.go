@@ -0,0 +1,59 @@
+package api_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/api"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/metrics"
+)
+
+func TestRateLimitedRequestsAreRetried(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer server.Close()
+
+	testApi := api.CloudflareAPI{Endpoint: server.URL + "/"}
+	data, err := testApi.GetZone("023e105f4ecef8ad9ca31a8372d0c353")
+	if err != nil || string(data) != `{"success": true}` || requests != 2 {
+		t.Errorf("GetZone returned %s %v after %d requests", data, err, requests)
+	}
+
+	var buffer bytes.Buffer
+	metrics.DefaultRegistry.Write(&buffer)
+	for _, line := range []string{
+		`cloudflare_api_rate_limited_total{method="GET",endpoint="zones/:id"} 1`,
+		`cloudflare_api_retries_total{method="GET",endpoint="zones/:id"} 1`,
+		`cloudflare_api_request_duration_seconds_count{method="GET",endpoint="zones/:id",status="200"} 1`,
+	} {
+		if !strings.Contains(buffer.String(), line) {
+			t.Errorf("Metrics do not contain %s", line)
+		}
+	}
+}
+
+func TestFailedCreateIsNotRetried(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	testApi := api.CloudflareAPI{Endpoint: server.URL + "/"}
+	testApi.AddZone("domain.com")
+	if requests != 1 {
+		t.Errorf("AddZone was sent %d times after a gateway error", requests)
+	}
+}
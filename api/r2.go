@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"net/url"
+)
+
+// Permission groups granted to the account tokens handed out as R2 S3 keys.
+const R2_BUCKET_ITEM_READ_PERMISSION = "6a018a9f2fc74eb6b293b0c548f38b39"
+const R2_BUCKET_ITEM_WRITE_PERMISSION = "2efd5506f9c8494dacb1fa10a3e7d5b6"
+
+type R2BucketRequest struct {
+	Name         string `json:"name"`
+	LocationHint string `json:"locationHint,omitempty"`
+}
+
+type TokenRequest struct {
+	Name     string        `json:"name"`
+	Policies []TokenPolicy `json:"policies"`
+}
+
+type TokenPolicy struct {
+	Effect           string                 `json:"effect"`
+	Resources        map[string]string      `json:"resources"`
+	PermissionGroups []TokenPermissionGroup `json:"permission_groups"`
+}
+
+type TokenPermissionGroup struct {
+	ID string `json:"id"`
+}
+
+func r2BucketPath(accountId string, bucketName string) string {
+	return "accounts/" + accountId + "/r2/buckets/" + bucketName
+}
+
+func (api CloudflareAPI) CreateR2Bucket(accountId string, bucket R2BucketRequest) ([]byte, error) {
+	jsonBody, err := json.Marshal(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.doRequest("POST", "accounts/"+accountId+"/r2/buckets", jsonBody)
+}
+
+// PutR2BucketCORS replaces the CORS policy of a bucket. rules is the JSON
+// array of CORS rules as accepted by the Cloudflare API.
+func (api CloudflareAPI) PutR2BucketCORS(accountId string, bucketName string, rules []byte) ([]byte, error) {
+	jsonBody, err := json.Marshal(map[string]json.RawMessage{"rules": rules})
+	if err != nil {
+		return nil, err
+	}
+
+	return api.doRequest("PUT", r2BucketPath(accountId, bucketName)+"/cors", jsonBody)
+}
+
+// PutR2BucketLifecycle replaces the object lifecycle rules of a bucket. rules
+// is the JSON array of lifecycle rules as accepted by the Cloudflare API.
+func (api CloudflareAPI) PutR2BucketLifecycle(accountId string, bucketName string, rules []byte) ([]byte, error) {
+	jsonBody, err := json.Marshal(map[string]json.RawMessage{"rules": rules})
+	if err != nil {
+		return nil, err
+	}
+
+	return api.doRequest("PUT", r2BucketPath(accountId, bucketName)+"/lifecycle", jsonBody)
+}
+
+func (api CloudflareAPI) ListR2Objects(accountId string, bucketName string, cursor string) ([]byte, error) {
+	path := r2BucketPath(accountId, bucketName) + "/objects"
+	if cursor != "" {
+		path += "?cursor=" + url.QueryEscape(cursor)
+	}
+
+	return api.doRequest("GET", path, nil)
+}
+
+func (api CloudflareAPI) DeleteR2Object(accountId string, bucketName string, key string) ([]byte, error) {
+	return api.doRequest("DELETE", r2BucketPath(accountId, bucketName)+"/objects/"+url.PathEscape(key), nil)
+}
+
+func (api CloudflareAPI) DeleteR2Bucket(accountId string, bucketName string) ([]byte, error) {
+	return api.doRequest("DELETE", r2BucketPath(accountId, bucketName), nil)
+}
+
+func (api CloudflareAPI) ListR2Buckets(accountId string) ([]byte, error) {
+	return api.doRequest("GET", "accounts/"+accountId+"/r2/buckets", nil)
+}
+
+func (api CloudflareAPI) CreateAccountToken(accountId string, token TokenRequest) ([]byte, error) {
+	jsonBody, err := json.Marshal(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.doRequest("POST", "accounts/"+accountId+"/tokens", jsonBody)
+}
+
+func (api CloudflareAPI) DeleteAccountToken(accountId string, tokenId string) ([]byte, error) {
+	return api.doRequest("DELETE", "accounts/"+accountId+"/tokens/"+tokenId, nil)
+}
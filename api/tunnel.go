@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+)
+
+type TunnelRequest struct {
+	Name string `json:"name"`
+	// ConfigSrc "cloudflare" makes the tunnel read its ingress rules from
+	// the configuration pushed through the API.
+	ConfigSrc    string `json:"config_src"`
+	TunnelSecret string `json:"tunnel_secret,omitempty"`
+}
+
+type TunnelConfiguration struct {
+	Ingress []TunnelIngressRule `json:"ingress"`
+}
+
+type TunnelIngressRule struct {
+	Hostname string `json:"hostname,omitempty"`
+	Service  string `json:"service"`
+}
+
+func tunnelsPath(accountId string) string {
+	return "accounts/" + accountId + "/cfd_tunnel"
+}
+
+func (api CloudflareAPI) CreateTunnel(accountId string, tunnel TunnelRequest) ([]byte, error) {
+	jsonBody, err := json.Marshal(tunnel)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.doRequest("POST", tunnelsPath(accountId), jsonBody)
+}
+
+func (api CloudflareAPI) GetTunnel(accountId string, tunnelId string) ([]byte, error) {
+	return api.doRequest("GET", tunnelsPath(accountId)+"/"+tunnelId, nil)
+}
+
+func (api CloudflareAPI) DeleteTunnel(accountId string, tunnelId string) ([]byte, error) {
+	return api.doRequest("DELETE", tunnelsPath(accountId)+"/"+tunnelId, nil)
+}
+
+// ListTunnels returns the tunnels of an account that have not been deleted.
+func (api CloudflareAPI) ListTunnels(accountId string) ([]byte, error) {
+	return api.doRequest("GET", tunnelsPath(accountId)+"?is_deleted=false", nil)
+}
+
+// GetTunnelToken returns the token a cloudflared connector runs the tunnel
+// with.
+func (api CloudflareAPI) GetTunnelToken(accountId string, tunnelId string) ([]byte, error) {
+	return api.doRequest("GET", tunnelsPath(accountId)+"/"+tunnelId+"/token", nil)
+}
+
+func (api CloudflareAPI) PutTunnelConfiguration(accountId string, tunnelId string, configuration TunnelConfiguration) ([]byte, error) {
+	jsonBody, err := json.Marshal(map[string]TunnelConfiguration{"config": configuration})
+	if err != nil {
+		return nil, err
+	}
+
+	return api.doRequest("PUT", tunnelsPath(accountId)+"/"+tunnelId+"/configurations", jsonBody)
+}
+
+func (api CloudflareAPI) ListTunnelConnections(accountId string, tunnelId string) ([]byte, error) {
+	return api.doRequest("GET", tunnelsPath(accountId)+"/"+tunnelId+"/connections", nil)
+}
+
+// CleanupTunnelConnections removes stale connections so that the tunnel can
+// be deleted.
+func (api CloudflareAPI) CleanupTunnelConnections(accountId string, tunnelId string) ([]byte, error) {
+	return api.doRequest("DELETE", tunnelsPath(accountId)+"/"+tunnelId+"/connections", nil)
+}
@@ -0,0 +1,386 @@
+// Package audit keeps a tamper-evident record of what the broker did and on
+// whose behalf: every Service Broker API operation and every call that
+// changes something in Cloudflare. Events are written as JSON lines, each
+// holding the hash of the one before, so that removing or editing an event
+// breaks the chain.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/tracing"
+)
+
+// Types of events.
+const EVENT_OSB = "osb"
+const EVENT_CLOUDFLARE = "cloudflare"
+const EVENT_ADMIN = "admin"
+
+const RESULT_SUCCESS = "success"
+const RESULT_ERROR = "error"
+
+const REDACTED = "[REDACTED]"
+
+// ORIGINATING_IDENTITY_HEADER names the user on whose behalf the platform
+// calls the broker.
+const ORIGINATING_IDENTITY_HEADER = "X-Broker-API-Originating-Identity"
+
+// MEMORY_SIZE is how many recent events are kept for queries when the sink
+// cannot be read back, like syslog.
+const MEMORY_SIZE = 1000
+
+// Identity is the decoded X-Broker-API-Originating-Identity, such as
+// {"platform": "cloudfoundry", "value": {"user_id": "..."}}.
+type Identity struct {
+	Platform string          `json:"platform"`
+	Value    json.RawMessage `json:"value,omitempty"`
+}
+
+// Event is one entry of the audit log. Cloudflare calls are recorded with the
+// operation they were made for.
+type Event struct {
+	Sequence            uint64          `json:"sequence"`
+	Time                time.Time       `json:"time"`
+	Type                string          `json:"type"`
+	Operation           string          `json:"operation"`
+	InstanceID          string          `json:"instance_id,omitempty"`
+	BindingID           string          `json:"binding_id,omitempty"`
+	ServiceID           string          `json:"service_id,omitempty"`
+	PlanID              string          `json:"plan_id,omitempty"`
+	OrganizationGUID    string          `json:"organization_guid,omitempty"`
+	SpaceGUID           string          `json:"space_guid,omitempty"`
+	OriginatingIdentity *Identity       `json:"originating_identity,omitempty"`
+	Parameters          json.RawMessage `json:"parameters,omitempty"`
+	Method              string          `json:"method,omitempty"`
+	Path                string          `json:"path,omitempty"`
+	Status              int             `json:"status,omitempty"`
+	ResourceID          string          `json:"resource_id,omitempty"`
+	CFRay               string          `json:"cf_ray,omitempty"`
+	State               string          `json:"state,omitempty"`
+	Result              string          `json:"result"`
+	Error               string          `json:"error,omitempty"`
+	TraceID             string          `json:"trace_id,omitempty"`
+	PrevHash            string          `json:"prev_hash"`
+	Hash                string          `json:"hash"`
+}
+
+// computeHash hashes the event without its own hash, which chains it to the
+// event before through PrevHash.
+func (e Event) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Sink stores events, one JSON line each.
+type Sink interface {
+	Write(line []byte) error
+}
+
+// Log chains events and writes them to a sink.
+type Log struct {
+	sink   Sink
+	logger lager.Logger
+
+	mu       sync.Mutex
+	sequence uint64
+	lastHash string
+	recent   []Event
+}
+
+// NewLog returns a log writing to sink. If the sink can be read back, the
+// chain continues from its last event.
+func NewLog(logger lager.Logger, sink Sink) (*Log, error) {
+	l := &Log{sink: sink, logger: logger.Session("audit")}
+
+	if reader, ok := sink.(Reader); ok {
+		events, err := reader.Events()
+		if err != nil {
+			return nil, err
+		}
+		if len(events) > 0 {
+			last := events[len(events)-1]
+			l.sequence = last.Sequence
+			l.lastHash = last.Hash
+		}
+	}
+
+	return l, nil
+}
+
+// Record completes event with its sequence number, time and hashes and
+// writes it. A failed write is logged; the operation is not failed for it.
+func (l *Log) Record(event Event) Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sequence++
+	event.Sequence = l.sequence
+	event.Time = time.Now().UTC()
+	event.PrevHash = l.lastHash
+	event.Hash = event.computeHash()
+
+	line, _ := json.Marshal(event)
+	if err := l.sink.Write(append(line, '\n')); err != nil {
+		l.logger.Error("Error writing audit event", err, lager.Data{"sequence": event.Sequence, "operation": event.Operation})
+	}
+	l.lastHash = event.Hash
+
+	l.recent = append(l.recent, event)
+	if len(l.recent) > MEMORY_SIZE {
+		l.recent = l.recent[len(l.recent)-MEMORY_SIZE:]
+	}
+
+	return event
+}
+
+// Filter selects events in Query. Empty fields match every event.
+type Filter struct {
+	InstanceID string
+	BindingID  string
+	Since      time.Time
+	// Limit keeps the last events only, if set.
+	Limit int
+}
+
+func (f Filter) matches(event Event) bool {
+	return (f.InstanceID == "" || event.InstanceID == f.InstanceID) &&
+		(f.BindingID == "" || event.BindingID == f.BindingID) &&
+		!event.Time.Before(f.Since)
+}
+
+// Query returns the events that match filter, oldest first. Events are read
+// back from the sink if it can be, or else from the last MEMORY_SIZE.
+func (l *Log) Query(filter Filter) ([]Event, error) {
+	events, err := l.events()
+	if err != nil {
+		return nil, err
+	}
+
+	matching := []Event{}
+	for _, event := range events {
+		if filter.matches(event) {
+			matching = append(matching, event)
+		}
+	}
+	if filter.Limit > 0 && len(matching) > filter.Limit {
+		matching = matching[len(matching)-filter.Limit:]
+	}
+
+	return matching, nil
+}
+
+// Verify checks the chain of the events in the sink, from the first, or of
+// the recent ones if it cannot be read back, and returns how many it checked.
+func (l *Log) Verify() (int, error) {
+	events, err := l.events()
+	if err != nil {
+		return 0, err
+	}
+	_, fromStart := l.sink.(Reader)
+
+	return len(events), VerifyChain(events, fromStart)
+}
+
+func (l *Log) events() ([]Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if reader, ok := l.sink.(Reader); ok {
+		return reader.Events()
+	}
+
+	return append([]Event{}, l.recent...), nil
+}
+
+// VerifyChain checks that every event has the hash of its content and of the
+// event before. Unless fromStart is set, the first event may continue a
+// chain that is not given; otherwise it must start the chain, so that
+// removing the oldest events is noticed too.
+func VerifyChain(events []Event, fromStart bool) error {
+	for i, event := range events {
+		if event.Hash != event.computeHash() {
+			return chainError(event, "does not match its hash")
+		}
+		if i == 0 && fromStart && (event.PrevHash != "" || event.Sequence != 1) {
+			return chainError(event, "does not start the chain")
+		}
+		if i > 0 && (event.PrevHash != events[i-1].Hash || event.Sequence != events[i-1].Sequence+1) {
+			return chainError(event, "does not follow the event before")
+		}
+	}
+
+	return nil
+}
+
+// ChainError tells which event breaks the chain.
+type ChainError struct {
+	Sequence uint64
+	Problem  string
+}
+
+func (e ChainError) Error() string {
+	return "audit event " + strconv.FormatUint(e.Sequence, 10) + " " + e.Problem
+}
+
+func chainError(event Event, problem string) error {
+	return ChainError{Sequence: event.Sequence, Problem: problem}
+}
+
+var (
+	currentMu sync.RWMutex
+	current   *Log
+)
+
+// SetLog sets the log Record writes to. Nothing is recorded until it is set.
+func SetLog(l *Log) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+
+	current = l
+}
+
+// Current returns the log set with SetLog, or nil.
+func Current() *Log {
+	currentMu.RLock()
+	defer currentMu.RUnlock()
+
+	return current
+}
+
+// Record adds event to the current log, completed with the scope and trace
+// in ctx.
+func Record(ctx context.Context, event Event) {
+	l := Current()
+	if l == nil {
+		return
+	}
+
+	scope := ScopeFromContext(ctx)
+	if event.Operation == "" {
+		event.Operation = scope.Operation
+	}
+	if event.InstanceID == "" {
+		event.InstanceID = scope.InstanceID
+	}
+	if event.BindingID == "" {
+		event.BindingID = scope.BindingID
+	}
+	if event.OriginatingIdentity == nil {
+		event.OriginatingIdentity = scope.Identity
+	}
+	if sc := tracing.SpanContextFromContext(ctx); sc.TraceID.IsValid() {
+		event.TraceID = sc.TraceID.String()
+	}
+
+	l.Record(event)
+}
+
+// Scope is what calls made during an operation are recorded with.
+type Scope struct {
+	Operation  string
+	InstanceID string
+	BindingID  string
+	Identity   *Identity
+}
+
+type scopeKey struct{}
+
+func WithScope(ctx context.Context, scope Scope) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return context.WithValue(ctx, scopeKey{}, scope)
+}
+
+func ScopeFromContext(ctx context.Context) Scope {
+	if ctx == nil {
+		return Scope{}
+	}
+	scope, _ := ctx.Value(scopeKey{}).(Scope)
+
+	return scope
+}
+
+// Middleware puts the originating identity of requests in their context.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if identity := ParseIdentity(req.Header.Get(ORIGINATING_IDENTITY_HEADER)); identity != nil {
+			req = req.WithContext(WithScope(req.Context(), Scope{Identity: identity}))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// ParseIdentity decodes an X-Broker-API-Originating-Identity header, the
+// platform followed by its base64-encoded JSON value.
+func ParseIdentity(header string) *Identity {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if parts[0] == "" {
+		return nil
+	}
+
+	identity := &Identity{Platform: parts[0]}
+	if len(parts) == 2 {
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil || !json.Valid(value) {
+			value, _ = json.Marshal(strings.TrimSpace(parts[1]))
+		}
+		identity.Value = value
+	}
+
+	return identity
+}
+
+// secretName matches the parameter names whose values are never recorded.
+var secretName = regexp.MustCompile(`(?i)(key|secret|token|password|credential)`)
+
+// Redact replaces the values of secret-looking parameters, at any depth, by
+// REDACTED. Parameters that are not JSON are left out.
+func Redact(parameters []byte) json.RawMessage {
+	if len(parameters) == 0 {
+		return nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(parameters, &value); err != nil {
+		data, _ := json.Marshal(REDACTED)
+		return data
+	}
+
+	data, _ := json.Marshal(redact(value))
+	return data
+}
+
+func redact(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for name, field := range typed {
+			if secretName.MatchString(name) {
+				typed[name] = REDACTED
+			} else {
+				typed[name] = redact(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range typed {
+			typed[i] = redact(item)
+		}
+	}
+
+	return value
+}
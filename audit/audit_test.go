@@ -0,0 +1,119 @@
+package audit_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/audit"
+)
+
+type memorySink struct {
+	lines []string
+}
+
+func (s *memorySink) Write(line []byte) error {
+	s.lines = append(s.lines, string(line))
+	return nil
+}
+
+func TestLogChainsEvents(t *testing.T) {
+	log, _ := audit.NewLog(lager.NewLogger("cloudflare-broker"), &memorySink{})
+	first := log.Record(audit.Event{Type: audit.EVENT_OSB, Operation: "provision", InstanceID: "1"})
+	second := log.Record(audit.Event{Type: audit.EVENT_OSB, Operation: "bind", InstanceID: "1", BindingID: "2"})
+
+	if first.Sequence != 1 || first.PrevHash != "" || second.Sequence != 2 || second.PrevHash != first.Hash {
+		t.Errorf("Record did not chain events %+v %+v", first, second)
+	}
+	if n, err := log.Verify(); n != 2 || err != nil {
+		t.Errorf("Verify failed %d %v", n, err)
+	}
+
+	events, _ := log.Query(audit.Filter{BindingID: "2"})
+	if len(events) != 1 || events[0].Operation != "bind" {
+		t.Errorf("Query returned %+v", events)
+	}
+
+	second.InstanceID = "3"
+	if err := audit.VerifyChain([]audit.Event{first, second}, true); err == nil {
+		t.Errorf("VerifyChain accepted a changed event")
+	}
+	if err := audit.VerifyChain([]audit.Event{second}, true); err == nil {
+		t.Errorf("VerifyChain accepted a chain without its first event")
+	}
+}
+
+func TestFileSinkResumesChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudflare-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	for _, operation := range []string{"provision", "bind"} {
+		sink, err := audit.NewFileSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log, err := audit.NewLog(lager.NewLogger("cloudflare-broker"), sink)
+		if err != nil {
+			t.Fatalf("NewLog failed %v", err)
+		}
+		log.Record(audit.Event{Type: audit.EVENT_OSB, Operation: operation})
+		sink.Close()
+	}
+
+	sink, _ := audit.NewFileSink(path)
+	defer sink.Close()
+	log, _ := audit.NewLog(lager.NewLogger("cloudflare-broker"), sink)
+	if n, err := log.Verify(); n != 2 || err != nil {
+		t.Errorf("Verify failed %d %v", n, err)
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, []byte(strings.Replace(string(data), `"bind"`, `"unbind"`, 1)), 0600)
+	if _, err := log.Verify(); err == nil {
+		t.Errorf("Verify accepted a changed file")
+	}
+}
+
+func TestRecordUsesScope(t *testing.T) {
+	sink := &memorySink{}
+	log, _ := audit.NewLog(lager.NewLogger("cloudflare-broker"), sink)
+	audit.SetLog(log)
+	defer audit.SetLog(nil)
+
+	var scoped context.Context
+	handler := audit.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		scoped = audit.WithScope(req.Context(), audit.Scope{Operation: "bind", InstanceID: "1", Identity: audit.ScopeFromContext(req.Context()).Identity})
+	}))
+	request := httptest.NewRequest("PUT", "/v2/service_instances/1", nil)
+	// {"user_id": "683ea748-3092-4ff4-b656-39cacc4d5360"}
+	request.Header.Set(audit.ORIGINATING_IDENTITY_HEADER, "cloudfoundry eyJ1c2VyX2lkIjogIjY4M2VhNzQ4LTMwOTItNGZmNC1iNjU2LTM5Y2FjYzRkNTM2MCJ9")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	audit.Record(scoped, audit.Event{Type: audit.EVENT_CLOUDFLARE, Method: "POST", Path: "zones/"})
+
+	var event audit.Event
+	json.Unmarshal([]byte(sink.lines[0]), &event)
+	if event.Operation != "bind" || event.InstanceID != "1" || event.OriginatingIdentity == nil ||
+		event.OriginatingIdentity.Platform != "cloudfoundry" || !strings.Contains(string(event.OriginatingIdentity.Value), "683ea748") {
+		t.Errorf("Record did not use the scope %s", sink.lines[0])
+	}
+}
+
+func TestRedact(t *testing.T) {
+	redacted := string(audit.Redact([]byte(`{"domain": "domain.com", "x-auth-key": "mykey", "access": {"client_secret": "s3cret"}}`)))
+	if strings.Contains(redacted, "mykey") || strings.Contains(redacted, "s3cret") || !strings.Contains(redacted, "domain.com") {
+		t.Errorf("Redact returned %s", redacted)
+	}
+}
@@ -0,0 +1,136 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/syslog"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// SYSLOG_TAG is what audit events are tagged with in syslog.
+const SYSLOG_TAG = "cloudflare-broker-audit"
+
+// Reader is a sink whose events can be read back.
+type Reader interface {
+	Events() ([]Event, error)
+}
+
+// FileSink appends events to a file, synced after every event.
+type FileSink struct {
+	Path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{Path: path, file: file}, nil
+}
+
+func (s *FileSink) Write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+// Events reads every event in the file.
+func (s *FileSink) Events() ([]Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadEvents(file)
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+// ReadEvents parses JSON lines of events, such as an audit file.
+func ReadEvents(r io.Reader) ([]Event, error) {
+	events := []Event{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, LineError{Line: line, Err: err}
+		}
+		events = append(events, event)
+	}
+
+	return events, scanner.Err()
+}
+
+// LineError tells which line of an audit file cannot be read.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e LineError) Error() string {
+	return "audit line " + strconv.Itoa(e.Line) + ": " + e.Err.Error()
+}
+
+// SyslogSink sends events to syslog, with the auth facility.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink connects to the syslog server at address, such as
+// udp://syslog.example.com:514 or tcp://syslog.example.com:514, or to the
+// local syslog daemon if address is empty.
+func NewSyslogSink(address string) (*SyslogSink, error) {
+	network, host := "", ""
+	if address != "" {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		network, host = u.Scheme, u.Host
+	}
+
+	writer, err := syslog.Dial(network, host, syslog.LOG_INFO|syslog.LOG_AUTH, SYSLOG_TAG)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyslogSink{writer: writer}, nil
+}
+
+func (s *SyslogSink) Write(line []byte) error {
+	return s.writer.Info(string(bytes.TrimRight(line, "\n")))
+}
+
+func (s *SyslogSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,193 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/api"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/hostname"
+)
+
+const ACCESS_APPLICATION_TYPE = "self_hosted"
+
+// AccessParameters are read from the "access" key of BindDetails.Parameters
+// and declare an Access application protecting the bound hostname.
+type AccessParameters struct {
+	AccountID           string   `json:"account_id"`
+	Hostname            string   `json:"hostname"`
+	Name                string   `json:"name"`
+	SessionDuration     string   `json:"session_duration"`
+	AllowedEmailDomains []string `json:"allowed_email_domains"`
+	AllowedGroups       []string `json:"allowed_groups"`
+	ServiceTokens       []string `json:"service_tokens"`
+}
+
+// AccessApplication is an Access application created for a binding.
+type AccessApplication struct {
+	AccountID  string `json:"account_id"`
+	ID         string `json:"id"`
+	AUD        string `json:"aud"`
+	Domain     string `json:"domain"`
+	TeamDomain string `json:"team_domain"`
+}
+
+// AccessCredentials let the bound app verify the Cf-Access-Jwt-Assertion
+// header of incoming requests.
+type AccessCredentials struct {
+	AUD        string `json:"aud"`
+	TeamDomain string `json:"team_domain"`
+	CertsURL   string `json:"certs_url"`
+}
+
+type accessOrganization struct {
+	AuthDomain string `json:"auth_domain"`
+}
+
+func (application AccessApplication) Credentials() AccessCredentials {
+	return AccessCredentials{
+		AUD:        application.AUD,
+		TeamDomain: application.TeamDomain,
+		CertsURL:   "https://" + application.TeamDomain + "/cdn-cgi/access/certs",
+	}
+}
+
+// parseAccessParameters decodes the "access" bind parameter. The hostname
+// defaults to the bound domain, which must be normalized, and is otherwise
+// normalized and required to be the domain or one of its subdomains.
+func parseAccessParameters(paramAccess interface{}, domain string) (AccessParameters, error) {
+	var parameters AccessParameters
+
+	data, err := json.Marshal(paramAccess)
+	if err != nil {
+		return parameters, err
+	}
+	if err := json.Unmarshal(data, &parameters); err != nil {
+		return parameters, errors.New("key 'access' is not a valid Access application: " + err.Error())
+	}
+
+	if parameters.AccountID == "" {
+		return parameters, errors.New("key 'access.account_id' not found in BindDetails.Parameters.")
+	}
+	if len(parameters.AllowedEmailDomains) == 0 && len(parameters.AllowedGroups) == 0 && len(parameters.ServiceTokens) == 0 {
+		return parameters, errors.New("key 'access' must allow at least one email domain, group or service token.")
+	}
+	if parameters.Hostname == "" {
+		parameters.Hostname = domain
+	} else {
+		// The hostname must lie in the bound zone, so the allowed domains
+		// checked for the zone cover it too
+		name := strings.TrimPrefix(parameters.Hostname, "*.")
+		ascii, err := hostname.ToASCII(name)
+		if err != nil {
+			return parameters, ParameterError{Problems: []string{"access.hostname " + err.Error()}}
+		}
+		if ascii != domain && !strings.HasSuffix(ascii, "."+domain) {
+			return parameters, ParameterError{Problems: []string{"access.hostname " + strconv.Quote(parameters.Hostname) + " must be " + domain + " or one of its subdomains"}}
+		}
+		parameters.Hostname = strings.TrimSuffix(parameters.Hostname, name) + ascii
+	}
+	if parameters.Name == "" {
+		parameters.Name = parameters.Hostname
+	}
+
+	return parameters, nil
+}
+
+func accessPolicies(parameters AccessParameters) []api.AccessPolicyRequest {
+	var policies []api.AccessPolicyRequest
+
+	var users []api.AccessPolicyRule
+	for _, domain := range parameters.AllowedEmailDomains {
+		users = append(users, api.AccessPolicyRule{EmailDomain: &api.AccessEmailDomainRule{Domain: domain}})
+	}
+	for _, group := range parameters.AllowedGroups {
+		users = append(users, api.AccessPolicyRule{Group: &api.AccessGroupRule{ID: group}})
+	}
+	if len(users) > 0 {
+		policies = append(policies, api.AccessPolicyRequest{
+			Name:     "Allow users",
+			Decision: "allow",
+			Include:  users,
+		})
+	}
+
+	var tokens []api.AccessPolicyRule
+	for _, token := range parameters.ServiceTokens {
+		tokens = append(tokens, api.AccessPolicyRule{ServiceToken: &api.AccessServiceTokenRule{TokenID: token}})
+	}
+	if len(tokens) > 0 {
+		policies = append(policies, api.AccessPolicyRequest{
+			Name:     "Allow service tokens",
+			Decision: "non_identity",
+			Include:  tokens,
+		})
+	}
+
+	for i := range policies {
+		policies[i].Precedence = i + 1
+	}
+
+	return policies
+}
+
+// createAccessApplication creates the Access application and its policies.
+// If a policy cannot be created the application is removed again.
+func (b *CloudflareBroker) createAccessApplication(client api.CloudflareAPIInterface, parameters AccessParameters) (AccessApplication, error) {
+	data, err := client.GetAccessOrganization(parameters.AccountID)
+	if err != nil {
+		return AccessApplication{}, err
+	}
+
+	var organization accessOrganization
+	if _, err := decodeCloudflareResponse(data, &organization); err != nil {
+		return AccessApplication{}, err
+	}
+
+	data, err = client.CreateAccessApplication(parameters.AccountID, api.AccessApplicationRequest{
+		Name:            parameters.Name,
+		Domain:          parameters.Hostname,
+		Type:            ACCESS_APPLICATION_TYPE,
+		SessionDuration: parameters.SessionDuration,
+	})
+	if err != nil {
+		return AccessApplication{}, err
+	}
+
+	application := AccessApplication{
+		AccountID:  parameters.AccountID,
+		Domain:     parameters.Hostname,
+		TeamDomain: organization.AuthDomain,
+	}
+	if _, err := decodeCloudflareResponse(data, &application); err != nil {
+		return AccessApplication{}, err
+	}
+
+	for _, policy := range accessPolicies(parameters) {
+		data, err := client.CreateAccessPolicy(application.AccountID, application.ID, policy)
+		if err == nil {
+			_, err = decodeCloudflareResponse(data, nil)
+		}
+		if err != nil {
+			// Do not leave the application behind for a binding that failed
+			if err := b.deleteAccessApplication(client, application); err != nil {
+				b.logger.Error("Bind calling api.cloudflare", err, lager.Data{"application_id": application.ID})
+			}
+			return AccessApplication{}, err
+		}
+	}
+
+	return application, nil
+}
+
+func (b *CloudflareBroker) deleteAccessApplication(client api.CloudflareAPIInterface, application AccessApplication) error {
+	data, err := client.DeleteAccessApplication(application.AccountID, application.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = decodeCloudflareResponse(data, nil)
+	return err
+}
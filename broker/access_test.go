@@ -0,0 +1,108 @@
+package broker_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestBindWithAccessWithoutRules(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	params := map[string]interface{}{
+		"domain": "domain.com",
+		"access": map[string]interface{}{"account_id": "account"},
+	}
+	_, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: params})
+	if err == nil || len(fakeAPI.Calls) != 0 {
+		t.Errorf("Bind with Access succeeded without allowed identities")
+	}
+}
+
+func TestBindAndUnbindWithAccess(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	var context context.Context
+
+	params := map[string]interface{}{
+		"domain": "domain.com",
+		"access": map[string]interface{}{
+			"account_id":            "account",
+			"hostname":              "tool.domain.com",
+			"allowed_email_domains": []string{"example.com"},
+			"service_tokens":        []string{"token"},
+		},
+	}
+	binding, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: params})
+	if err != nil {
+		t.Fatalf("Bind with Access failed %v", err)
+	}
+
+	credentials, ok := binding.Credentials.(broker.ZoneCredentials)
+	expected := &broker.AccessCredentials{
+		AUD:        "app-aud",
+		TeamDomain: "team.cloudflareaccess.com",
+		CertsURL:   "https://team.cloudflareaccess.com/cdn-cgi/access/certs",
+	}
+	if !ok || !reflect.DeepEqual(credentials.Access, expected) {
+		t.Errorf("Bind with Access returned credentials %+v", binding.Credentials)
+	}
+
+	expectedCalls := []string{
+		"CreateAccessApplication tool.domain.com",
+		"CreateAccessPolicy allow",
+		"CreateAccessPolicy non_identity",
+	}
+	if !reflect.DeepEqual(fakeAPI.Calls, expectedCalls) {
+		t.Errorf("Bind with Access made calls %v", fakeAPI.Calls)
+	}
+
+	err = cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{})
+	if err != nil || len(cloudflarebroker.AccessApplications) != 0 {
+		t.Errorf("Unbind with Access failed %v", err)
+	}
+}
+
+func TestBindWithAccessHostname(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	var context context.Context
+
+	for bindingID, hostname := range map[string]string{"2": "evil.com", "3": "notdomain.com", "4": "bad_name.domain.com"} {
+		params := map[string]interface{}{
+			"domain": "domain.com",
+			"access": map[string]interface{}{"account_id": "account", "hostname": hostname, "service_tokens": []string{"token"}},
+		}
+		_, err := cloudflarebroker.Bind(context, "1", bindingID, brokerapi.BindDetails{Parameters: params})
+		if _, ok := err.(broker.ParameterError); !ok || !strings.Contains(err.Error(), "access.hostname") || len(fakeAPI.Calls) != 0 {
+			t.Errorf("Bind with Access hostname %s returned %v", hostname, err)
+		}
+	}
+
+	params := map[string]interface{}{
+		"domain": "domain.com",
+		"access": map[string]interface{}{"account_id": "account", "hostname": "*.Tool.Domain.com.", "service_tokens": []string{"token"}},
+	}
+	if _, err := cloudflarebroker.Bind(context, "1", "5", brokerapi.BindDetails{Parameters: params}); err != nil {
+		t.Fatalf("Bind with Access hostname failed %v", err)
+	}
+	if application := cloudflarebroker.AccessApplications["1:5"]; application.Domain != "*.tool.domain.com" {
+		t.Errorf("Bind with Access created application for %s", application.Domain)
+	}
+}
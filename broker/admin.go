@@ -0,0 +1,184 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/audit"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// NewAdminHandler serves operator endpoints under /admin/. It does not
+// authenticate requests; wrap it like the broker API.
+func NewAdminHandler(b *CloudflareBroker) http.Handler {
+	router := mux.NewRouter()
+
+	router.HandleFunc("/admin/instances", func(w http.ResponseWriter, req *http.Request) {
+		respond(w, http.StatusOK, b.ListInstances())
+	}).Methods("GET")
+
+	router.HandleFunc("/admin/instances/{instance_id}", func(w http.ResponseWriter, req *http.Request) {
+		instance, err := b.GetInstance(mux.Vars(req)["instance_id"])
+		if err != nil {
+			respondAdminError(w, err)
+			return
+		}
+
+		respond(w, http.StatusOK, instance)
+	}).Methods("GET")
+
+	router.HandleFunc("/admin/operations", func(w http.ResponseWriter, req *http.Request) {
+		respond(w, http.StatusOK, b.OperationHistory(req.URL.Query().Get("instance_id")))
+	}).Methods("GET")
+
+	// force_unbind forgets a binding even if its resources cannot be
+	// deleted, and lists what was left behind.
+	router.HandleFunc("/admin/instances/{instance_id}/bindings/{binding_id}/force_unbind", func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		problems, err := b.ForceUnbind(vars["instance_id"], vars["binding_id"])
+		if err != nil {
+			respondAdminError(w, err)
+			return
+		}
+
+		respond(w, http.StatusOK, map[string][]string{"problems": problems})
+	}).Methods("POST")
+
+	router.HandleFunc("/admin/instances/{instance_id}/resync", func(w http.ResponseWriter, req *http.Request) {
+		status, err := b.ResyncInstance(req.Context(), mux.Vars(req)["instance_id"])
+		if err != nil {
+			respondAdminError(w, err)
+			return
+		}
+
+		respond(w, http.StatusOK, status)
+	}).Methods("POST")
+
+	router.HandleFunc("/admin/instances/{instance_id}/retry", func(w http.ResponseWriter, req *http.Request) {
+		operation, err := b.RetryOperation(mux.Vars(req)["instance_id"])
+		if err != nil {
+			respondAdminError(w, err)
+			return
+		}
+
+		respond(w, http.StatusAccepted, operation)
+	}).Methods("POST")
+
+	router.HandleFunc("/admin/zones/pending_deletion", func(w http.ResponseWriter, req *http.Request) {
+		respond(w, http.StatusOK, b.ListPendingDeletions())
+	}).Methods("GET")
+
+	router.HandleFunc("/admin/zones/{zone_id}/restore", func(w http.ResponseWriter, req *http.Request) {
+		zone, err := b.RestoreZone(mux.Vars(req)["zone_id"])
+		if err != nil {
+			respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+
+		respond(w, http.StatusOK, zone)
+	}).Methods("POST")
+
+	router.HandleFunc("/admin/reconcile", func(w http.ResponseWriter, req *http.Request) {
+		report := b.LatestReconcileReport()
+		if report == nil {
+			respond(w, http.StatusNotFound, brokerapi.ErrorResponse{Description: "the reconciler has not run yet"})
+			return
+		}
+
+		respond(w, http.StatusOK, report)
+	}).Methods("GET")
+
+	// POST /admin/reconcile runs the reconciler now. Orphans are only
+	// deleted with ?dry_run=false.
+	router.HandleFunc("/admin/reconcile", func(w http.ResponseWriter, req *http.Request) {
+		options := b.ReconcileOptions
+		switch req.URL.Query().Get("dry_run") {
+		case "", "true":
+			options.DryRun = true
+		case "false":
+			options.DryRun = false
+		default:
+			respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: "dry_run must be true or false"})
+			return
+		}
+
+		respond(w, http.StatusOK, b.Reconcile(options))
+	}).Methods("POST")
+
+	// GET /admin/audit queries the audit log by instance_id, binding_id, since
+	// (RFC 3339) and limit, which keeps the most recent events.
+	router.HandleFunc("/admin/audit", func(w http.ResponseWriter, req *http.Request) {
+		log := audit.Current()
+		if log == nil {
+			respond(w, http.StatusNotFound, brokerapi.ErrorResponse{Description: "the audit log is not enabled"})
+			return
+		}
+
+		query := req.URL.Query()
+		filter := audit.Filter{InstanceID: query.Get("instance_id"), BindingID: query.Get("binding_id")}
+		if since := query.Get("since"); since != "" {
+			t, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: "since must be an RFC 3339 time"})
+				return
+			}
+			filter.Since = t
+		}
+		if limit := query.Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n < 0 {
+				respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: "limit must be a positive number"})
+				return
+			}
+			filter.Limit = n
+		}
+
+		events, err := log.Query(filter)
+		if err != nil {
+			respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+
+		respond(w, http.StatusOK, events)
+	}).Methods("GET")
+
+	// GET /admin/audit/verify checks that no audit event was changed or
+	// removed.
+	router.HandleFunc("/admin/audit/verify", func(w http.ResponseWriter, req *http.Request) {
+		log := audit.Current()
+		if log == nil {
+			respond(w, http.StatusNotFound, brokerapi.ErrorResponse{Description: "the audit log is not enabled"})
+			return
+		}
+
+		events, err := log.Verify()
+		result := map[string]interface{}{"valid": err == nil, "events": events}
+		if err != nil {
+			result["error"] = err.Error()
+		}
+
+		respond(w, http.StatusOK, result)
+	}).Methods("GET")
+
+	return router
+}
+
+func respondAdminError(w http.ResponseWriter, err error) {
+	switch err {
+	case brokerapi.ErrInstanceDoesNotExist, brokerapi.ErrBindingDoesNotExist:
+		respond(w, http.StatusNotFound, brokerapi.ErrorResponse{Description: err.Error()})
+	case ErrConcurrentInstanceAccess:
+		respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{Error: "ConcurrencyError", Description: err.Error()})
+	default:
+		respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{Description: err.Error()})
+	}
+}
+
+func respond(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
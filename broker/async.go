@@ -0,0 +1,195 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/audit"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/tracing"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
+)
+
+// BindAsync binds in the background, for clients that accept an incomplete
+// bind. The request is checked right away; if it repeats the request that
+// created the binding, its credentials are returned and async is false.
+// Otherwise the instance stays locked until the bind is done, and its
+// progress is reported by BindingLastOperation.
+func (b *CloudflareBroker) BindAsync(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (binding brokerapi.Binding, async bool, err error) {
+	if !b.instanceLocks.tryLock(instanceID) {
+		return brokerapi.Binding{}, false, ErrConcurrentInstanceAccess
+	}
+
+	startedAt := time.Now()
+	b.mu.Lock()
+	request, existing, err := b.checkBind(instanceID, bindingID, details)
+	if err != nil || existing != nil {
+		b.recordOperation(OPERATION_BIND, instanceID, bindingID, startedAt, err)
+		b.mu.Unlock()
+		b.instanceLocks.unlock(instanceID)
+		if err != nil {
+			return brokerapi.Binding{}, false, err
+		}
+		return *existing, false, nil
+	}
+	b.mu.Unlock()
+
+	b.update(func() {
+		b.setBindingOperation(getZoneKey(instanceID, bindingID), &Operation{
+			Type:        OPERATION_BIND,
+			InstanceID:  instanceID,
+			BindingID:   bindingID,
+			State:       brokerapi.InProgress,
+			Description: "creating the resources of the binding",
+			StartedAt:   startedAt,
+		})
+	})
+	go func() {
+		defer b.instanceLocks.unlock(instanceID)
+		defer b.unreserveZone(getZoneKey(instanceID, bindingID))
+		b.finishBindingOperation(detach(ctx), instanceID, bindingID, startedAt, func(ctx context.Context) error {
+			_, err := b.completeBind(ctx, instanceID, bindingID, details, request)
+			return err
+		})
+	}()
+
+	return brokerapi.Binding{}, true, nil
+}
+
+// finishBindingOperation runs the work of an asynchronous bind and records
+// its outcome as the binding's last operation, like finishOperation. The
+// work calls Cloudflare without b.mu, so other instances are not held up.
+func (b *CloudflareBroker) finishBindingOperation(ctx context.Context, instanceID string, bindingID string, startedAt time.Time, work func(context.Context) error) {
+	ctx, span := tracing.StartSpan(ctx, OPERATION_BIND+" (async)", tracing.SPAN_KIND_INTERNAL)
+	span.SetAttribute("instance_id", instanceID)
+	span.SetAttribute("binding_id", bindingID)
+
+	err := work(ctx)
+	span.Finish(err)
+	recordEvent(ctx, audit.EVENT_OSB, audit.Event{Operation: OPERATION_BIND + " (async)", InstanceID: instanceID, BindingID: bindingID}, err)
+
+	b.update(func() {
+		operation := b.recordOperation(OPERATION_BIND, instanceID, bindingID, startedAt, err)
+		b.setBindingOperation(getZoneKey(instanceID, bindingID), &operation)
+	})
+}
+
+// BindingLastOperation reports the state of the last asynchronous bind of a
+// binding. It only takes operationsMu, so it answers while the bind runs.
+func (b *CloudflareBroker) BindingLastOperation(instanceID string, bindingID string) (brokerapi.LastOperation, error) {
+	b.operationsMu.Lock()
+	defer b.operationsMu.Unlock()
+
+	operation, ok := b.BindingOperations[getZoneKey(instanceID, bindingID)]
+	if !ok {
+		return brokerapi.LastOperation{}, brokerapi.ErrBindingDoesNotExist
+	}
+
+	return brokerapi.LastOperation{State: operation.State, Description: operation.Description}, nil
+}
+
+// setBindingOperation sets the last operation of a binding, or forgets it if
+// operation is nil.
+func (b *CloudflareBroker) setBindingOperation(zoneKey string, operation *Operation) {
+	b.operationsMu.Lock()
+	defer b.operationsMu.Unlock()
+
+	if operation == nil {
+		delete(b.BindingOperations, zoneKey)
+		return
+	}
+	b.BindingOperations[zoneKey] = *operation
+}
+
+// bindInProgress reports whether an asynchronous bind of a binding has not
+// finished yet.
+func (b *CloudflareBroker) bindInProgress(zoneKey string) bool {
+	b.operationsMu.Lock()
+	defer b.operationsMu.Unlock()
+
+	operation, ok := b.BindingOperations[zoneKey]
+
+	return ok && operation.State == brokerapi.InProgress
+}
+
+// bindingProgress describes what an asynchronous bind is doing. It does
+// nothing for synchronous binds.
+func (b *CloudflareBroker) bindingProgress(instanceID string, bindingID string, description string) {
+	b.operationsMu.Lock()
+	defer b.operationsMu.Unlock()
+
+	zoneKey := getZoneKey(instanceID, bindingID)
+	if operation, ok := b.BindingOperations[zoneKey]; ok && operation.State == brokerapi.InProgress {
+		operation.Description = description
+		b.BindingOperations[zoneKey] = operation
+	}
+}
+
+// NewAsyncBindHandler serves the binds that accept an incomplete response
+// and the last operation of bindings, which brokerapi does not know about,
+// with the broker's credentials, and passes every other request to next.
+// Invalid parameters and policy refusals are answered with 422, other errors
+// like brokerapi does, so NewErrorStatusHandler maps them the same way. The
+// last operation of an unknown binding is answered with 410 Gone.
+func NewAsyncBindHandler(b *CloudflareBroker, credentials brokerapi.BrokerCredentials, next http.Handler) http.Handler {
+	router := mux.NewRouter()
+	router.NotFoundHandler = next
+	authWrapper := auth.NewWrapper(credentials.Username, credentials.Password)
+
+	router.Handle("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", authWrapper.WrapFunc(func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		instanceID, bindingID := vars["instance_id"], vars["binding_id"]
+
+		var details brokerapi.BindDetails
+		if err := json.NewDecoder(req.Body).Decode(&details); err != nil {
+			respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+
+		// Recorded like the synchronous bind is by InstrumentedBroker and
+		// AuditedBroker
+		ctx, span, startedAt := startOperation(req.Context(), OPERATION_BIND, instanceID, bindingID)
+		span.SetAttribute("app_guid", details.AppGUID)
+		ctx = auditScope(ctx, OPERATION_BIND, instanceID, bindingID)
+		binding, async, err := b.BindAsync(ctx, instanceID, bindingID, details)
+		observeOperation(span, OPERATION_BIND, startedAt, err, async)
+		recordEvent(ctx, audit.EVENT_OSB, audit.Event{
+			ServiceID:  details.ServiceID,
+			PlanID:     details.PlanID,
+			Parameters: redactParameters(details.Parameters),
+		}, err)
+
+		_, invalid := err.(ParameterError)
+		_, refused := err.(PolicyError)
+		switch {
+		case err == brokerapi.ErrInstanceDoesNotExist:
+			respond(w, http.StatusNotFound, brokerapi.ErrorResponse{Description: err.Error()})
+		case err == brokerapi.ErrBindingAlreadyExists:
+			respond(w, http.StatusConflict, brokerapi.ErrorResponse{Description: err.Error()})
+		case invalid || refused:
+			respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{Description: err.Error()})
+		case err != nil:
+			respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+		case async:
+			respond(w, http.StatusAccepted, map[string]string{"operation": OPERATION_BIND})
+		default:
+			respond(w, http.StatusOK, BindingResponse{Credentials: binding.Credentials})
+		}
+	})).Methods("PUT").Queries("accepts_incomplete", "true")
+
+	router.Handle("/v2/service_instances/{instance_id}/service_bindings/{binding_id}/last_operation", authWrapper.WrapFunc(func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		operation, err := b.BindingLastOperation(vars["instance_id"], vars["binding_id"])
+		if err != nil {
+			respond(w, http.StatusGone, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+
+		respond(w, http.StatusOK, brokerapi.LastOperationResponse{State: string(operation.State), Description: operation.Description})
+	})).Methods("GET")
+
+	return router
+}
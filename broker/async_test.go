@@ -0,0 +1,229 @@
+package broker_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/credhub"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func asyncBindHandler(cloudflarebroker *broker.CloudflareBroker) http.Handler {
+	logger := lager.NewLogger("cloudflare-broker")
+	credentials := brokerapi.BrokerCredentials{Username: "username", Password: "password"}
+
+	return broker.NewErrorStatusHandler(broker.NewAsyncBindHandler(cloudflarebroker, credentials, brokerapi.New(cloudflarebroker, logger, credentials)))
+}
+
+// waitForBind polls the last operation of a binding until it is done.
+func waitForBind(t *testing.T, cloudflarebroker *broker.CloudflareBroker, instanceID string, bindingID string) brokerapi.LastOperation {
+	for i := 0; i < 200; i++ {
+		operation, err := cloudflarebroker.BindingLastOperation(instanceID, bindingID)
+		if err != nil {
+			t.Fatalf("BindingLastOperation failed %v", err)
+		}
+		if operation.State != brokerapi.InProgress {
+			return operation
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Bind of %s did not finish", bindingID)
+
+	return brokerapi.LastOperation{}
+}
+
+func TestAsyncBind(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{Block: make(chan struct{}), Blocked: make(chan struct{})}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	handler := asyncBindHandler(&cloudflarebroker)
+	var context context.Context
+
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	body := `{"service_id": "s", "plan_id": "` + broker.FREE_PLAN_ID + `", "parameters": {"domain": "domain.com"}}`
+
+	recorder := serve(handler, "PUT", "/v2/service_instances/1/service_bindings/2?accepts_incomplete=true", body)
+	if recorder.Code != http.StatusAccepted || !strings.Contains(recorder.Body.String(), `"operation":"bind"`) {
+		t.Fatalf("Async bind returned %d %s", recorder.Code, recorder.Body.String())
+	}
+	<-fakeAPI.Blocked
+
+	// The last operation is reported while the bind holds the broker
+	recorder = serve(handler, "GET", "/v2/service_instances/1/service_bindings/2/last_operation", "")
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"state":"in progress"`) || !strings.Contains(recorder.Body.String(), "adding the zone of domain.com") {
+		t.Errorf("Binding last operation returned %d %s", recorder.Code, recorder.Body.String())
+	}
+	if err := cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{}); err != broker.ErrConcurrentInstanceAccess {
+		t.Errorf("Unbind during an async bind returned %v", err)
+	}
+	if _, err := cloudflarebroker.FetchBinding("1", "2"); err != brokerapi.ErrBindingDoesNotExist {
+		t.Errorf("FetchBinding during an async bind returned %v", err)
+	}
+
+	close(fakeAPI.Block)
+	if operation := waitForBind(t, &cloudflarebroker, "1", "2"); operation.State != brokerapi.Succeeded {
+		t.Errorf("Async bind finished with %+v", operation)
+	}
+	if binding, err := cloudflarebroker.FetchBinding("1", "2"); err != nil || binding.Credentials == nil {
+		t.Errorf("FetchBinding after an async bind returned %+v %v", binding, err)
+	}
+
+	recorder = serve(handler, "PUT", "/v2/service_instances/1/service_bindings/2?accepts_incomplete=true", body)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"credentials"`) {
+		t.Errorf("Repeated async bind returned %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	fakeAPI.Block = nil
+	recorder = serve(handler, "PUT", "/v2/service_instances/1/service_bindings/3", strings.Replace(body, "domain.com", "other.com", 1))
+	if recorder.Code != http.StatusCreated {
+		t.Errorf("Bind without accepts_incomplete returned %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := serve(handler, "GET", "/v2/service_instances/1/service_bindings/3/last_operation", ""); recorder.Code != http.StatusGone {
+		t.Errorf("Last operation of a synchronous binding returned %d", recorder.Code)
+	}
+
+	if err := cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{}); err != nil {
+		t.Fatalf("Unbind failed %v", err)
+	}
+	if _, err := cloudflarebroker.BindingLastOperation("1", "2"); err != brokerapi.ErrBindingDoesNotExist {
+		t.Errorf("BindingLastOperation after unbind returned %v", err)
+	}
+}
+
+func TestAsyncBindRejectsInvalidRequests(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	cloudflarebroker.Policies = policies(t, `[{"allowed_domains": ["corp.example.com"]}]`)
+	credentials := brokerapi.BrokerCredentials{Username: "username", Password: "password"}
+	// Without NewErrorStatusHandler, which would map the errors anyway
+	handler := broker.NewAsyncBindHandler(&cloudflarebroker, credentials, brokerapi.New(&cloudflarebroker, logger, credentials))
+
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	for _, request := range []struct {
+		instanceID string
+		parameters string
+		status     int
+		problem    string
+	}{
+		{"1", `{}`, http.StatusUnprocessableEntity, "domain is required"},
+		{"1", `{"domain": "co.uk"}`, http.StatusUnprocessableEntity, "public suffix"},
+		{"1", `{"domain": "domain.com"}`, http.StatusUnprocessableEntity, broker.POLICY_ERROR_PREFIX},
+		{"2", `{"domain": "shop.corp.example.com"}`, http.StatusNotFound, "instance does not exist"},
+	} {
+		recorder := serve(handler, "PUT", "/v2/service_instances/"+request.instanceID+"/service_bindings/2?accepts_incomplete=true", `{"service_id": "s", "plan_id": "`+broker.FREE_PLAN_ID+`", "parameters": `+request.parameters+`}`)
+		if recorder.Code != request.status || !strings.Contains(recorder.Body.String(), request.problem) {
+			t.Errorf("Async bind with %s returned %d %s", request.parameters, recorder.Code, recorder.Body.String())
+		}
+	}
+	if _, err := cloudflarebroker.BindingLastOperation("1", "2"); err != brokerapi.ErrBindingDoesNotExist {
+		t.Errorf("Async bind with invalid parameters started an operation %v", err)
+	}
+	if len(fakeAPI.AddedDomains) != 0 {
+		t.Errorf("Async bind with invalid parameters called Cloudflare %v", fakeAPI.AddedDomains)
+	}
+	if recorder := serve(handler, "GET", "/v2/service_instances/1/service_bindings/2/last_operation", ""); recorder.Code != http.StatusGone {
+		t.Errorf("Last operation of an unknown binding returned %d", recorder.Code)
+	}
+}
+
+func TestAsyncBindFailure(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	cloudflarebroker.CredHub = failingCredHub{credhub.NewMemoryStore()}
+	var context context.Context
+
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	_, async, err := cloudflarebroker.BindAsync(context, "1", "2", brokerapi.BindDetails{AppGUID: "app", Parameters: map[string]interface{}{"domain": "domain.com"}})
+	if err != nil || !async {
+		t.Fatalf("BindAsync returned %v %v", async, err)
+	}
+
+	operation := waitForBind(t, &cloudflarebroker, "1", "2")
+	if operation.State != brokerapi.Failed || !strings.Contains(operation.Description, "CredHub is down") {
+		t.Errorf("Failed async bind finished with %+v", operation)
+	}
+	// Nothing is left of the binding
+	if _, err := cloudflarebroker.FetchBinding("1", "2"); err != brokerapi.ErrBindingDoesNotExist || len(cloudflarebroker.Zones) != 0 {
+		t.Errorf("Failed async bind left %v %v", cloudflarebroker.Zones, err)
+	}
+}
+
+func TestAsyncBindDoesNotHoldOtherInstances(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{Block: make(chan struct{}), Blocked: make(chan struct{})}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	_, async, err := cloudflarebroker.BindAsync(context, "1", "2", brokerapi.BindDetails{AppGUID: "app", Parameters: map[string]interface{}{"domain": "domain.com"}})
+	if err != nil || !async {
+		t.Fatalf("BindAsync returned %v %v", async, err)
+	}
+	<-fakeAPI.Blocked
+
+	// Another instance is provisioned while the bind waits on Cloudflare
+	done := make(chan error)
+	go func() {
+		_, err := cloudflarebroker.Provision(context, "3", brokerapi.ProvisionDetails{RawParameters: []byte(zoneParameters)}, false)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Provision during an async bind failed %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Provision waited for the async bind")
+	}
+
+	close(fakeAPI.Block)
+	if operation := waitForBind(t, &cloudflarebroker, "1", "2"); operation.State != brokerapi.Succeeded {
+		t.Errorf("Async bind finished with %+v", operation)
+	}
+}
+
+func TestAsyncBindOfExistingZone(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	var context context.Context
+
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	_, async, err := cloudflarebroker.BindAsync(context, "1", "2", brokerapi.BindDetails{AppGUID: "app", Parameters: map[string]interface{}{"domain": "existing.com"}})
+	if err != nil || !async {
+		t.Fatalf("BindAsync returned %v %v", async, err)
+	}
+
+	if operation := waitForBind(t, &cloudflarebroker, "1", "2"); operation.State != brokerapi.Failed {
+		t.Errorf("Async bind of an existing zone finished with %+v", operation)
+	}
+	if len(cloudflarebroker.ZoneIntents) != 0 || len(cloudflarebroker.Zones) != 0 {
+		t.Errorf("Failed async bind left %v %v", cloudflarebroker.ZoneIntents, cloudflarebroker.Zones)
+	}
+}
+
+func TestImportStateFailsInterruptedBinds(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+
+	err := cloudflarebroker.ImportState(broker.State{
+		SchemaVersion:     broker.STATE_SCHEMA_VERSION,
+		BindingOperations: map[string]broker.Operation{"1:2": {Type: broker.OPERATION_BIND, State: brokerapi.InProgress}},
+	})
+	operation, _ := cloudflarebroker.BindingLastOperation("1", "2")
+	if err != nil || operation.State != brokerapi.Failed {
+		t.Errorf("ImportState left the interrupted bind %+v %v", operation, err)
+	}
+}
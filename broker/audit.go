@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/audit"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/tracing"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// Operations the broker runs on its own or for an operator, as recorded in
+// the audit log.
+const AUDIT_FORCE_UNBIND = "admin force_unbind"
+const AUDIT_RESYNC = "admin resync"
+const AUDIT_RETRY = "admin retry"
+const AUDIT_RESTORE_ZONE = "admin restore_zone"
+const AUDIT_RECONCILE = "reconcile"
+const AUDIT_DELETE_EXPIRED_ZONES = "delete_expired_zones"
+
+// AuditedBroker records every operation of the service broker it wraps in
+// the audit log, and the Cloudflare calls made for it with its scope.
+type AuditedBroker struct {
+	brokerapi.ServiceBroker
+}
+
+func NewAuditedBroker(broker brokerapi.ServiceBroker) AuditedBroker {
+	return AuditedBroker{ServiceBroker: broker}
+}
+
+// auditScope returns ctx with the scope of an operation, keeping the
+// originating identity the audit middleware found in the request.
+func auditScope(ctx context.Context, operation string, instanceID string, bindingID string) context.Context {
+	scope := audit.ScopeFromContext(ctx)
+	scope.Operation = operation
+	scope.InstanceID = instanceID
+	scope.BindingID = bindingID
+
+	return audit.WithScope(ctx, scope)
+}
+
+// recordEvent records the outcome of an operation in the audit log.
+func recordEvent(ctx context.Context, eventType string, event audit.Event, err error) {
+	event.Type = eventType
+	event.Result = audit.RESULT_SUCCESS
+	if err != nil {
+		event.Result = audit.RESULT_ERROR
+		event.Error = err.Error()
+	}
+
+	audit.Record(ctx, event)
+}
+
+func redactParameters(parameters map[string]interface{}) json.RawMessage {
+	if len(parameters) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(parameters)
+
+	return audit.Redact(data)
+}
+
+func (b AuditedBroker) Provision(context context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	context = auditScope(context, OPERATION_PROVISION, instanceID, "")
+	spec, err := b.ServiceBroker.Provision(context, instanceID, details, asyncAllowed)
+	recordEvent(context, audit.EVENT_OSB, audit.Event{
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+		Parameters:       audit.Redact(details.RawParameters),
+	}, err)
+
+	return spec, err
+}
+
+func (b AuditedBroker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	context = auditScope(context, OPERATION_DEPROVISION, instanceID, "")
+	spec, err := b.ServiceBroker.Deprovision(context, instanceID, details, asyncAllowed)
+	recordEvent(context, audit.EVENT_OSB, audit.Event{ServiceID: details.ServiceID, PlanID: details.PlanID}, err)
+
+	return spec, err
+}
+
+func (b AuditedBroker) Bind(context context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	context = auditScope(context, OPERATION_BIND, instanceID, bindingID)
+	binding, err := b.ServiceBroker.Bind(context, instanceID, bindingID, details)
+	recordEvent(context, audit.EVENT_OSB, audit.Event{
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		Parameters: redactParameters(details.Parameters),
+	}, err)
+
+	return binding, err
+}
+
+func (b AuditedBroker) Unbind(context context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+	context = auditScope(context, OPERATION_UNBIND, instanceID, bindingID)
+	err := b.ServiceBroker.Unbind(context, instanceID, bindingID, details)
+	recordEvent(context, audit.EVENT_OSB, audit.Event{ServiceID: details.ServiceID, PlanID: details.PlanID}, err)
+
+	return err
+}
+
+func (b AuditedBroker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	context = auditScope(context, OPERATION_UPDATE, instanceID, "")
+	spec, err := b.ServiceBroker.Update(context, instanceID, details, asyncAllowed)
+	recordEvent(context, audit.EVENT_OSB, audit.Event{
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		Parameters: redactParameters(details.Parameters),
+	}, err)
+
+	return spec, err
+}
+
+func (b AuditedBroker) LastOperation(context context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
+	context = auditScope(context, OPERATION_LAST_OPERATION, instanceID, "")
+	operation, err := b.ServiceBroker.LastOperation(context, instanceID, operationData)
+	recordEvent(context, audit.EVENT_OSB, audit.Event{State: string(operation.State)}, err)
+
+	return operation, err
+}
+
+// detach is tracing.Detach keeping the audit scope of ctx, so that the
+// Cloudflare calls of an asynchronous operation are recorded with it.
+func detach(ctx context.Context) context.Context {
+	return audit.WithScope(tracing.Detach(ctx), audit.ScopeFromContext(ctx))
+}
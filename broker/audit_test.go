@@ -0,0 +1,69 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/audit"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+type memorySink struct {
+	lines []string
+}
+
+func (s *memorySink) Write(line []byte) error {
+	s.lines = append(s.lines, string(line))
+	return nil
+}
+
+func TestAuditedBroker(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	audited := broker.NewAuditedBroker(&cloudflarebroker)
+
+	sink := &memorySink{}
+	log, _ := audit.NewLog(logger, sink)
+	audit.SetLog(log)
+	defer audit.SetLog(nil)
+
+	identity := &audit.Identity{Platform: "cloudfoundry", Value: json.RawMessage(`{"user_id":"683ea748-3092-4ff4-b656-39cacc4d5360"}`)}
+	context := audit.WithScope(context.Background(), audit.Scope{Identity: identity})
+
+	audited.Provision(context, "1", brokerapi.ProvisionDetails{OrganizationGUID: "org", SpaceGUID: "space", RawParameters: []byte(zoneParameters)}, false)
+	audited.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": "domain.com"}})
+	audited.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": "other.com"}})
+
+	if len(sink.lines) != 3 {
+		t.Fatalf("Audit log has %d events", len(sink.lines))
+	}
+	if strings.Contains(sink.lines[0], "mykey") {
+		t.Errorf("Provision was audited with its API key %s", sink.lines[0])
+	}
+
+	var events []audit.Event
+	for _, line := range sink.lines {
+		var event audit.Event
+		json.Unmarshal([]byte(line), &event)
+		events = append(events, event)
+	}
+	if events[0].Operation != broker.OPERATION_PROVISION || events[0].OrganizationGUID != "org" || events[0].SpaceGUID != "space" ||
+		events[0].OriginatingIdentity == nil || events[0].Result != audit.RESULT_SUCCESS {
+		t.Errorf("Provision was audited as %+v", events[0])
+	}
+	if events[1].Operation != broker.OPERATION_BIND || events[1].BindingID != "2" || !strings.Contains(string(events[1].Parameters), "domain.com") {
+		t.Errorf("Bind was audited as %+v", events[1])
+	}
+	if events[2].Result != audit.RESULT_ERROR || events[2].Error != brokerapi.ErrBindingAlreadyExists.Error() {
+		t.Errorf("Failed bind was audited as %+v", events[2])
+	}
+	if _, err := log.Verify(); err != nil {
+		t.Errorf("Verify failed %v", err)
+	}
+}
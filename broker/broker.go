@@ -5,28 +5,113 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/api"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/audit"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/credhub"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/hostname"
 	"github.com/pivotal-cf/brokerapi"
 )
 
 const BROKER_PASSWORD = "SECURITY_USER_PASSWORD"
 const BROKER_PORT = "PORT"
 const BROKER_USERNAME = "SECURITY_USER_NAME"
+const BROKER_NS_RESOLVER = "NS_RESOLVER"
+const BROKER_ZONE_DELETION_POLICY = "ZONE_DELETION_POLICY"
+const BROKER_ZONE_DELETION_GRACE_PERIOD = "ZONE_DELETION_GRACE_PERIOD"
+const BROKER_RECONCILE_INTERVAL = "RECONCILE_INTERVAL"
+const BROKER_RECONCILE_ORPHAN_AGE = "RECONCILE_ORPHAN_AGE"
+const BROKER_RECONCILE_DRY_RUN = "RECONCILE_DRY_RUN"
+const BROKER_STATE_FILE = "STATE_FILE"
 
 const ENDPOINT_NOT_AVAILABLE = "This endpoint is not available"
 
+const SERVICE_ID = "31e38e96-df7e-4a38-b3cb-f489fc8ab421"
+const FREE_PLAN_ID = "e5c2ef96-fda2-417a-92af-dee310081600"
+
 type CloudflareBroker struct {
-	logger        lager.Logger
-	Zones         map[string]Zone
-	CloudflareAPI api.CloudflareAPIInterface
+	logger             lager.Logger
+	Zones              map[string]Zone
+	Bindings           map[string]BindingRecord
+	Instances          map[string]Instance
+	R2AccessKeys       map[string]R2AccessKey
+	AccessApplications map[string]AccessApplication
+	TunnelBindings     map[string]string
+	CloudflareAPI      api.CloudflareAPIInterface
+	// Resolver is used to show which nameservers of a pending zone are
+	// still wrong. NS records are not checked if it is nil.
+	Resolver NameServerResolver
+	// DeletionPolicy applies to instances that do not set their own
+	DeletionPolicy   DeletionPolicy
+	PendingDeletions map[string]PendingDeletion
+	// Operations holds the last asynchronous operation of each instance
+	Operations map[string]Operation
+	// BindingOperations holds the last asynchronous bind of each binding,
+	// keyed by zone key. It is guarded by operationsMu rather than mu.
+	BindingOperations map[string]Operation
+	// History holds the last OPERATION_HISTORY_SIZE finished operations
+	History []Operation
+	// ZoneIntents holds the zones being created, keyed by zone key
+	ZoneIntents map[string]ZoneIntent
+	// ResourceIntents holds the tunnels and R2 buckets being created,
+	// keyed by instance ID
+	ResourceIntents map[string]ResourceIntent
+	// ReconcileOptions are used by the reconciler and the admin endpoint
+	ReconcileOptions    ReconcileOptions
+	LastReconcileReport *ReconcileReport
+	activationChecks    map[string]time.Time
+	// Store keeps the state across restarts. Nothing is saved if it is nil.
+	Store StateStore
+	// CredHub keeps the credentials of app bindings, which are returned as
+	// a credhub-ref. Credentials are returned inline if it is nil.
+	CredHub           credhub.Store
+	CredHubClientName string
+	// Policies limit what orgs and spaces can provision and bind
+	Policies []Policy
+	// mu guards the maps above. It is only held to read or change them,
+	// never while Cloudflare is called; instanceLocks keeps operations on
+	// the same instance apart.
+	mu            *sync.Mutex
+	operationsMu  *sync.Mutex
+	instanceLocks *instanceLocks
+	// reservedInstances and reservedZones count the instances and zones
+	// being created against the policy limits until they are stored.
+	reservedInstances map[string]Instance
+	reservedZones     map[string]bool
+}
+
+type Instance struct {
+	ServiceID        string          `json:"service_id"`
+	PlanID           string          `json:"plan_id"`
+	OrganizationGUID string          `json:"organization_guid"`
+	SpaceGUID        string          `json:"space_guid"`
+	Auth             api.AuthHeaders `json:"auth"`
+	R2Bucket         *R2Bucket       `json:"r2_bucket,omitempty"`
+	Tunnel           *Tunnel         `json:"tunnel,omitempty"`
+	DeletionPolicy   *DeletionPolicy `json:"deletion_policy,omitempty"`
+	// Parameters are the provision parameters with their secrets redacted
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+	// RequestHash identifies the provision request that created the instance
+	RequestHash string `json:"request_hash"`
 }
 
 type Zone struct {
 	ID          string   `json:"id"`
 	Name        string   `json:"name"`
+	Status      string   `json:"status"`
 	NameServers []string `json:"name_servers"`
+	// Adopted zones existed before they were bound and are not deleted
+	// on Unbind.
+	Adopted bool `json:"adopted,omitempty"`
+}
+
+// ZoneCredentials are returned on Bind for the zone service.
+type ZoneCredentials struct {
+	Zone
+	Access *AccessCredentials `json:"access,omitempty"`
 }
 
 type ZoneCreateResponse struct {
@@ -36,6 +121,66 @@ type ZoneCreateResponse struct {
 	Success  bool          `json:"success"`
 }
 
+// CloudflareResponse is the envelope shared by all Cloudflare client API
+// responses. Result is left raw so callers can decode it into their own type.
+type CloudflareResponse struct {
+	Errors     []interface{}   `json:"errors"`
+	Messages   []interface{}   `json:"messages"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo ResultInfo      `json:"result_info"`
+	Success    bool            `json:"success"`
+}
+
+// CloudflareError is a failure the Cloudflare API reported in its response.
+// Unlike a request that failed on its way, the request was not carried out.
+type CloudflareError struct {
+	Errors []interface{}
+}
+
+func (e CloudflareError) Error() string {
+	return fmt.Sprintf("Error from Cloudflare Client API: %+v", e.Errors)
+}
+
+type ResultInfo struct {
+	Cursor      string `json:"cursor"`
+	IsTruncated bool   `json:"is_truncated"`
+	Page        int    `json:"page"`
+	TotalPages  int    `json:"total_pages"`
+}
+
+// decodeCloudflareResponse unmarshals a Cloudflare client API response body,
+// returning an error if the API reported a failure. If result is not nil the
+// response result is decoded into it.
+func decodeCloudflareResponse(data []byte, result interface{}) (CloudflareResponse, error) {
+	var response CloudflareResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return response, err
+	}
+
+	if response.Success == false {
+		return response, CloudflareError{Errors: response.Errors}
+	}
+
+	if result != nil && len(response.Result) > 0 {
+		if err := json.Unmarshal(response.Result, result); err != nil {
+			return response, err
+		}
+	}
+
+	return response, nil
+}
+
+// hasErrorCode reports whether the API reported an error with the code.
+func (response CloudflareResponse) hasErrorCode(code int) bool {
+	for _, e := range response.Errors {
+		if e, ok := e.(map[string]interface{}); ok && e["code"] == float64(code) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func getZoneKey(instanceID string, bindingID string) string {
 	return instanceID + ":" + bindingID
 }
@@ -43,7 +188,7 @@ func getZoneKey(instanceID string, bindingID string) string {
 func (*CloudflareBroker) Services(context context.Context) []brokerapi.Service {
 	return []brokerapi.Service{
 		{
-			ID:            "31e38e96-df7e-4a38-b3cb-f489fc8ab421",
+			ID:            SERVICE_ID,
 			Name:          "cloudflare",
 			Description:   "Cloud-based performance and security solution for websites and applications.",
 			Bindable:      true,
@@ -53,7 +198,7 @@ func (*CloudflareBroker) Services(context context.Context) []brokerapi.Service {
 			Tags: []string{"Cloudflare"},
 			Plans: []brokerapi.ServicePlan{
 				{
-					ID:          "e5c2ef96-fda2-417a-92af-dee310081600",
+					ID:          FREE_PLAN_ID,
 					Name:        "free",
 					Description: "Cloudflare delivers performance, security, reliability and insights for all websites and applications that join the network.",
 					Metadata: &brokerapi.ServicePlanMetadata{
@@ -68,6 +213,7 @@ func (*CloudflareBroker) Services(context context.Context) []brokerapi.Service {
 						},
 					},
 				},
+				tunnelPlan(),
 			},
 			Metadata: &brokerapi.ServiceMetadata{
 				DisplayName:         "Cloudflare",
@@ -78,10 +224,55 @@ func (*CloudflareBroker) Services(context context.Context) []brokerapi.Service {
 				LongDescription:     "Cloudflare delivers performance, security, reliability and insights for all websites and applications that join the network. Once your website is on Cloudflare, all traffic will be routed through their intelligent global network of 100+ data centers. Cloudflare’s platform includes a myriad of security features, including DDoS attack mitigation and a web application firewall (WAF) for paid plans.",
 			},
 		},
+		r2Service(),
 	}
 }
 
 func (b *CloudflareBroker) Provision(context context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	if !b.instanceLocks.tryLock(instanceID) {
+		return brokerapi.ProvisionedServiceSpec{}, ErrConcurrentInstanceAccess
+	}
+	defer b.instanceLocks.unlock(instanceID)
+
+	startedAt := time.Now()
+	spec, err := b.provision(context, instanceID, details)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.recordOperation(OPERATION_PROVISION, instanceID, "", startedAt, err)
+
+	return spec, err
+}
+
+func (b *CloudflareBroker) provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails) (brokerapi.ProvisionedServiceSpec, error) {
+	requestHash, err := provisionRequestHash(details)
+	if err != nil {
+		b.logger.Error("Error decoding details.RawParameters", err)
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrRawParamsInvalid
+	}
+
+	// A retry of the request that created the instance gets the same result,
+	// any other request for the instance is a conflict
+	b.mu.Lock()
+	instance, ok := b.Instances[instanceID]
+	b.mu.Unlock()
+	if ok {
+		if instance.RequestHash == requestHash {
+			return brokerapi.ProvisionedServiceSpec{DashboardURL: dashboardURL(instance)}, nil
+		}
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	}
+	release, err := b.reserveInstance(instanceID, details)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	defer release()
+	if schemas, ok := Schemas(details.PlanID); ok {
+		if err := validateParameters(schemas.ServiceInstance.Create.Parameters, details.RawParameters); err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+	}
+
 	var authHeaders api.AuthHeaders
 
 	if err := json.Unmarshal(details.RawParameters, &authHeaders); err != nil {
@@ -93,76 +284,480 @@ func (b *CloudflareBroker) Provision(context context.Context, instanceID string,
 		return brokerapi.ProvisionedServiceSpec{}, errors.New("Error: Auth parameters are empty")
 	}
 
-	// Maybe check if already provision and do not allow unless deprovisioned?
-	b.CloudflareAPI.SetAuthHeaders(authHeaders)
+	deletionPolicy, err := parseInstanceDeletionPolicy(details.RawParameters)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
+	client := b.CloudflareAPI.With(ctx, authHeaders)
+
+	instance = Instance{
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+		Auth:             authHeaders,
+		DeletionPolicy:   deletionPolicy,
+		Parameters:       audit.Redact(details.RawParameters),
+		RequestHash:      requestHash,
+	}
+
+	if details.ServiceID == R2_SERVICE_ID {
+		bucket, err := b.provisionR2Bucket(client, instanceID, authHeaders, details.RawParameters)
+		if err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+		instance.R2Bucket = &bucket
+	} else if details.PlanID == TUNNEL_PLAN_ID {
+		tunnel, err := b.provisionTunnel(client, instanceID, authHeaders, details.RawParameters)
+		if err != nil {
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+		instance.Tunnel = &tunnel
+	}
+
+	b.update(func() {
+		b.Instances[instanceID] = instance
+		delete(b.ResourceIntents, instanceID)
+	})
 
-	return brokerapi.ProvisionedServiceSpec{}, nil
+	return brokerapi.ProvisionedServiceSpec{DashboardURL: dashboardURL(instance)}, nil
 }
 
 func (b *CloudflareBroker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
-	// Clear data
-	b.CloudflareAPI = &api.CloudflareAPI{}
+	if !b.instanceLocks.tryLock(instanceID) {
+		return brokerapi.DeprovisionServiceSpec{}, ErrConcurrentInstanceAccess
+	}
+
+	// An asynchronous deprovision keeps the instance locked until it is done
+	// and records itself when it finishes
+	startedAt := time.Now()
+	spec, err := b.deprovision(context, instanceID, asyncAllowed)
+	if !spec.IsAsync {
+		b.instanceLocks.unlock(instanceID)
+		b.mu.Lock()
+		b.recordOperation(OPERATION_DEPROVISION, instanceID, "", startedAt, err)
+		b.mu.Unlock()
+	}
+
+	return spec, err
+}
+
+func (b *CloudflareBroker) deprovision(ctx context.Context, instanceID string, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	b.mu.Lock()
+	bindings := b.instanceBindings(instanceID)
+	_, ok := b.Instances[instanceID]
+	b.mu.Unlock()
+
+	if len(bindings) > 0 {
+		err := BindingsExistError{InstanceID: instanceID, Bindings: bindings}
+		b.logger.Error("Deprovision refused", err)
+		return brokerapi.DeprovisionServiceSpec{}, err
+	}
+	if !ok {
+		return brokerapi.DeprovisionServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	if asyncAllowed {
+		b.update(func() {
+			b.Operations[instanceID] = Operation{
+				Type:        OPERATION_DEPROVISION,
+				State:       brokerapi.InProgress,
+				Description: "deleting the resources of the instance",
+				StartedAt:   time.Now(),
+			}
+		})
+		go func() {
+			defer b.instanceLocks.unlock(instanceID)
+			b.finishOperation(detach(ctx), instanceID, OPERATION_DEPROVISION, func(ctx context.Context) []error {
+				return b.cleanupInstance(ctx, instanceID)
+			})
+		}()
+
+		return brokerapi.DeprovisionServiceSpec{IsAsync: true, OperationData: OPERATION_DEPROVISION}, nil
+	}
+
+	if errs := b.cleanupInstance(ctx, instanceID); len(errs) > 0 {
+		return brokerapi.DeprovisionServiceSpec{}, joinErrors(errs)
+	}
 
 	return brokerapi.DeprovisionServiceSpec{}, nil
 }
 
 func (b *CloudflareBroker) Bind(context context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	if !b.instanceLocks.tryLock(instanceID) {
+		return brokerapi.Binding{}, ErrConcurrentInstanceAccess
+	}
+	defer b.instanceLocks.unlock(instanceID)
+
+	startedAt := time.Now()
+	binding, err := b.bind(context, instanceID, bindingID, details)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.recordOperation(OPERATION_BIND, instanceID, bindingID, startedAt, err)
+
+	return binding, err
+}
+
+func (b *CloudflareBroker) bind(context context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	b.mu.Lock()
+	request, existing, err := b.checkBind(instanceID, bindingID, details)
+	b.mu.Unlock()
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if existing != nil {
+		return *existing, nil
+	}
+	defer b.unreserveZone(getZoneKey(instanceID, bindingID))
+	b.setBindingOperation(getZoneKey(instanceID, bindingID), nil)
+
+	return b.completeBind(context, instanceID, bindingID, details, request)
+}
+
+// bindRequest is a bind request checkBind accepted.
+type bindRequest struct {
+	requestHash string
+	// domain and access are those of a zone binding, in normalized form
+	domain string
+	access *AccessParameters
+}
+
+// checkBind refuses a bind request for a binding that exists, an instance
+// that does not, with invalid parameters or against a policy, before
+// anything is created. A retry of the request that created the binding gets
+// the same credentials back. The zone of an accepted request counts against
+// the policy limits until the caller unreserves it. Callers hold b.mu.
+func (b *CloudflareBroker) checkBind(instanceID, bindingID string, details brokerapi.BindDetails) (bindRequest, *brokerapi.Binding, error) {
+	requestHash, err := bindRequestHash(details)
+	if err != nil {
+		return bindRequest{}, nil, err
+	}
+	instance, ok := b.Instances[instanceID]
+	if !ok {
+		return bindRequest{}, nil, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	// A retry of the request that created the binding gets the same
+	// credentials, any other request for the binding is a conflict
+	zoneKey := getZoneKey(instanceID, bindingID)
+	if record, ok := b.Bindings[zoneKey]; ok {
+		if record.RequestHash == requestHash {
+			return bindRequest{}, &brokerapi.Binding{Credentials: record.Credentials}, nil
+		}
+		return bindRequest{}, nil, brokerapi.ErrBindingAlreadyExists
+	}
+	if b.bindingExists(zoneKey) {
+		return bindRequest{}, nil, brokerapi.ErrBindingAlreadyExists
+	}
+	if schemas, ok := Schemas(details.PlanID); ok {
+		if err := validateParameterMap(schemas.ServiceBinding.Create.Parameters, details.Parameters); err != nil {
+			return bindRequest{}, nil, err
+		}
+	}
+
+	request := bindRequest{requestHash: requestHash}
+	if instance.R2Bucket != nil || instance.Tunnel != nil {
+		return request, nil, nil
+	}
+
 	paramDomain, ok := details.Parameters["domain"]
 	if !ok {
-		return brokerapi.Binding{}, errors.New("key 'domain' not found in BindDetails.Parameters.")
+		return bindRequest{}, nil, ParameterError{Problems: []string{"domain is required"}}
 	}
 
 	domain, ok := paramDomain.(string)
 	if !ok {
-		return brokerapi.Binding{}, errors.New("key 'domain' is not a in type string.")
+		return bindRequest{}, nil, ParameterError{Problems: []string{"domain must be a string"}}
 	}
 
-	data, err := b.CloudflareAPI.AddZone(domain)
+	// Zones are added and looked up by their normalized name only
+	request.domain, err = hostname.Normalize(domain)
+	if err != nil {
+		return bindRequest{}, nil, ParameterError{Problems: []string{"domain " + err.Error()}}
+	}
+
+	if paramAccess, ok := details.Parameters["access"]; ok {
+		parameters, err := parseAccessParameters(paramAccess, request.domain)
+		if err != nil {
+			return bindRequest{}, nil, err
+		}
+		request.access = &parameters
+	}
+
+	if err := b.reserveZone(instanceID, bindingID, request.domain); err != nil {
+		return bindRequest{}, nil, err
+	}
+
+	return request, nil, nil
+}
+
+// completeBind creates the resources of a binding that checkBind accepted,
+// and remembers it.
+func (b *CloudflareBroker) completeBind(context context.Context, instanceID, bindingID string, details brokerapi.BindDetails, request bindRequest) (brokerapi.Binding, error) {
+	binding, err := b.createBinding(context, instanceID, bindingID, details, request)
+	if err != nil {
+		return binding, err
+	}
+
+	// Only the bound app may read credentials kept in CredHub, so those of
+	// service keys are returned inline
+	if b.CredHub != nil && bindingAppGUID(details) != "" {
+		b.bindingProgress(instanceID, bindingID, "storing the credentials in CredHub")
+		ref, err := b.storeCredentials(instanceID, bindingID, details, binding.Credentials)
+		if err != nil {
+			b.logger.Error("Error storing credentials in CredHub", err, lager.Data{"instance_id": instanceID, "binding_id": bindingID})
+			// Do not leave resources behind for a binding that failed
+			if err := b.deleteBinding(context, instanceID, bindingID); err != nil {
+				b.logger.Error("Error deleting binding", err, lager.Data{"instance_id": instanceID, "binding_id": bindingID})
+			}
+			return brokerapi.Binding{}, err
+		}
+		binding.Credentials = ref
+	}
+
+	b.update(func() {
+		b.Bindings[getZoneKey(instanceID, bindingID)] = BindingRecord{
+			RequestHash: request.requestHash,
+			Credentials: binding.Credentials,
+			Parameters:  redactParameters(details.Parameters),
+		}
+	})
+
+	return binding, nil
+}
+
+func (b *CloudflareBroker) createBinding(context context.Context, instanceID, bindingID string, details brokerapi.BindDetails, request bindRequest) (brokerapi.Binding, error) {
+	b.mu.Lock()
+	instance := b.Instances[instanceID]
+	b.mu.Unlock()
+	client := b.CloudflareAPI.With(context, instance.Auth)
+
+	if instance.R2Bucket != nil {
+		b.bindingProgress(instanceID, bindingID, "creating an R2 access key")
+		return b.bindR2Bucket(client, instanceID, bindingID, *instance.R2Bucket)
+	}
+	if instance.Tunnel != nil {
+		b.bindingProgress(instanceID, bindingID, "fetching the tunnel token")
+		return b.bindTunnel(client, instanceID, bindingID, *instance.Tunnel)
+	}
+
+	domain := request.domain
+	accessParameters := request.access
+	adopt, _ := details.Parameters["adopt"].(bool)
+	zoneID, _ := details.Parameters["zone_id"].(string)
+
+	zoneKey := getZoneKey(instanceID, bindingID)
+
+	var zone Zone
+	var err error
+	if adopt {
+		b.bindingProgress(instanceID, bindingID, "adopting the zone of "+domain)
+		zone, err = b.adoptZone(client, domain, zoneID)
+	} else {
+		b.bindingProgress(instanceID, bindingID, "adding the zone of "+domain)
+		// Until the zone is stored, only the intent tells the reconciler
+		// that the broker created it. The intent is kept if the request
+		// to add the zone fails on its way, because the zone may have been
+		// created anyway, but not if Cloudflare refused it, for instance
+		// because the zone already exists. The intent of an earlier attempt
+		// is kept as it is: its zone may be the one that exists now.
+		var retried bool
+		b.update(func() {
+			intent, ok := b.ZoneIntents[zoneKey]
+			retried = ok && intent.Domain == domain
+			if !retried {
+				b.ZoneIntents[zoneKey] = ZoneIntent{Domain: domain, Auth: instance.Auth, StartedAt: time.Now()}
+			}
+		})
+		zone, err = b.addZone(client, domain)
+		if _, refused := err.(CloudflareError); refused && !retried {
+			b.update(func() { delete(b.ZoneIntents, zoneKey) })
+		}
+	}
 	if err != nil {
-		b.logger.Error("Bind calling api.cloudflare", err)
 		return brokerapi.Binding{}, err
 	}
+	credentials := ZoneCredentials{Zone: zone}
+
+	if accessParameters != nil {
+		b.bindingProgress(instanceID, bindingID, "creating the Access application of "+accessParameters.Hostname)
+		application, err := b.createAccessApplication(client, *accessParameters)
+		if err != nil {
+			b.logger.Error("Error creating Access application", err, lager.Data{"domain": accessParameters.Hostname})
+			// Do not leave the zone behind for a binding that failed
+			if !zone.Adopted {
+				if err := b.deleteZone(client, zone.ID); err != nil {
+					b.logger.Error("Bind calling api.cloudflare", err)
+				} else {
+					b.update(func() { delete(b.ZoneIntents, zoneKey) })
+				}
+			}
+			return brokerapi.Binding{}, err
+		}
+
+		accessCredentials := application.Credentials()
+		credentials.Access = &accessCredentials
+		b.update(func() { b.AccessApplications[zoneKey] = application })
+	}
+
+	b.update(func() {
+		b.Zones[zoneKey] = zone
+		delete(b.ZoneIntents, zoneKey)
+	})
+
+	return brokerapi.Binding{
+		Credentials: credentials,
+	}, nil
+}
+
+// addZone creates a new zone for domain.
+func (b *CloudflareBroker) addZone(client api.CloudflareAPIInterface, domain string) (Zone, error) {
+	data, err := client.AddZone(domain)
+	if err != nil {
+		b.logger.Error("Bind calling api.cloudflare", err)
+		return Zone{}, err
+	}
 
 	var zoneCreateResponse ZoneCreateResponse
 	if err := json.Unmarshal(data, &zoneCreateResponse); err != nil {
 		b.logger.Error("Error decoding details.RawParameters", err)
-		return brokerapi.Binding{}, err
+		return Zone{}, err
 	}
 
 	if zoneCreateResponse.Success == false {
-		b.logger.Error("Error from CloudFlare Client API", errors.New(fmt.Sprintf("%+v", zoneCreateResponse)))
-		return brokerapi.Binding{}, errors.New(fmt.Sprintf("%+v", zoneCreateResponse))
+		err := CloudflareError{Errors: zoneCreateResponse.Errors}
+		b.logger.Error("Error from CloudFlare Client API", err)
+		return Zone{}, err
 	}
 
-	zoneKey := getZoneKey(instanceID, bindingID)
-	b.Zones[zoneKey] = zoneCreateResponse.Result
+	return zoneCreateResponse.Result, nil
+}
 
-	return brokerapi.Binding{
-		Credentials: zoneCreateResponse.Result,
-	}, nil
+// adoptZone looks up an existing zone by ID, or by name if zoneID is empty,
+// and marks it as adopted so that Unbind leaves it in place.
+func (b *CloudflareBroker) adoptZone(client api.CloudflareAPIInterface, domain string, zoneID string) (Zone, error) {
+	var zone Zone
+
+	if zoneID != "" {
+		data, err := client.GetZone(zoneID)
+		if err != nil {
+			b.logger.Error("Bind calling api.cloudflare", err)
+			return Zone{}, err
+		}
+		if _, err := decodeCloudflareResponse(data, &zone); err != nil {
+			b.logger.Error("Error from CloudFlare Client API", err)
+			return Zone{}, err
+		}
+		if zone.Name != domain {
+			return Zone{}, errors.New("zone " + zoneID + " is " + zone.Name + ", not " + domain)
+		}
+	} else {
+		data, err := client.GetZoneByName(domain)
+		if err != nil {
+			b.logger.Error("Bind calling api.cloudflare", err)
+			return Zone{}, err
+		}
+		var zones []Zone
+		if _, err := decodeCloudflareResponse(data, &zones); err != nil {
+			b.logger.Error("Error from CloudFlare Client API", err)
+			return Zone{}, err
+		}
+		if len(zones) == 0 {
+			return Zone{}, errors.New("zone " + domain + " does not exist and cannot be adopted")
+		}
+		zone = zones[0]
+	}
+
+	zone.Adopted = true
+
+	return zone, nil
 }
 
 func (b *CloudflareBroker) Unbind(context context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+	if !b.instanceLocks.tryLock(instanceID) {
+		return ErrConcurrentInstanceAccess
+	}
+	defer b.instanceLocks.unlock(instanceID)
+
+	startedAt := time.Now()
+	// Credentials are deleted first, as deleting them again on a retry
+	// succeeds while deleting the resources may not
+	err := b.deleteCredentials(getZoneKey(instanceID, bindingID))
+	if err == nil {
+		err = b.deleteBinding(context, instanceID, bindingID)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.Bindings, getZoneKey(instanceID, bindingID))
+		b.setBindingOperation(getZoneKey(instanceID, bindingID), nil)
+	}
+	b.recordOperation(OPERATION_UNBIND, instanceID, bindingID, startedAt, err)
+
+	return err
+}
+
+func (b *CloudflareBroker) deleteBinding(ctx context.Context, instanceID, bindingID string) error {
 	zoneKey := getZoneKey(instanceID, bindingID)
-	zone, ok := b.Zones[zoneKey]
-	if !ok {
-		return errors.New("Zone does not exist")
+
+	b.mu.Lock()
+	instance := b.Instances[instanceID]
+	accessKey, hasAccessKey := b.R2AccessKeys[zoneKey]
+	_, hasTunnel := b.TunnelBindings[zoneKey]
+	zone, hasZone := b.Zones[zoneKey]
+	application, hasApplication := b.AccessApplications[zoneKey]
+	b.mu.Unlock()
+	client := b.CloudflareAPI.With(ctx, instance.Auth)
+
+	if hasAccessKey {
+		return b.unbindR2Bucket(client, zoneKey, accessKey)
+	}
+	if hasTunnel {
+		// The connector token stays valid for the tunnel's lifetime
+		b.update(func() { delete(b.TunnelBindings, zoneKey) })
+		return nil
 	}
 
-	// Delete Zone from Cloudflare
-	err := b.CloudflareAPI.DeleteZone(zone.ID)
-	if err != nil {
-		b.logger.Error("Unbind calling api.cloudflare", err)
+	if !hasZone {
+		return brokerapi.ErrBindingDoesNotExist
+	}
+
+	// Delete the Access application protecting the zone
+	if hasApplication {
+		if err := b.deleteAccessApplication(client, application); err != nil {
+			b.logger.Error("Unbind calling api.cloudflare", err)
+			return err
+		}
+		b.update(func() { delete(b.AccessApplications, zoneKey) })
+	}
+
+	// Delete, retain or soft-delete the zone in Cloudflare
+	if err := b.releaseZone(client, instanceID, bindingID, zone); err != nil {
 		return err
 	}
 
 	// Remove from local Zone List
-	delete(b.Zones, zoneKey)
+	b.update(func() { delete(b.Zones, zoneKey) })
 
 	return nil
 }
 
 func (b *CloudflareBroker) LastOperation(context context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
+	b.mu.Lock()
+	operation, ok := b.Operations[instanceID]
+	b.mu.Unlock()
+	if ok {
+		return brokerapi.LastOperation{State: operation.State, Description: operation.Description}, nil
+	}
+
+	status, err := b.InstanceStatus(context, instanceID)
+	if err == nil {
+		return brokerapi.LastOperation{State: status.State, Description: status.Description}, nil
+	}
+
 	b.logger.Debug("LastOperation", lager.Data{"log_message": ENDPOINT_NOT_AVAILABLE})
 
 	return brokerapi.LastOperation{State: "failed", Description: ENDPOINT_NOT_AVAILABLE}, nil
@@ -171,15 +766,77 @@ func (b *CloudflareBroker) LastOperation(context context.Context, instanceID, op
 func (b *CloudflareBroker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
 	b.logger.Debug("Update", lager.Data{"log_message": ENDPOINT_NOT_AVAILABLE})
 
+	// No plan takes update parameters, so they are refused rather than
+	// silently ignored
+	planID := details.PlanID
+	if planID == "" {
+		planID = details.PreviousValues.PlanID
+	}
+	if schemas, ok := Schemas(planID); ok {
+		if err := validateParameterMap(schemas.ServiceInstance.Update.Parameters, details.Parameters); err != nil {
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+	}
+
 	return brokerapi.UpdateServiceSpec{OperationData: ENDPOINT_NOT_AVAILABLE}, nil
 }
 
+// CheckCredentials reports whether Cloudflare accepts authHeaders, by listing
+// the first page of their zones.
+func (b *CloudflareBroker) CheckCredentials(authHeaders api.AuthHeaders) error {
+	return CheckCloudflareCredentials(b.CloudflareAPI, authHeaders)
+}
+
+// CheckCloudflareCredentials is CheckCredentials with a client of its own,
+// such as one with a shorter timeout.
+func CheckCloudflareCredentials(cloudflareAPI api.CloudflareAPIInterface, authHeaders api.AuthHeaders) error {
+	data, err := cloudflareAPI.With(context.Background(), authHeaders).ListZones(1)
+	if err != nil {
+		return err
+	}
+
+	_, err = decodeCloudflareResponse(data, nil)
+	return err
+}
+
+// KnownCredentials returns every set of Cloudflare credentials in the broker
+// state.
+func (b *CloudflareBroker) KnownCredentials() []api.AuthHeaders {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var credentials []api.AuthHeaders
+	for _, account := range knownAccounts(b.state()) {
+		credentials = append(credentials, account.auth)
+	}
+
+	return credentials
+}
+
 func New(logger lager.Logger, zones map[string]Zone) CloudflareBroker {
 	cloudflareAPI := &api.CloudflareAPI{}
 
 	return CloudflareBroker{
-		Zones:         zones,
-		CloudflareAPI: cloudflareAPI,
-		logger:        logger,
+		Zones:              zones,
+		Bindings:           map[string]BindingRecord{},
+		Instances:          map[string]Instance{},
+		R2AccessKeys:       map[string]R2AccessKey{},
+		AccessApplications: map[string]AccessApplication{},
+		TunnelBindings:     map[string]string{},
+		DeletionPolicy:     DeletionPolicy{Policy: DELETION_POLICY_DELETE, GracePeriod: DEFAULT_DELETION_GRACE_PERIOD},
+		PendingDeletions:   map[string]PendingDeletion{},
+		Operations:         map[string]Operation{},
+		BindingOperations:  map[string]Operation{},
+		ZoneIntents:        map[string]ZoneIntent{},
+		ResourceIntents:    map[string]ResourceIntent{},
+		ReconcileOptions:   ReconcileOptions{DryRun: true, OrphanAge: DEFAULT_ORPHAN_AGE},
+		activationChecks:   map[string]time.Time{},
+		mu:                 &sync.Mutex{},
+		operationsMu:       &sync.Mutex{},
+		instanceLocks:      newInstanceLocks(),
+		reservedInstances:  map[string]Instance{},
+		reservedZones:      map[string]bool{},
+		CloudflareAPI:      cloudflareAPI,
+		logger:             logger,
 	}
 }
@@ -4,6 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 
 	"code.cloudfoundry.org/lager"
@@ -118,8 +122,10 @@ func TestProvisionWithCredentials(t *testing.T) {
 func TestDeprovision(t *testing.T) {
 	logger := lager.NewLogger("cloudflare-broker")
 	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
 	var context context.Context
 	instanceId := "1"
+	provisionIn(&cloudflarebroker, instanceId, "org", "space", broker.FREE_PLAN_ID)
 
 	_, err := cloudflarebroker.Deprovision(
 		context,
@@ -130,14 +136,100 @@ func TestDeprovision(t *testing.T) {
 	if err != nil {
 		t.Errorf("Deprovision failed")
 	}
+
+	// A retry after the instance is gone is answered with 410
+	_, err = cloudflarebroker.Deprovision(context, instanceId, brokerapi.DeprovisionDetails{}, false)
+	if err != brokerapi.ErrInstanceDoesNotExist {
+		t.Errorf("Deprovision of an unknown instance returned %v", err)
+	}
+}
+
+type FakeCloudflareAPI struct {
+	mu         sync.Mutex
+	Calls      []string
+	ZoneStatus string
+	// Fail names the methods that report an API error, separated by
+	// commas, or for DNS records "DeleteDNSRecord <record ID>"
+	Fail string
+	// Listed* are returned by the List methods
+	ListedZones   []map[string]interface{}
+	ListedTunnels []map[string]interface{}
+	ListedBuckets []map[string]interface{}
+	// If Block is set AddZone signals Blocked and waits until Block is closed
+	Block   chan struct{}
+	Blocked chan struct{}
+	// AddZoneContext is the context of the client AddZone was called on
+	AddZoneContext context.Context
+	// AddedDomains holds the domains AddZone was called with
+	AddedDomains []string
+	// DeletedRecords holds the DNS records deleted, which are not found
+	// when deleted again
+	DeletedRecords map[string]bool
+}
+
+// fakeClient is the client of one operation. It records its context when
+// AddZone is called.
+type fakeClient struct {
+	*FakeCloudflareAPI
+	ctx context.Context
+}
+
+func (client fakeClient) AddZone(domain string) ([]byte, error) {
+	client.mu.Lock()
+	client.AddZoneContext = client.ctx
+	client.mu.Unlock()
+
+	return client.FakeCloudflareAPI.AddZone(domain)
+}
+
+func (api *FakeCloudflareAPI) With(ctx context.Context, authHeaders api.AuthHeaders) api.CloudflareAPIInterface {
+	return fakeClient{api, ctx}
+}
+
+func (api *FakeCloudflareAPI) record(call string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	api.Calls = append(api.Calls, call)
+}
+
+func (api *FakeCloudflareAPI) fails(method string) bool {
+	for _, failing := range strings.Split(api.Fail, ",") {
+		if failing == method {
+			return true
+		}
+	}
+
+	return false
 }
 
-type FakeCloudflareAPI struct{}
+func fakeFailure() []byte {
+	data, _ := json.Marshal(map[string]interface{}{"success": false, "errors": []string{"Fake Error."}})
+
+	return data
+}
+
+func fakeSuccess(result interface{}) []byte {
+	data, _ := json.Marshal(map[string]interface{}{"success": true, "result": result})
+
+	return data
+}
 
 func (api *FakeCloudflareAPI) AddZone(domain string) ([]byte, error) {
+	api.mu.Lock()
+	api.AddedDomains = append(api.AddedDomains, domain)
+	api.mu.Unlock()
 	if domain == "" {
 		return nil, errors.New("Fake Error.")
 	}
+	if domain == "existing.com" {
+		data, _ := json.Marshal(map[string]interface{}{"success": false, "errors": []map[string]interface{}{{"code": 1061, "message": "existing.com already exists"}}})
+		return data, nil
+	}
+	if api.Block != nil {
+		api.Blocked <- struct{}{}
+		<-api.Block
+	}
 
 	response := broker.ZoneCreateResponse{Success: true}
 	data, _ := json.Marshal(response)
@@ -145,11 +237,186 @@ func (api *FakeCloudflareAPI) AddZone(domain string) ([]byte, error) {
 	return data, nil
 }
 
-func (api *FakeCloudflareAPI) DeleteZone(zoneId string) error {
-	return nil
+func (api *FakeCloudflareAPI) DeleteZone(zoneId string) ([]byte, error) {
+	api.record("DeleteZone " + zoneId)
+	if api.fails("DeleteZone") {
+		return fakeFailure(), nil
+	}
+	return fakeSuccess(map[string]string{"id": zoneId}), nil
+}
+
+func (api *FakeCloudflareAPI) GetZone(zoneId string) ([]byte, error) {
+	return fakeSuccess(broker.Zone{
+		ID:          zoneId,
+		Name:        "domain.com",
+		Status:      api.ZoneStatus,
+		NameServers: []string{"ns1.cloudflare.com", "ns2.cloudflare.com"},
+	}), nil
+}
+
+func (api *FakeCloudflareAPI) GetZoneByName(domain string) ([]byte, error) {
+	if domain != "existing.com" {
+		return fakeSuccess([]broker.Zone{}), nil
+	}
+
+	return fakeSuccess([]broker.Zone{{ID: "existing-zone", Name: domain, Status: broker.ZONE_STATUS_ACTIVE}}), nil
+}
+
+func (api *FakeCloudflareAPI) ListZones(page int) ([]byte, error) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"success":     true,
+		"result":      api.ListedZones,
+		"result_info": map[string]int{"page": page, "total_pages": 1},
+	})
+	return data, nil
+}
+
+func (api *FakeCloudflareAPI) SetZonePaused(zoneId string, paused bool) ([]byte, error) {
+	if paused {
+		api.record("PauseZone " + zoneId)
+	} else {
+		api.record("ResumeZone " + zoneId)
+	}
+	return fakeSuccess(nil), nil
+}
+
+func (api *FakeCloudflareAPI) ZoneActivationCheck(zoneId string) ([]byte, error) {
+	api.record("ZoneActivationCheck " + zoneId)
+	return fakeSuccess(nil), nil
+}
+
+func (api *FakeCloudflareAPI) CreateR2Bucket(accountId string, bucket api.R2BucketRequest) ([]byte, error) {
+	api.record("CreateR2Bucket " + bucket.Name)
+	return fakeSuccess(map[string]string{"name": bucket.Name, "location": "WNAM"}), nil
+}
+
+func (api *FakeCloudflareAPI) PutR2BucketCORS(accountId string, bucketName string, rules []byte) ([]byte, error) {
+	api.record("PutR2BucketCORS " + bucketName)
+	if api.fails("PutR2BucketCORS") {
+		return fakeFailure(), nil
+	}
+	return fakeSuccess(nil), nil
+}
+
+func (api *FakeCloudflareAPI) PutR2BucketLifecycle(accountId string, bucketName string, rules []byte) ([]byte, error) {
+	api.record("PutR2BucketLifecycle " + bucketName)
+	if api.fails("PutR2BucketLifecycle") {
+		return fakeFailure(), nil
+	}
+	return fakeSuccess(nil), nil
+}
+
+func (api *FakeCloudflareAPI) ListR2Objects(accountId string, bucketName string, cursor string) ([]byte, error) {
+	api.record("ListR2Objects " + bucketName)
+	return fakeSuccess([]map[string]string{{"key": "object"}}), nil
+}
+
+func (api *FakeCloudflareAPI) DeleteR2Object(accountId string, bucketName string, key string) ([]byte, error) {
+	api.record("DeleteR2Object " + key)
+	return fakeSuccess(nil), nil
+}
+
+func (api *FakeCloudflareAPI) DeleteR2Bucket(accountId string, bucketName string) ([]byte, error) {
+	api.record("DeleteR2Bucket " + bucketName)
+	if api.fails("DeleteR2Bucket") {
+		return fakeFailure(), nil
+	}
+	return fakeSuccess(nil), nil
 }
 
-func (api *FakeCloudflareAPI) SetAuthHeaders(authHeaders api.AuthHeaders) {
+func (api *FakeCloudflareAPI) ListR2Buckets(accountId string) ([]byte, error) {
+	return fakeSuccess(map[string]interface{}{"buckets": api.ListedBuckets}), nil
+}
+
+func (api *FakeCloudflareAPI) CreateAccountToken(accountId string, token api.TokenRequest) ([]byte, error) {
+	api.record("CreateAccountToken " + token.Name)
+	return fakeSuccess(map[string]string{"id": "token-id", "value": "token-value"}), nil
+}
+
+func (api *FakeCloudflareAPI) DeleteAccountToken(accountId string, tokenId string) ([]byte, error) {
+	api.record("DeleteAccountToken " + tokenId)
+	if api.fails("DeleteAccountToken") {
+		return fakeFailure(), nil
+	}
+	return fakeSuccess(nil), nil
+}
+
+func (api *FakeCloudflareAPI) CreateAccessApplication(accountId string, application api.AccessApplicationRequest) ([]byte, error) {
+	api.record("CreateAccessApplication " + application.Domain)
+	return fakeSuccess(map[string]string{"id": "app-id", "aud": "app-aud", "domain": application.Domain}), nil
+}
+
+func (api *FakeCloudflareAPI) DeleteAccessApplication(accountId string, applicationId string) ([]byte, error) {
+	api.record("DeleteAccessApplication " + applicationId)
+	return fakeSuccess(nil), nil
+}
+
+func (api *FakeCloudflareAPI) CreateAccessPolicy(accountId string, applicationId string, policy api.AccessPolicyRequest) ([]byte, error) {
+	api.record("CreateAccessPolicy " + policy.Decision)
+	return fakeSuccess(nil), nil
+}
+
+func (api *FakeCloudflareAPI) GetAccessOrganization(accountId string) ([]byte, error) {
+	return fakeSuccess(map[string]string{"auth_domain": "team.cloudflareaccess.com"}), nil
+}
+
+func (api *FakeCloudflareAPI) CreateTunnel(accountId string, tunnel api.TunnelRequest) ([]byte, error) {
+	api.record("CreateTunnel " + tunnel.Name)
+	return fakeSuccess(map[string]string{"id": "tunnel-id", "name": tunnel.Name}), nil
+}
+
+func (api *FakeCloudflareAPI) GetTunnel(accountId string, tunnelId string) ([]byte, error) {
+	return fakeSuccess(map[string]string{"id": tunnelId}), nil
+}
+
+func (api *FakeCloudflareAPI) DeleteTunnel(accountId string, tunnelId string) ([]byte, error) {
+	api.record("DeleteTunnel " + tunnelId)
+	return fakeSuccess(nil), nil
+}
+
+func (api *FakeCloudflareAPI) ListTunnels(accountId string) ([]byte, error) {
+	return fakeSuccess(api.ListedTunnels), nil
+}
+
+func (api *FakeCloudflareAPI) GetTunnelToken(accountId string, tunnelId string) ([]byte, error) {
+	return fakeSuccess("tunnel-token"), nil
+}
+
+func (api *FakeCloudflareAPI) PutTunnelConfiguration(accountId string, tunnelId string, configuration api.TunnelConfiguration) ([]byte, error) {
+	api.record("PutTunnelConfiguration " + tunnelId)
+	return fakeSuccess(nil), nil
+}
+
+func (api *FakeCloudflareAPI) ListTunnelConnections(accountId string, tunnelId string) ([]byte, error) {
+	return fakeSuccess([]map[string]interface{}{{"id": "client", "conns": []map[string]string{{"id": "conn", "colo_name": "AMS"}}}}), nil
+}
+
+func (api *FakeCloudflareAPI) CleanupTunnelConnections(accountId string, tunnelId string) ([]byte, error) {
+	api.record("CleanupTunnelConnections " + tunnelId)
+	return fakeSuccess(nil), nil
+}
+
+func (api *FakeCloudflareAPI) CreateDNSRecord(zoneId string, record api.DNSRecordRequest) ([]byte, error) {
+	api.record("CreateDNSRecord " + record.Name + " " + record.Content)
+	return fakeSuccess(map[string]string{"id": "record-" + record.Name}), nil
+}
+
+func (api *FakeCloudflareAPI) DeleteDNSRecord(zoneId string, recordId string) ([]byte, error) {
+	api.record("DeleteDNSRecord " + recordId)
+	if api.fails("DeleteDNSRecord " + recordId) {
+		return fakeFailure(), nil
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.DeletedRecords[recordId] {
+		data, _ := json.Marshal(map[string]interface{}{"success": false, "errors": []map[string]interface{}{{"code": broker.DNS_RECORD_NOT_FOUND_CODE, "message": "Record does not exist."}}})
+		return data, nil
+	}
+	if api.DeletedRecords == nil {
+		api.DeletedRecords = map[string]bool{}
+	}
+	api.DeletedRecords[recordId] = true
+	return fakeSuccess(nil), nil
 }
 
 func TestBindWithEmptyParameters(t *testing.T) {
@@ -195,6 +462,7 @@ func TestBindWithCorrectParameters(t *testing.T) {
 	logger := lager.NewLogger("cloudflare-broker")
 	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
 	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
 	var context context.Context
 	instanceId := "1"
 	bindingId := "2"
@@ -240,6 +508,31 @@ func TestUnbind(t *testing.T) {
 	}
 }
 
+func TestUnbindUnknownBinding(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	var context context.Context
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+
+	if err := cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{}); err != brokerapi.ErrBindingDoesNotExist {
+		t.Errorf("Unbind of an unknown binding returned %v", err)
+	}
+}
+
+func TestBindUnknownInstance(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	_, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": "domain.com"}})
+	if err != brokerapi.ErrInstanceDoesNotExist || len(fakeAPI.AddedDomains) != 0 {
+		t.Errorf("Bind to an unknown instance returned %v and added %v", err, fakeAPI.AddedDomains)
+	}
+}
+
 func TestLastOperation(t *testing.T) {
 	logger := lager.NewLogger("cloudflare-broker")
 	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
@@ -265,3 +558,106 @@ func TestUpdate(t *testing.T) {
 		t.Errorf("LastOperation failed")
 	}
 }
+
+func TestBindAdoptsExistingZone(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	var context context.Context
+
+	params := map[string]interface{}{
+		"domain": "existing.com",
+		"adopt":  true,
+	}
+	binding, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: params})
+	credentials, _ := binding.Credentials.(broker.ZoneCredentials)
+	if err != nil || credentials.ID != "existing-zone" || !credentials.Adopted {
+		t.Fatalf("Bind adopt failed %+v %v", binding.Credentials, err)
+	}
+
+	err = cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{})
+	if err != nil || len(cloudflarebroker.Zones) != 0 || len(fakeAPI.Calls) != 0 {
+		t.Errorf("Unbind deleted an adopted zone %v %v", err, fakeAPI.Calls)
+	}
+}
+
+func TestBindAdoptWithZoneID(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	var context context.Context
+
+	params := map[string]interface{}{
+		"domain":  "domain.com",
+		"adopt":   true,
+		"zone_id": "zone",
+	}
+	_, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: params})
+	if err != nil || cloudflarebroker.Zones["1:2"].ID != "zone" {
+		t.Errorf("Bind adopt by zone_id failed %v", err)
+	}
+
+	params["domain"] = "other.com"
+	_, err = cloudflarebroker.Bind(context, "1", "3", brokerapi.BindDetails{Parameters: params})
+	if err == nil {
+		t.Errorf("Bind adopted zone of another domain")
+	}
+}
+
+func TestBindAdoptMissingZone(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	var context context.Context
+
+	params := map[string]interface{}{
+		"domain": "missing.com",
+		"adopt":  true,
+	}
+	_, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: params})
+	if err == nil {
+		t.Errorf("Bind adopted a zone that does not exist")
+	}
+}
+
+func TestBindNormalizesDomain(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	var context context.Context
+
+	_, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": "Bücher.Example.COM."}})
+	if err != nil || len(fakeAPI.AddedDomains) != 1 || fakeAPI.AddedDomains[0] != "xn--bcher-kva.example.com" {
+		t.Errorf("Bind added %v %v", fakeAPI.AddedDomains, err)
+	}
+}
+
+func TestBindRejectsInvalidDomain(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	credentials := brokerapi.BrokerCredentials{Username: "username", Password: "password"}
+	handler := broker.NewErrorStatusHandler(brokerapi.New(&cloudflarebroker, logger, credentials))
+
+	for _, domain := range []string{`"co.uk"`, `"192.0.2.1"`, `"*.domain.com"`, `"domain.com\", \"type\": \"partial"`, `42`} {
+		req := httptest.NewRequest("PUT", "/v2/service_instances/1/service_bindings/2", strings.NewReader(`{"service_id": "s", "plan_id": "p", "parameters": {"domain": `+domain+`}}`))
+		req.SetBasicAuth("username", "password")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != http.StatusUnprocessableEntity || !strings.Contains(recorder.Body.String(), broker.INVALID_PARAMETERS_PREFIX+"domain") {
+			t.Errorf("Bind of %s returned %d %s", domain, recorder.Code, recorder.Body.String())
+		}
+	}
+	if len(fakeAPI.AddedDomains) != 0 || len(cloudflarebroker.ZoneIntents) != 0 {
+		t.Errorf("Bind of invalid domains called Cloudflare %v", fakeAPI.AddedDomains)
+	}
+}
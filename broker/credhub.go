@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"encoding/json"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/credhub"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// DEFAULT_CREDHUB_CLIENT_NAME is the broker name in the CredHub names of
+// binding credentials if CredHubClientName is not set.
+const DEFAULT_CREDHUB_CLIENT_NAME = "cloudflare-broker"
+
+// bindingAppGUID returns the GUID of the app a binding is for, or "" for a
+// service key.
+func bindingAppGUID(details brokerapi.BindDetails) string {
+	if details.AppGUID != "" {
+		return details.AppGUID
+	}
+	if details.BindResource != nil {
+		return details.BindResource.AppGuid
+	}
+
+	return ""
+}
+
+// storeCredentials stores the credentials of a binding in CredHub, readable
+// by the bound app only, and returns the reference to give Cloud Controller
+// in their place.
+func (b *CloudflareBroker) storeCredentials(instanceID string, bindingID string, details brokerapi.BindDetails, credentials interface{}) (interface{}, error) {
+	serviceID := details.ServiceID
+	if serviceID == "" {
+		b.mu.Lock()
+		serviceID = b.Instances[instanceID].ServiceID
+		b.mu.Unlock()
+	}
+	clientName := b.CredHubClientName
+	if clientName == "" {
+		clientName = DEFAULT_CREDHUB_CLIENT_NAME
+	}
+	name := credhub.BindingCredentialName(clientName, serviceID, bindingID)
+
+	if err := b.CredHub.Set(name, credentials); err != nil {
+		return nil, err
+	}
+	if err := b.CredHub.AddPermission(name, credhub.APP_ACTOR_PREFIX+bindingAppGUID(details), credhub.OPERATION_READ); err != nil {
+		if err := b.CredHub.Delete(name); err != nil {
+			b.logger.Error("Error deleting credentials from CredHub", err, lager.Data{"name": name})
+		}
+		return nil, err
+	}
+
+	return map[string]string{credhub.REF_KEY: name}, nil
+}
+
+// deleteCredentials deletes the credentials of a binding from CredHub if
+// they are stored there.
+func (b *CloudflareBroker) deleteCredentials(zoneKey string) error {
+	b.mu.Lock()
+	record, ok := b.Bindings[zoneKey]
+	b.mu.Unlock()
+	if !ok || b.CredHub == nil {
+		return nil
+	}
+
+	name := credentialsRef(record.Credentials)
+	if name == "" {
+		return nil
+	}
+
+	return b.CredHub.Delete(name)
+}
+
+// credentialsRef returns the CredHub reference of credentials, or "" if they
+// are inline. Credentials loaded from the state are decoded as generic maps.
+func credentialsRef(credentials interface{}) string {
+	data, err := json.Marshal(credentials)
+	if err != nil {
+		return ""
+	}
+
+	var ref map[string]interface{}
+	if err := json.Unmarshal(data, &ref); err != nil || len(ref) != 1 {
+		return ""
+	}
+	name, _ := ref[credhub.REF_KEY].(string)
+
+	return name
+}
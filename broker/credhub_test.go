@@ -0,0 +1,71 @@
+package broker_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/credhub"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+type failingCredHub struct {
+	*credhub.MemoryStore
+}
+
+func (failingCredHub) AddPermission(name string, actor string, operations ...string) error {
+	return errors.New("CredHub is down")
+}
+
+func TestBindStoresCredentialsInCredHub(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	store := credhub.NewMemoryStore()
+	cloudflarebroker.CredHub = store
+	var context context.Context
+
+	details := brokerapi.BindDetails{ServiceID: "service", AppGUID: "app", Parameters: map[string]interface{}{"domain": "domain.com"}}
+	binding, err := cloudflarebroker.Bind(context, "1", "2", details)
+	name := credhub.BindingCredentialName(broker.DEFAULT_CREDHUB_CLIENT_NAME, "service", "2")
+	if ref, _ := binding.Credentials.(map[string]string); err != nil || ref[credhub.REF_KEY] != name {
+		t.Fatalf("Bind returned %+v %v", binding.Credentials, err)
+	}
+	if len(store.Values[name]) == 0 || store.Permissions[name][0] != "mtls-app:app:read" {
+		t.Errorf("Bind stored %v %v", store.Values, store.Permissions)
+	}
+
+	if retried, err := cloudflarebroker.Bind(context, "1", "2", details); err != nil || retried.Credentials.(map[string]string)[credhub.REF_KEY] != name {
+		t.Errorf("Bind retry returned %+v %v", retried.Credentials, err)
+	}
+
+	// Service keys have no app to be read by
+	serviceKey, err := cloudflarebroker.Bind(context, "1", "3", brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": "other.com"}})
+	if _, ok := serviceKey.Credentials.(broker.ZoneCredentials); err != nil || !ok {
+		t.Errorf("Bind of a service key returned %+v %v", serviceKey.Credentials, err)
+	}
+
+	if err := cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{}); err != nil || len(store.Values) != 0 {
+		t.Errorf("Unbind left %v %v", store.Values, err)
+	}
+}
+
+func TestBindWithCredHubDownDeletesZone(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	store := failingCredHub{credhub.NewMemoryStore()}
+	cloudflarebroker.CredHub = store
+	var context context.Context
+
+	_, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{AppGUID: "app", Parameters: map[string]interface{}{"domain": "domain.com"}})
+	if err == nil || len(cloudflarebroker.Zones) != 0 || len(cloudflarebroker.Bindings) != 0 || len(store.Values) != 0 || len(fakeAPI.Calls) != 1 {
+		t.Errorf("Bind with CredHub down returned %v and left %v %v %v", err, cloudflarebroker.Zones, store.Values, fakeAPI.Calls)
+	}
+}
@@ -0,0 +1,276 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/api"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/audit"
+)
+
+// What Unbind does with the zone of a binding
+const DELETION_POLICY_DELETE = "delete"
+const DELETION_POLICY_RETAIN = "retain"
+const DELETION_POLICY_SOFT_DELETE = "soft-delete"
+
+const DEFAULT_DELETION_GRACE_PERIOD = 7 * 24 * time.Hour
+
+// DeletionPolicy decides what happens to a zone on Unbind. The operator sets
+// the default with ZONE_DELETION_POLICY and ZONE_DELETION_GRACE_PERIOD, and
+// an instance can override it with the "deletion_policy" and
+// "deletion_grace_period" provision parameters.
+type DeletionPolicy struct {
+	Policy string `json:"policy"`
+	// GracePeriod is how long a soft-deleted zone is kept paused before it
+	// is deleted.
+	GracePeriod time.Duration `json:"grace_period"`
+}
+
+// PendingDeletion is a soft-deleted zone waiting for its grace period to end.
+type PendingDeletion struct {
+	Zone        Zone            `json:"zone"`
+	InstanceID  string          `json:"instance_id"`
+	BindingID   string          `json:"binding_id"`
+	Auth        api.AuthHeaders `json:"auth"`
+	DeleteAfter time.Time       `json:"delete_after"`
+}
+
+type deletionParameters struct {
+	Policy      string `json:"deletion_policy"`
+	GracePeriod string `json:"deletion_grace_period"`
+}
+
+// NewDeletionPolicy validates a policy name and grace period. An empty policy
+// means DELETION_POLICY_DELETE and an empty grace period
+// DEFAULT_DELETION_GRACE_PERIOD.
+func NewDeletionPolicy(policy string, gracePeriod string) (DeletionPolicy, error) {
+	deletionPolicy := DeletionPolicy{Policy: policy, GracePeriod: DEFAULT_DELETION_GRACE_PERIOD}
+
+	switch policy {
+	case "":
+		deletionPolicy.Policy = DELETION_POLICY_DELETE
+	case DELETION_POLICY_DELETE, DELETION_POLICY_RETAIN, DELETION_POLICY_SOFT_DELETE:
+	default:
+		return deletionPolicy, errors.New("deletion policy must be one of delete, retain or soft-delete, not " + policy)
+	}
+
+	if gracePeriod != "" {
+		duration, err := time.ParseDuration(gracePeriod)
+		if err != nil {
+			return deletionPolicy, errors.New("deletion grace period is not a duration: " + err.Error())
+		}
+		if duration <= 0 {
+			return deletionPolicy, errors.New("deletion grace period must be positive")
+		}
+		deletionPolicy.GracePeriod = duration
+	}
+
+	return deletionPolicy, nil
+}
+
+// parseInstanceDeletionPolicy returns the deletion policy requested in the
+// provision parameters, or nil to use the operator's default.
+func parseInstanceDeletionPolicy(rawParameters json.RawMessage) (*DeletionPolicy, error) {
+	var parameters deletionParameters
+	if err := json.Unmarshal(rawParameters, &parameters); err != nil {
+		return nil, err
+	}
+
+	if parameters.Policy == "" && parameters.GracePeriod == "" {
+		return nil, nil
+	}
+
+	policy, err := NewDeletionPolicy(parameters.Policy, parameters.GracePeriod)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+// deletionPolicy returns the deletion policy of an instance. Callers hold
+// b.mu.
+func (b *CloudflareBroker) deletionPolicy(instanceID string) DeletionPolicy {
+	if instance, ok := b.Instances[instanceID]; ok && instance.DeletionPolicy != nil {
+		return *instance.DeletionPolicy
+	}
+
+	return b.DeletionPolicy
+}
+
+// releaseZone applies the deletion policy of the instance to the zone of an
+// unbound binding.
+func (b *CloudflareBroker) releaseZone(client api.CloudflareAPIInterface, instanceID string, bindingID string, zone Zone) error {
+	if zone.Adopted {
+		return nil
+	}
+
+	b.mu.Lock()
+	policy := b.deletionPolicy(instanceID)
+	auth := b.instanceAuth(instanceID)
+	b.mu.Unlock()
+	logger := b.logger.Session("release-zone", lager.Data{"zone": zone.Name, "policy": policy.Policy})
+
+	switch policy.Policy {
+	case DELETION_POLICY_RETAIN:
+		logger.Info("Retaining zone")
+		return nil
+
+	case DELETION_POLICY_SOFT_DELETE:
+		data, err := client.SetZonePaused(zone.ID, true)
+		if err == nil {
+			_, err = decodeCloudflareResponse(data, nil)
+		}
+		if err != nil {
+			logger.Error("Error pausing zone", err)
+			return err
+		}
+
+		pending := PendingDeletion{
+			Zone:        zone,
+			InstanceID:  instanceID,
+			BindingID:   bindingID,
+			Auth:        auth,
+			DeleteAfter: time.Now().Add(policy.GracePeriod),
+		}
+		b.update(func() { b.PendingDeletions[zone.ID] = pending })
+		logger.Info("Scheduled zone deletion", lager.Data{"delete_after": pending.DeleteAfter})
+		return nil
+
+	default:
+		err := b.deleteZone(client, zone.ID)
+		if err != nil {
+			logger.Error("Unbind calling api.cloudflare", err)
+		}
+		return err
+	}
+}
+
+// deleteZone deletes a zone, failing unless the API reports success.
+func (b *CloudflareBroker) deleteZone(client api.CloudflareAPIInterface, zoneID string) error {
+	data, err := client.DeleteZone(zoneID)
+	if err != nil {
+		return err
+	}
+
+	_, err = decodeCloudflareResponse(data, nil)
+	return err
+}
+
+// ListPendingDeletions returns the soft-deleted zones, the next to be deleted
+// first.
+func (b *CloudflareBroker) ListPendingDeletions() []PendingDeletion {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pending := []PendingDeletion{}
+	for _, deletion := range b.PendingDeletions {
+		pending = append(pending, deletion)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].DeleteAfter.Before(pending[j].DeleteAfter)
+	})
+
+	return pending
+}
+
+// RestoreZone cancels the deletion of a soft-deleted zone and resumes it. The
+// zone stays in the account but is no longer bound.
+func (b *CloudflareBroker) RestoreZone(zoneID string) (Zone, error) {
+	if !b.instanceLocks.tryLock(zoneLockKey(zoneID)) {
+		return Zone{}, errors.New("zone " + zoneID + " is being restored or deleted")
+	}
+	defer b.instanceLocks.unlock(zoneLockKey(zoneID))
+	ctx := auditScope(context.Background(), AUDIT_RESTORE_ZONE, "", "")
+
+	b.mu.Lock()
+	pending, ok := b.PendingDeletions[zoneID]
+	b.mu.Unlock()
+	if !ok {
+		return Zone{}, errors.New("zone " + zoneID + " is not scheduled for deletion")
+	}
+
+	data, err := b.CloudflareAPI.With(ctx, pending.Auth).SetZonePaused(zoneID, false)
+	if err == nil {
+		_, err = decodeCloudflareResponse(data, nil)
+	}
+	recordEvent(ctx, audit.EVENT_ADMIN, audit.Event{InstanceID: pending.InstanceID, BindingID: pending.BindingID, ResourceID: zoneID}, err)
+	if err != nil {
+		b.logger.Error("Error resuming zone", err, lager.Data{"zone": pending.Zone.Name})
+		return Zone{}, err
+	}
+
+	b.update(func() { delete(b.PendingDeletions, zoneID) })
+	b.logger.Info("Restored zone", lager.Data{"zone": pending.Zone.Name})
+
+	return pending.Zone, nil
+}
+
+// DeleteExpiredZones deletes the soft-deleted zones whose grace period ended
+// before now. Zones that cannot be deleted are retried on the next run.
+func (b *CloudflareBroker) DeleteExpiredZones(now time.Time) {
+	ctx := auditScope(context.Background(), AUDIT_DELETE_EXPIRED_ZONES, "", "")
+
+	b.mu.Lock()
+	var expired []string
+	for zoneID, pending := range b.PendingDeletions {
+		if !now.Before(pending.DeleteAfter) {
+			expired = append(expired, zoneID)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, zoneID := range expired {
+		b.deleteExpiredZone(ctx, zoneID)
+	}
+}
+
+// deleteExpiredZone deletes a soft-deleted zone, unless it is being restored
+// or was restored since it expired.
+func (b *CloudflareBroker) deleteExpiredZone(ctx context.Context, zoneID string) {
+	if !b.instanceLocks.tryLock(zoneLockKey(zoneID)) {
+		return
+	}
+	defer b.instanceLocks.unlock(zoneLockKey(zoneID))
+
+	b.mu.Lock()
+	pending, ok := b.PendingDeletions[zoneID]
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if err := b.deleteZone(b.CloudflareAPI.With(ctx, pending.Auth), zoneID); err != nil {
+		b.logger.Error("Error deleting soft-deleted zone", err, lager.Data{"zone": pending.Zone.Name})
+		return
+	}
+
+	b.update(func() { delete(b.PendingDeletions, zoneID) })
+	b.logger.Info("Deleted soft-deleted zone", lager.Data{"zone": pending.Zone.Name})
+}
+
+// zoneLockKey is the key under which instanceLocks marks a soft-deleted zone
+// that is being restored or deleted.
+func zoneLockKey(zoneID string) string {
+	return "zone:" + zoneID
+}
+
+// RunZoneDeletionJob calls DeleteExpiredZones every interval until stop is
+// closed.
+func (b *CloudflareBroker) RunZoneDeletionJob(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			b.DeleteExpiredZones(now)
+		case <-stop:
+			return
+		}
+	}
+}
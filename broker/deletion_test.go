@@ -0,0 +1,149 @@
+package broker_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func newDeletionPolicyBroker(t *testing.T, fakeAPI *FakeCloudflareAPI, parameters string) broker.CloudflareBroker {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(
+		logger,
+		map[string]broker.Zone{
+			"1:2": broker.Zone{ID: "zone", Name: "domain.com"},
+		},
+	)
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	_, err := cloudflarebroker.Provision(
+		context,
+		"1",
+		brokerapi.ProvisionDetails{RawParameters: []byte(parameters)},
+		false,
+	)
+	if err != nil {
+		t.Fatalf("Provision failed %v", err)
+	}
+
+	return cloudflarebroker
+}
+
+func TestNewDeletionPolicy(t *testing.T) {
+	policy, err := broker.NewDeletionPolicy("", "")
+	if err != nil || policy.Policy != broker.DELETION_POLICY_DELETE || policy.GracePeriod != broker.DEFAULT_DELETION_GRACE_PERIOD {
+		t.Errorf("NewDeletionPolicy default returned %+v %v", policy, err)
+	}
+
+	policy, err = broker.NewDeletionPolicy("soft-delete", "48h")
+	if err != nil || policy.GracePeriod != 48*time.Hour {
+		t.Errorf("NewDeletionPolicy returned %+v %v", policy, err)
+	}
+
+	if _, err := broker.NewDeletionPolicy("archive", ""); err == nil {
+		t.Errorf("NewDeletionPolicy accepted an unknown policy")
+	}
+	if _, err := broker.NewDeletionPolicy("soft-delete", "a week"); err == nil {
+		t.Errorf("NewDeletionPolicy accepted an invalid grace period")
+	}
+}
+
+func TestUnbindRetainsZone(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker := newDeletionPolicyBroker(t, fakeAPI, `{
+		"x-auth-key":      "mykey",
+		"x-auth-email":    "email@email.com",
+		"deletion_policy": "retain"
+	}`)
+	var context context.Context
+
+	err := cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{})
+	if err != nil || len(cloudflarebroker.Zones) != 0 || len(fakeAPI.Calls) != 0 {
+		t.Errorf("Unbind did not retain zone %v %v", err, fakeAPI.Calls)
+	}
+}
+
+func TestUnbindSoftDeletesAndRestoresZone(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker := newDeletionPolicyBroker(t, fakeAPI, `{
+		"x-auth-key":            "mykey",
+		"x-auth-email":          "email@email.com",
+		"deletion_policy":       "soft-delete",
+		"deletion_grace_period": "1h"
+	}`)
+	var context context.Context
+
+	err := cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{})
+	pending := cloudflarebroker.ListPendingDeletions()
+	if err != nil || len(pending) != 1 || pending[0].Zone.ID != "zone" {
+		t.Fatalf("Unbind did not soft-delete zone %v %+v", err, pending)
+	}
+
+	cloudflarebroker.DeleteExpiredZones(time.Now())
+	if len(cloudflarebroker.PendingDeletions) != 1 {
+		t.Errorf("DeleteExpiredZones deleted a zone within its grace period")
+	}
+
+	handler := broker.NewAdminHandler(&cloudflarebroker)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/admin/zones/zone/restore", nil))
+	if recorder.Code != http.StatusOK || len(cloudflarebroker.PendingDeletions) != 0 {
+		t.Errorf("Restore zone returned %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	if !reflect.DeepEqual(fakeAPI.Calls, []string{"PauseZone zone", "ResumeZone zone"}) {
+		t.Errorf("Soft-delete made calls %v", fakeAPI.Calls)
+	}
+}
+
+func TestDeleteExpiredZones(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker := newDeletionPolicyBroker(t, fakeAPI, `{
+		"x-auth-key":      "mykey",
+		"x-auth-email":    "email@email.com",
+		"deletion_policy": "soft-delete"
+	}`)
+	var context context.Context
+
+	cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{})
+	cloudflarebroker.DeleteExpiredZones(time.Now().Add(broker.DEFAULT_DELETION_GRACE_PERIOD + time.Minute))
+
+	if len(cloudflarebroker.PendingDeletions) != 0 ||
+		!reflect.DeepEqual(fakeAPI.Calls, []string{"PauseZone zone", "DeleteZone zone"}) {
+		t.Errorf("DeleteExpiredZones made calls %v", fakeAPI.Calls)
+	}
+}
+
+func TestFailedZoneDeletionIsRetried(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{Fail: "DeleteZone"}
+	cloudflarebroker := newDeletionPolicyBroker(t, fakeAPI, `{
+		"x-auth-key":      "mykey",
+		"x-auth-email":    "email@email.com",
+		"deletion_policy": "soft-delete"
+	}`)
+	var context context.Context
+
+	cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{})
+	cloudflarebroker.DeleteExpiredZones(time.Now().Add(broker.DEFAULT_DELETION_GRACE_PERIOD + time.Minute))
+	if _, ok := cloudflarebroker.PendingDeletions["zone"]; !ok {
+		t.Errorf("DeleteExpiredZones forgot a zone it could not delete")
+	}
+
+	fakeAPI = &FakeCloudflareAPI{Fail: "DeleteZone"}
+	cloudflarebroker = newDeletionPolicyBroker(t, fakeAPI, `{"x-auth-key": "mykey", "x-auth-email": "email@email.com"}`)
+	if err := cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{}); err == nil {
+		t.Errorf("Unbind succeeded although the zone could not be deleted")
+	}
+	if _, ok := cloudflarebroker.Zones["1:2"]; !ok {
+		t.Errorf("Unbind forgot a zone it could not delete")
+	}
+}
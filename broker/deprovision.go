@@ -0,0 +1,170 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/audit"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/tracing"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const OPERATION_PROVISION = "provision"
+const OPERATION_DEPROVISION = "deprovision"
+const OPERATION_BIND = "bind"
+const OPERATION_UNBIND = "unbind"
+
+// OPERATION_HISTORY_SIZE is how many finished operations are kept for the
+// admin API.
+const OPERATION_HISTORY_SIZE = 200
+
+// Operation is the outcome of an operation. The last asynchronous operation
+// of an instance is reported by LastOperation, and every finished operation
+// is kept in the history.
+type Operation struct {
+	Type        string                       `json:"type"`
+	InstanceID  string                       `json:"instance_id,omitempty"`
+	BindingID   string                       `json:"binding_id,omitempty"`
+	State       brokerapi.LastOperationState `json:"state"`
+	Description string                       `json:"description"`
+	Errors      []string                     `json:"errors,omitempty"`
+	StartedAt   time.Time                    `json:"started_at"`
+	FinishedAt  time.Time                    `json:"finished_at,omitempty"`
+}
+
+// instanceBindings returns the IDs of all bindings of an instance, of any
+// service. Callers hold b.mu.
+func (b *CloudflareBroker) instanceBindings(instanceID string) []string {
+	prefix := instanceID + ":"
+
+	bindings := []string{}
+	for zoneKey := range b.bindingKeys() {
+		if strings.HasPrefix(zoneKey, prefix) {
+			bindings = append(bindings, strings.TrimPrefix(zoneKey, prefix))
+		}
+	}
+	sort.Strings(bindings)
+
+	return bindings
+}
+
+// cleanupInstance deletes every resource the instance created outside of its
+// bindings, honouring the retention settings of each. All resources are
+// attempted even if one fails; the instance is only forgotten once nothing is
+// left, so that a repeated Deprovision retries what failed.
+func (b *CloudflareBroker) cleanupInstance(ctx context.Context, instanceID string) []error {
+	b.mu.Lock()
+	instance := b.Instances[instanceID]
+	b.mu.Unlock()
+	logger := b.logger.Session("cleanup-instance", lager.Data{"instance_id": instanceID})
+	client := b.CloudflareAPI.With(ctx, instance.Auth)
+	var errs []error
+
+	if instance.R2Bucket != nil {
+		if err := b.deprovisionR2Bucket(client, *instance.R2Bucket); err != nil {
+			errs = append(errs, errors.New("R2 bucket "+instance.R2Bucket.Name+": "+err.Error()))
+		} else {
+			instance.R2Bucket = nil
+		}
+	}
+
+	if instance.Tunnel != nil {
+		// The routes already deleted are dropped from the stored tunnel
+		// even if the rest fails
+		tunnel := *instance.Tunnel
+		instance.Tunnel = &tunnel
+		if err := b.deprovisionTunnel(client, &tunnel); err != nil {
+			errs = append(errs, errors.New("tunnel "+instance.Tunnel.Name+": "+err.Error()))
+		} else {
+			instance.Tunnel = nil
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(errs) > 0 {
+		b.Instances[instanceID] = instance
+		logger.Error("Error deleting instance resources", joinErrors(errs))
+		return errs
+	}
+
+	delete(b.Instances, instanceID)
+	logger.Info("Deleted instance resources")
+
+	return nil
+}
+
+// finishOperation runs work and records its outcome as the instance's last
+// operation. The work is traced as a span of the trace in ctx, and its outcome
+// recorded in the audit log with the scope in ctx. b.mu is only taken to
+// record the outcome.
+func (b *CloudflareBroker) finishOperation(ctx context.Context, instanceID string, operationType string, work func(context.Context) []error) {
+	ctx, span := tracing.StartSpan(ctx, operationType+" (async)", tracing.SPAN_KIND_INTERNAL)
+	span.SetAttribute("instance_id", instanceID)
+
+	startedAt := time.Now()
+	errs := work(ctx)
+	var err error
+	if len(errs) > 0 {
+		err = joinErrors(errs)
+	}
+	span.Finish(err)
+	recordEvent(ctx, audit.EVENT_OSB, audit.Event{Operation: operationType + " (async)", InstanceID: instanceID}, err)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Operations[instanceID] = b.recordOperation(operationType, instanceID, "", startedAt, errs...)
+}
+
+// recordOperation adds the outcome of an operation to the history and
+// returns it. The oldest entries are dropped beyond OPERATION_HISTORY_SIZE.
+// Callers hold b.mu.
+func (b *CloudflareBroker) recordOperation(operationType string, instanceID string, bindingID string, startedAt time.Time, errs ...error) Operation {
+	operation := Operation{
+		Type:       operationType,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+		StartedAt:  startedAt,
+		FinishedAt: time.Now(),
+	}
+
+	var failures []error
+	for _, err := range errs {
+		if err != nil {
+			failures = append(failures, err)
+		}
+	}
+
+	if len(failures) == 0 {
+		operation.State = brokerapi.Succeeded
+		operation.Description = operationType + " succeeded"
+	} else {
+		operation.State = brokerapi.Failed
+		operation.Description = operationType + " failed: " + joinErrors(failures).Error()
+		for _, err := range failures {
+			operation.Errors = append(operation.Errors, err.Error())
+		}
+	}
+
+	b.History = append(b.History, operation)
+	if len(b.History) > OPERATION_HISTORY_SIZE {
+		b.History = b.History[len(b.History)-OPERATION_HISTORY_SIZE:]
+	}
+	b.saveState()
+
+	return operation
+}
+
+func joinErrors(errs []error) error {
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+
+	return errors.New(strings.Join(messages, "; "))
+}
@@ -0,0 +1,105 @@
+package broker_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const r2Parameters = `{"x-auth-key": "mykey", "x-auth-email": "email@email.com", "account_id": "account"}`
+
+func waitForOperation(t *testing.T, cloudflarebroker *broker.CloudflareBroker, instanceId string) brokerapi.LastOperation {
+	var context context.Context
+
+	for i := 0; i < 100; i++ {
+		operation, err := cloudflarebroker.LastOperation(context, instanceId, broker.OPERATION_DEPROVISION)
+		if err != nil {
+			t.Fatalf("LastOperation failed %v", err)
+		}
+		if operation.State != brokerapi.InProgress {
+			return operation
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Operation did not finish")
+	return brokerapi.LastOperation{}
+}
+
+func TestDeprovisionWithBindings(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	provisionR2(t, &cloudflarebroker, "1", r2Parameters)
+	if _, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{}); err != nil {
+		t.Fatalf("Bind r2 failed %v", err)
+	}
+
+	_, err := cloudflarebroker.Deprovision(context, "1", brokerapi.DeprovisionDetails{}, false)
+	if err == nil || !strings.Contains(err.Error(), "still has bindings 2") {
+		t.Errorf("Deprovision did not refuse an instance with bindings %v", err)
+	}
+	if _, ok := cloudflarebroker.Instances["1"]; !ok {
+		t.Errorf("Deprovision removed an instance with bindings")
+	}
+
+	credentials := brokerapi.BrokerCredentials{Username: "username", Password: "password"}
+	handler := broker.NewErrorStatusHandler(brokerapi.New(&cloudflarebroker, logger, credentials))
+	recorder := serve(handler, "DELETE", "/v2/service_instances/1?service_id=s&plan_id=p", "")
+	if recorder.Code != http.StatusUnprocessableEntity || !strings.Contains(recorder.Body.String(), "unbind them before deprovisioning") {
+		t.Errorf("Deprovision of an instance with bindings returned %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestDeprovisionAsync(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	var context context.Context
+
+	provisionR2(t, &cloudflarebroker, "1", r2Parameters)
+
+	spec, err := cloudflarebroker.Deprovision(context, "1", brokerapi.DeprovisionDetails{}, true)
+	if err != nil || !spec.IsAsync || spec.OperationData != broker.OPERATION_DEPROVISION {
+		t.Fatalf("Deprovision async returned %+v %v", spec, err)
+	}
+
+	operation := waitForOperation(t, &cloudflarebroker, "1")
+	if operation.State != brokerapi.Succeeded {
+		t.Errorf("Deprovision async finished with %+v", operation)
+	}
+	if _, ok := cloudflarebroker.Instances["1"]; ok {
+		t.Errorf("Deprovision async kept the instance")
+	}
+}
+
+func TestDeprovisionAsyncPartialFailure(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{Fail: "DeleteR2Bucket"}
+	var context context.Context
+
+	provisionR2(t, &cloudflarebroker, "1", r2Parameters)
+
+	if _, err := cloudflarebroker.Deprovision(context, "1", brokerapi.DeprovisionDetails{}, true); err != nil {
+		t.Fatalf("Deprovision async failed %v", err)
+	}
+
+	operation := waitForOperation(t, &cloudflarebroker, "1")
+	if operation.State != brokerapi.Failed || !strings.Contains(operation.Description, "R2 bucket cf-1") {
+		t.Errorf("Deprovision async finished with %+v", operation)
+	}
+	if instance, ok := cloudflarebroker.Instances["1"]; !ok || instance.R2Bucket == nil {
+		t.Errorf("Deprovision async forgot a bucket it could not delete")
+	}
+}
@@ -0,0 +1,316 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/envelope"
+)
+
+// EncryptedStateStore keeps the secrets of the state, the Cloudflare API keys
+// and the credentials of bindings, encrypted in the store it wraps. The rest
+// of the state stays readable. Secrets are kept in State.Secrets by where
+// they belong, such as "instances/1/auth", and are decrypted on Load.
+type EncryptedStateStore struct {
+	Store   StateStore
+	Keyring *envelope.Keyring
+
+	mu sync.Mutex
+	// sealed caches the envelope of every secret by path, so that a secret is
+	// only encrypted again when it changes or its key is rotated.
+	sealed map[string]sealedSecret
+	// plaintext is set if the last loaded state had secrets not encrypted yet.
+	plaintext bool
+}
+
+type sealedSecret struct {
+	plaintext string
+	envelope  envelope.Envelope
+}
+
+func NewEncryptedStateStore(store StateStore, keyring *envelope.Keyring) *EncryptedStateStore {
+	return &EncryptedStateStore{Store: store, Keyring: keyring, sealed: map[string]sealedSecret{}}
+}
+
+// secretField is a secret of the state: where it is kept, and how it is read
+// from and written to its record.
+type secretField struct {
+	path  string
+	get   func() ([]byte, error)
+	clear func()
+	set   func(plaintext []byte) error
+}
+
+// secretFields lists every secret in state. Its functions change state.
+func secretFields(state *State) []secretField {
+	var fields []secretField
+
+	for id := range state.Instances {
+		id := id
+		fields = append(fields, secretField{
+			path: "instances/" + id + "/auth",
+			get:  func() ([]byte, error) { return []byte(state.Instances[id].Auth.XAuthKey), nil },
+			clear: func() {
+				instance := state.Instances[id]
+				instance.Auth.XAuthKey = ""
+				state.Instances[id] = instance
+			},
+			set: func(plaintext []byte) error {
+				instance := state.Instances[id]
+				instance.Auth.XAuthKey = string(plaintext)
+				state.Instances[id] = instance
+				return nil
+			},
+		})
+	}
+	for id := range state.PendingDeletions {
+		id := id
+		fields = append(fields, secretField{
+			path: "pending_deletions/" + id + "/auth",
+			get:  func() ([]byte, error) { return []byte(state.PendingDeletions[id].Auth.XAuthKey), nil },
+			clear: func() {
+				pending := state.PendingDeletions[id]
+				pending.Auth.XAuthKey = ""
+				state.PendingDeletions[id] = pending
+			},
+			set: func(plaintext []byte) error {
+				pending := state.PendingDeletions[id]
+				pending.Auth.XAuthKey = string(plaintext)
+				state.PendingDeletions[id] = pending
+				return nil
+			},
+		})
+	}
+	for id := range state.ZoneIntents {
+		id := id
+		fields = append(fields, secretField{
+			path: "zone_intents/" + id + "/auth",
+			get:  func() ([]byte, error) { return []byte(state.ZoneIntents[id].Auth.XAuthKey), nil },
+			clear: func() {
+				intent := state.ZoneIntents[id]
+				intent.Auth.XAuthKey = ""
+				state.ZoneIntents[id] = intent
+			},
+			set: func(plaintext []byte) error {
+				intent := state.ZoneIntents[id]
+				intent.Auth.XAuthKey = string(plaintext)
+				state.ZoneIntents[id] = intent
+				return nil
+			},
+		})
+	}
+	for id := range state.ResourceIntents {
+		id := id
+		fields = append(fields, secretField{
+			path: "resource_intents/" + id + "/auth",
+			get:  func() ([]byte, error) { return []byte(state.ResourceIntents[id].Auth.XAuthKey), nil },
+			clear: func() {
+				intent := state.ResourceIntents[id]
+				intent.Auth.XAuthKey = ""
+				state.ResourceIntents[id] = intent
+			},
+			set: func(plaintext []byte) error {
+				intent := state.ResourceIntents[id]
+				intent.Auth.XAuthKey = string(plaintext)
+				state.ResourceIntents[id] = intent
+				return nil
+			},
+		})
+	}
+	for id := range state.Bindings {
+		id := id
+		fields = append(fields, secretField{
+			path: "bindings/" + id + "/credentials",
+			get: func() ([]byte, error) {
+				if state.Bindings[id].Credentials == nil {
+					return nil, nil
+				}
+				return json.Marshal(state.Bindings[id].Credentials)
+			},
+			clear: func() {
+				binding := state.Bindings[id]
+				binding.Credentials = nil
+				state.Bindings[id] = binding
+			},
+			set: func(plaintext []byte) error {
+				binding := state.Bindings[id]
+				if err := json.Unmarshal(plaintext, &binding.Credentials); err != nil {
+					return err
+				}
+				state.Bindings[id] = binding
+				return nil
+			},
+		})
+	}
+
+	return fields
+}
+
+// Load decrypts every secret of the stored state. It fails if any cannot be
+// decrypted, such as when its key was removed from the keyring, rather than
+// run with secrets missing.
+func (s *EncryptedStateStore) Load() (State, error) {
+	state, err := s.Store.Load()
+	if err != nil {
+		return State{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sealed := map[string]sealedSecret{}
+	plaintextFound := false
+	for _, field := range secretFields(&state) {
+		secret, ok := state.Secrets[field.path]
+		if !ok {
+			// Secrets saved before encryption was set up are still in
+			// plaintext until the next save.
+			if plaintext, _ := field.get(); len(plaintext) > 0 {
+				plaintextFound = true
+			}
+			continue
+		}
+
+		plaintext, err := s.Keyring.Open(secret, []byte(field.path))
+		if err != nil {
+			return State{}, errors.New("cannot decrypt " + field.path + ": " + err.Error())
+		}
+		if err := field.set(plaintext); err != nil {
+			return State{}, errors.New("cannot decode " + field.path + ": " + err.Error())
+		}
+		sealed[field.path] = sealedSecret{plaintext: string(plaintext), envelope: secret}
+	}
+	state.Secrets = nil
+	s.sealed = sealed
+	s.plaintext = plaintextFound
+
+	return state, nil
+}
+
+// Save encrypts every secret of state that changed since it was last saved.
+func (s *EncryptedStateStore) Save(state State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.save(state, false)
+	return err
+}
+
+// Rotate saves state with every secret encrypted with the primary key, and
+// returns how many secrets it encrypted, including those not encrypted yet.
+func (s *EncryptedStateStore) Rotate(state State) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.save(state, true)
+}
+
+// NeedsRotation reports whether a secret of the last loaded or saved state is
+// not encrypted, or encrypted with a key other than the primary key.
+func (s *EncryptedStateStore) NeedsRotation() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.plaintext {
+		return true
+	}
+	for _, secret := range s.sealed {
+		if secret.envelope.KeyID != s.Keyring.Primary() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *EncryptedStateStore) save(state State, rotate bool) (int, error) {
+	// The maps of state are shared with the caller
+	state = copyState(state)
+	state.Secrets = map[string]envelope.Envelope{}
+
+	sealed := map[string]sealedSecret{}
+	encrypted := 0
+	for _, field := range secretFields(&state) {
+		plaintext, err := field.get()
+		if err != nil {
+			return 0, err
+		}
+		if len(plaintext) == 0 {
+			continue
+		}
+
+		secret, ok := s.sealed[field.path]
+		if !ok || secret.plaintext != string(plaintext) || (rotate && secret.envelope.KeyID != s.Keyring.Primary()) {
+			e, err := s.Keyring.Seal(plaintext, []byte(field.path))
+			if err != nil {
+				return 0, err
+			}
+			secret = sealedSecret{plaintext: string(plaintext), envelope: e}
+			encrypted++
+		}
+
+		state.Secrets[field.path] = secret.envelope
+		sealed[field.path] = secret
+		field.clear()
+	}
+
+	if err := s.Store.Save(state); err != nil {
+		return 0, err
+	}
+	s.sealed = sealed
+	s.plaintext = false
+
+	return encrypted, nil
+}
+
+func (s *EncryptedStateStore) Check() error {
+	return s.Store.Check()
+}
+
+// copyState copies the maps of state that hold secrets.
+func copyState(state State) State {
+	instances := map[string]Instance{}
+	for key, value := range state.Instances {
+		instances[key] = value
+	}
+	pendingDeletions := map[string]PendingDeletion{}
+	for key, value := range state.PendingDeletions {
+		pendingDeletions[key] = value
+	}
+	zoneIntents := map[string]ZoneIntent{}
+	for key, value := range state.ZoneIntents {
+		zoneIntents[key] = value
+	}
+	resourceIntents := map[string]ResourceIntent{}
+	for key, value := range state.ResourceIntents {
+		resourceIntents[key] = value
+	}
+	bindings := map[string]BindingRecord{}
+	for key, value := range state.Bindings {
+		bindings[key] = value
+	}
+
+	state.Instances = instances
+	state.PendingDeletions = pendingDeletions
+	state.ZoneIntents = zoneIntents
+	state.ResourceIntents = resourceIntents
+	state.Bindings = bindings
+
+	return state
+}
+
+// RotateEncryptionKeys encrypts every secret of the state again with the
+// primary key, and returns how many it encrypted. Operations wait for the one
+// save only, so keys can be rotated while the broker serves.
+func (b *CloudflareBroker) RotateEncryptionKeys() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	store, ok := b.Store.(*EncryptedStateStore)
+	if !ok {
+		return 0, errors.New("the state is not encrypted")
+	}
+
+	return store.Rotate(b.state())
+}
@@ -0,0 +1,82 @@
+package broker_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/envelope"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func testKeyring(t *testing.T, primary string, ids ...string) *envelope.Keyring {
+	keys := map[string][]byte{}
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte(id[:1]), envelope.KEY_SIZE)
+	}
+
+	keyring, err := envelope.NewKeyring(primary, keys)
+	if err != nil {
+		t.Fatalf("NewKeyring failed %v", err)
+	}
+
+	return keyring
+}
+
+func TestEncryptedStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudflare-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := broker.FileStateStore{Path: filepath.Join(dir, "state.json")}
+
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	if err := cloudflarebroker.LoadState(broker.NewEncryptedStateStore(file, testKeyring(t, "a", "a"))); err != nil {
+		t.Fatalf("LoadState of a missing file failed %v", err)
+	}
+	var context context.Context
+
+	provisionR2(t, &cloudflarebroker, "1", r2Parameters)
+	if _, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{}); err != nil {
+		t.Fatalf("Bind r2 failed %v", err)
+	}
+
+	data, _ := ioutil.ReadFile(file.Path)
+	if strings.Contains(string(data), "mykey") || strings.Contains(string(data), "secret_access_key") || !strings.Contains(string(data), "email@email.com") {
+		t.Errorf("State file holds secrets in plaintext\n%s", data)
+	}
+
+	rotatedStore := broker.NewEncryptedStateStore(file, testKeyring(t, "b", "a", "b"))
+	restarted := broker.New(logger, map[string]broker.Zone{})
+	restarted.CloudflareAPI = &FakeCloudflareAPI{}
+	if err := restarted.LoadState(rotatedStore); err != nil {
+		t.Fatalf("LoadState with an added key failed %v", err)
+	}
+	if restarted.Instances["1"].Auth.XAuthKey != "mykey" || restarted.Bindings["1:2"].Credentials == nil {
+		t.Errorf("LoadState did not decrypt the secrets %+v", restarted.ExportState())
+	}
+	if !rotatedStore.NeedsRotation() {
+		t.Errorf("NeedsRotation is false after a key was added")
+	}
+	if encrypted, err := restarted.RotateEncryptionKeys(); err != nil || encrypted != 2 || rotatedStore.NeedsRotation() {
+		t.Errorf("RotateEncryptionKeys returned %d %v", encrypted, err)
+	}
+
+	withoutKey := broker.New(logger, map[string]broker.Zone{})
+	if err := withoutKey.LoadState(broker.NewEncryptedStateStore(file, testKeyring(t, "a", "a"))); err == nil {
+		t.Errorf("LoadState succeeded without the key the state is encrypted with")
+	}
+	if err := withoutKey.LoadState(file); err == nil {
+		t.Errorf("LoadState of an encrypted state succeeded without keys")
+	}
+}
@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// INVALID_PARAMETERS_PREFIX starts the description of a request with invalid
+// parameters, by which it is answered with 422.
+const INVALID_PARAMETERS_PREFIX = "Invalid parameters: "
+
+// ParameterError lists every problem with the parameters of a request, such
+// as "domain is required".
+type ParameterError struct {
+	Problems []string
+}
+
+func (e ParameterError) Error() string {
+	return INVALID_PARAMETERS_PREFIX + strings.Join(e.Problems, "; ")
+}
+
+// BINDINGS_EXIST_PREFIX starts the description of a deprovision refused
+// because the instance still has bindings, by which it is answered with 422.
+const BINDINGS_EXIST_PREFIX = "Unbind first: "
+
+// BindingsExistError is a deprovision of an instance that still has
+// bindings.
+type BindingsExistError struct {
+	InstanceID string
+	Bindings   []string
+}
+
+func (e BindingsExistError) Error() string {
+	return BINDINGS_EXIST_PREFIX + "instance " + e.InstanceID + " still has bindings " + strings.Join(e.Bindings, ", ") + "; unbind them before deprovisioning"
+}
+
+// NewErrorStatusHandler answers requests failed with
+// ErrConcurrentInstanceAccess with 422 ConcurrencyError, as the Service Broker
+// API specifies, and those refused by a policy or with an invalid parameter
+// with 422, like deprovisions of instances with bindings. brokerapi reports
+// errors it does not know as 500.
+func NewErrorStatusHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		recorder := &responseRecorder{header: w.Header(), status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+
+		var response brokerapi.ErrorResponse
+		if recorder.status == http.StatusInternalServerError && json.Unmarshal(recorder.body.Bytes(), &response) == nil {
+			if response.Description == ErrConcurrentInstanceAccess.Error() {
+				respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{
+					Error:       "ConcurrencyError",
+					Description: response.Description,
+				})
+				return
+			}
+			if strings.HasPrefix(response.Description, POLICY_ERROR_PREFIX) || strings.HasPrefix(response.Description, INVALID_PARAMETERS_PREFIX) || strings.HasPrefix(response.Description, BINDINGS_EXIST_PREFIX) {
+				respond(w, http.StatusUnprocessableEntity, brokerapi.ErrorResponse{Description: response.Description})
+				return
+			}
+		}
+
+		w.WriteHeader(recorder.status)
+		w.Write(recorder.body.Bytes())
+	})
+}
+
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	return r.body.Write(data)
+}
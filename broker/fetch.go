@@ -0,0 +1,148 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
+)
+
+const DASHBOARD_URL = "https://dash.cloudflare.com"
+const ZERO_TRUST_DASHBOARD_URL = "https://one.dash.cloudflare.com"
+
+// InstanceResponse is the body of GET /v2/service_instances/:instance_id.
+type InstanceResponse struct {
+	ServiceID    string          `json:"service_id"`
+	PlanID       string          `json:"plan_id"`
+	DashboardURL string          `json:"dashboard_url,omitempty"`
+	Parameters   json.RawMessage `json:"parameters,omitempty"`
+}
+
+// BindingResponse is the body of
+// GET /v2/service_instances/:instance_id/service_bindings/:binding_id.
+type BindingResponse struct {
+	Credentials interface{}     `json:"credentials"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// dashboardURL is where the resources of an instance are managed in the
+// Cloudflare dashboard. Zones are bound one by one, so zone instances get
+// the dashboard's home page.
+func dashboardURL(instance Instance) string {
+	if instance.R2Bucket != nil {
+		return DASHBOARD_URL + "/" + instance.R2Bucket.AccountID + "/r2/default/buckets/" + instance.R2Bucket.Name
+	}
+	if instance.Tunnel != nil {
+		return ZERO_TRUST_DASHBOARD_URL + "/" + instance.Tunnel.AccountID + "/networks/tunnels"
+	}
+
+	return DASHBOARD_URL
+}
+
+// FetchInstance returns an instance as Cloud Controller provisioned it. Its
+// parameters were redacted when it was provisioned.
+func (b *CloudflareBroker) FetchInstance(instanceID string) (InstanceResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	instance, ok := b.Instances[instanceID]
+	if !ok {
+		return InstanceResponse{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	return InstanceResponse{
+		ServiceID:    instance.ServiceID,
+		PlanID:       instance.PlanID,
+		DashboardURL: dashboardURL(instance),
+		Parameters:   instance.Parameters,
+	}, nil
+}
+
+// FetchBinding returns the current credentials of a binding. They are
+// rebuilt from the state, so a zone shows its status now rather than when
+// it was bound; secrets are those returned by Bind, and credentials kept in
+// CredHub are still returned as a credhub-ref. A binding is not found until
+// its bind has finished and stored its record, so that credentials meant for
+// CredHub are never returned inline.
+func (b *CloudflareBroker) FetchBinding(instanceID string, bindingID string) (BindingResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	zoneKey := getZoneKey(instanceID, bindingID)
+	record, hasRecord := b.Bindings[zoneKey]
+	if !hasRecord || b.bindInProgress(zoneKey) {
+		return BindingResponse{}, brokerapi.ErrBindingDoesNotExist
+	}
+
+	response := BindingResponse{Credentials: record.Credentials, Parameters: record.Parameters}
+	if credentialsRef(record.Credentials) != "" {
+		return response, nil
+	}
+
+	instance := b.Instances[instanceID]
+	if zone, ok := b.Zones[zoneKey]; ok {
+		credentials := ZoneCredentials{Zone: zone}
+		if application, ok := b.AccessApplications[zoneKey]; ok {
+			accessCredentials := application.Credentials()
+			credentials.Access = &accessCredentials
+		}
+		response.Credentials = credentials
+	} else if accessKey, ok := b.R2AccessKeys[zoneKey]; ok && instance.R2Bucket != nil {
+		var stored R2Credentials
+		decodeCredentials(record.Credentials, &stored)
+		response.Credentials = newR2Credentials(*instance.R2Bucket, accessKey.AccessKeyID, stored.SecretAccessKey)
+	} else if tunnelID, ok := b.TunnelBindings[zoneKey]; ok && instance.Tunnel != nil {
+		var stored TunnelCredentials
+		decodeCredentials(record.Credentials, &stored)
+		credentials := TunnelCredentials{TunnelID: tunnelID, TunnelName: instance.Tunnel.Name, Token: stored.Token}
+		for _, route := range instance.Tunnel.Routes {
+			credentials.Hostnames = append(credentials.Hostnames, route.Hostname)
+		}
+		response.Credentials = credentials
+	}
+
+	return response, nil
+}
+
+// decodeCredentials decodes credentials returned by Bind into result.
+// Credentials loaded from the state are generic maps, and missing ones
+// leave result empty.
+func decodeCredentials(credentials interface{}, result interface{}) {
+	if data, err := json.Marshal(credentials); err == nil {
+		json.Unmarshal(data, result)
+	}
+}
+
+// NewFetchHandler serves the GET endpoints of instances and bindings, which
+// brokerapi does not know about, with the broker's credentials, and passes
+// every other request to next.
+func NewFetchHandler(b *CloudflareBroker, credentials brokerapi.BrokerCredentials, next http.Handler) http.Handler {
+	router := mux.NewRouter()
+	router.NotFoundHandler = next
+	authWrapper := auth.NewWrapper(credentials.Username, credentials.Password)
+
+	router.Handle("/v2/service_instances/{instance_id}", authWrapper.WrapFunc(func(w http.ResponseWriter, req *http.Request) {
+		instance, err := b.FetchInstance(mux.Vars(req)["instance_id"])
+		if err != nil {
+			respond(w, http.StatusNotFound, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+
+		respond(w, http.StatusOK, instance)
+	})).Methods("GET")
+
+	router.Handle("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", authWrapper.WrapFunc(func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		binding, err := b.FetchBinding(vars["instance_id"], vars["binding_id"])
+		if err != nil {
+			respond(w, http.StatusNotFound, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+
+		respond(w, http.StatusOK, binding)
+	})).Methods("GET")
+
+	return router
+}
@@ -0,0 +1,128 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func fetchHandler(cloudflarebroker *broker.CloudflareBroker) http.Handler {
+	logger := lager.NewLogger("cloudflare-broker")
+	credentials := brokerapi.BrokerCredentials{Username: "username", Password: "password"}
+
+	return broker.NewFetchHandler(cloudflarebroker, credentials, brokerapi.New(cloudflarebroker, logger, credentials))
+}
+
+func serve(handler http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.SetBasicAuth("username", "password")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	return recorder
+}
+
+func TestFetchInstance(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	handler := fetchHandler(&cloudflarebroker)
+
+	recorder := serve(handler, "PUT", "/v2/service_instances/1", `{"service_id": "`+broker.SERVICE_ID+`", "plan_id": "`+broker.TUNNEL_PLAN_ID+`", "parameters": `+tunnelParameters+`}`)
+	if recorder.Code != http.StatusCreated || !strings.Contains(recorder.Body.String(), "one.dash.cloudflare.com/account") {
+		t.Fatalf("Provision through the fetch handler returned %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = serve(handler, "GET", "/v2/service_instances/1", "")
+	var instance broker.InstanceResponse
+	json.Unmarshal(recorder.Body.Bytes(), &instance)
+	if recorder.Code != http.StatusOK || instance.PlanID != broker.TUNNEL_PLAN_ID || instance.DashboardURL != broker.ZERO_TRUST_DASHBOARD_URL+"/account/networks/tunnels" {
+		t.Errorf("GET instance returned %d %s", recorder.Code, recorder.Body.String())
+	}
+	if strings.Contains(string(instance.Parameters), "mykey") || !strings.Contains(string(instance.Parameters), "app.domain.com") {
+		t.Errorf("GET instance returned parameters %s", instance.Parameters)
+	}
+
+	if recorder := serve(handler, "GET", "/v2/service_instances/2", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("GET of an unknown instance returned %d", recorder.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/v2/service_instances/1", nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("GET instance without credentials returned %d", recorder.Code)
+	}
+}
+
+func TestFetchBinding(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	var context context.Context
+
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	if _, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": "domain.com"}}); err != nil {
+		t.Fatalf("Bind failed %v", err)
+	}
+
+	// The zone is activated after bind
+	zone := cloudflarebroker.Zones["1:2"]
+	zone.Status = "active"
+	cloudflarebroker.Zones["1:2"] = zone
+
+	binding, err := cloudflarebroker.FetchBinding("1", "2")
+	credentials, ok := binding.Credentials.(broker.ZoneCredentials)
+	if err != nil || !ok || credentials.Status != "active" || string(binding.Parameters) != `{"domain":"domain.com"}` {
+		t.Errorf("FetchBinding returned %+v %v", binding, err)
+	}
+
+	if _, err := cloudflarebroker.FetchBinding("1", "3"); err != brokerapi.ErrBindingDoesNotExist {
+		t.Errorf("FetchBinding of an unknown binding returned %v", err)
+	}
+	// A zone whose bind has not stored its record yet
+	cloudflarebroker.Zones["1:4"] = zone
+	if _, err := cloudflarebroker.FetchBinding("1", "4"); err != brokerapi.ErrBindingDoesNotExist {
+		t.Errorf("FetchBinding of a binding being created returned %v", err)
+	}
+	if recorder := serve(fetchHandler(&cloudflarebroker), "GET", "/v2/service_instances/1/service_bindings/3", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("GET of an unknown binding returned %d", recorder.Code)
+	}
+}
+
+func TestFetchTunnelBinding(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	var context context.Context
+
+	provisionTunnel(t, &cloudflarebroker, "1")
+	bound, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatalf("Bind tunnel failed %v", err)
+	}
+
+	// Credentials read back from the state are generic maps
+	data, _ := json.Marshal(bound.Credentials)
+	record := cloudflarebroker.Bindings["1:2"]
+	json.Unmarshal(data, &record.Credentials)
+	cloudflarebroker.Bindings["1:2"] = record
+
+	recorder := serve(fetchHandler(&cloudflarebroker), "GET", "/v2/service_instances/1/service_bindings/2", "")
+	var binding struct {
+		Credentials broker.TunnelCredentials `json:"credentials"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &binding)
+	if recorder.Code != http.StatusOK || !reflect.DeepEqual(binding.Credentials, bound.Credentials) {
+		t.Errorf("GET tunnel binding returned %d %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,64 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// BindingRecord remembers the request that created a binding and the
+// credentials it returned, so that Cloud Controller retries get the same
+// answer instead of a second set of Cloudflare resources.
+type BindingRecord struct {
+	RequestHash string      `json:"request_hash"`
+	Credentials interface{} `json:"credentials"`
+	// Parameters are the bind parameters with their secrets redacted
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
+// provisionRequestHash identifies a provision request by everything Cloud
+// Controller sends for it. Parameters are hashed rather than stored because
+// they hold the Cloudflare credentials.
+func provisionRequestHash(details brokerapi.ProvisionDetails) (string, error) {
+	var parameters interface{}
+	if len(details.RawParameters) > 0 {
+		// Decode so that whitespace and key order do not matter
+		if err := json.Unmarshal(details.RawParameters, &parameters); err != nil {
+			return "", err
+		}
+	}
+
+	return requestHash(map[string]interface{}{
+		"service_id":        details.ServiceID,
+		"plan_id":           details.PlanID,
+		"organization_guid": details.OrganizationGUID,
+		"space_guid":        details.SpaceGUID,
+		"parameters":        parameters,
+	})
+}
+
+func bindRequestHash(details brokerapi.BindDetails) (string, error) {
+	return requestHash(details)
+}
+
+func requestHash(request interface{}) (string, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// bindingExists reports whether any service holds a binding under zoneKey.
+func (b *CloudflareBroker) bindingExists(zoneKey string) bool {
+	_, zone := b.Zones[zoneKey]
+	_, accessKey := b.R2AccessKeys[zoneKey]
+	_, tunnel := b.TunnelBindings[zoneKey]
+	_, application := b.AccessApplications[zoneKey]
+
+	return zone || accessKey || tunnel || application
+}
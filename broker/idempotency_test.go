@@ -0,0 +1,93 @@
+package broker_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestProvisionRepeated(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	details := brokerapi.ProvisionDetails{
+		ServiceID:     broker.R2_SERVICE_ID,
+		PlanID:        broker.R2_STANDARD_PLAN_ID,
+		RawParameters: []byte(`{"x-auth-key": "mykey", "x-auth-email": "email@email.com", "account_id": "account"}`),
+	}
+	if _, err := cloudflarebroker.Provision(context, "1", details, false); err != nil {
+		t.Fatalf("Provision failed %v", err)
+	}
+
+	// Same request with different formatting
+	details.RawParameters = []byte(`{"account_id":"account","x-auth-email":"email@email.com","x-auth-key":"mykey"}`)
+	if _, err := cloudflarebroker.Provision(context, "1", details, false); err != nil {
+		t.Errorf("Identical Provision failed %v", err)
+	}
+	if len(fakeAPI.Calls) != 1 {
+		t.Errorf("Identical Provision created resources again %v", fakeAPI.Calls)
+	}
+
+	details.RawParameters = []byte(`{"x-auth-key": "mykey", "x-auth-email": "email@email.com", "account_id": "other"}`)
+	if _, err := cloudflarebroker.Provision(context, "1", details, false); err != brokerapi.ErrInstanceAlreadyExists {
+		t.Errorf("Conflicting Provision returned %v", err)
+	}
+}
+
+func TestBindRepeated(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	var context context.Context
+
+	details := brokerapi.BindDetails{
+		AppGUID:    "app",
+		Parameters: map[string]interface{}{"domain": "existing.com", "adopt": true},
+	}
+	first, err := cloudflarebroker.Bind(context, "1", "2", details)
+	if err != nil {
+		t.Fatalf("Bind failed %v", err)
+	}
+
+	second, err := cloudflarebroker.Bind(context, "1", "2", details)
+	if err != nil || !reflect.DeepEqual(first, second) {
+		t.Errorf("Identical Bind returned %+v %v", second, err)
+	}
+
+	details.Parameters = map[string]interface{}{"domain": "other.com"}
+	if _, err := cloudflarebroker.Bind(context, "1", "2", details); err != brokerapi.ErrBindingAlreadyExists {
+		t.Errorf("Conflicting Bind returned %v", err)
+	}
+
+	if err := cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{}); err != nil || len(cloudflarebroker.Bindings) != 0 {
+		t.Errorf("Unbind kept the binding record %v", err)
+	}
+}
+
+func TestBindExistingZoneWithoutRecord(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(
+		logger,
+		map[string]broker.Zone{
+			"1:2": broker.Zone{ID: "zone", Name: "domain.com"},
+		},
+	)
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	var context context.Context
+
+	params := map[string]interface{}{"domain": "domain.com"}
+	if _, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: params}); err != brokerapi.ErrBindingAlreadyExists {
+		t.Errorf("Bind over an existing zone returned %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/audit"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// InstanceSummary describes an instance and everything it manages for the
+// admin API. It leaves out the Cloudflare API key.
+type InstanceSummary struct {
+	InstanceID       string           `json:"instance_id"`
+	ServiceID        string           `json:"service_id"`
+	PlanID           string           `json:"plan_id"`
+	OrganizationGUID string           `json:"organization_guid"`
+	SpaceGUID        string           `json:"space_guid"`
+	AuthEmail        string           `json:"auth_email"`
+	R2Bucket         *R2Bucket        `json:"r2_bucket,omitempty"`
+	Tunnel           *Tunnel          `json:"tunnel,omitempty"`
+	DeletionPolicy   DeletionPolicy   `json:"deletion_policy"`
+	Bindings         []BindingSummary `json:"bindings"`
+	LastOperation    *Operation       `json:"last_operation,omitempty"`
+}
+
+type BindingSummary struct {
+	BindingID         string             `json:"binding_id"`
+	Zone              *Zone              `json:"zone,omitempty"`
+	AccessApplication *AccessApplication `json:"access_application,omitempty"`
+	R2AccessKey       *R2AccessKey       `json:"r2_access_key,omitempty"`
+	TunnelID          string             `json:"tunnel_id,omitempty"`
+}
+
+// ListInstances summarizes every instance, and the bindings of instances the
+// broker no longer knows, ordered by instance ID.
+func (b *CloudflareBroker) ListInstances() []InstanceSummary {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	found := map[string]bool{}
+	for instanceID := range b.Instances {
+		found[instanceID] = true
+	}
+	for zoneKey := range b.bindingKeys() {
+		found[zoneKey[:strings.Index(zoneKey, ":")]] = true
+	}
+
+	var instanceIDs []string
+	for instanceID := range found {
+		instanceIDs = append(instanceIDs, instanceID)
+	}
+	sort.Strings(instanceIDs)
+
+	summaries := []InstanceSummary{}
+	for _, instanceID := range instanceIDs {
+		summaries = append(summaries, b.instanceSummary(instanceID))
+	}
+
+	return summaries
+}
+
+// GetInstance summarizes one instance.
+func (b *CloudflareBroker) GetInstance(instanceID string) (InstanceSummary, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.Instances[instanceID]; !ok && len(b.instanceBindings(instanceID)) == 0 {
+		return InstanceSummary{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	return b.instanceSummary(instanceID), nil
+}
+
+// OperationHistory returns the finished operations of an instance, or of all
+// instances if instanceID is empty, the most recent first.
+func (b *CloudflareBroker) OperationHistory(instanceID string) []Operation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	history := []Operation{}
+	for i := len(b.History) - 1; i >= 0; i-- {
+		if instanceID == "" || b.History[i].InstanceID == instanceID {
+			history = append(history, b.History[i])
+		}
+	}
+
+	return history
+}
+
+// ForceUnbind removes a binding from broker state even if its Cloudflare
+// resources cannot be deleted. The errors of the cleanup are returned so
+// the operator can remove what was left behind.
+func (b *CloudflareBroker) ForceUnbind(instanceID string, bindingID string) ([]string, error) {
+	if !b.instanceLocks.tryLock(instanceID) {
+		return nil, ErrConcurrentInstanceAccess
+	}
+	defer b.instanceLocks.unlock(instanceID)
+	ctx := auditScope(context.Background(), AUDIT_FORCE_UNBIND, instanceID, bindingID)
+
+	zoneKey := getZoneKey(instanceID, bindingID)
+	b.mu.Lock()
+	_, hasRecord := b.Bindings[zoneKey]
+	exists := hasRecord || b.bindingExists(zoneKey)
+	b.mu.Unlock()
+	if !exists {
+		return nil, brokerapi.ErrBindingDoesNotExist
+	}
+
+	startedAt := time.Now()
+	problems := []string{}
+	if err := b.deleteCredentials(zoneKey); err != nil {
+		problems = append(problems, err.Error())
+		b.logger.Error("Error deleting credentials from CredHub, forgetting them anyway", err, lager.Data{"instance_id": instanceID, "binding_id": bindingID})
+	}
+	err := b.deleteBinding(ctx, instanceID, bindingID)
+	if err != nil {
+		problems = append(problems, err.Error())
+		b.logger.Error("Error deleting binding, forgetting it anyway", err, lager.Data{"instance_id": instanceID, "binding_id": bindingID})
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.Zones, zoneKey)
+	delete(b.AccessApplications, zoneKey)
+	delete(b.R2AccessKeys, zoneKey)
+	delete(b.TunnelBindings, zoneKey)
+	delete(b.ZoneIntents, zoneKey)
+	delete(b.Bindings, zoneKey)
+	b.setBindingOperation(zoneKey, nil)
+	b.recordOperation(OPERATION_UNBIND, instanceID, bindingID, startedAt, err)
+	recordEvent(ctx, audit.EVENT_ADMIN, audit.Event{}, err)
+
+	return problems, nil
+}
+
+// ResyncInstance refreshes the zones of an instance from Cloudflare, running
+// an activation check for pending zones right away.
+func (b *CloudflareBroker) ResyncInstance(ctx context.Context, instanceID string) (InstanceStatus, error) {
+	if !b.instanceLocks.tryLock(instanceID) {
+		return InstanceStatus{}, ErrConcurrentInstanceAccess
+	}
+	defer b.instanceLocks.unlock(instanceID)
+	ctx = auditScope(ctx, AUDIT_RESYNC, instanceID, "")
+
+	b.mu.Lock()
+	for zoneKey, zone := range b.Zones {
+		if strings.HasPrefix(zoneKey, instanceID+":") {
+			delete(b.activationChecks, zone.ID)
+		}
+	}
+	b.mu.Unlock()
+
+	status, err := b.InstanceStatus(ctx, instanceID)
+
+	// Keep the zones InstanceStatus refreshed
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.saveState()
+
+	return status, err
+}
+
+// RetryOperation runs the failed last operation of an instance again in the
+// background. Only deprovisioning runs asynchronously, so only a failed
+// deprovision can be retried; Cloud Controller retries the others.
+func (b *CloudflareBroker) RetryOperation(instanceID string) (Operation, error) {
+	if !b.instanceLocks.tryLock(instanceID) {
+		return Operation{}, ErrConcurrentInstanceAccess
+	}
+	ctx := auditScope(context.Background(), AUDIT_RETRY, instanceID, "")
+
+	b.mu.Lock()
+	operation, ok := b.Operations[instanceID]
+	b.mu.Unlock()
+	if !ok || operation.State != brokerapi.Failed || operation.Type != OPERATION_DEPROVISION {
+		b.instanceLocks.unlock(instanceID)
+		return Operation{}, errors.New("instance " + instanceID + " has no failed operation to retry")
+	}
+
+	_, err := b.deprovision(ctx, instanceID, true)
+	recordEvent(ctx, audit.EVENT_ADMIN, audit.Event{}, err)
+	if err != nil {
+		b.instanceLocks.unlock(instanceID)
+		return Operation{}, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.Operations[instanceID], nil
+}
+
+// bindingKeys returns the zone keys of all bindings of any service. Callers
+// hold b.mu.
+func (b *CloudflareBroker) bindingKeys() map[string]bool {
+	found := map[string]bool{}
+	for zoneKey := range b.Zones {
+		found[zoneKey] = true
+	}
+	for zoneKey := range b.Bindings {
+		found[zoneKey] = true
+	}
+	for zoneKey := range b.R2AccessKeys {
+		found[zoneKey] = true
+	}
+	for zoneKey := range b.TunnelBindings {
+		found[zoneKey] = true
+	}
+	for zoneKey := range b.AccessApplications {
+		found[zoneKey] = true
+	}
+
+	return found
+}
+
+func (b *CloudflareBroker) instanceSummary(instanceID string) InstanceSummary {
+	instance := b.Instances[instanceID]
+	summary := InstanceSummary{
+		InstanceID:       instanceID,
+		ServiceID:        instance.ServiceID,
+		PlanID:           instance.PlanID,
+		OrganizationGUID: instance.OrganizationGUID,
+		SpaceGUID:        instance.SpaceGUID,
+		AuthEmail:        instance.Auth.XAuthEmail,
+		R2Bucket:         instance.R2Bucket,
+		Tunnel:           instance.Tunnel,
+		DeletionPolicy:   b.deletionPolicy(instanceID),
+		Bindings:         []BindingSummary{},
+	}
+
+	if operation, ok := b.Operations[instanceID]; ok {
+		summary.LastOperation = &operation
+	}
+
+	for _, bindingID := range b.instanceBindings(instanceID) {
+		zoneKey := getZoneKey(instanceID, bindingID)
+		binding := BindingSummary{BindingID: bindingID, TunnelID: b.TunnelBindings[zoneKey]}
+		if zone, ok := b.Zones[zoneKey]; ok {
+			binding.Zone = &zone
+		}
+		if application, ok := b.AccessApplications[zoneKey]; ok {
+			binding.AccessApplication = &application
+		}
+		if accessKey, ok := b.R2AccessKeys[zoneKey]; ok {
+			binding.R2AccessKey = &accessKey
+		}
+		summary.Bindings = append(summary.Bindings, binding)
+	}
+
+	return summary
+}
@@ -0,0 +1,166 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestListInstances(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	var context context.Context
+
+	provisionR2(t, &cloudflarebroker, "1", r2Parameters)
+	if _, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{}); err != nil {
+		t.Fatalf("Bind r2 failed %v", err)
+	}
+
+	instances := cloudflarebroker.ListInstances()
+	if len(instances) != 1 || instances[0].R2Bucket == nil || len(instances[0].Bindings) != 1 || instances[0].Bindings[0].R2AccessKey == nil {
+		t.Fatalf("ListInstances returned %+v", instances)
+	}
+
+	data, _ := json.Marshal(instances)
+	if strings.Contains(string(data), "mykey") || !strings.Contains(string(data), "email@email.com") {
+		t.Errorf("ListInstances did not redact the API key %s", data)
+	}
+
+	if _, err := cloudflarebroker.GetInstance("unknown"); err != brokerapi.ErrInstanceDoesNotExist {
+		t.Errorf("GetInstance of an unknown instance returned %v", err)
+	}
+}
+
+func TestOperationHistory(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	var context context.Context
+
+	provisionR2(t, &cloudflarebroker, "1", r2Parameters)
+	cloudflarebroker.Bind(context, "2", "3", brokerapi.BindDetails{})
+
+	history := cloudflarebroker.OperationHistory("")
+	if len(history) != 2 || history[0].Type != broker.OPERATION_BIND || history[0].State != brokerapi.Failed || len(history[0].Errors) != 1 {
+		t.Errorf("OperationHistory returned %+v", history)
+	}
+
+	history = cloudflarebroker.OperationHistory("1")
+	if len(history) != 1 || history[0].Type != broker.OPERATION_PROVISION || history[0].State != brokerapi.Succeeded {
+		t.Errorf("OperationHistory of an instance returned %+v", history)
+	}
+}
+
+func TestForceUnbind(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	provisionR2(t, &cloudflarebroker, "1", r2Parameters)
+	if _, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{}); err != nil {
+		t.Fatalf("Bind r2 failed %v", err)
+	}
+	fakeAPI.Fail = "DeleteAccountToken"
+
+	if err := cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{}); err == nil {
+		t.Fatalf("Unbind succeeded although the token could not be deleted")
+	}
+
+	problems, err := cloudflarebroker.ForceUnbind("1", "2")
+	if err != nil || len(problems) != 1 {
+		t.Errorf("ForceUnbind returned %v %v", problems, err)
+	}
+	if len(cloudflarebroker.R2AccessKeys) != 0 || len(cloudflarebroker.Bindings) != 0 {
+		t.Errorf("ForceUnbind kept the binding")
+	}
+
+	if _, err := cloudflarebroker.ForceUnbind("1", "2"); err != brokerapi.ErrBindingDoesNotExist {
+		t.Errorf("ForceUnbind of an unknown binding returned %v", err)
+	}
+}
+
+func TestRetryOperation(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{Fail: "DeleteR2Bucket"}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	provisionR2(t, &cloudflarebroker, "1", r2Parameters)
+	if _, err := cloudflarebroker.RetryOperation("1"); err == nil {
+		t.Errorf("RetryOperation retried without a failed operation")
+	}
+
+	if _, err := cloudflarebroker.Deprovision(context, "1", brokerapi.DeprovisionDetails{}, true); err != nil {
+		t.Fatalf("Deprovision async failed %v", err)
+	}
+	if operation := waitForOperation(t, &cloudflarebroker, "1"); operation.State != brokerapi.Failed {
+		t.Fatalf("Deprovision async finished with %+v", operation)
+	}
+
+	fakeAPI.Fail = ""
+	if _, err := cloudflarebroker.RetryOperation("1"); err != nil {
+		t.Fatalf("RetryOperation failed %v", err)
+	}
+	if operation := waitForOperation(t, &cloudflarebroker, "1"); operation.State != brokerapi.Succeeded {
+		t.Errorf("Retried deprovision finished with %+v", operation)
+	}
+}
+
+func TestAdminInstances(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	var context context.Context
+	handler := broker.NewAdminHandler(&cloudflarebroker)
+
+	provisionR2(t, &cloudflarebroker, "1", r2Parameters)
+	if _, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{}); err != nil {
+		t.Fatalf("Bind r2 failed %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/instances/1", nil))
+	var instance broker.InstanceSummary
+	json.Unmarshal(recorder.Body.Bytes(), &instance)
+	if recorder.Code != http.StatusOK || instance.InstanceID != "1" || len(instance.Bindings) != 1 {
+		t.Errorf("GET /admin/instances/1 returned %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/instances/unknown", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/instances/unknown returned %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/admin/instances/1/bindings/2/force_unbind", nil))
+	if recorder.Code != http.StatusOK || len(cloudflarebroker.R2AccessKeys) != 0 {
+		t.Errorf("POST force_unbind returned %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/operations?instance_id=1", nil))
+	var history []broker.Operation
+	json.Unmarshal(recorder.Body.Bytes(), &history)
+	if recorder.Code != http.StatusOK || len(history) != 3 || history[0].Type != broker.OPERATION_UNBIND {
+		t.Errorf("GET /admin/operations returned %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/admin/instances/1/retry", nil))
+	if recorder.Code != http.StatusUnprocessableEntity {
+		t.Errorf("POST retry without a failed operation returned %d", recorder.Code)
+	}
+}
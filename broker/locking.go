@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrConcurrentInstanceAccess is returned when an operation is requested for
+// an instance that already has one in progress.
+var ErrConcurrentInstanceAccess = errors.New("another operation for this service instance is in progress")
+
+// instanceLocks marks the instances, and the soft-deleted zones, that have an
+// operation in progress. Unlike a mutex per instance it does not make a
+// second operation wait: the Service Broker API expects it to be refused.
+type instanceLocks struct {
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+func newInstanceLocks() *instanceLocks {
+	return &instanceLocks{busy: map[string]bool{}}
+}
+
+func (l *instanceLocks) tryLock(instanceID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.busy[instanceID] {
+		return false
+	}
+	l.busy[instanceID] = true
+
+	return true
+}
+
+func (l *instanceLocks) unlock(instanceID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.busy, instanceID)
+}
+
+// update changes the state with b.mu held and saves it. Operations call
+// Cloudflare without b.mu and only take it to read or change the state.
+func (b *CloudflareBroker) update(change func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	change()
+	b.saveState()
+}
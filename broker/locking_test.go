@@ -0,0 +1,160 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const zoneParameters = `{"x-auth-key": "mykey", "x-auth-email": "email@email.com"}`
+
+// startBlockedBind starts a Bind of instance "1" that waits in AddZone until
+// fakeAPI.Block is closed, and returns its result channel.
+func startBlockedBind(t *testing.T, cloudflarebroker *broker.CloudflareBroker, fakeAPI *FakeCloudflareAPI) chan error {
+	var context context.Context
+
+	if _, err := cloudflarebroker.Provision(context, "1", brokerapi.ProvisionDetails{RawParameters: []byte(zoneParameters)}, false); err != nil {
+		t.Fatalf("Provision failed %v", err)
+	}
+
+	fakeAPI.Block = make(chan struct{})
+	fakeAPI.Blocked = make(chan struct{})
+	result := make(chan error)
+	go func() {
+		_, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": "domain.com"}})
+		result <- err
+	}()
+	<-fakeAPI.Blocked
+
+	return result
+}
+
+func TestConcurrentInstanceOperations(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	result := startBlockedBind(t, &cloudflarebroker, fakeAPI)
+
+	if _, err := cloudflarebroker.Bind(context, "1", "3", brokerapi.BindDetails{}); err != broker.ErrConcurrentInstanceAccess {
+		t.Errorf("Bind during a bind returned %v", err)
+	}
+	if err := cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{}); err != broker.ErrConcurrentInstanceAccess {
+		t.Errorf("Unbind during a bind returned %v", err)
+	}
+	if _, err := cloudflarebroker.Deprovision(context, "1", brokerapi.DeprovisionDetails{}, true); err != broker.ErrConcurrentInstanceAccess {
+		t.Errorf("Deprovision during a bind returned %v", err)
+	}
+	if _, err := cloudflarebroker.Provision(context, "1", brokerapi.ProvisionDetails{}, false); err != broker.ErrConcurrentInstanceAccess {
+		t.Errorf("Provision during a bind returned %v", err)
+	}
+
+	close(fakeAPI.Block)
+	if err := <-result; err != nil {
+		t.Fatalf("Bind failed %v", err)
+	}
+
+	if err := cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{}); err != nil {
+		t.Errorf("Unbind after the bind failed %v", err)
+	}
+}
+
+func TestConcurrencyErrorHandler(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	credentials := brokerapi.BrokerCredentials{Username: "username", Password: "password"}
+	handler := broker.NewErrorStatusHandler(brokerapi.New(&cloudflarebroker, logger, credentials))
+
+	result := startBlockedBind(t, &cloudflarebroker, fakeAPI)
+
+	req := httptest.NewRequest("DELETE", "/v2/service_instances/1/service_bindings/2?service_id=s&plan_id=p", nil)
+	req.SetBasicAuth("username", "password")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	var response brokerapi.ErrorResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if recorder.Code != http.StatusUnprocessableEntity || response.Error != "ConcurrencyError" {
+		t.Errorf("Unbind during a bind returned %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	close(fakeAPI.Block)
+	<-result
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Unbind after the bind returned %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// TestConcurrentBrokerAccess runs every operation on many instances at once.
+// Run it with -race.
+func TestConcurrentBrokerAccess(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	var context context.Context
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		instanceId := strconv.Itoa(i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := cloudflarebroker.Provision(context, instanceId, brokerapi.ProvisionDetails{RawParameters: []byte(zoneParameters)}, false); err != nil {
+				t.Errorf("Provision %s failed %v", instanceId, err)
+				return
+			}
+			for _, bindingId := range []string{"a", "b"} {
+				details := brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": instanceId + bindingId + ".com"}}
+				if _, err := cloudflarebroker.Bind(context, instanceId, bindingId, details); err != nil {
+					t.Errorf("Bind %s failed %v", instanceId, err)
+				}
+			}
+			cloudflarebroker.InstanceStatus(context, instanceId)
+			cloudflarebroker.LastOperation(context, instanceId, "")
+			for _, bindingId := range []string{"a", "b"} {
+				if err := cloudflarebroker.Unbind(context, instanceId, bindingId, brokerapi.UnbindDetails{}); err != nil {
+					t.Errorf("Unbind %s failed %v", instanceId, err)
+				}
+			}
+			if _, err := cloudflarebroker.Deprovision(context, instanceId, brokerapi.DeprovisionDetails{}, false); err != nil {
+				t.Errorf("Deprovision %s failed %v", instanceId, err)
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 20; i++ {
+			cloudflarebroker.Reconcile(broker.ReconcileOptions{DryRun: true})
+			cloudflarebroker.ListPendingDeletions()
+			cloudflarebroker.DeleteExpiredZones(time.Now())
+		}
+	}()
+
+	wg.Wait()
+
+	if len(cloudflarebroker.Instances) != 0 || len(cloudflarebroker.Zones) != 0 || len(cloudflarebroker.Bindings) != 0 {
+		t.Errorf("Broker kept state after all instances were deprovisioned")
+	}
+}
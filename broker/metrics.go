@@ -0,0 +1,214 @@
+package broker
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/metrics"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/tracing"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const OPERATION_UPDATE = "update"
+const OPERATION_LAST_OPERATION = "last_operation"
+
+// Outcomes of an OSB operation in the metrics. Rejected operations failed
+// because of the request, such as a binding that already exists; errors are
+// failures of the broker or of Cloudflare.
+const OUTCOME_SUCCESS = "success"
+const OUTCOME_ASYNC = "async"
+const OUTCOME_REJECTED = "rejected"
+const OUTCOME_ERROR = "error"
+
+var operationsTotal = metrics.NewCounterVec(
+	"cloudflare_broker_operations_total",
+	"Service broker API operations by operation and outcome.",
+	"operation", "outcome",
+)
+
+var operationDuration = metrics.NewHistogramVec(
+	"cloudflare_broker_operation_duration_seconds",
+	"Latency of service broker API operations by operation and outcome.",
+	metrics.DEFAULT_BUCKETS,
+	"operation", "outcome",
+)
+
+func init() {
+	metrics.MustRegister(operationsTotal, operationDuration)
+}
+
+var rejections = []error{
+	brokerapi.ErrInstanceAlreadyExists,
+	brokerapi.ErrInstanceDoesNotExist,
+	brokerapi.ErrInstanceLimitMet,
+	brokerapi.ErrPlanQuotaExceeded,
+	brokerapi.ErrBindingAlreadyExists,
+	brokerapi.ErrBindingDoesNotExist,
+	brokerapi.ErrAsyncRequired,
+	brokerapi.ErrPlanChangeNotSupported,
+	brokerapi.ErrRawParamsInvalid,
+	brokerapi.ErrAppGuidNotProvided,
+	ErrConcurrentInstanceAccess,
+}
+
+func outcome(err error, async bool) string {
+	if err == nil {
+		if async {
+			return OUTCOME_ASYNC
+		}
+		return OUTCOME_SUCCESS
+	}
+
+	if _, ok := err.(PolicyError); ok {
+		return OUTCOME_REJECTED
+	}
+	for _, rejection := range rejections {
+		if err == rejection {
+			return OUTCOME_REJECTED
+		}
+	}
+
+	return OUTCOME_ERROR
+}
+
+// startOperation starts the span of an operation, as a child of the request
+// span in ctx.
+func startOperation(ctx context.Context, operation string, instanceID string, bindingID string) (context.Context, *tracing.Span, time.Time) {
+	ctx, span := tracing.StartSpan(ctx, "osb "+operation, tracing.SPAN_KIND_INTERNAL)
+	span.SetAttribute("instance_id", instanceID)
+	span.SetAttribute("binding_id", bindingID)
+
+	return ctx, span, time.Now()
+}
+
+func observeOperation(span *tracing.Span, operation string, startedAt time.Time, err error, async bool) {
+	result := outcome(err, async)
+	operationsTotal.Inc(operation, result)
+	operationDuration.Observe(time.Since(startedAt).Seconds(), operation, result)
+
+	span.SetAttribute("outcome", result)
+	span.Finish(err)
+}
+
+// InstrumentedBroker records the outcome and latency of every operation of
+// the service broker it wraps, and traces it.
+type InstrumentedBroker struct {
+	brokerapi.ServiceBroker
+}
+
+func NewInstrumentedBroker(broker brokerapi.ServiceBroker) InstrumentedBroker {
+	return InstrumentedBroker{ServiceBroker: broker}
+}
+
+func (b InstrumentedBroker) Provision(context context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	context, span, startedAt := startOperation(context, OPERATION_PROVISION, instanceID, "")
+	span.SetAttribute("plan_id", details.PlanID)
+	span.SetAttribute("organization_guid", details.OrganizationGUID)
+	span.SetAttribute("space_guid", details.SpaceGUID)
+	spec, err := b.ServiceBroker.Provision(context, instanceID, details, asyncAllowed)
+	observeOperation(span, OPERATION_PROVISION, startedAt, err, spec.IsAsync)
+
+	return spec, err
+}
+
+func (b InstrumentedBroker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	context, span, startedAt := startOperation(context, OPERATION_DEPROVISION, instanceID, "")
+	spec, err := b.ServiceBroker.Deprovision(context, instanceID, details, asyncAllowed)
+	observeOperation(span, OPERATION_DEPROVISION, startedAt, err, spec.IsAsync)
+
+	return spec, err
+}
+
+func (b InstrumentedBroker) Bind(context context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	context, span, startedAt := startOperation(context, OPERATION_BIND, instanceID, bindingID)
+	span.SetAttribute("app_guid", details.AppGUID)
+	binding, err := b.ServiceBroker.Bind(context, instanceID, bindingID, details)
+	observeOperation(span, OPERATION_BIND, startedAt, err, false)
+
+	return binding, err
+}
+
+func (b InstrumentedBroker) Unbind(context context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+	context, span, startedAt := startOperation(context, OPERATION_UNBIND, instanceID, bindingID)
+	err := b.ServiceBroker.Unbind(context, instanceID, bindingID, details)
+	observeOperation(span, OPERATION_UNBIND, startedAt, err, false)
+
+	return err
+}
+
+func (b InstrumentedBroker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	context, span, startedAt := startOperation(context, OPERATION_UPDATE, instanceID, "")
+	spec, err := b.ServiceBroker.Update(context, instanceID, details, asyncAllowed)
+	observeOperation(span, OPERATION_UPDATE, startedAt, err, spec.IsAsync)
+
+	return spec, err
+}
+
+func (b InstrumentedBroker) LastOperation(context context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
+	context, span, startedAt := startOperation(context, OPERATION_LAST_OPERATION, instanceID, "")
+	operation, err := b.ServiceBroker.LastOperation(context, instanceID, operationData)
+	span.SetAttribute("state", string(operation.State))
+	observeOperation(span, OPERATION_LAST_OPERATION, startedAt, err, false)
+
+	return operation, err
+}
+
+// InventoryMetrics returns gauges of the instances, bindings and zones of the
+// broker by plan name.
+func (b *CloudflareBroker) InventoryMetrics() []metrics.Collector {
+	byPlan := func(instanceIDs func() []string) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			names := b.planNames()
+			var samples []metrics.Sample
+			for _, instanceID := range instanceIDs() {
+				plan := b.Instances[instanceID].PlanID
+				if name, ok := names[plan]; ok {
+					plan = name
+				}
+				samples = append(samples, metrics.Sample{LabelValues: []string{plan}, Value: 1})
+			}
+			return samples
+		}
+	}
+
+	return []metrics.Collector{
+		metrics.NewGaugeFunc("cloudflare_broker_instances", "Service instances by plan.", byPlan(func() []string {
+			var instanceIDs []string
+			for instanceID := range b.Instances {
+				instanceIDs = append(instanceIDs, instanceID)
+			}
+			return instanceIDs
+		}), "plan"),
+		metrics.NewGaugeFunc("cloudflare_broker_bindings", "Service bindings by plan.", byPlan(func() []string {
+			var instanceIDs []string
+			for zoneKey := range b.bindingKeys() {
+				instanceIDs = append(instanceIDs, zoneKey[:strings.Index(zoneKey, ":")])
+			}
+			return instanceIDs
+		}), "plan"),
+		metrics.NewGaugeFunc("cloudflare_broker_zones", "Zones created or adopted by bindings, by plan.", byPlan(func() []string {
+			var instanceIDs []string
+			for zoneKey := range b.Zones {
+				instanceIDs = append(instanceIDs, zoneKey[:strings.Index(zoneKey, ":")])
+			}
+			return instanceIDs
+		}), "plan"),
+	}
+}
+
+// planNames maps the plan IDs of the catalog to plan names. Instances of a
+// plan no longer in the catalog are counted by plan ID.
+func (b *CloudflareBroker) planNames() map[string]string {
+	names := map[string]string{}
+	for _, service := range b.Services(context.Background()) {
+		for _, plan := range service.Plans {
+			names[plan.ID] = plan.Name
+		}
+	}
+
+	return names
+}
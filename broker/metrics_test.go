@@ -0,0 +1,68 @@
+package broker_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/metrics"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/tracing"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestInstrumentedBroker(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	instrumented := broker.NewInstrumentedBroker(&cloudflarebroker)
+	var context context.Context
+
+	instrumented.Provision(context, "1", brokerapi.ProvisionDetails{PlanID: broker.FREE_PLAN_ID, RawParameters: []byte(zoneParameters)}, false)
+	if _, err := instrumented.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": "domain.com"}}); err != nil {
+		t.Fatalf("Bind failed %v", err)
+	}
+	instrumented.Bind(context, "1", "2", brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": "other.com"}})
+
+	registry := metrics.NewRegistry()
+	registry.MustRegister(cloudflarebroker.InventoryMetrics()...)
+
+	var buffer bytes.Buffer
+	registry.Write(&buffer)
+	metrics.DefaultRegistry.Write(&buffer)
+	for _, line := range []string{
+		`cloudflare_broker_operations_total{operation="provision",outcome="success"}`,
+		`cloudflare_broker_operations_total{operation="bind",outcome="success"}`,
+		`cloudflare_broker_operations_total{operation="bind",outcome="rejected"}`,
+		`cloudflare_broker_operation_duration_seconds_count{operation="bind",outcome="success"}`,
+		`cloudflare_broker_instances{plan="free"} 1`,
+		`cloudflare_broker_bindings{plan="free"} 1`,
+		`cloudflare_broker_zones{plan="free"} 1`,
+	} {
+		if !strings.Contains(buffer.String(), line) {
+			t.Errorf("Metrics do not contain %s in\n%s", line, buffer.String())
+		}
+	}
+}
+
+func TestInstrumentedBrokerTracesCloudflareCalls(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	instrumented := broker.NewInstrumentedBroker(&cloudflarebroker)
+
+	ctx, request := tracing.StartSpan(context.Background(), "PUT /v2/service_instances/1/service_bindings/2", tracing.SPAN_KIND_SERVER)
+	instrumented.Provision(ctx, "1", brokerapi.ProvisionDetails{RawParameters: []byte(zoneParameters)}, false)
+	if _, err := instrumented.Bind(ctx, "1", "2", brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": "domain.com"}}); err != nil {
+		t.Fatalf("Bind failed %v", err)
+	}
+
+	span := tracing.SpanFromContext(fakeAPI.AddZoneContext)
+	if span == nil || span.Name != "osb bind" || span.Parent != request.Context.SpanID || span.Attributes["binding_id"] != "2" {
+		t.Errorf("AddZone was not traced as part of the bind %+v", span)
+	}
+}
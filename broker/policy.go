@@ -0,0 +1,305 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/hostname"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// POLICY_ERROR_PREFIX starts the description of a request refused by a
+// policy, by which it is answered with 422.
+const POLICY_ERROR_PREFIX = "Refused by the operator's policy: "
+
+// Policy limits what can be provisioned and bound in the org it applies to,
+// or in one space of it if SpaceGUID is set. A policy without an org applies
+// to every org. Limits are counted over everything the policy applies to, so
+// an org-wide and a space policy can both apply to a request.
+type Policy struct {
+	OrganizationGUID string `json:"organization_guid,omitempty"`
+	SpaceGUID        string `json:"space_guid,omitempty"`
+	// MaxInstances and MaxZones are not limited if they are nil
+	MaxInstances *int `json:"max_instances,omitempty"`
+	MaxZones     *int `json:"max_zones,omitempty"`
+	// AllowedPlans holds the names or IDs of the plans that can be
+	// provisioned. Every plan can be if it is empty.
+	AllowedPlans []string `json:"allowed_plans,omitempty"`
+	// AllowedDomains holds the domains zones can be bound for:
+	// "corp.example.com" allows the domain and its subdomains,
+	// "*.corp.example.com" its subdomains only. Every domain can be bound
+	// if it is empty.
+	AllowedDomains []string `json:"allowed_domains,omitempty"`
+}
+
+// PolicyError is a request refused by a policy.
+type PolicyError struct {
+	Reason string
+}
+
+func (e PolicyError) Error() string {
+	return POLICY_ERROR_PREFIX + e.Reason
+}
+
+// LoadPolicies reads a JSON array of policies from path.
+func LoadPolicies(path string) ([]Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []Policy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, err
+	}
+	for i, policy := range policies {
+		if err := policy.validate(); err != nil {
+			return nil, errors.New("policy " + strconv.Itoa(i) + ": " + err.Error())
+		}
+		// Domains are compared in the form they are bound with
+		for j, domain := range policy.AllowedDomains {
+			ascii, err := hostname.ToASCII(strings.TrimPrefix(domain, "*."))
+			if err != nil {
+				return nil, errors.New("policy " + strconv.Itoa(i) + ": " + err.Error())
+			}
+			policy.AllowedDomains[j] = strings.TrimSuffix(domain, strings.TrimPrefix(domain, "*.")) + ascii
+		}
+	}
+
+	return policies, nil
+}
+
+func (p Policy) validate() error {
+	if p.SpaceGUID != "" && p.OrganizationGUID == "" {
+		return errors.New("space_guid needs organization_guid")
+	}
+	if (p.MaxInstances != nil && *p.MaxInstances < 0) || (p.MaxZones != nil && *p.MaxZones < 0) {
+		return errors.New("limits must not be negative")
+	}
+	for _, domain := range p.AllowedDomains {
+		if strings.TrimPrefix(domain, "*.") == "" || strings.Contains(strings.TrimPrefix(domain, "*."), "*") {
+			return errors.New("allowed domain " + strconv.Quote(domain) + " must be a domain, optionally prefixed with *.")
+		}
+	}
+
+	return nil
+}
+
+func (p Policy) appliesTo(organizationGUID string, spaceGUID string) bool {
+	return (p.OrganizationGUID == "" || p.OrganizationGUID == organizationGUID) &&
+		(p.SpaceGUID == "" || p.SpaceGUID == spaceGUID)
+}
+
+// scope describes what the policy applies to in errors.
+func (p Policy) scope() string {
+	switch {
+	case p.SpaceGUID != "":
+		return "space " + p.SpaceGUID
+	case p.OrganizationGUID != "":
+		return "org " + p.OrganizationGUID
+	}
+
+	return "every org"
+}
+
+func (p Policy) allowsPlan(planID string, planName string) bool {
+	if len(p.AllowedPlans) == 0 {
+		return true
+	}
+
+	return contains(p.AllowedPlans, planID) || (planName != "" && contains(p.AllowedPlans, planName))
+}
+
+func (p Policy) allowsDomain(domain string) bool {
+	if len(p.AllowedDomains) == 0 {
+		return true
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, allowed := range p.AllowedDomains {
+		allowed = strings.ToLower(strings.TrimSuffix(allowed, "."))
+		if suffix := strings.TrimPrefix(allowed, "*."); suffix != allowed {
+			if strings.HasSuffix(domain, "."+suffix) {
+				return true
+			}
+		} else if domain == allowed || strings.HasSuffix(domain, "."+allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// planName returns the name of a plan in the catalog, or "" if there is no
+// such plan.
+func (b *CloudflareBroker) planName(planID string) string {
+	for _, service := range b.Services(context.Background()) {
+		for _, plan := range service.Plans {
+			if plan.ID == planID {
+				return plan.Name
+			}
+		}
+	}
+
+	return ""
+}
+
+// reserveInstance checks the provision policies and counts the instance
+// against their limits until the returned function releases it, so that
+// provisions running at once cannot exceed a limit together.
+func (b *CloudflareBroker) reserveInstance(instanceID string, details brokerapi.ProvisionDetails) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkProvisionPolicies(details); err != nil {
+		return nil, err
+	}
+	b.reservedInstances[instanceID] = Instance{OrganizationGUID: details.OrganizationGUID, SpaceGUID: details.SpaceGUID}
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.reservedInstances, instanceID)
+	}, nil
+}
+
+// reserveZone checks the bind policies for a zone of domain and counts it
+// against their limits until unreserveZone, like reserveInstance. Callers
+// hold b.mu.
+func (b *CloudflareBroker) reserveZone(instanceID string, bindingID string, domain string) error {
+	if err := b.checkBindPolicies(instanceID, domain); err != nil {
+		return err
+	}
+	b.reservedZones[getZoneKey(instanceID, bindingID)] = true
+
+	return nil
+}
+
+// unreserveZone stops counting a zone reserveZone counted, once it is stored
+// or its bind failed.
+func (b *CloudflareBroker) unreserveZone(zoneKey string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.reservedZones, zoneKey)
+}
+
+// checkProvisionPolicies refuses to provision an instance of a plan that is
+// not allowed, or beyond the number of instances allowed.
+func (b *CloudflareBroker) checkProvisionPolicies(details brokerapi.ProvisionDetails) error {
+	for _, policy := range b.Policies {
+		if !policy.appliesTo(details.OrganizationGUID, details.SpaceGUID) {
+			continue
+		}
+
+		if !policy.allowsPlan(details.PlanID, b.planName(details.PlanID)) {
+			b.logger.Info("Plan not allowed by policy", policyData(policy, details.PlanID))
+			return PolicyError{Reason: "plan " + planDescription(details.PlanID, b.planName(details.PlanID)) + " cannot be provisioned in " + policy.scope() + "; allowed plans are " + strings.Join(policy.AllowedPlans, ", ")}
+		}
+		if policy.MaxInstances != nil && b.countInstances(policy) >= *policy.MaxInstances {
+			b.logger.Info("Instance limit of policy met", policyData(policy, details.PlanID))
+			return PolicyError{Reason: policy.scope() + " has reached its limit of " + strconv.Itoa(*policy.MaxInstances) + " instances"}
+		}
+		// Tunnel routes add DNS records, so their hostnames are allowed
+		// like the domains of zones
+		if details.PlanID == TUNNEL_PLAN_ID {
+			for _, routeHostname := range tunnelRouteHostnames(details.RawParameters) {
+				if !policy.allowsDomain(routeHostname) {
+					return PolicyError{Reason: "tunnel routes for " + routeHostname + " cannot be provisioned in " + policy.scope() + "; allowed domains are " + strings.Join(policy.AllowedDomains, ", ")}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkBindPolicies refuses to bind a zone for a domain that is not allowed,
+// or beyond the number of zones allowed.
+func (b *CloudflareBroker) checkBindPolicies(instanceID string, domain string) error {
+	instance := b.Instances[instanceID]
+	for _, policy := range b.Policies {
+		if !policy.appliesTo(instance.OrganizationGUID, instance.SpaceGUID) {
+			continue
+		}
+
+		if !policy.allowsDomain(domain) {
+			return PolicyError{Reason: "zones for " + domain + " cannot be bound in " + policy.scope() + "; allowed domains are " + strings.Join(policy.AllowedDomains, ", ")}
+		}
+		if policy.MaxZones != nil && b.countZones(policy) >= *policy.MaxZones {
+			return PolicyError{Reason: policy.scope() + " has reached its limit of " + strconv.Itoa(*policy.MaxZones) + " zones"}
+		}
+	}
+
+	return nil
+}
+
+// countInstances counts the instances a policy applies to, including those
+// being provisioned.
+func (b *CloudflareBroker) countInstances(policy Policy) int {
+	count := 0
+	for instanceID, instance := range b.reservedInstances {
+		if _, stored := b.Instances[instanceID]; !stored && policy.appliesTo(instance.OrganizationGUID, instance.SpaceGUID) {
+			count++
+		}
+	}
+	for _, instance := range b.Instances {
+		if policy.appliesTo(instance.OrganizationGUID, instance.SpaceGUID) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// countZones counts the zones a policy applies to, including those being
+// bound.
+func (b *CloudflareBroker) countZones(policy Policy) int {
+	zoneKeys := map[string]bool{}
+	for zoneKey := range b.Zones {
+		zoneKeys[zoneKey] = true
+	}
+	for zoneKey := range b.reservedZones {
+		zoneKeys[zoneKey] = true
+	}
+
+	count := 0
+	for zoneKey := range zoneKeys {
+		instance := b.Instances[strings.SplitN(zoneKey, ":", 2)[0]]
+		if policy.appliesTo(instance.OrganizationGUID, instance.SpaceGUID) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// planDescription names a plan in errors by its name and ID, or its ID alone
+// if it is not in the catalog.
+func planDescription(planID string, planName string) string {
+	if planName == "" {
+		return planID
+	}
+
+	return planName + " (" + planID + ")"
+}
+
+func policyData(policy Policy, planID string) lager.Data {
+	return lager.Data{"policy": policy.scope(), "plan_id": planID}
+}
@@ -0,0 +1,177 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func policies(t *testing.T, data string) []broker.Policy {
+	var policies []broker.Policy
+	if err := json.Unmarshal([]byte(data), &policies); err != nil {
+		t.Fatal(err)
+	}
+
+	return policies
+}
+
+func provisionIn(cloudflarebroker *broker.CloudflareBroker, instanceID string, org string, space string, planID string) error {
+	_, err := cloudflarebroker.Provision(context.Background(), instanceID, brokerapi.ProvisionDetails{
+		PlanID:           planID,
+		OrganizationGUID: org,
+		SpaceGUID:        space,
+		RawParameters:    []byte(zoneParameters),
+	}, false)
+
+	return err
+}
+
+func TestProvisionPolicies(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	cloudflarebroker.Policies = policies(t, `[
+		{"organization_guid": "org", "max_instances": 2},
+		{"organization_guid": "org", "space_guid": "dev", "allowed_plans": ["free"]}
+	]`)
+
+	if err := provisionIn(&cloudflarebroker, "1", "org", "dev", broker.TUNNEL_PLAN_ID); err == nil || !strings.Contains(err.Error(), "allowed plans are free") {
+		t.Errorf("Provision of a plan not allowed returned %v", err)
+	}
+	if err := provisionIn(&cloudflarebroker, "1", "org", "dev", broker.FREE_PLAN_ID); err != nil {
+		t.Errorf("Provision of an allowed plan failed %v", err)
+	}
+	if err := provisionIn(&cloudflarebroker, "2", "org", "prod", "any"); err != nil {
+		t.Errorf("Provision in another space failed %v", err)
+	}
+	if err := provisionIn(&cloudflarebroker, "3", "org", "prod", "any"); err == nil || !strings.Contains(err.Error(), "org org has reached its limit of 2 instances") {
+		t.Errorf("Provision beyond the org limit returned %v", err)
+	}
+	if err := provisionIn(&cloudflarebroker, "3", "other", "prod", "any"); err != nil {
+		t.Errorf("Provision in another org failed %v", err)
+	}
+}
+
+func TestBindPolicies(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	cloudflarebroker.Policies = policies(t, `[
+		{"organization_guid": "marketing", "allowed_domains": ["*.corp.example.com", "example.org"], "max_zones": 2}
+	]`)
+	provisionIn(&cloudflarebroker, "1", "marketing", "space", "")
+	provisionIn(&cloudflarebroker, "2", "other", "space", "")
+	var context context.Context
+
+	bind := func(instanceID string, bindingID string, domain string) error {
+		_, err := cloudflarebroker.Bind(context, instanceID, bindingID, brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": domain}})
+		return err
+	}
+
+	for _, domain := range []string{"corp.example.com", "evilcorp.example.com", "domain.com"} {
+		if err := bind("1", domain, domain); err == nil || !strings.HasPrefix(err.Error(), broker.POLICY_ERROR_PREFIX) {
+			t.Errorf("Bind of %s returned %v", domain, err)
+		}
+	}
+	for _, domain := range []string{"shop.corp.example.com", "example.org"} {
+		if err := bind("1", domain, domain); err != nil {
+			t.Errorf("Bind of %s failed %v", domain, err)
+		}
+	}
+	if err := bind("1", "3", "www.example.org"); err == nil || !strings.Contains(err.Error(), "limit of 2 zones") {
+		t.Errorf("Bind beyond the zone limit returned %v", err)
+	}
+	if err := bind("2", "4", "domain.com"); err != nil {
+		t.Errorf("Bind in another org failed %v", err)
+	}
+}
+
+func TestTunnelRoutePolicies(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	cloudflarebroker.Policies = policies(t, `[{"organization_guid": "org", "allowed_domains": ["corp.example.com"]}]`)
+	var context context.Context
+
+	provision := func(instanceID string, routes string) error {
+		_, err := cloudflarebroker.Provision(context, instanceID, brokerapi.ProvisionDetails{
+			PlanID:           broker.TUNNEL_PLAN_ID,
+			OrganizationGUID: "org",
+			RawParameters:    []byte(`{"x-auth-key": "mykey", "x-auth-email": "email@email.com", "account_id": "account", "routes": ` + routes + `}`),
+		}, false)
+		return err
+	}
+
+	if err := provision("1", `[{"hostname": "APP.Domain.com.", "zone_id": "zone"}]`); err == nil || !strings.HasPrefix(err.Error(), broker.POLICY_ERROR_PREFIX) || !strings.Contains(err.Error(), "app.domain.com") {
+		t.Errorf("Provision of a route not allowed returned %v", err)
+	}
+	if len(fakeAPI.Calls) != 0 {
+		t.Errorf("Provision of a route not allowed called Cloudflare %v", fakeAPI.Calls)
+	}
+
+	// The fake zone is domain.com, so the route's hostname is not in it
+	if err := provision("2", `[{"hostname": "app.corp.example.com", "zone_id": "zone"}]`); err == nil || !strings.HasPrefix(err.Error(), broker.INVALID_PARAMETERS_PREFIX) {
+		t.Errorf("Provision of a route outside its zone returned %v", err)
+	}
+	if len(fakeAPI.Calls) != 0 {
+		t.Errorf("Provision of a route outside its zone created %v", fakeAPI.Calls)
+	}
+}
+
+func TestPolicyErrorStatus(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	cloudflarebroker.Policies = policies(t, `[{"allowed_domains": ["corp.example.com"], "allowed_plans": ["free"]}]`)
+	credentials := brokerapi.BrokerCredentials{Username: "username", Password: "password"}
+	handler := broker.NewErrorStatusHandler(brokerapi.New(&cloudflarebroker, logger, credentials))
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+
+	recorder := serve(handler, "PUT", "/v2/service_instances/3", `{"service_id": "s", "plan_id": "`+broker.TUNNEL_PLAN_ID+`", "organization_guid": "org", "space_guid": "space", "parameters": {}}`)
+	if recorder.Code != http.StatusUnprocessableEntity || !strings.Contains(recorder.Body.String(), "allowed plans are free") {
+		t.Errorf("Provision refused by a policy returned %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	req := httptest.NewRequest("PUT", "/v2/service_instances/1/service_bindings/2", strings.NewReader(`{"service_id": "s", "plan_id": "p", "parameters": {"domain": "domain.com"}}`))
+	req.SetBasicAuth("username", "password")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusUnprocessableEntity || !strings.Contains(recorder.Body.String(), "domain.com") {
+		t.Errorf("Bind refused by a policy returned %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestLoadPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudflare-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "policies.json")
+
+	ioutil.WriteFile(file, []byte(`[{"organization_guid": "org", "max_zones": 1, "allowed_domains": ["*.Corp.Example.com", "münchen.de"]}]`), 0600)
+	loaded, err := broker.LoadPolicies(file)
+	if err != nil || len(loaded) != 1 || *loaded[0].MaxZones != 1 || loaded[0].AllowedDomains[0] != "*.corp.example.com" || loaded[0].AllowedDomains[1] != "xn--mnchen-3ya.de" {
+		t.Errorf("LoadPolicies returned %+v %v", loaded, err)
+	}
+
+	for _, invalid := range []string{`[{"space_guid": "space"}]`, `[{"max_instances": -1}]`, `[{"allowed_domains": ["*.*.com"]}]`, `{}`} {
+		ioutil.WriteFile(file, []byte(invalid), 0600)
+		if _, err := broker.LoadPolicies(file); err == nil {
+			t.Errorf("LoadPolicies accepted %s", invalid)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/api"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const R2_SERVICE_ID = "8d4b1f2a-6a0e-4c4e-9d57-2f0f3b9c1e6d"
+const R2_STANDARD_PLAN_ID = "0b9f6a3e-2c71-4f0e-8a5d-7e4c1d2b9f30"
+
+// R2 buckets are addressed through the S3 API with the region "auto".
+const R2_REGION = "auto"
+
+type R2Bucket struct {
+	AccountID           string `json:"account_id"`
+	Name                string `json:"name"`
+	Location            string `json:"location"`
+	EmptyOnDeprovision  bool   `json:"empty_on_deprovision"`
+	RetainOnDeprovision bool   `json:"retain_on_deprovision"`
+}
+
+type R2AccessKey struct {
+	AccountID   string `json:"account_id"`
+	TokenID     string `json:"token_id"`
+	AccessKeyID string `json:"access_key_id"`
+}
+
+// R2Parameters are the provision parameters of the r2 service, next to the
+// api.AuthHeaders shared by all services.
+type R2Parameters struct {
+	AccountID                 string          `json:"account_id"`
+	BucketName                string          `json:"bucket_name"`
+	LocationHint              string          `json:"location_hint"`
+	CORSRules                 json.RawMessage `json:"cors_rules"`
+	LifecycleRules            json.RawMessage `json:"lifecycle_rules"`
+	EmptyBucketOnDeprovision  bool            `json:"empty_bucket_on_deprovision"`
+	RetainBucketOnDeprovision bool            `json:"retain_bucket_on_deprovision"`
+}
+
+// R2Credentials are returned on Bind. The field names follow the S3 service
+// credentials understood by Spring Cloud Connectors and most S3 libraries.
+type R2Credentials struct {
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Bucket          string `json:"bucket"`
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	URI             string `json:"uri"`
+}
+
+type r2Bucket struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+}
+
+type r2Object struct {
+	Key string `json:"key"`
+}
+
+type accountToken struct {
+	ID    string `json:"id"`
+	Value string `json:"value"`
+}
+
+func r2Service() brokerapi.Service {
+	return brokerapi.Service{
+		ID:            R2_SERVICE_ID,
+		Name:          "cloudflare-r2",
+		Description:   "S3-compatible object storage without egress fees.",
+		Bindable:      true,
+		PlanUpdatable: false,
+		Tags:          []string{"Cloudflare", "R2", "s3", "object-storage"},
+		Plans: []brokerapi.ServicePlan{
+			{
+				ID:          R2_STANDARD_PLAN_ID,
+				Name:        "standard",
+				Description: "A dedicated R2 bucket with S3 credentials per binding.",
+				Metadata: &brokerapi.ServicePlanMetadata{
+					DisplayName: "Standard",
+					Bullets: []string{
+						"S3-compatible API",
+						"Zero egress fees",
+						"Location hints",
+						"CORS and lifecycle rules",
+					},
+				},
+			},
+		},
+		Metadata: &brokerapi.ServiceMetadata{
+			DisplayName:         "Cloudflare R2",
+			ImageUrl:            "https://www.cloudflare.com/img/logo-cloudflare.svg",
+			SupportUrl:          "support.cloudflare.com",
+			DocumentationUrl:    "https://github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry",
+			ProviderDisplayName: "Cloudflare",
+			LongDescription:     "Cloudflare R2 stores large amounts of unstructured data behind an S3-compatible API without the egress bandwidth fees of typical cloud storage.",
+		},
+	}
+}
+
+// r2BucketName returns the bucket name requested in the parameters or derives
+// one from the instance ID.
+func r2BucketName(instanceID string, parameters R2Parameters) string {
+	if parameters.BucketName != "" {
+		return parameters.BucketName
+	}
+
+	return "cf-" + strings.ToLower(instanceID)
+}
+
+// provisionR2Bucket creates the bucket of an instance. Until the instance is
+// stored, the intent recorded before the bucket is created tells the
+// reconciler that the broker owns it.
+func (b *CloudflareBroker) provisionR2Bucket(client api.CloudflareAPIInterface, instanceID string, auth api.AuthHeaders, rawParameters json.RawMessage) (R2Bucket, error) {
+	var parameters R2Parameters
+	if err := json.Unmarshal(rawParameters, &parameters); err != nil {
+		b.logger.Error("Error decoding details.RawParameters", err)
+		return R2Bucket{}, err
+	}
+
+	if parameters.AccountID == "" {
+		return R2Bucket{}, errors.New("key 'account_id' not found in ProvisionDetails.RawParameters.")
+	}
+
+	b.update(func() {
+		b.ResourceIntents[instanceID] = ResourceIntent{
+			Resource:  "r2_bucket",
+			AccountID: parameters.AccountID,
+			Name:      r2BucketName(instanceID, parameters),
+			Auth:      auth,
+			StartedAt: time.Now(),
+		}
+	})
+
+	data, err := client.CreateR2Bucket(parameters.AccountID, api.R2BucketRequest{
+		Name:         r2BucketName(instanceID, parameters),
+		LocationHint: parameters.LocationHint,
+	})
+	if err != nil {
+		b.logger.Error("Provision calling api.cloudflare", err)
+		return R2Bucket{}, err
+	}
+
+	var created r2Bucket
+	if _, err := decodeCloudflareResponse(data, &created); err != nil {
+		b.logger.Error("Error from CloudFlare Client API", err)
+		b.forgetResourceIntent(instanceID, err)
+		return R2Bucket{}, err
+	}
+
+	bucket := R2Bucket{
+		AccountID:           parameters.AccountID,
+		Name:                created.Name,
+		Location:            created.Location,
+		EmptyOnDeprovision:  parameters.EmptyBucketOnDeprovision,
+		RetainOnDeprovision: parameters.RetainBucketOnDeprovision,
+	}
+	if bucket.Name == "" {
+		bucket.Name = r2BucketName(instanceID, parameters)
+	}
+
+	if len(parameters.CORSRules) > 0 {
+		data, err := client.PutR2BucketCORS(bucket.AccountID, bucket.Name, parameters.CORSRules)
+		if err == nil {
+			_, err = decodeCloudflareResponse(data, nil)
+		}
+		if err != nil {
+			b.logger.Error("Error setting R2 bucket CORS rules", err, lager.Data{"bucket": bucket.Name})
+			b.discardR2Bucket(client, instanceID, bucket)
+			return R2Bucket{}, err
+		}
+	}
+
+	if len(parameters.LifecycleRules) > 0 {
+		data, err := client.PutR2BucketLifecycle(bucket.AccountID, bucket.Name, parameters.LifecycleRules)
+		if err == nil {
+			_, err = decodeCloudflareResponse(data, nil)
+		}
+		if err != nil {
+			b.logger.Error("Error setting R2 bucket lifecycle rules", err, lager.Data{"bucket": bucket.Name})
+			b.discardR2Bucket(client, instanceID, bucket)
+			return R2Bucket{}, err
+		}
+	}
+
+	return bucket, nil
+}
+
+// discardR2Bucket deletes a bucket whose provision failed after it was
+// created, so that a retry can create it again. If it cannot be deleted, the
+// intent is kept for the reconciler to delete it.
+func (b *CloudflareBroker) discardR2Bucket(client api.CloudflareAPIInterface, instanceID string, bucket R2Bucket) {
+	data, err := client.DeleteR2Bucket(bucket.AccountID, bucket.Name)
+	if err == nil {
+		_, err = decodeCloudflareResponse(data, nil)
+	}
+	if err != nil {
+		b.logger.Error("Error deleting R2 bucket of failed provision", err, lager.Data{"bucket": bucket.Name})
+		return
+	}
+	b.update(func() { delete(b.ResourceIntents, instanceID) })
+}
+
+func (b *CloudflareBroker) bindR2Bucket(client api.CloudflareAPIInterface, instanceID string, bindingID string, bucket R2Bucket) (brokerapi.Binding, error) {
+	resource := "com.cloudflare.edge.r2.bucket." + bucket.AccountID + "_default_" + bucket.Name
+	data, err := client.CreateAccountToken(bucket.AccountID, api.TokenRequest{
+		Name: "cf-binding-" + bindingID,
+		Policies: []api.TokenPolicy{
+			{
+				Effect:    "allow",
+				Resources: map[string]string{resource: "*"},
+				PermissionGroups: []api.TokenPermissionGroup{
+					{ID: api.R2_BUCKET_ITEM_READ_PERMISSION},
+					{ID: api.R2_BUCKET_ITEM_WRITE_PERMISSION},
+				},
+			},
+		},
+	})
+	if err != nil {
+		b.logger.Error("Bind calling api.cloudflare", err)
+		return brokerapi.Binding{}, err
+	}
+
+	var token accountToken
+	if _, err := decodeCloudflareResponse(data, &token); err != nil {
+		b.logger.Error("Error from CloudFlare Client API", err)
+		return brokerapi.Binding{}, err
+	}
+
+	// The S3 secret access key of an R2 token is the SHA-256 of its value.
+	secret := sha256.Sum256([]byte(token.Value))
+	credentials := newR2Credentials(bucket, token.ID, hex.EncodeToString(secret[:]))
+
+	b.update(func() {
+		b.R2AccessKeys[getZoneKey(instanceID, bindingID)] = R2AccessKey{
+			AccountID:   bucket.AccountID,
+			TokenID:     token.ID,
+			AccessKeyID: token.ID,
+		}
+	})
+
+	return brokerapi.Binding{
+		Credentials: credentials,
+	}, nil
+}
+
+func newR2Credentials(bucket R2Bucket, accessKeyID string, secretAccessKey string) R2Credentials {
+	host := bucket.AccountID + ".r2.cloudflarestorage.com"
+
+	return R2Credentials{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		Bucket:          bucket.Name,
+		Endpoint:        "https://" + host,
+		Region:          R2_REGION,
+		URI:             "s3://" + accessKeyID + ":" + secretAccessKey + "@" + host + "/" + bucket.Name,
+	}
+}
+
+func (b *CloudflareBroker) unbindR2Bucket(client api.CloudflareAPIInterface, zoneKey string, accessKey R2AccessKey) error {
+	if err := b.revokeR2AccessKey(client, accessKey); err != nil {
+		b.logger.Error("Unbind calling api.cloudflare", err)
+		return err
+	}
+
+	b.update(func() { delete(b.R2AccessKeys, zoneKey) })
+
+	return nil
+}
+
+func (b *CloudflareBroker) revokeR2AccessKey(client api.CloudflareAPIInterface, accessKey R2AccessKey) error {
+	data, err := client.DeleteAccountToken(accessKey.AccountID, accessKey.TokenID)
+	if err != nil {
+		return err
+	}
+
+	_, err = decodeCloudflareResponse(data, nil)
+	return err
+}
+
+// deprovisionR2Bucket empties the bucket if requested and deletes it, unless
+// it is retained.
+func (b *CloudflareBroker) deprovisionR2Bucket(client api.CloudflareAPIInterface, bucket R2Bucket) error {
+	if bucket.RetainOnDeprovision {
+		return nil
+	}
+
+	if bucket.EmptyOnDeprovision {
+		if err := b.emptyR2Bucket(client, bucket); err != nil {
+			b.logger.Error("Error emptying R2 bucket", err, lager.Data{"bucket": bucket.Name})
+			return err
+		}
+	}
+
+	data, err := client.DeleteR2Bucket(bucket.AccountID, bucket.Name)
+	if err == nil {
+		_, err = decodeCloudflareResponse(data, nil)
+	}
+	if err != nil {
+		b.logger.Error("Error deleting R2 bucket", err, lager.Data{"bucket": bucket.Name})
+		return err
+	}
+
+	return nil
+}
+
+func (b *CloudflareBroker) emptyR2Bucket(client api.CloudflareAPIInterface, bucket R2Bucket) error {
+	cursor := ""
+	for {
+		data, err := client.ListR2Objects(bucket.AccountID, bucket.Name, cursor)
+		if err != nil {
+			return err
+		}
+
+		var objects []r2Object
+		response, err := decodeCloudflareResponse(data, &objects)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range objects {
+			data, err := client.DeleteR2Object(bucket.AccountID, bucket.Name, object.Key)
+			if err == nil {
+				_, err = decodeCloudflareResponse(data, nil)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if !response.ResultInfo.IsTruncated || response.ResultInfo.Cursor == "" {
+			return nil
+		}
+		cursor = response.ResultInfo.Cursor
+	}
+}
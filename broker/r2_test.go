@@ -0,0 +1,175 @@
+package broker_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func provisionR2(t *testing.T, cloudflarebroker *broker.CloudflareBroker, instanceId string, parameters string) {
+	var context context.Context
+
+	_, err := cloudflarebroker.Provision(
+		context,
+		instanceId,
+		brokerapi.ProvisionDetails{
+			ServiceID:     broker.R2_SERVICE_ID,
+			PlanID:        broker.R2_STANDARD_PLAN_ID,
+			RawParameters: []byte(parameters),
+		},
+		false,
+	)
+	if err != nil {
+		t.Fatalf("Provision r2 failed %v", err)
+	}
+}
+
+func TestServiceR2(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	var context context.Context
+
+	services := cloudflarebroker.Services(context)
+	if len(services) != 2 || services[1].ID != broker.R2_SERVICE_ID {
+		t.Errorf("Service r2 missing from catalog")
+	}
+}
+
+func TestProvisionR2WithoutAccount(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	var context context.Context
+
+	_, err := cloudflarebroker.Provision(
+		context,
+		"1",
+		brokerapi.ProvisionDetails{
+			ServiceID:     broker.R2_SERVICE_ID,
+			RawParameters: []byte(`{"x-auth-key": "mykey", "x-auth-email": "email@email.com"}`),
+		},
+		false,
+	)
+	if err == nil {
+		t.Errorf("Provision r2 succeeded without account_id")
+	}
+}
+
+func TestProvisionR2WithRules(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+
+	provisionR2(t, &cloudflarebroker, "Instance", `{
+		"x-auth-key":      "mykey",
+		"x-auth-email":    "email@email.com",
+		"account_id":      "account",
+		"location_hint":   "wnam",
+		"cors_rules":      [{"allowed": {"methods": ["GET"], "origins": ["*"]}}],
+		"lifecycle_rules": [{"id": "expire", "enabled": true}]
+	}`)
+
+	expected := []string{
+		"CreateR2Bucket cf-instance",
+		"PutR2BucketCORS cf-instance",
+		"PutR2BucketLifecycle cf-instance",
+	}
+	if !reflect.DeepEqual(fakeAPI.Calls, expected) {
+		t.Errorf("Provision r2 made calls %v", fakeAPI.Calls)
+	}
+
+	bucket := cloudflarebroker.Instances["Instance"].R2Bucket
+	if bucket == nil || bucket.Name != "cf-instance" || bucket.Location != "WNAM" {
+		t.Errorf("Provision r2 stored bucket %+v", bucket)
+	}
+}
+
+func TestProvisionR2DeletesBucketWhenRulesFail(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	var context context.Context
+
+	for _, method := range []string{"PutR2BucketCORS", "PutR2BucketLifecycle"} {
+		fakeAPI := &FakeCloudflareAPI{Fail: method}
+		cloudflarebroker.CloudflareAPI = fakeAPI
+
+		_, err := cloudflarebroker.Provision(context, "Instance", brokerapi.ProvisionDetails{
+			ServiceID:     broker.R2_SERVICE_ID,
+			PlanID:        broker.R2_STANDARD_PLAN_ID,
+			RawParameters: []byte(`{"x-auth-key": "mykey", "x-auth-email": "email@email.com", "account_id": "account", "cors_rules": [{"allowed": {"methods": ["GET"]}}], "lifecycle_rules": [{"id": "expire"}]}`),
+		}, false)
+		if err == nil {
+			t.Errorf("Provision r2 succeeded although %s failed", method)
+		}
+		if calls := fakeAPI.Calls; calls[len(calls)-1] != "DeleteR2Bucket cf-instance" {
+			t.Errorf("Provision r2 failing in %s made calls %v", method, calls)
+		}
+		if _, ok := cloudflarebroker.Instances["Instance"]; ok {
+			t.Errorf("Provision r2 failing in %s stored the instance", method)
+		}
+	}
+}
+
+func TestBindAndUnbindR2(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	provisionR2(t, &cloudflarebroker, "1", `{"x-auth-key": "mykey", "x-auth-email": "email@email.com", "account_id": "account"}`)
+
+	binding, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatalf("Bind r2 failed %v", err)
+	}
+
+	secret := sha256.Sum256([]byte("token-value"))
+	credentials, ok := binding.Credentials.(broker.R2Credentials)
+	if !ok ||
+		credentials.AccessKeyID != "token-id" ||
+		credentials.SecretAccessKey != hex.EncodeToString(secret[:]) ||
+		credentials.Endpoint != "https://account.r2.cloudflarestorage.com" ||
+		credentials.Bucket != "cf-1" {
+		t.Errorf("Bind r2 returned credentials %+v", binding.Credentials)
+	}
+
+	err = cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{})
+	if err != nil || len(cloudflarebroker.R2AccessKeys) != 0 {
+		t.Errorf("Unbind r2 failed %v", err)
+	}
+}
+
+func TestDeprovisionR2EmptiesAndDeletesBucket(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	provisionR2(t, &cloudflarebroker, "1", `{
+		"x-auth-key":                  "mykey",
+		"x-auth-email":                "email@email.com",
+		"account_id":                  "account",
+		"empty_bucket_on_deprovision": true
+	}`)
+	fakeAPI.Calls = nil
+
+	_, err := cloudflarebroker.Deprovision(context, "1", brokerapi.DeprovisionDetails{}, false)
+	expected := []string{
+		"ListR2Objects cf-1",
+		"DeleteR2Object object",
+		"DeleteR2Bucket cf-1",
+	}
+	if err != nil || !reflect.DeepEqual(fakeAPI.Calls, expected) {
+		t.Errorf("Deprovision r2 failed %v %v", err, fakeAPI.Calls)
+	}
+}
@@ -0,0 +1,549 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/api"
+)
+
+// Kinds of drift between broker state and Cloudflare
+const DRIFT_ORPHANED = "orphaned"
+const DRIFT_MISSING = "missing"
+const DRIFT_MODIFIED = "modified"
+
+const DEFAULT_ORPHAN_AGE = 24 * time.Hour
+
+// INTENT_CLOCK_SKEW is how much earlier than the intent recorded before its
+// creation a resource may appear to be created, as the clocks of the broker
+// and Cloudflare differ.
+const INTENT_CLOCK_SKEW = time.Minute
+
+// ZoneIntent is recorded before a zone is created and cleared once the zone
+// is stored, so that a zone created by a Bind that never finished can be
+// recognised as an orphan.
+type ZoneIntent struct {
+	Domain    string          `json:"domain"`
+	Auth      api.AuthHeaders `json:"auth"`
+	StartedAt time.Time       `json:"started_at"`
+}
+
+// ResourceIntent is recorded before the tunnel or R2 bucket of an instance is
+// created and cleared once the instance is stored, like a ZoneIntent.
+type ResourceIntent struct {
+	// Resource is "tunnel" or "r2_bucket"
+	Resource  string          `json:"resource"`
+	AccountID string          `json:"account_id"`
+	Name      string          `json:"name"`
+	Auth      api.AuthHeaders `json:"auth"`
+	StartedAt time.Time       `json:"started_at"`
+}
+
+type ReconcileOptions struct {
+	// DryRun reports orphans without deleting any
+	DryRun bool `json:"dry_run"`
+	// OrphanAge is how old an orphan must be before it is deleted
+	OrphanAge time.Duration `json:"orphan_age"`
+}
+
+type ReconcileReport struct {
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt time.Time        `json:"finished_at"`
+	Options    ReconcileOptions `json:"options"`
+	Drift      []Drift          `json:"drift"`
+	Errors     []string         `json:"errors,omitempty"`
+}
+
+type Drift struct {
+	Kind       string    `json:"kind"`
+	Resource   string    `json:"resource"`
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	InstanceID string    `json:"instance_id,omitempty"`
+	BindingID  string    `json:"binding_id,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	CreatedOn  time.Time `json:"created_on,omitempty"`
+	Deleted    bool      `json:"deleted"`
+}
+
+type cloudflareZone struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	Paused    bool      `json:"paused"`
+	CreatedOn time.Time `json:"created_on"`
+}
+
+type cloudflareTunnel struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type cloudflareBucket struct {
+	Name         string    `json:"name"`
+	CreationDate time.Time `json:"creation_date"`
+}
+
+// reconcileAccount is one set of credentials the broker knows, with the
+// account IDs used with it.
+type reconcileAccount struct {
+	auth       api.AuthHeaders
+	accountIDs map[string]bool
+}
+
+// knownAccounts returns the accounts of the instances, soft-deleted zones and
+// intents in state.
+func knownAccounts(state State) []*reconcileAccount {
+	accounts := map[api.AuthHeaders]*reconcileAccount{}
+	add := func(auth api.AuthHeaders, accountID string) {
+		if auth == (api.AuthHeaders{}) {
+			return
+		}
+		account, ok := accounts[auth]
+		if !ok {
+			account = &reconcileAccount{auth: auth, accountIDs: map[string]bool{}}
+			accounts[auth] = account
+		}
+		if accountID != "" {
+			account.accountIDs[accountID] = true
+		}
+	}
+
+	for _, instance := range state.Instances {
+		add(instance.Auth, "")
+		if instance.R2Bucket != nil {
+			add(instance.Auth, instance.R2Bucket.AccountID)
+		}
+		if instance.Tunnel != nil {
+			add(instance.Auth, instance.Tunnel.AccountID)
+		}
+	}
+	for _, pending := range state.PendingDeletions {
+		add(pending.Auth, "")
+	}
+	for _, intent := range state.ZoneIntents {
+		add(intent.Auth, "")
+	}
+	for _, intent := range state.ResourceIntents {
+		add(intent.Auth, intent.AccountID)
+	}
+
+	var result []*reconcileAccount
+	for _, account := range accounts {
+		result = append(result, account)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].auth.XAuthEmail < result[j].auth.XAuthEmail
+	})
+
+	return result
+}
+
+// Reconcile compares the zones, tunnels and R2 buckets in every known account
+// with broker state and reports orphaned, missing and modified resources.
+// Unless options.DryRun is set, orphans older than options.OrphanAge are
+// deleted. The report is kept as b.LastReconcileReport.
+//
+// Cloudflare is compared with a snapshot of the state taken when the run
+// starts, so that operations are not held up meanwhile. Intents the run
+// finds stale are dropped from the snapshot and forgotten at the end.
+func (b *CloudflareBroker) Reconcile(options ReconcileOptions) ReconcileReport {
+	ctx := auditScope(context.Background(), AUDIT_RECONCILE, "", "")
+	report := ReconcileReport{StartedAt: time.Now(), Options: options, Drift: []Drift{}}
+	logger := b.logger.Session("reconcile", lager.Data{"dry_run": options.DryRun})
+
+	b.mu.Lock()
+	state := b.state()
+	b.mu.Unlock()
+
+	for _, account := range knownAccounts(state) {
+		client := b.CloudflareAPI.With(ctx, account.auth)
+
+		if err := b.reconcileZones(client, account, state, options, &report); err != nil {
+			report.Errors = append(report.Errors, "zones of "+account.auth.XAuthEmail+": "+err.Error())
+		}
+		for accountID := range account.accountIDs {
+			if err := b.reconcileTunnels(client, account, accountID, state, options, &report); err != nil {
+				report.Errors = append(report.Errors, "tunnels of account "+accountID+": "+err.Error())
+			}
+			if err := b.reconcileR2Buckets(client, account, accountID, state, options, &report); err != nil {
+				report.Errors = append(report.Errors, "R2 buckets of account "+accountID+": "+err.Error())
+			}
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	logger.Info("Reconciled", lager.Data{"drift": len(report.Drift), "errors": len(report.Errors)})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// An intent missing from the snapshot but recorded before the run
+	// started was found stale; one recorded since is left alone
+	for zoneKey, intent := range b.ZoneIntents {
+		if _, ok := state.ZoneIntents[zoneKey]; !ok && intent.StartedAt.Before(report.StartedAt) {
+			delete(b.ZoneIntents, zoneKey)
+		}
+	}
+	for instanceID, intent := range b.ResourceIntents {
+		if _, ok := state.ResourceIntents[instanceID]; !ok && intent.StartedAt.Before(report.StartedAt) {
+			delete(b.ResourceIntents, instanceID)
+		}
+	}
+	b.LastReconcileReport = &report
+	b.saveState()
+
+	return report
+}
+
+// LatestReconcileReport returns the report of the last run of Reconcile, or
+// nil if it has not run yet.
+func (b *CloudflareBroker) LatestReconcileReport() *ReconcileReport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.LastReconcileReport
+}
+
+// RunReconciler calls Reconcile every interval until stop is closed.
+func (b *CloudflareBroker) RunReconciler(interval time.Duration, options ReconcileOptions, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.Reconcile(options)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (b *CloudflareBroker) listAllZones(client api.CloudflareAPIInterface) ([]cloudflareZone, error) {
+	var zones []cloudflareZone
+	for page := 1; ; page++ {
+		data, err := client.ListZones(page)
+		if err != nil {
+			return nil, err
+		}
+
+		var pageZones []cloudflareZone
+		response, err := decodeCloudflareResponse(data, &pageZones)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, pageZones...)
+
+		if len(pageZones) == 0 || page >= response.ResultInfo.TotalPages {
+			return zones, nil
+		}
+	}
+}
+
+func (b *CloudflareBroker) reconcileZones(client api.CloudflareAPIInterface, account *reconcileAccount, state State, options ReconcileOptions, report *ReconcileReport) error {
+	zones, err := b.listAllZones(client)
+	if err != nil {
+		return err
+	}
+
+	found := map[string]cloudflareZone{}
+	for _, zone := range zones {
+		found[zone.ID] = zone
+	}
+
+	known := map[string]bool{}
+	for zoneKey, zone := range state.Zones {
+		instanceID := zoneKey[:strings.Index(zoneKey, ":")]
+		if instance, ok := state.Instances[instanceID]; !ok || instance.Auth != account.auth {
+			continue
+		}
+		known[zone.ID] = true
+
+		drift := Drift{
+			Resource:   "zone",
+			ID:         zone.ID,
+			Name:       zone.Name,
+			InstanceID: instanceID,
+			BindingID:  zoneKey[len(instanceID)+1:],
+		}
+		actual, ok := found[zone.ID]
+		switch {
+		case !ok:
+			drift.Kind = DRIFT_MISSING
+		case actual.Name != zone.Name:
+			drift.Kind, drift.Detail = DRIFT_MODIFIED, "zone is now named "+actual.Name
+		case actual.Paused:
+			drift.Kind, drift.Detail = DRIFT_MODIFIED, "zone is paused"
+		case actual.Status == ZONE_STATUS_MOVED:
+			drift.Kind, drift.Detail = DRIFT_MODIFIED, "zone moved away from Cloudflare"
+		default:
+			continue
+		}
+		report.Drift = append(report.Drift, drift)
+	}
+
+	for zoneID, pending := range state.PendingDeletions {
+		if pending.Auth != account.auth {
+			continue
+		}
+		known[zoneID] = true
+		if _, ok := found[zoneID]; !ok {
+			report.Drift = append(report.Drift, Drift{
+				Kind:     DRIFT_MISSING,
+				Resource: "zone",
+				ID:       zoneID,
+				Name:     pending.Zone.Name,
+				Detail:   "zone scheduled for deletion no longer exists",
+			})
+		}
+	}
+
+	for zoneKey, intent := range state.ZoneIntents {
+		if intent.Auth != account.auth {
+			continue
+		}
+
+		orphaned := false
+		for _, zone := range zones {
+			// A zone created before the intent was not created by the
+			// bind, even if it has the same name
+			if zone.Name != intent.Domain || known[zone.ID] || !createdAfter(zone.CreatedOn, intent.StartedAt) {
+				continue
+			}
+			orphaned = true
+
+			drift := Drift{
+				Kind:      DRIFT_ORPHANED,
+				Resource:  "zone",
+				ID:        zone.ID,
+				Name:      zone.Name,
+				Detail:    "zone created by an unfinished bind",
+				CreatedOn: zone.CreatedOn,
+			}
+			if orphanExpired(zone.CreatedOn, options) {
+				if err := b.deleteZone(client, zone.ID); err != nil {
+					report.Errors = append(report.Errors, "deleting zone "+zone.Name+": "+err.Error())
+				} else {
+					drift.Deleted = true
+					orphaned = false
+				}
+			}
+			report.Drift = append(report.Drift, drift)
+		}
+
+		// Forget intents that left nothing behind
+		if !orphaned && time.Since(intent.StartedAt) > options.OrphanAge {
+			delete(state.ZoneIntents, zoneKey)
+		}
+	}
+
+	return nil
+}
+
+func (b *CloudflareBroker) reconcileTunnels(client api.CloudflareAPIInterface, account *reconcileAccount, accountID string, state State, options ReconcileOptions, report *ReconcileReport) error {
+	data, err := client.ListTunnels(accountID)
+	if err != nil {
+		return err
+	}
+	var tunnels []cloudflareTunnel
+	if _, err := decodeCloudflareResponse(data, &tunnels); err != nil {
+		return err
+	}
+
+	found := map[string]cloudflareTunnel{}
+	for _, tunnel := range tunnels {
+		found[tunnel.ID] = tunnel
+	}
+
+	known := map[string]bool{}
+	for instanceID, instance := range state.Instances {
+		if instance.Tunnel == nil || instance.Auth != account.auth || instance.Tunnel.AccountID != accountID {
+			continue
+		}
+		known[instance.Tunnel.ID] = true
+
+		drift := Drift{Resource: "tunnel", ID: instance.Tunnel.ID, Name: instance.Tunnel.Name, InstanceID: instanceID}
+		if actual, ok := found[instance.Tunnel.ID]; !ok {
+			drift.Kind = DRIFT_MISSING
+		} else if actual.Name != instance.Tunnel.Name {
+			drift.Kind, drift.Detail = DRIFT_MODIFIED, "tunnel is now named "+actual.Name
+		} else {
+			continue
+		}
+		report.Drift = append(report.Drift, drift)
+	}
+
+	for instanceID, intent := range state.ResourceIntents {
+		if intent.Resource != "tunnel" || intent.Auth != account.auth || intent.AccountID != accountID {
+			continue
+		}
+
+		orphaned := false
+		for _, tunnel := range tunnels {
+			if tunnel.Name != intent.Name || known[tunnel.ID] || !createdAfter(tunnel.CreatedAt, intent.StartedAt) {
+				continue
+			}
+			orphaned = true
+
+			drift := Drift{
+				Kind:      DRIFT_ORPHANED,
+				Resource:  "tunnel",
+				ID:        tunnel.ID,
+				Name:      tunnel.Name,
+				Detail:    "tunnel created by an unfinished provision",
+				CreatedOn: tunnel.CreatedAt,
+			}
+			if orphanExpired(tunnel.CreatedAt, options) {
+				if err := b.deleteTunnel(client, &Tunnel{AccountID: accountID, ID: tunnel.ID}); err != nil {
+					report.Errors = append(report.Errors, "deleting tunnel "+tunnel.Name+": "+err.Error())
+				} else {
+					drift.Deleted = true
+					orphaned = false
+				}
+			}
+			report.Drift = append(report.Drift, drift)
+		}
+
+		if !orphaned && time.Since(intent.StartedAt) > options.OrphanAge {
+			delete(state.ResourceIntents, instanceID)
+		}
+	}
+
+	return nil
+}
+
+func (b *CloudflareBroker) reconcileR2Buckets(client api.CloudflareAPIInterface, account *reconcileAccount, accountID string, state State, options ReconcileOptions, report *ReconcileReport) error {
+	data, err := client.ListR2Buckets(accountID)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Buckets []cloudflareBucket `json:"buckets"`
+	}
+	if _, err := decodeCloudflareResponse(data, &result); err != nil {
+		return err
+	}
+
+	found := map[string]cloudflareBucket{}
+	for _, bucket := range result.Buckets {
+		found[bucket.Name] = bucket
+	}
+
+	known := map[string]bool{}
+	for instanceID, instance := range state.Instances {
+		if instance.R2Bucket == nil || instance.Auth != account.auth || instance.R2Bucket.AccountID != accountID {
+			continue
+		}
+		known[instance.R2Bucket.Name] = true
+
+		if _, ok := found[instance.R2Bucket.Name]; !ok {
+			report.Drift = append(report.Drift, Drift{
+				Kind:       DRIFT_MISSING,
+				Resource:   "r2_bucket",
+				ID:         instance.R2Bucket.Name,
+				Name:       instance.R2Bucket.Name,
+				InstanceID: instanceID,
+			})
+		}
+	}
+
+	for instanceID, intent := range state.ResourceIntents {
+		if intent.Resource != "r2_bucket" || intent.Auth != account.auth || intent.AccountID != accountID {
+			continue
+		}
+
+		orphaned := false
+		bucket, ok := found[intent.Name]
+		if ok && !known[bucket.Name] && createdAfter(bucket.CreationDate, intent.StartedAt) {
+			orphaned = true
+
+			drift := Drift{
+				Kind:      DRIFT_ORPHANED,
+				Resource:  "r2_bucket",
+				ID:        bucket.Name,
+				Name:      bucket.Name,
+				Detail:    "bucket created by an unfinished provision",
+				CreatedOn: bucket.CreationDate,
+			}
+			if orphanExpired(bucket.CreationDate, options) {
+				data, err := client.DeleteR2Bucket(accountID, bucket.Name)
+				if err == nil {
+					_, err = decodeCloudflareResponse(data, nil)
+				}
+				if err != nil {
+					report.Errors = append(report.Errors, "deleting R2 bucket "+bucket.Name+": "+err.Error())
+				} else {
+					drift.Deleted = true
+					orphaned = false
+				}
+			}
+			report.Drift = append(report.Drift, drift)
+		}
+
+		if !orphaned && time.Since(intent.StartedAt) > options.OrphanAge {
+			delete(state.ResourceIntents, instanceID)
+		}
+	}
+
+	return nil
+}
+
+// createdAfter reports whether a resource created at createdOn may have been
+// created by an operation started at startedAt.
+func createdAfter(createdOn time.Time, startedAt time.Time) bool {
+	return !createdOn.IsZero() && !createdOn.Before(startedAt.Add(-INTENT_CLOCK_SKEW))
+}
+
+// orphanExpired reports whether an orphan created at createdOn may be deleted.
+func orphanExpired(createdOn time.Time, options ReconcileOptions) bool {
+	if options.DryRun || createdOn.IsZero() {
+		return false
+	}
+
+	return time.Since(createdOn) > options.OrphanAge
+}
+
+// ParseReconcileOptions reads the orphan age and dry-run switch, as given in
+// RECONCILE_ORPHAN_AGE and RECONCILE_DRY_RUN. Both may be empty for the
+// defaults: a 24h orphan age and a dry run.
+func ParseReconcileOptions(orphanAge string, dryRun string) (ReconcileOptions, error) {
+	options := ReconcileOptions{DryRun: true, OrphanAge: DEFAULT_ORPHAN_AGE}
+
+	if orphanAge != "" {
+		duration, err := time.ParseDuration(orphanAge)
+		if err != nil || duration <= 0 {
+			return options, errors.New("orphan age must be a positive duration, not " + orphanAge)
+		}
+		options.OrphanAge = duration
+	}
+
+	switch dryRun {
+	case "", "true":
+	case "false":
+		options.DryRun = false
+	default:
+		return options, errors.New("dry run must be true or false, not " + dryRun)
+	}
+
+	return options, nil
+}
+
+// forgetResourceIntent forgets the intent of an instance to create a tunnel
+// or R2 bucket if the creation failed with err because Cloudflare refused it,
+// so that nothing was created.
+func (b *CloudflareBroker) forgetResourceIntent(instanceID string, err error) {
+	if _, refused := err.(CloudflareError); refused {
+		b.update(func() { delete(b.ResourceIntents, instanceID) })
+	}
+}
+
+// instanceAuth returns the credentials of an instance. Callers hold b.mu.
+func (b *CloudflareBroker) instanceAuth(instanceID string) api.AuthHeaders {
+	return b.Instances[instanceID].Auth
+}
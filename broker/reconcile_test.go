@@ -0,0 +1,289 @@
+package broker_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/api"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func newReconcileBroker(t *testing.T, fakeAPI *FakeCloudflareAPI) broker.CloudflareBroker {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(
+		logger,
+		map[string]broker.Zone{
+			"1:2": broker.Zone{ID: "zone", Name: "domain.com"},
+			"1:3": broker.Zone{ID: "gone", Name: "gone.com"},
+		},
+	)
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	_, err := cloudflarebroker.Provision(
+		context,
+		"1",
+		brokerapi.ProvisionDetails{RawParameters: []byte(`{"x-auth-key": "mykey", "x-auth-email": "email@email.com"}`)},
+		false,
+	)
+	if err != nil {
+		t.Fatalf("Provision failed %v", err)
+	}
+
+	cloudflarebroker.ZoneIntents["1:4"] = broker.ZoneIntent{
+		Domain:    "orphan.com",
+		Auth:      api.AuthHeaders{XAuthKey: "mykey", XAuthEmail: "email@email.com"},
+		StartedAt: time.Now().Add(-48 * time.Hour),
+	}
+	fakeAPI.ListedZones = []map[string]interface{}{
+		{"id": "zone", "name": "domain.com", "status": "active", "paused": true},
+		{"id": "orphan", "name": "orphan.com", "status": "pending", "created_on": time.Now().Add(-48 * time.Hour)},
+		{"id": "foreign", "name": "foreign.com", "status": "active"},
+	}
+
+	return cloudflarebroker
+}
+
+func findDrift(report broker.ReconcileReport, id string) *broker.Drift {
+	for i := range report.Drift {
+		if report.Drift[i].ID == id {
+			return &report.Drift[i]
+		}
+	}
+
+	return nil
+}
+
+func TestReconcileReportsDrift(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker := newReconcileBroker(t, fakeAPI)
+
+	report := cloudflarebroker.Reconcile(broker.ReconcileOptions{DryRun: true, OrphanAge: time.Hour})
+
+	if drift := findDrift(report, "zone"); drift == nil || drift.Kind != broker.DRIFT_MODIFIED {
+		t.Errorf("Reconcile did not report the paused zone %+v", report)
+	}
+	if drift := findDrift(report, "gone"); drift == nil || drift.Kind != broker.DRIFT_MISSING || drift.BindingID != "3" {
+		t.Errorf("Reconcile did not report the missing zone %+v", report)
+	}
+	if drift := findDrift(report, "orphan"); drift == nil || drift.Kind != broker.DRIFT_ORPHANED || drift.Deleted {
+		t.Errorf("Reconcile did not report the orphaned zone %+v", report)
+	}
+	if findDrift(report, "foreign") != nil {
+		t.Errorf("Reconcile reported a zone the broker did not create %+v", report)
+	}
+	if len(fakeAPI.Calls) != 0 || cloudflarebroker.LastReconcileReport == nil {
+		t.Errorf("Reconcile dry run changed something %v", fakeAPI.Calls)
+	}
+}
+
+func TestReconcileDeletesOldOrphans(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker := newReconcileBroker(t, fakeAPI)
+
+	report := cloudflarebroker.Reconcile(broker.ReconcileOptions{OrphanAge: 72 * time.Hour})
+	if len(fakeAPI.Calls) != 0 || findDrift(report, "orphan").Deleted {
+		t.Errorf("Reconcile deleted a young orphan %v", fakeAPI.Calls)
+	}
+
+	report = cloudflarebroker.Reconcile(broker.ReconcileOptions{OrphanAge: time.Hour})
+	if len(fakeAPI.Calls) != 1 || fakeAPI.Calls[0] != "DeleteZone orphan" || !findDrift(report, "orphan").Deleted {
+		t.Errorf("Reconcile did not delete the orphan %v", fakeAPI.Calls)
+	}
+	if _, ok := cloudflarebroker.ZoneIntents["1:4"]; ok {
+		t.Errorf("Reconcile kept the intent of a deleted orphan")
+	}
+}
+
+func TestReconcileKeepsZonesCreatedBeforeTheBind(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker := newReconcileBroker(t, fakeAPI)
+	var context context.Context
+	fakeAPI.ListedZones = []map[string]interface{}{
+		{"id": "existing-zone", "name": "existing.com", "status": "active", "created_on": time.Now().Add(-365 * 24 * time.Hour)},
+	}
+
+	// Cloudflare refuses to add a zone that exists, so nothing is left to
+	// clean up
+	_, err := cloudflarebroker.Bind(context, "1", "5", brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": "existing.com"}})
+	if _, ok := cloudflarebroker.ZoneIntents["1:5"]; err == nil || ok {
+		t.Fatalf("Bind of an existing zone returned %v", err)
+	}
+
+	// Even an intent kept after a failed request does not claim the zone
+	cloudflarebroker.ZoneIntents["1:6"] = broker.ZoneIntent{
+		Domain:    "existing.com",
+		Auth:      api.AuthHeaders{XAuthKey: "mykey", XAuthEmail: "email@email.com"},
+		StartedAt: time.Now().Add(-2 * time.Hour),
+	}
+	report := cloudflarebroker.Reconcile(broker.ReconcileOptions{OrphanAge: time.Hour})
+	if len(fakeAPI.Calls) != 0 || findDrift(report, "existing-zone") != nil {
+		t.Errorf("Reconcile claimed a zone created before the bind %v %+v", fakeAPI.Calls, report)
+	}
+}
+
+func TestReconcileClaimsZoneOfRetriedBind(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker := newReconcileBroker(t, fakeAPI)
+	var context context.Context
+	// The first attempt created the zone, but its answer was lost
+	startedAt := time.Now().Add(-48 * time.Hour)
+	cloudflarebroker.ZoneIntents["1:5"] = broker.ZoneIntent{
+		Domain:    "existing.com",
+		Auth:      api.AuthHeaders{XAuthKey: "mykey", XAuthEmail: "email@email.com"},
+		StartedAt: startedAt,
+	}
+	fakeAPI.ListedZones = []map[string]interface{}{
+		{"id": "existing-zone", "name": "existing.com", "status": "pending", "created_on": startedAt.Add(time.Minute)},
+	}
+
+	_, err := cloudflarebroker.Bind(context, "1", "5", brokerapi.BindDetails{Parameters: map[string]interface{}{"domain": "existing.com"}})
+	if intent, ok := cloudflarebroker.ZoneIntents["1:5"]; err == nil || !ok || !intent.StartedAt.Equal(startedAt) {
+		t.Fatalf("Retried bind of an existing zone returned %v and left %+v", err, cloudflarebroker.ZoneIntents)
+	}
+
+	report := cloudflarebroker.Reconcile(broker.ReconcileOptions{DryRun: true, OrphanAge: time.Hour})
+	if drift := findDrift(report, "existing-zone"); drift == nil || drift.Kind != broker.DRIFT_ORPHANED {
+		t.Errorf("Reconcile did not claim the zone of the first attempt %+v", report)
+	}
+}
+
+func TestReconcileTunnelsAndR2Buckets(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{
+		ListedTunnels: []map[string]interface{}{
+			{"id": "tunnel-id", "name": "renamed"},
+			{"id": "stale", "name": "my-tunnel", "created_at": time.Now().Add(-48 * time.Hour)},
+			{"id": "other", "name": "cf-manual", "created_at": time.Now().Add(-48 * time.Hour)},
+		},
+		ListedBuckets: []map[string]interface{}{
+			{"name": "my-bucket", "creation_date": time.Now().Add(-48 * time.Hour)},
+			{"name": "cf-manual", "creation_date": time.Now().Add(-48 * time.Hour)},
+		},
+	}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	auth := api.AuthHeaders{XAuthKey: "mykey", XAuthEmail: "email@email.com"}
+	cloudflarebroker.Instances["tunnel"] = broker.Instance{
+		Auth:   auth,
+		Tunnel: &broker.Tunnel{AccountID: "account", ID: "tunnel-id", Name: "cf-tunnel"},
+	}
+	cloudflarebroker.Instances["r2"] = broker.Instance{
+		Auth:     auth,
+		R2Bucket: &broker.R2Bucket{AccountID: "account", Name: "cf-bucket"},
+	}
+	// Provisions that never finished, whatever the names of what they
+	// created; only resources the broker intended to create are orphans
+	startedAt := time.Now().Add(-49 * time.Hour)
+	cloudflarebroker.ResourceIntents["3"] = broker.ResourceIntent{Resource: "tunnel", AccountID: "account", Name: "my-tunnel", Auth: auth, StartedAt: startedAt}
+	cloudflarebroker.ResourceIntents["4"] = broker.ResourceIntent{Resource: "r2_bucket", AccountID: "account", Name: "my-bucket", Auth: auth, StartedAt: startedAt}
+
+	report := cloudflarebroker.Reconcile(broker.ReconcileOptions{OrphanAge: time.Hour})
+
+	if drift := findDrift(report, "tunnel-id"); drift == nil || drift.Kind != broker.DRIFT_MODIFIED {
+		t.Errorf("Reconcile did not report the renamed tunnel %+v", report)
+	}
+	if drift := findDrift(report, "stale"); drift == nil || !drift.Deleted {
+		t.Errorf("Reconcile did not delete the orphaned tunnel %+v", report)
+	}
+	if drift := findDrift(report, "cf-bucket"); drift == nil || drift.Kind != broker.DRIFT_MISSING {
+		t.Errorf("Reconcile did not report the missing bucket %+v", report)
+	}
+	if drift := findDrift(report, "my-bucket"); drift == nil || !drift.Deleted {
+		t.Errorf("Reconcile did not delete the orphaned bucket %+v", report)
+	}
+	if findDrift(report, "other") != nil || findDrift(report, "cf-manual") != nil {
+		t.Errorf("Reconcile reported resources the broker did not create %+v", report)
+	}
+	if len(cloudflarebroker.ResourceIntents) != 0 {
+		t.Errorf("Reconcile kept the intents of deleted orphans %v", cloudflarebroker.ResourceIntents)
+	}
+}
+
+func TestProvisionRecordsResourceIntents(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+
+	provisionTunnel(t, &cloudflarebroker, "1")
+	if len(cloudflarebroker.ResourceIntents) != 0 {
+		t.Errorf("Provision kept the intent of a stored tunnel %v", cloudflarebroker.ResourceIntents)
+	}
+
+	// A bucket that cannot be deleted after a failure is left to the
+	// reconciler
+	var context context.Context
+	details := brokerapi.ProvisionDetails{
+		ServiceID:     broker.R2_SERVICE_ID,
+		PlanID:        broker.R2_STANDARD_PLAN_ID,
+		RawParameters: []byte(`{"x-auth-key": "mykey", "x-auth-email": "email@email.com", "account_id": "account", "bucket_name": "my-bucket", "cors_rules": [{"allowed": {"methods": ["GET"]}}]}`),
+	}
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{Fail: "PutR2BucketCORS"}
+	cloudflarebroker.Provision(context, "2", details, false)
+	if len(cloudflarebroker.ResourceIntents) != 0 {
+		t.Errorf("Provision kept the intent of a deleted bucket %v", cloudflarebroker.ResourceIntents)
+	}
+
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{Fail: "PutR2BucketCORS,DeleteR2Bucket"}
+	cloudflarebroker.Provision(context, "2", details, false)
+	intent, ok := cloudflarebroker.ResourceIntents["2"]
+	if !ok || intent.Resource != "r2_bucket" || intent.Name != "my-bucket" || intent.AccountID != "account" {
+		t.Errorf("Failed provision recorded intents %v", cloudflarebroker.ResourceIntents)
+	}
+}
+
+func TestParseReconcileOptions(t *testing.T) {
+	options, err := broker.ParseReconcileOptions("", "")
+	if err != nil || !options.DryRun || options.OrphanAge != broker.DEFAULT_ORPHAN_AGE {
+		t.Errorf("ParseReconcileOptions default returned %+v %v", options, err)
+	}
+
+	options, err = broker.ParseReconcileOptions("6h", "false")
+	if err != nil || options.DryRun || options.OrphanAge != 6*time.Hour {
+		t.Errorf("ParseReconcileOptions returned %+v %v", options, err)
+	}
+
+	if _, err := broker.ParseReconcileOptions("-1h", ""); err == nil {
+		t.Errorf("ParseReconcileOptions accepted a negative orphan age")
+	}
+	if _, err := broker.ParseReconcileOptions("", "maybe"); err == nil {
+		t.Errorf("ParseReconcileOptions accepted an invalid dry run")
+	}
+}
+
+func TestAdminReconcile(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker := newReconcileBroker(t, fakeAPI)
+	cloudflarebroker.ReconcileOptions.OrphanAge = time.Hour
+	handler := broker.NewAdminHandler(&cloudflarebroker)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/reconcile", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/reconcile before a run returned %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/admin/reconcile", nil))
+	if recorder.Code != http.StatusOK || len(fakeAPI.Calls) != 0 {
+		t.Errorf("POST /admin/reconcile returned %d %v", recorder.Code, fakeAPI.Calls)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/admin/reconcile?dry_run=false", nil))
+	if recorder.Code != http.StatusOK || len(fakeAPI.Calls) != 1 {
+		t.Errorf("POST /admin/reconcile?dry_run=false returned %d %v", recorder.Code, fakeAPI.Calls)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/reconcile", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("GET /admin/reconcile returned %d", recorder.Code)
+	}
+}
@@ -0,0 +1,277 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/jsonschema"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// PlanSchemas are the JSON Schemas of the parameters of a plan, published
+// in the catalog as the Service Broker API 2.13 specifies.
+type PlanSchemas struct {
+	ServiceInstance ServiceInstanceSchemas `json:"service_instance"`
+	ServiceBinding  ServiceBindingSchemas  `json:"service_binding"`
+}
+
+type ServiceInstanceSchemas struct {
+	Create SchemaParameters `json:"create"`
+	Update SchemaParameters `json:"update"`
+}
+
+type ServiceBindingSchemas struct {
+	Create SchemaParameters `json:"create"`
+}
+
+type SchemaParameters struct {
+	Parameters *jsonschema.Schema `json:"parameters"`
+}
+
+func boolPointer(b bool) *bool {
+	return &b
+}
+
+func intPointer(i int) *int {
+	return &i
+}
+
+// parameters is a root schema of an object with only the given properties.
+func parameters(required []string, properties map[string]*jsonschema.Schema) *jsonschema.Schema {
+	return &jsonschema.Schema{
+		Schema:               jsonschema.DRAFT,
+		Type:                 jsonschema.TYPE_OBJECT,
+		Properties:           properties,
+		Required:             required,
+		AdditionalProperties: boolPointer(false),
+	}
+}
+
+func stringProperty(description string) *jsonschema.Schema {
+	return &jsonschema.Schema{Type: jsonschema.TYPE_STRING, Description: description, MinLength: intPointer(1)}
+}
+
+func booleanProperty(description string) *jsonschema.Schema {
+	return &jsonschema.Schema{Type: jsonschema.TYPE_BOOLEAN, Description: description, Default: false}
+}
+
+func stringsProperty(description string) *jsonschema.Schema {
+	return &jsonschema.Schema{Type: jsonschema.TYPE_ARRAY, Description: description, Items: &jsonschema.Schema{Type: jsonschema.TYPE_STRING}}
+}
+
+// withAuth adds the credentials every plan is provisioned with.
+func withAuth(properties map[string]*jsonschema.Schema) map[string]*jsonschema.Schema {
+	properties["x-auth-email"] = stringProperty("Email of the Cloudflare account")
+	properties["x-auth-key"] = stringProperty("Global API key of the Cloudflare account")
+
+	return properties
+}
+
+// authRequired lists the required parameters of a plan with the credentials.
+func authRequired(required ...string) []string {
+	return append([]string{"x-auth-email", "x-auth-key"}, required...)
+}
+
+// noParameters is the schema of requests that take no parameters.
+func noParameters() *jsonschema.Schema {
+	return parameters(nil, map[string]*jsonschema.Schema{})
+}
+
+func zoneSchemas() PlanSchemas {
+	return PlanSchemas{
+		ServiceInstance: ServiceInstanceSchemas{
+			Create: SchemaParameters{Parameters: parameters(authRequired(), withAuth(map[string]*jsonschema.Schema{
+				"deletion_policy": {
+					Type:        jsonschema.TYPE_STRING,
+					Description: "What unbind does with the zones of the instance; the broker's policy if empty",
+					Enum:        []string{DELETION_POLICY_DELETE, DELETION_POLICY_RETAIN, DELETION_POLICY_SOFT_DELETE},
+				},
+				"deletion_grace_period": {
+					Type:        jsonschema.TYPE_STRING,
+					Description: "How long soft-deleted zones are kept, such as 72h",
+					Pattern:     `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`,
+				},
+			}))},
+			Update: SchemaParameters{Parameters: noParameters()},
+		},
+		ServiceBinding: ServiceBindingSchemas{
+			Create: SchemaParameters{Parameters: parameters([]string{"domain"}, map[string]*jsonschema.Schema{
+				"domain":  stringProperty("Domain the zone is added for, such as example.com"),
+				"adopt":   booleanProperty("Bind the existing zone of the domain instead of adding one; it is kept on unbind"),
+				"zone_id": stringProperty("ID of the existing zone to adopt; it is looked up by domain if empty"),
+				"access": {
+					Type:                 jsonschema.TYPE_OBJECT,
+					Description:          "Cloudflare Access application protecting the domain",
+					Required:             []string{"account_id"},
+					AdditionalProperties: boolPointer(false),
+					Properties: map[string]*jsonschema.Schema{
+						"account_id":            stringProperty("Account of the Access application"),
+						"hostname":              stringProperty("Hostname protected, the domain or one of its subdomains; the domain if empty"),
+						"name":                  stringProperty("Name of the application; the hostname if empty"),
+						"session_duration":      stringProperty("How long a login lasts, such as 24h"),
+						"allowed_email_domains": stringsProperty("Email domains of the users allowed in"),
+						"allowed_groups":        stringsProperty("Access groups allowed in"),
+						"service_tokens":        stringsProperty("Service tokens allowed in"),
+					},
+				},
+			})},
+		},
+	}
+}
+
+func tunnelSchemas() PlanSchemas {
+	return PlanSchemas{
+		ServiceInstance: ServiceInstanceSchemas{
+			Create: SchemaParameters{Parameters: parameters(authRequired("account_id", "routes"), withAuth(map[string]*jsonschema.Schema{
+				"account_id":  stringProperty("Account the tunnel is created in"),
+				"tunnel_name": stringProperty("Name of the tunnel; cf-<instance_id> if empty"),
+				"routes": {
+					Type:        jsonschema.TYPE_ARRAY,
+					Description: "Hostnames routed through the tunnel",
+					MinItems:    intPointer(1),
+					Items: &jsonschema.Schema{
+						Type:                 jsonschema.TYPE_OBJECT,
+						Required:             []string{"hostname", "zone_id"},
+						AdditionalProperties: boolPointer(false),
+						Properties: map[string]*jsonschema.Schema{
+							"hostname": stringProperty("Hostname routed to the tunnel"),
+							"zone_id":  stringProperty("Zone the DNS record of the hostname is created in"),
+							"service":  {Type: jsonschema.TYPE_STRING, Description: "Where cloudflared sends the requests", Default: TUNNEL_DEFAULT_SERVICE},
+						},
+					},
+				},
+			}))},
+			Update: SchemaParameters{Parameters: noParameters()},
+		},
+		ServiceBinding: ServiceBindingSchemas{
+			Create: SchemaParameters{Parameters: noParameters()},
+		},
+	}
+}
+
+func r2Schemas() PlanSchemas {
+	return PlanSchemas{
+		ServiceInstance: ServiceInstanceSchemas{
+			Create: SchemaParameters{Parameters: parameters(authRequired("account_id"), withAuth(map[string]*jsonschema.Schema{
+				"account_id":                   stringProperty("Account the bucket is created in"),
+				"bucket_name":                  {Type: jsonschema.TYPE_STRING, Description: "Name of the bucket; cf-<instance_id> if empty", Pattern: "^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$"},
+				"location_hint":                {Type: jsonschema.TYPE_STRING, Description: "Region the bucket is created in", Enum: []string{"apac", "eeur", "enam", "weur", "wnam", "oc"}},
+				"cors_rules":                   {Type: jsonschema.TYPE_ARRAY, Description: "CORS rules of the bucket, as the R2 API takes them", Items: &jsonschema.Schema{Type: jsonschema.TYPE_OBJECT}},
+				"lifecycle_rules":              {Type: jsonschema.TYPE_ARRAY, Description: "Lifecycle rules of the bucket, as the R2 API takes them", Items: &jsonschema.Schema{Type: jsonschema.TYPE_OBJECT}},
+				"empty_bucket_on_deprovision":  booleanProperty("Delete the objects of the bucket on deprovision so that it can be deleted"),
+				"retain_bucket_on_deprovision": booleanProperty("Keep the bucket on deprovision"),
+			}))},
+			Update: SchemaParameters{Parameters: noParameters()},
+		},
+		ServiceBinding: ServiceBindingSchemas{
+			Create: SchemaParameters{Parameters: noParameters()},
+		},
+	}
+}
+
+// Schemas returns the schemas of a plan, or false for a plan not in the
+// catalog, whose parameters are not validated.
+func Schemas(planID string) (PlanSchemas, bool) {
+	switch planID {
+	case FREE_PLAN_ID:
+		return zoneSchemas(), true
+	case TUNNEL_PLAN_ID:
+		return tunnelSchemas(), true
+	case R2_STANDARD_PLAN_ID:
+		return r2Schemas(), true
+	}
+
+	return PlanSchemas{}, false
+}
+
+// validateParameters validates the JSON parameters of a request against
+// schema, and returns all their problems at once.
+func validateParameters(schema *jsonschema.Schema, data []byte) error {
+	errors := schema.ValidateJSON(data)
+	if len(errors) == 0 {
+		return nil
+	}
+
+	problems := make([]string, len(errors))
+	for i, err := range errors {
+		if err.Path == "" {
+			err.Path = "parameters"
+		}
+		problems[i] = err.Error()
+	}
+
+	return ParameterError{Problems: problems}
+}
+
+// validateParameterMap validates parameters decoded by brokerapi.
+func validateParameterMap(schema *jsonschema.Schema, parameters map[string]interface{}) error {
+	if parameters == nil {
+		parameters = map[string]interface{}{}
+	}
+	data, err := json.Marshal(parameters)
+	if err != nil {
+		return err
+	}
+
+	return validateParameters(schema, data)
+}
+
+// extendCatalog adds to a decoded catalog what brokerapi does not know
+// about: the schemas of every plan, and that instances and bindings can be
+// fetched from NewFetchHandler.
+func extendCatalog(catalog map[string][]map[string]interface{}) {
+	for _, service := range catalog["services"] {
+		service["instances_retrievable"] = true
+		service["bindings_retrievable"] = true
+		plans, _ := service["plans"].([]interface{})
+		for _, plan := range plans {
+			plan, ok := plan.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			id, _ := plan["id"].(string)
+			if schemas, ok := Schemas(id); ok {
+				plan["schemas"] = schemas
+			}
+		}
+	}
+}
+
+// Catalog returns the catalog of services as the broker serves it.
+func Catalog(services []brokerapi.Service) (interface{}, error) {
+	data, err := json.Marshal(brokerapi.CatalogResponse{Services: services})
+	if err != nil {
+		return nil, err
+	}
+
+	var catalog map[string][]map[string]interface{}
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, err
+	}
+	extendCatalog(catalog)
+
+	return catalog, nil
+}
+
+// NewCatalogHandler extends the catalog served by next with extendCatalog.
+func NewCatalogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" || req.URL.Path != "/v2/catalog" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		recorder := &responseRecorder{header: w.Header(), status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+
+		var catalog map[string][]map[string]interface{}
+		if recorder.status != http.StatusOK || json.Unmarshal(recorder.body.Bytes(), &catalog) != nil {
+			w.WriteHeader(recorder.status)
+			w.Write(recorder.body.Bytes())
+			return
+		}
+		extendCatalog(catalog)
+
+		respond(w, http.StatusOK, catalog)
+	})
+}
@@ -0,0 +1,113 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestCatalogPublishesSchemas(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	credentials := brokerapi.BrokerCredentials{Username: "username", Password: "password"}
+	handler := broker.NewCatalogHandler(brokerapi.New(&cloudflarebroker, logger, credentials))
+
+	req := httptest.NewRequest("GET", "/v2/catalog", nil)
+	req.SetBasicAuth("username", "password")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	var catalog struct {
+		Services []struct {
+			InstancesRetrievable bool `json:"instances_retrievable"`
+			BindingsRetrievable  bool `json:"bindings_retrievable"`
+			Plans                []struct {
+				ID      string             `json:"id"`
+				Schemas broker.PlanSchemas `json:"schemas"`
+			} `json:"plans"`
+		} `json:"services"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &catalog); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("Catalog returned %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	plans := 0
+	for _, service := range catalog.Services {
+		if !service.InstancesRetrievable || !service.BindingsRetrievable {
+			t.Errorf("Catalog does not advertise fetching instances and bindings")
+		}
+		for _, plan := range service.Plans {
+			plans++
+			if plan.Schemas.ServiceInstance.Create.Parameters == nil || plan.Schemas.ServiceInstance.Update.Parameters == nil || plan.Schemas.ServiceBinding.Create.Parameters == nil {
+				t.Errorf("Plan %s has no schemas", plan.ID)
+			}
+		}
+	}
+	if plans != 3 {
+		t.Errorf("Catalog has %d plans", plans)
+	}
+
+	req = httptest.NewRequest("GET", "/v2/catalog", nil)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Catalog without credentials returned %d", recorder.Code)
+	}
+}
+
+func TestProvisionValidatesParameters(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	_, err := cloudflarebroker.Provision(context, "1", brokerapi.ProvisionDetails{
+		PlanID:        broker.TUNNEL_PLAN_ID,
+		RawParameters: []byte(`{"x-auth-key": "mykey", "account_id": 42, "routes": [{"hostname": "app.domain.com"}], "tunel_name": "tunnel"}`),
+	}, false)
+	expected := broker.INVALID_PARAMETERS_PREFIX + "account_id must be a string; routes[0].zone_id is required; tunel_name is not a known parameter; x-auth-email is required"
+	if err == nil || err.Error() != expected || len(fakeAPI.Calls) != 0 {
+		t.Errorf("Provision with invalid parameters returned %v", err)
+	}
+
+	_, err = cloudflarebroker.Provision(context, "1", brokerapi.ProvisionDetails{PlanID: broker.TUNNEL_PLAN_ID, RawParameters: []byte(tunnelParameters)}, false)
+	if err != nil {
+		t.Errorf("Provision with valid parameters failed %v", err)
+	}
+}
+
+func TestBindAndUpdateValidateParameters(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	provisionIn(&cloudflarebroker, "1", "org", "space", broker.FREE_PLAN_ID)
+	credentials := brokerapi.BrokerCredentials{Username: "username", Password: "password"}
+	handler := broker.NewErrorStatusHandler(brokerapi.New(&cloudflarebroker, logger, credentials))
+
+	for _, request := range []struct{ method, path, body, problem string }{
+		{"PUT", "/v2/service_instances/1/service_bindings/2", `{"service_id": "s", "plan_id": "` + broker.FREE_PLAN_ID + `", "parameters": {"adopt": "yes", "access": {}}}`,
+			"access.account_id is required; adopt must be a boolean; domain is required"},
+		{"PATCH", "/v2/service_instances/1", `{"service_id": "s", "plan_id": "` + broker.FREE_PLAN_ID + `", "parameters": {"deletion_policy": "retain"}}`,
+			"deletion_policy is not a known parameter"},
+	} {
+		req := httptest.NewRequest(request.method, request.path, strings.NewReader(request.body))
+		req.SetBasicAuth("username", "password")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		var response brokerapi.ErrorResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		if recorder.Code != http.StatusUnprocessableEntity || response.Description != broker.INVALID_PARAMETERS_PREFIX+request.problem {
+			t.Errorf("%s %s returned %d %s", request.method, request.path, recorder.Code, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/envelope"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// STATE_SCHEMA_VERSION is the version of the State written by this broker.
+// Files of an older version are upgraded with MigrateState.
+const STATE_SCHEMA_VERSION = 1
+
+// State is everything the broker remembers, as saved to the state file.
+type State struct {
+	SchemaVersion      int                          `json:"schema_version"`
+	Instances          map[string]Instance          `json:"instances"`
+	Zones              map[string]Zone              `json:"zones"`
+	Bindings           map[string]BindingRecord     `json:"bindings"`
+	R2AccessKeys       map[string]R2AccessKey       `json:"r2_access_keys"`
+	AccessApplications map[string]AccessApplication `json:"access_applications"`
+	TunnelBindings     map[string]string            `json:"tunnel_bindings"`
+	PendingDeletions   map[string]PendingDeletion   `json:"pending_deletions"`
+	ZoneIntents        map[string]ZoneIntent        `json:"zone_intents"`
+	ResourceIntents    map[string]ResourceIntent    `json:"resource_intents,omitempty"`
+	Operations         map[string]Operation         `json:"operations"`
+	BindingOperations  map[string]Operation         `json:"binding_operations,omitempty"`
+	History            []Operation                  `json:"history"`
+	// Secrets holds the secrets of the records above, encrypted, if the
+	// state is kept in an EncryptedStateStore.
+	Secrets map[string]envelope.Envelope `json:"secrets,omitempty"`
+}
+
+// StateStore keeps the broker state across restarts.
+type StateStore interface {
+	Load() (State, error)
+	Save(state State) error
+	// Check reports whether the store can be read and written, without
+	// changing the state.
+	Check() error
+}
+
+// FileStateStore keeps the state in a JSON file. A missing file is an empty
+// state.
+type FileStateStore struct {
+	Path string
+}
+
+func (s FileStateStore) Load() (State, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return State{SchemaVersion: STATE_SCHEMA_VERSION}, nil
+	}
+	if err != nil {
+		return State{}, err
+	}
+
+	return DecodeState(data)
+}
+
+// Check reads the file, if there is one, and creates and removes a file next
+// to it, as Save does.
+func (s FileStateStore) Check() error {
+	if _, err := ioutil.ReadFile(s.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".check")
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	return os.Remove(file.Name())
+}
+
+// Save replaces the file atomically so that a crash leaves either the old or
+// the new state.
+func (s FileStateStore) Save(state State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), s.Path)
+}
+
+// DecodeState reads a state file of the current schema version.
+func DecodeState(data []byte) (State, error) {
+	version, err := stateSchemaVersion(data)
+	if err != nil {
+		return State{}, err
+	}
+	if version != STATE_SCHEMA_VERSION {
+		return State{}, errors.New("state has schema version " + strconv.Itoa(version) + ", not " + strconv.Itoa(STATE_SCHEMA_VERSION) + "; run migrate first")
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return State{}, err
+	}
+
+	return state, nil
+}
+
+// MigrateState upgrades a state file to STATE_SCHEMA_VERSION and returns it
+// with the version it had. Version 0 is the zone map kept by brokers that
+// had no state file, keyed by "instance:binding".
+func MigrateState(data []byte) ([]byte, int, error) {
+	version, err := stateSchemaVersion(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch version {
+	case STATE_SCHEMA_VERSION:
+		return data, version, nil
+
+	case 0:
+		var zones map[string]Zone
+		if err := json.Unmarshal(data, &zones); err != nil {
+			return nil, version, errors.New("state without schema version is not a zone map: " + err.Error())
+		}
+
+		migrated, err := json.MarshalIndent(State{SchemaVersion: STATE_SCHEMA_VERSION, Zones: zones}, "", "  ")
+		return migrated, version, err
+
+	default:
+		return nil, version, errors.New("state schema version " + strconv.Itoa(version) + " is newer than this broker supports")
+	}
+}
+
+func stateSchemaVersion(data []byte) (int, error) {
+	var header struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return 0, errors.New("state is not valid JSON: " + err.Error())
+	}
+
+	return header.SchemaVersion, nil
+}
+
+// ExportState returns a copy of the broker state.
+func (b *CloudflareBroker) ExportState() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state()
+}
+
+// ImportState replaces the broker state. Operations that were in progress
+// when the state was saved are marked as failed, since nothing runs them
+// anymore; they can be retried.
+func (b *CloudflareBroker) ImportState(state State) error {
+	if state.SchemaVersion != STATE_SCHEMA_VERSION {
+		return errors.New("state has schema version " + strconv.Itoa(state.SchemaVersion) + ", not " + strconv.Itoa(STATE_SCHEMA_VERSION))
+	}
+	if len(state.Secrets) > 0 {
+		return errors.New("state has encrypted secrets; configure its encryption keys")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.operationsMu.Lock()
+	defer b.operationsMu.Unlock()
+
+	b.Instances = state.Instances
+	b.Zones = state.Zones
+	b.Bindings = state.Bindings
+	b.R2AccessKeys = state.R2AccessKeys
+	b.AccessApplications = state.AccessApplications
+	b.TunnelBindings = state.TunnelBindings
+	b.PendingDeletions = state.PendingDeletions
+	b.ZoneIntents = state.ZoneIntents
+	b.ResourceIntents = state.ResourceIntents
+	b.Operations = state.Operations
+	b.BindingOperations = state.BindingOperations
+	b.History = state.History
+	b.initializeState()
+
+	for instanceID, operation := range b.Operations {
+		if operation.State == brokerapi.InProgress {
+			operation.State = brokerapi.Failed
+			operation.Description = operation.Type + " was interrupted by a broker restart"
+			b.Operations[instanceID] = operation
+		}
+	}
+	for zoneKey, operation := range b.BindingOperations {
+		if operation.State == brokerapi.InProgress {
+			operation.State = brokerapi.Failed
+			operation.Description = operation.Type + " was interrupted by a broker restart"
+			b.BindingOperations[zoneKey] = operation
+		}
+	}
+
+	return nil
+}
+
+// LoadState imports the state kept in the store and saves every later change
+// to it.
+func (b *CloudflareBroker) LoadState(store StateStore) error {
+	state, err := store.Load()
+	if err != nil {
+		return err
+	}
+	if err := b.ImportState(state); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.Store = store
+	b.mu.Unlock()
+
+	return nil
+}
+
+func (b *CloudflareBroker) state() State {
+	state := State{
+		SchemaVersion:      STATE_SCHEMA_VERSION,
+		Instances:          map[string]Instance{},
+		Zones:              map[string]Zone{},
+		Bindings:           map[string]BindingRecord{},
+		R2AccessKeys:       map[string]R2AccessKey{},
+		AccessApplications: map[string]AccessApplication{},
+		TunnelBindings:     map[string]string{},
+		PendingDeletions:   map[string]PendingDeletion{},
+		ZoneIntents:        map[string]ZoneIntent{},
+		ResourceIntents:    map[string]ResourceIntent{},
+		Operations:         map[string]Operation{},
+		BindingOperations:  map[string]Operation{},
+		History:            append([]Operation{}, b.History...),
+	}
+
+	for key, value := range b.Instances {
+		state.Instances[key] = value
+	}
+	for key, value := range b.Zones {
+		state.Zones[key] = value
+	}
+	for key, value := range b.Bindings {
+		state.Bindings[key] = value
+	}
+	for key, value := range b.R2AccessKeys {
+		state.R2AccessKeys[key] = value
+	}
+	for key, value := range b.AccessApplications {
+		state.AccessApplications[key] = value
+	}
+	for key, value := range b.TunnelBindings {
+		state.TunnelBindings[key] = value
+	}
+	for key, value := range b.PendingDeletions {
+		state.PendingDeletions[key] = value
+	}
+	for key, value := range b.ZoneIntents {
+		state.ZoneIntents[key] = value
+	}
+	for key, value := range b.ResourceIntents {
+		state.ResourceIntents[key] = value
+	}
+	for key, value := range b.Operations {
+		state.Operations[key] = value
+	}
+	b.operationsMu.Lock()
+	for key, value := range b.BindingOperations {
+		state.BindingOperations[key] = value
+	}
+	b.operationsMu.Unlock()
+
+	return state
+}
+
+// initializeState replaces maps missing from an imported state with empty
+// ones.
+func (b *CloudflareBroker) initializeState() {
+	if b.Instances == nil {
+		b.Instances = map[string]Instance{}
+	}
+	if b.Zones == nil {
+		b.Zones = map[string]Zone{}
+	}
+	if b.Bindings == nil {
+		b.Bindings = map[string]BindingRecord{}
+	}
+	if b.R2AccessKeys == nil {
+		b.R2AccessKeys = map[string]R2AccessKey{}
+	}
+	if b.AccessApplications == nil {
+		b.AccessApplications = map[string]AccessApplication{}
+	}
+	if b.TunnelBindings == nil {
+		b.TunnelBindings = map[string]string{}
+	}
+	if b.PendingDeletions == nil {
+		b.PendingDeletions = map[string]PendingDeletion{}
+	}
+	if b.ZoneIntents == nil {
+		b.ZoneIntents = map[string]ZoneIntent{}
+	}
+	if b.ResourceIntents == nil {
+		b.ResourceIntents = map[string]ResourceIntent{}
+	}
+	if b.Operations == nil {
+		b.Operations = map[string]Operation{}
+	}
+	if b.BindingOperations == nil {
+		b.BindingOperations = map[string]Operation{}
+	}
+}
+
+// saveState writes the state to the store, if there is one. Callers hold
+// b.mu. A failed save is logged; the change stays in memory.
+func (b *CloudflareBroker) saveState() {
+	if b.Store == nil {
+		return
+	}
+
+	if err := b.Store.Save(b.state()); err != nil {
+		b.logger.Error("Error saving state", err, lager.Data{"instances": len(b.Instances)})
+	}
+}
@@ -0,0 +1,112 @@
+package broker_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestStateSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudflare-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := broker.FileStateStore{Path: filepath.Join(dir, "state.json")}
+
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	if err := cloudflarebroker.LoadState(store); err != nil {
+		t.Fatalf("LoadState of a missing file failed %v", err)
+	}
+	var context context.Context
+
+	provisionR2(t, &cloudflarebroker, "1", r2Parameters)
+	if _, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{}); err != nil {
+		t.Fatalf("Bind r2 failed %v", err)
+	}
+
+	restarted := broker.New(logger, map[string]broker.Zone{})
+	restarted.CloudflareAPI = &FakeCloudflareAPI{}
+	if err := restarted.LoadState(store); err != nil {
+		t.Fatalf("LoadState failed %v", err)
+	}
+
+	if _, ok := restarted.Instances["1"]; !ok || len(restarted.R2AccessKeys) != 1 || len(restarted.History) != 2 {
+		t.Errorf("LoadState lost state %+v", restarted.ExportState())
+	}
+	if err := restarted.Unbind(context, "1", "2", brokerapi.UnbindDetails{}); err != nil {
+		t.Errorf("Unbind after a restart failed %v", err)
+	}
+}
+
+func TestFileStateStoreCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudflare-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := (broker.FileStateStore{Path: filepath.Join(dir, "state.json")}).Check(); err != nil {
+		t.Errorf("Check failed %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Check left %d files behind", len(files))
+	}
+	if err := (broker.FileStateStore{Path: filepath.Join(dir, "missing", "state.json")}).Check(); err == nil {
+		t.Errorf("Check accepted a missing directory")
+	}
+}
+
+func TestImportStateFailsInterruptedOperations(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+
+	err := cloudflarebroker.ImportState(broker.State{
+		SchemaVersion: broker.STATE_SCHEMA_VERSION,
+		Operations: map[string]broker.Operation{
+			"1": {Type: broker.OPERATION_DEPROVISION, State: brokerapi.InProgress},
+		},
+	})
+	if err != nil {
+		t.Fatalf("ImportState failed %v", err)
+	}
+
+	if operation := cloudflarebroker.Operations["1"]; operation.State != brokerapi.Failed {
+		t.Errorf("ImportState kept an interrupted operation in progress %+v", operation)
+	}
+	if cloudflarebroker.Zones == nil || cloudflarebroker.Instances == nil {
+		t.Errorf("ImportState left maps uninitialized")
+	}
+
+	if err := cloudflarebroker.ImportState(broker.State{}); err == nil {
+		t.Errorf("ImportState accepted a state without schema version")
+	}
+}
+
+func TestMigrateState(t *testing.T) {
+	data, version, err := broker.MigrateState([]byte(`{"1:2": {"id": "zone", "name": "domain.com"}}`))
+	if err != nil || version != 0 {
+		t.Fatalf("MigrateState returned %d %v", version, err)
+	}
+
+	state, err := broker.DecodeState(data)
+	if err != nil || state.Zones["1:2"].ID != "zone" {
+		t.Errorf("MigrateState returned %s %v", data, err)
+	}
+
+	if _, _, err := broker.MigrateState([]byte(`{"schema_version": 99}`)); err == nil {
+		t.Errorf("MigrateState accepted a newer schema version")
+	}
+	if _, err := broker.DecodeState([]byte(`{"1:2": {"id": "zone"}}`)); err == nil {
+		t.Errorf("DecodeState accepted a state that needs migrating")
+	}
+}
@@ -0,0 +1,272 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/api"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// Zone statuses reported by the Cloudflare client API
+const ZONE_STATUS_INITIALIZING = "initializing"
+const ZONE_STATUS_PENDING = "pending"
+const ZONE_STATUS_ACTIVE = "active"
+const ZONE_STATUS_MOVED = "moved"
+
+// ACTIVATION_CHECK_INTERVAL limits how often the broker asks Cloudflare to
+// re-check the nameservers of a pending zone.
+const ACTIVATION_CHECK_INTERVAL = time.Hour
+
+// ZONE_REFRESH_INTERVAL is how often the broker polls Cloudflare for the
+// zones that are not active yet.
+const ZONE_REFRESH_INTERVAL = 10 * time.Minute
+
+// NameServerResolver looks up the NS records of a domain. *net.Resolver
+// satisfies it.
+type NameServerResolver interface {
+	LookupNS(ctx context.Context, name string) ([]*net.NS, error)
+}
+
+// NewNameServerResolver returns a resolver that sends its queries to address
+// (host:port) instead of the system resolver.
+func NewNameServerResolver(address string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+type InstanceStatus struct {
+	InstanceID  string                       `json:"instance_id"`
+	State       brokerapi.LastOperationState `json:"state"`
+	Description string                       `json:"description"`
+	Zones       []ZoneStatus                 `json:"zones"`
+}
+
+type ZoneStatus struct {
+	BindingID           string   `json:"binding_id"`
+	ZoneID              string   `json:"zone_id"`
+	Name                string   `json:"name"`
+	Status              string   `json:"status"`
+	NameServers         []string `json:"name_servers"`
+	ResolvedNameServers []string `json:"resolved_name_servers,omitempty"`
+	Problems            []string `json:"problems,omitempty"`
+}
+
+// InstanceStatus refreshes the zones bound to an instance from Cloudflare and
+// reports whether they are active. Pending zones get an activation check, and
+// if a Resolver is configured their published NS records are compared with
+// the nameservers Cloudflare assigned.
+func (b *CloudflareBroker) InstanceStatus(ctx context.Context, instanceID string) (InstanceStatus, error) {
+	status := InstanceStatus{InstanceID: instanceID, Zones: []ZoneStatus{}}
+
+	b.mu.Lock()
+	instance, known := b.Instances[instanceID]
+	zones := map[string]Zone{}
+	var zoneKeys []string
+	for zoneKey, zone := range b.Zones {
+		if strings.HasPrefix(zoneKey, instanceID+":") {
+			zones[zoneKey] = zone
+			zoneKeys = append(zoneKeys, zoneKey)
+		}
+	}
+	b.mu.Unlock()
+	sort.Strings(zoneKeys)
+
+	if !known && len(zoneKeys) == 0 {
+		return status, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	client := b.CloudflareAPI.With(ctx, instance.Auth)
+	for _, zoneKey := range zoneKeys {
+		zone := b.refreshZone(client, zoneKey, zones[zoneKey])
+		status.Zones = append(status.Zones, b.zoneStatus(ctx, zoneKey, zone))
+	}
+
+	status.State, status.Description = summarizeZones(status.Zones)
+
+	return status, nil
+}
+
+// refreshZone fetches the zone stored under zoneKey from Cloudflare and
+// saves it in b.Zones, unless it was unbound meanwhile. The stored zone is
+// returned unchanged if that fails.
+func (b *CloudflareBroker) refreshZone(client api.CloudflareAPIInterface, zoneKey string, zone Zone) Zone {
+	b.mu.Lock()
+	checkActivation := zone.Status == ZONE_STATUS_PENDING && time.Since(b.activationChecks[zone.ID]) > ACTIVATION_CHECK_INTERVAL
+	if checkActivation {
+		b.activationChecks[zone.ID] = time.Now()
+	}
+	b.mu.Unlock()
+
+	if checkActivation {
+		data, err := client.ZoneActivationCheck(zone.ID)
+		if err == nil {
+			_, err = decodeCloudflareResponse(data, nil)
+		}
+		if err != nil {
+			b.logger.Error("Error triggering zone activation check", err, lager.Data{"zone": zone.Name})
+		}
+	}
+
+	data, err := client.GetZone(zone.ID)
+	if err != nil {
+		b.logger.Error("Error fetching zone", err, lager.Data{"zone": zone.Name})
+		return zone
+	}
+
+	var refreshed Zone
+	if _, err := decodeCloudflareResponse(data, &refreshed); err != nil {
+		b.logger.Error("Error fetching zone", err, lager.Data{"zone": zone.Name})
+		return zone
+	}
+
+	refreshed.Adopted = zone.Adopted
+	b.update(func() {
+		if stored, ok := b.Zones[zoneKey]; ok && stored.ID == zone.ID {
+			b.Zones[zoneKey] = refreshed
+		}
+	})
+
+	return refreshed
+}
+
+// RefreshPendingZones refreshes every bound zone that is not active yet from
+// Cloudflare, like InstanceStatus does for the zones of one instance, so that
+// activation is noticed without anyone asking for the status.
+func (b *CloudflareBroker) RefreshPendingZones(ctx context.Context) {
+	b.mu.Lock()
+	zones := map[string]Zone{}
+	auth := map[string]api.AuthHeaders{}
+	for zoneKey, zone := range b.Zones {
+		switch zone.Status {
+		case ZONE_STATUS_PENDING, ZONE_STATUS_INITIALIZING, "":
+			zones[zoneKey] = zone
+			auth[zoneKey] = b.Instances[strings.SplitN(zoneKey, ":", 2)[0]].Auth
+		}
+	}
+	b.mu.Unlock()
+
+	for zoneKey, zone := range zones {
+		b.refreshZone(b.CloudflareAPI.With(ctx, auth[zoneKey]), zoneKey, zone)
+	}
+}
+
+// RunZoneRefreshJob calls RefreshPendingZones every interval until stop is
+// closed.
+func (b *CloudflareBroker) RunZoneRefreshJob(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.RefreshPendingZones(context.Background())
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (b *CloudflareBroker) zoneStatus(ctx context.Context, zoneKey string, zone Zone) ZoneStatus {
+	status := ZoneStatus{
+		BindingID:   zoneKey[strings.Index(zoneKey, ":")+1:],
+		ZoneID:      zone.ID,
+		Name:        zone.Name,
+		Status:      zone.Status,
+		NameServers: zone.NameServers,
+	}
+
+	if b.Resolver == nil || zone.Status == ZONE_STATUS_ACTIVE {
+		return status
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	records, err := b.Resolver.LookupNS(ctx, zone.Name)
+	if err != nil {
+		status.Problems = append(status.Problems, "could not resolve NS records: "+err.Error())
+		return status
+	}
+
+	expected := map[string]bool{}
+	for _, nameServer := range zone.NameServers {
+		expected[normalizeNameServer(nameServer)] = true
+	}
+
+	found := map[string]bool{}
+	for _, record := range records {
+		nameServer := normalizeNameServer(record.Host)
+		found[nameServer] = true
+		status.ResolvedNameServers = append(status.ResolvedNameServers, nameServer)
+		if !expected[nameServer] {
+			status.Problems = append(status.Problems, "nameserver "+nameServer+" is not assigned by Cloudflare")
+		}
+	}
+	for _, nameServer := range zone.NameServers {
+		if !found[normalizeNameServer(nameServer)] {
+			status.Problems = append(status.Problems, "nameserver "+nameServer+" is missing at the registrar")
+		}
+	}
+
+	return status
+}
+
+func normalizeNameServer(nameServer string) string {
+	return strings.TrimSuffix(strings.ToLower(nameServer), ".")
+}
+
+// summarizeZones reduces zone statuses to a single operation state: failed if
+// any zone moved away from Cloudflare, in progress while any zone waits for
+// activation and succeeded once all are active.
+func summarizeZones(zones []ZoneStatus) (brokerapi.LastOperationState, string) {
+	var pending []string
+	for _, zone := range zones {
+		switch zone.Status {
+		case ZONE_STATUS_ACTIVE:
+		case ZONE_STATUS_PENDING, ZONE_STATUS_INITIALIZING, "":
+			description := "zone " + zone.Name + " is pending: set its nameservers to " + strings.Join(zone.NameServers, ", ")
+			if len(zone.Problems) > 0 {
+				description += " (" + strings.Join(zone.Problems, "; ") + ")"
+			}
+			pending = append(pending, description)
+		default:
+			return brokerapi.Failed, "zone " + zone.Name + " is " + zone.Status
+		}
+	}
+
+	if len(pending) > 0 {
+		return brokerapi.InProgress, strings.Join(pending, "; ")
+	}
+
+	return brokerapi.Succeeded, "all zones are active"
+}
+
+// NewStatusHandler serves InstanceStatus as JSON at
+// /status/{instance_id}.
+func NewStatusHandler(b *CloudflareBroker) http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/status/{instance_id}", func(w http.ResponseWriter, req *http.Request) {
+		status, err := b.InstanceStatus(req.Context(), mux.Vars(req)["instance_id"])
+
+		if err == brokerapi.ErrInstanceDoesNotExist {
+			respond(w, http.StatusNotFound, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+
+		respond(w, http.StatusOK, status)
+	}).Methods("GET")
+
+	return router
+}
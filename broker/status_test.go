@@ -0,0 +1,142 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+type FakeResolver struct {
+	NameServers []string
+}
+
+func (resolver FakeResolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	var records []*net.NS
+	for _, nameServer := range resolver.NameServers {
+		records = append(records, &net.NS{Host: nameServer})
+	}
+
+	return records, nil
+}
+
+func newPendingZoneBroker(fakeAPI *FakeCloudflareAPI) broker.CloudflareBroker {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(
+		logger,
+		map[string]broker.Zone{
+			"1:2": broker.Zone{ID: "zone", Name: "domain.com", Status: broker.ZONE_STATUS_PENDING},
+		},
+	)
+	cloudflarebroker.CloudflareAPI = fakeAPI
+
+	return cloudflarebroker
+}
+
+func TestLastOperationPendingZone(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{ZoneStatus: broker.ZONE_STATUS_PENDING}
+	cloudflarebroker := newPendingZoneBroker(fakeAPI)
+	var context context.Context
+
+	operation, err := cloudflarebroker.LastOperation(context, "1", "")
+	if err != nil || operation.State != brokerapi.InProgress {
+		t.Errorf("LastOperation returned %+v %v", operation, err)
+	}
+
+	if !reflect.DeepEqual(fakeAPI.Calls, []string{"ZoneActivationCheck zone"}) {
+		t.Errorf("LastOperation made calls %v", fakeAPI.Calls)
+	}
+
+	// The activation check is not repeated on every poll
+	cloudflarebroker.LastOperation(context, "1", "")
+	if len(fakeAPI.Calls) != 1 {
+		t.Errorf("LastOperation repeated the activation check %v", fakeAPI.Calls)
+	}
+}
+
+func TestRefreshPendingZones(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{ZoneStatus: broker.ZONE_STATUS_ACTIVE}
+	cloudflarebroker := newPendingZoneBroker(fakeAPI)
+	cloudflarebroker.Zones["1:3"] = broker.Zone{ID: "active", Name: "active.com", Status: broker.ZONE_STATUS_ACTIVE}
+	dir, err := ioutil.TempDir("", "cloudflare-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := broker.FileStateStore{Path: filepath.Join(dir, "state.json")}
+	cloudflarebroker.Store = store
+
+	cloudflarebroker.RefreshPendingZones(context.Background())
+
+	if cloudflarebroker.Zones["1:2"].Status != broker.ZONE_STATUS_ACTIVE || !reflect.DeepEqual(fakeAPI.Calls, []string{"ZoneActivationCheck zone"}) {
+		t.Errorf("RefreshPendingZones left %+v and made calls %v", cloudflarebroker.Zones, fakeAPI.Calls)
+	}
+	if state, err := store.Load(); err != nil || state.Zones["1:2"].Status != broker.ZONE_STATUS_ACTIVE {
+		t.Errorf("RefreshPendingZones did not save the refreshed zone %+v %v", state.Zones, err)
+	}
+}
+
+func TestLastOperationActiveAndMovedZone(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{ZoneStatus: broker.ZONE_STATUS_ACTIVE}
+	cloudflarebroker := newPendingZoneBroker(fakeAPI)
+	var context context.Context
+
+	operation, err := cloudflarebroker.LastOperation(context, "1", "")
+	if err != nil || operation.State != brokerapi.Succeeded {
+		t.Errorf("LastOperation returned %+v %v", operation, err)
+	}
+
+	fakeAPI.ZoneStatus = broker.ZONE_STATUS_MOVED
+	operation, err = cloudflarebroker.LastOperation(context, "1", "")
+	if err != nil || operation.State != brokerapi.Failed {
+		t.Errorf("LastOperation returned %+v %v", operation, err)
+	}
+}
+
+func TestInstanceStatusResolvesNameServers(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{ZoneStatus: broker.ZONE_STATUS_PENDING}
+	cloudflarebroker := newPendingZoneBroker(fakeAPI)
+	cloudflarebroker.Resolver = FakeResolver{NameServers: []string{"NS1.cloudflare.com.", "ns.registrar.com."}}
+	var context context.Context
+
+	status, err := cloudflarebroker.InstanceStatus(context, "1")
+	expected := []string{
+		"nameserver ns.registrar.com is not assigned by Cloudflare",
+		"nameserver ns2.cloudflare.com is missing at the registrar",
+	}
+	if err != nil || len(status.Zones) != 1 || !reflect.DeepEqual(status.Zones[0].Problems, expected) {
+		t.Errorf("InstanceStatus returned %+v %v", status, err)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	fakeAPI := &FakeCloudflareAPI{ZoneStatus: broker.ZONE_STATUS_PENDING}
+	cloudflarebroker := newPendingZoneBroker(fakeAPI)
+	handler := broker.NewStatusHandler(&cloudflarebroker)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/status/1", nil))
+
+	var status broker.InstanceStatus
+	json.Unmarshal(recorder.Body.Bytes(), &status)
+	if recorder.Code != http.StatusOK || status.Zones[0].Status != broker.ZONE_STATUS_PENDING {
+		t.Errorf("StatusHandler returned %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/status/unknown", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("StatusHandler returned %d for an unknown instance", recorder.Code)
+	}
+}
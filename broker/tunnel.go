@@ -0,0 +1,410 @@
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/api"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/hostname"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const TUNNEL_PLAN_ID = "5c0d7e1a-93f4-4b6e-a2d8-1f6e9b3c4a75"
+
+// TUNNEL_CNAME_SUFFIX is appended to the tunnel ID to form the target of the
+// DNS records routing hostnames to a tunnel.
+const TUNNEL_CNAME_SUFFIX = ".cfargotunnel.com"
+
+// DNS_RECORD_NOT_FOUND_CODE is the Cloudflare API error code for a DNS
+// record that does not exist.
+const DNS_RECORD_NOT_FOUND_CODE = 81044
+
+// TUNNEL_DEFAULT_SERVICE is where cloudflared, running as a sidecar in the
+// app container, forwards requests unless a route names another service.
+const TUNNEL_DEFAULT_SERVICE = "http://localhost:8080"
+
+// TUNNEL_CATCH_ALL_SERVICE answers requests that match no route. The
+// Cloudflare API requires the last ingress rule to match everything.
+const TUNNEL_CATCH_ALL_SERVICE = "http_status:404"
+
+// TunnelParameters are the provision parameters of the tunnel plan.
+type TunnelParameters struct {
+	AccountID  string        `json:"account_id"`
+	TunnelName string        `json:"tunnel_name"`
+	Routes     []TunnelRoute `json:"routes"`
+}
+
+type TunnelRoute struct {
+	Hostname string `json:"hostname"`
+	ZoneID   string `json:"zone_id"`
+	Service  string `json:"service"`
+}
+
+type Tunnel struct {
+	AccountID  string           `json:"account_id"`
+	ID         string           `json:"id"`
+	Name       string           `json:"name"`
+	Routes     []TunnelRoute    `json:"routes"`
+	DNSRecords []TunnelDNSRoute `json:"dns_records"`
+}
+
+type TunnelDNSRoute struct {
+	ZoneID   string `json:"zone_id"`
+	RecordID string `json:"record_id"`
+	Hostname string `json:"hostname"`
+}
+
+// TunnelCredentials are returned on Bind. Token is passed to
+// `cloudflared tunnel run --token`.
+type TunnelCredentials struct {
+	TunnelID   string   `json:"tunnel_id"`
+	TunnelName string   `json:"tunnel_name"`
+	Token      string   `json:"token"`
+	Hostnames  []string `json:"hostnames"`
+}
+
+type TunnelConnection struct {
+	ID                 string `json:"id"`
+	ColoName           string `json:"colo_name"`
+	OriginIP           string `json:"origin_ip"`
+	OpenedAt           string `json:"opened_at"`
+	ClientVersion      string `json:"client_version"`
+	IsPendingReconnect bool   `json:"is_pending_reconnect"`
+}
+
+type tunnelClient struct {
+	ID    string             `json:"id"`
+	Conns []TunnelConnection `json:"conns"`
+}
+
+type dnsRecord struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func tunnelPlan() brokerapi.ServicePlan {
+	return brokerapi.ServicePlan{
+		ID:          TUNNEL_PLAN_ID,
+		Name:        "tunnel",
+		Description: "Expose apps through a Cloudflare Tunnel without a public route.",
+		Metadata: &brokerapi.ServicePlanMetadata{
+			DisplayName: "Tunnel",
+			Bullets: []string{
+				"Outbound-only connections from the app container",
+				"Ingress rules per hostname",
+				"DNS routes created for you",
+			},
+		},
+	}
+}
+
+func parseTunnelParameters(instanceID string, rawParameters json.RawMessage) (TunnelParameters, error) {
+	var parameters TunnelParameters
+	if err := json.Unmarshal(rawParameters, &parameters); err != nil {
+		return parameters, err
+	}
+
+	if parameters.AccountID == "" {
+		return parameters, errors.New("key 'account_id' not found in ProvisionDetails.RawParameters.")
+	}
+	if len(parameters.Routes) == 0 {
+		return parameters, errors.New("key 'routes' must contain at least one route.")
+	}
+	for i, route := range parameters.Routes {
+		if route.Hostname == "" || route.ZoneID == "" {
+			return parameters, errors.New("every route needs a 'hostname' and a 'zone_id'.")
+		}
+		// Routes are checked against the policies in their normalized form
+		routeHostname, err := hostname.Normalize(route.Hostname)
+		if err != nil {
+			return parameters, ParameterError{Problems: []string{"route hostname " + err.Error()}}
+		}
+		parameters.Routes[i].Hostname = routeHostname
+		if route.Service == "" {
+			parameters.Routes[i].Service = TUNNEL_DEFAULT_SERVICE
+		}
+	}
+	if parameters.TunnelName == "" {
+		parameters.TunnelName = "cf-" + strings.ToLower(instanceID)
+	}
+
+	return parameters, nil
+}
+
+// tunnelRouteHostnames returns the normalized hostnames of the routes in the
+// provision parameters of a tunnel. Those that cannot be normalized are left
+// out, as parseTunnelParameters refuses them.
+func tunnelRouteHostnames(rawParameters json.RawMessage) []string {
+	var parameters TunnelParameters
+	json.Unmarshal(rawParameters, &parameters)
+
+	var hostnames []string
+	for _, route := range parameters.Routes {
+		if routeHostname, err := hostname.Normalize(route.Hostname); err == nil {
+			hostnames = append(hostnames, routeHostname)
+		}
+	}
+
+	return hostnames
+}
+
+// checkRouteZones refuses routes whose hostname is not in the zone they
+// name, as the DNS record would be created for another name in that zone.
+func (b *CloudflareBroker) checkRouteZones(client api.CloudflareAPIInterface, routes []TunnelRoute) error {
+	for _, route := range routes {
+		data, err := client.GetZone(route.ZoneID)
+		if err != nil {
+			b.logger.Error("Provision calling api.cloudflare", err)
+			return err
+		}
+		var zone Zone
+		if _, err := decodeCloudflareResponse(data, &zone); err != nil {
+			b.logger.Error("Error from CloudFlare Client API", err)
+			return err
+		}
+		if route.Hostname != zone.Name && !strings.HasSuffix(route.Hostname, "."+zone.Name) {
+			return ParameterError{Problems: []string{"route hostname " + route.Hostname + " is not in zone " + route.ZoneID + " (" + zone.Name + ")"}}
+		}
+	}
+
+	return nil
+}
+
+func newTunnelSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+func tunnelConfiguration(routes []TunnelRoute) api.TunnelConfiguration {
+	var configuration api.TunnelConfiguration
+	for _, route := range routes {
+		configuration.Ingress = append(configuration.Ingress, api.TunnelIngressRule{
+			Hostname: route.Hostname,
+			Service:  route.Service,
+		})
+	}
+	configuration.Ingress = append(configuration.Ingress, api.TunnelIngressRule{Service: TUNNEL_CATCH_ALL_SERVICE})
+
+	return configuration
+}
+
+// provisionTunnel creates the tunnel, pushes its ingress configuration and
+// routes every hostname to it. Anything created is removed again if a later
+// step fails. Until the instance is stored, the intent recorded before the
+// tunnel is created tells the reconciler that the broker owns it.
+func (b *CloudflareBroker) provisionTunnel(client api.CloudflareAPIInterface, instanceID string, auth api.AuthHeaders, rawParameters json.RawMessage) (Tunnel, error) {
+	parameters, err := parseTunnelParameters(instanceID, rawParameters)
+	if err != nil {
+		b.logger.Error("Error decoding details.RawParameters", err)
+		return Tunnel{}, err
+	}
+
+	if err := b.checkRouteZones(client, parameters.Routes); err != nil {
+		return Tunnel{}, err
+	}
+
+	secret, err := newTunnelSecret()
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	b.update(func() {
+		b.ResourceIntents[instanceID] = ResourceIntent{
+			Resource:  "tunnel",
+			AccountID: parameters.AccountID,
+			Name:      parameters.TunnelName,
+			Auth:      auth,
+			StartedAt: time.Now(),
+		}
+	})
+
+	data, err := client.CreateTunnel(parameters.AccountID, api.TunnelRequest{
+		Name:         parameters.TunnelName,
+		ConfigSrc:    "cloudflare",
+		TunnelSecret: secret,
+	})
+	if err != nil {
+		b.logger.Error("Provision calling api.cloudflare", err)
+		return Tunnel{}, err
+	}
+
+	tunnel := Tunnel{AccountID: parameters.AccountID, Routes: parameters.Routes}
+	if _, err := decodeCloudflareResponse(data, &tunnel); err != nil {
+		b.logger.Error("Error from CloudFlare Client API", err)
+		b.forgetResourceIntent(instanceID, err)
+		return Tunnel{}, err
+	}
+
+	data, err = client.PutTunnelConfiguration(tunnel.AccountID, tunnel.ID, tunnelConfiguration(tunnel.Routes))
+	if err == nil {
+		_, err = decodeCloudflareResponse(data, nil)
+	}
+	if err != nil {
+		b.logger.Error("Error pushing tunnel configuration", err, lager.Data{"tunnel": tunnel.ID})
+		b.discardTunnel(client, instanceID, &tunnel)
+		return Tunnel{}, err
+	}
+
+	for _, route := range tunnel.Routes {
+		data, err := client.CreateDNSRecord(route.ZoneID, api.DNSRecordRequest{
+			Type:    "CNAME",
+			Name:    route.Hostname,
+			Content: tunnel.ID + TUNNEL_CNAME_SUFFIX,
+			Proxied: true,
+		})
+
+		var record dnsRecord
+		if err == nil {
+			_, err = decodeCloudflareResponse(data, &record)
+		}
+		if err != nil {
+			b.logger.Error("Error routing hostname to tunnel", err, lager.Data{"tunnel": tunnel.ID, "hostname": route.Hostname})
+			b.discardTunnel(client, instanceID, &tunnel)
+			return Tunnel{}, err
+		}
+
+		tunnel.DNSRecords = append(tunnel.DNSRecords, TunnelDNSRoute{
+			ZoneID:   route.ZoneID,
+			RecordID: record.ID,
+			Hostname: route.Hostname,
+		})
+	}
+
+	return tunnel, nil
+}
+
+// discardTunnel deletes a tunnel whose provision failed after it was created.
+// If it cannot be deleted, the intent is kept for the reconciler to delete it.
+func (b *CloudflareBroker) discardTunnel(client api.CloudflareAPIInterface, instanceID string, tunnel *Tunnel) {
+	if err := b.deleteTunnel(client, tunnel); err != nil {
+		b.logger.Error("Error deleting tunnel of failed provision", err, lager.Data{"tunnel": tunnel.ID})
+		return
+	}
+	b.update(func() { delete(b.ResourceIntents, instanceID) })
+}
+
+func (b *CloudflareBroker) bindTunnel(client api.CloudflareAPIInterface, instanceID string, bindingID string, tunnel Tunnel) (brokerapi.Binding, error) {
+	data, err := client.GetTunnelToken(tunnel.AccountID, tunnel.ID)
+	if err != nil {
+		b.logger.Error("Bind calling api.cloudflare", err)
+		return brokerapi.Binding{}, err
+	}
+
+	var token string
+	if _, err := decodeCloudflareResponse(data, &token); err != nil {
+		b.logger.Error("Error from CloudFlare Client API", err)
+		return brokerapi.Binding{}, err
+	}
+
+	credentials := TunnelCredentials{
+		TunnelID:   tunnel.ID,
+		TunnelName: tunnel.Name,
+		Token:      token,
+	}
+	for _, route := range tunnel.Routes {
+		credentials.Hostnames = append(credentials.Hostnames, route.Hostname)
+	}
+
+	b.update(func() { b.TunnelBindings[getZoneKey(instanceID, bindingID)] = tunnel.ID })
+
+	return brokerapi.Binding{
+		Credentials: credentials,
+	}, nil
+}
+
+// TunnelConnections lists the cloudflared connections of the tunnel owned by
+// an instance.
+func (b *CloudflareBroker) TunnelConnections(instanceID string) ([]TunnelConnection, error) {
+	b.mu.Lock()
+	instance, ok := b.Instances[instanceID]
+	b.mu.Unlock()
+	if !ok || instance.Tunnel == nil {
+		return nil, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	return b.tunnelConnections(b.CloudflareAPI.With(context.Background(), instance.Auth), *instance.Tunnel)
+}
+
+func (b *CloudflareBroker) tunnelConnections(client api.CloudflareAPIInterface, tunnel Tunnel) ([]TunnelConnection, error) {
+	data, err := client.ListTunnelConnections(tunnel.AccountID, tunnel.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []tunnelClient
+	if _, err := decodeCloudflareResponse(data, &clients); err != nil {
+		return nil, err
+	}
+
+	var connections []TunnelConnection
+	for _, connector := range clients {
+		connections = append(connections, connector.Conns...)
+	}
+
+	return connections, nil
+}
+
+// deprovisionTunnel removes the DNS routes, the tunnel's connections and the
+// tunnel itself.
+func (b *CloudflareBroker) deprovisionTunnel(client api.CloudflareAPIInterface, tunnel *Tunnel) error {
+	connections, err := b.tunnelConnections(client, *tunnel)
+	if err != nil {
+		b.logger.Error("Error listing tunnel connections", err, lager.Data{"tunnel": tunnel.ID})
+	} else if len(connections) > 0 {
+		b.logger.Info("Deleting tunnel with active connections", lager.Data{"tunnel": tunnel.ID, "connections": len(connections)})
+	}
+
+	if err := b.deleteTunnel(client, tunnel); err != nil {
+		b.logger.Error("Error deleting tunnel", err, lager.Data{"tunnel": tunnel.ID})
+		return err
+	}
+
+	return nil
+}
+
+// deleteTunnel removes the DNS routes and the tunnel. Each route is dropped
+// from tunnel.DNSRecords once it is gone, so that a retry after a failure only
+// deletes what is left; a route that no longer exists counts as deleted.
+func (b *CloudflareBroker) deleteTunnel(client api.CloudflareAPIInterface, tunnel *Tunnel) error {
+	for len(tunnel.DNSRecords) > 0 {
+		route := tunnel.DNSRecords[0]
+		data, err := client.DeleteDNSRecord(route.ZoneID, route.RecordID)
+		if err == nil {
+			var response CloudflareResponse
+			response, err = decodeCloudflareResponse(data, nil)
+			if response.hasErrorCode(DNS_RECORD_NOT_FOUND_CODE) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		tunnel.DNSRecords = tunnel.DNSRecords[1:]
+	}
+
+	data, err := client.CleanupTunnelConnections(tunnel.AccountID, tunnel.ID)
+	if err == nil {
+		_, err = decodeCloudflareResponse(data, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err = client.DeleteTunnel(tunnel.AccountID, tunnel.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = decodeCloudflareResponse(data, nil)
+	return err
+}
@@ -0,0 +1,170 @@
+package broker_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const tunnelParameters = `{
+	"x-auth-key":   "mykey",
+	"x-auth-email": "email@email.com",
+	"account_id":   "account",
+	"routes":       [{"hostname": "app.domain.com", "zone_id": "zone"}]
+}`
+
+func provisionTunnel(t *testing.T, cloudflarebroker *broker.CloudflareBroker, instanceId string) {
+	var context context.Context
+
+	_, err := cloudflarebroker.Provision(
+		context,
+		instanceId,
+		brokerapi.ProvisionDetails{
+			PlanID:        broker.TUNNEL_PLAN_ID,
+			RawParameters: []byte(tunnelParameters),
+		},
+		false,
+	)
+	if err != nil {
+		t.Fatalf("Provision tunnel failed %v", err)
+	}
+}
+
+func TestProvisionTunnelWithoutRoutes(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	var context context.Context
+
+	_, err := cloudflarebroker.Provision(
+		context,
+		"1",
+		brokerapi.ProvisionDetails{
+			PlanID:        broker.TUNNEL_PLAN_ID,
+			RawParameters: []byte(`{"x-auth-key": "mykey", "x-auth-email": "email@email.com", "account_id": "account"}`),
+		},
+		false,
+	)
+	if err == nil {
+		t.Errorf("Provision tunnel succeeded without routes")
+	}
+}
+
+func TestProvisionTunnel(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+
+	provisionTunnel(t, &cloudflarebroker, "1")
+
+	expected := []string{
+		"CreateTunnel cf-1",
+		"PutTunnelConfiguration tunnel-id",
+		"CreateDNSRecord app.domain.com tunnel-id.cfargotunnel.com",
+	}
+	if !reflect.DeepEqual(fakeAPI.Calls, expected) {
+		t.Errorf("Provision tunnel made calls %v", fakeAPI.Calls)
+	}
+
+	tunnel := cloudflarebroker.Instances["1"].Tunnel
+	if tunnel == nil || tunnel.Routes[0].Service != broker.TUNNEL_DEFAULT_SERVICE {
+		t.Errorf("Provision tunnel stored tunnel %+v", tunnel)
+	}
+}
+
+func TestBindTunnel(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	cloudflarebroker.CloudflareAPI = &FakeCloudflareAPI{}
+	var context context.Context
+
+	provisionTunnel(t, &cloudflarebroker, "1")
+
+	binding, err := cloudflarebroker.Bind(context, "1", "2", brokerapi.BindDetails{})
+	expected := broker.TunnelCredentials{
+		TunnelID:   "tunnel-id",
+		TunnelName: "cf-1",
+		Token:      "tunnel-token",
+		Hostnames:  []string{"app.domain.com"},
+	}
+	if err != nil || !reflect.DeepEqual(binding.Credentials, expected) {
+		t.Errorf("Bind tunnel returned %+v %v", binding.Credentials, err)
+	}
+
+	connections, err := cloudflarebroker.TunnelConnections("1")
+	if err != nil || len(connections) != 1 || connections[0].ColoName != "AMS" {
+		t.Errorf("TunnelConnections returned %+v %v", connections, err)
+	}
+
+	err = cloudflarebroker.Unbind(context, "1", "2", brokerapi.UnbindDetails{})
+	if err != nil || len(cloudflarebroker.TunnelBindings) != 0 {
+		t.Errorf("Unbind tunnel failed %v", err)
+	}
+}
+
+func TestDeprovisionTunnel(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	provisionTunnel(t, &cloudflarebroker, "1")
+	fakeAPI.Calls = nil
+
+	_, err := cloudflarebroker.Deprovision(context, "1", brokerapi.DeprovisionDetails{}, false)
+	expected := []string{
+		"DeleteDNSRecord record-app.domain.com",
+		"CleanupTunnelConnections tunnel-id",
+		"DeleteTunnel tunnel-id",
+	}
+	if err != nil || !reflect.DeepEqual(fakeAPI.Calls, expected) {
+		t.Errorf("Deprovision tunnel failed %v %v", err, fakeAPI.Calls)
+	}
+}
+
+func TestDeprovisionTunnelRetriesDNSRecords(t *testing.T) {
+	logger := lager.NewLogger("cloudflare-broker")
+	cloudflarebroker := broker.New(logger, map[string]broker.Zone{})
+	fakeAPI := &FakeCloudflareAPI{Fail: "DeleteDNSRecord record-api.domain.com"}
+	cloudflarebroker.CloudflareAPI = fakeAPI
+	var context context.Context
+
+	_, err := cloudflarebroker.Provision(context, "1", brokerapi.ProvisionDetails{
+		PlanID:        broker.TUNNEL_PLAN_ID,
+		RawParameters: []byte(`{"x-auth-key": "mykey", "x-auth-email": "email@email.com", "account_id": "account", "routes": [{"hostname": "app.domain.com", "zone_id": "zone"}, {"hostname": "api.domain.com", "zone_id": "zone"}]}`),
+	}, false)
+	if err != nil {
+		t.Fatalf("Provision tunnel failed %v", err)
+	}
+
+	// The record deleted before the failure is forgotten
+	if _, err := cloudflarebroker.Deprovision(context, "1", brokerapi.DeprovisionDetails{}, false); err == nil {
+		t.Fatalf("Deprovision tunnel succeeded although a DNS record could not be deleted")
+	}
+	tunnel := cloudflarebroker.Instances["1"].Tunnel
+	if tunnel == nil || len(tunnel.DNSRecords) != 1 || tunnel.DNSRecords[0].RecordID != "record-api.domain.com" {
+		t.Fatalf("Failed deprovision left tunnel %+v", tunnel)
+	}
+
+	// A record that is already gone counts as deleted
+	tunnel.DNSRecords = append([]broker.TunnelDNSRoute{{ZoneID: "zone", RecordID: "record-app.domain.com"}}, tunnel.DNSRecords...)
+	fakeAPI.Fail = ""
+	fakeAPI.Calls = nil
+	_, err = cloudflarebroker.Deprovision(context, "1", brokerapi.DeprovisionDetails{}, false)
+	expected := []string{
+		"DeleteDNSRecord record-app.domain.com",
+		"DeleteDNSRecord record-api.domain.com",
+		"CleanupTunnelConnections tunnel-id",
+		"DeleteTunnel tunnel-id",
+	}
+	if _, ok := cloudflarebroker.Instances["1"]; err != nil || ok || !reflect.DeepEqual(fakeAPI.Calls, expected) {
+		t.Errorf("Retried deprovision of tunnel failed %v %v", err, fakeAPI.Calls)
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/api"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/audit"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/config"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/credhub"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/health"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/metrics"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/server"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/tracing"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
+)
+
+// READINESS_TIMEOUT limits each readiness check, so that /readyz answers
+// within the timeout of platform health checks.
+const READINESS_TIMEOUT = 2 * time.Second
+
+// READINESS_CREDENTIALS_CACHE is how long a check of the operator's
+// Cloudflare credentials is reused, to stay clear of API rate limits.
+const READINESS_CREDENTIALS_CACHE = time.Minute
+
+type command struct {
+	name        string
+	description string
+	run         func(logger lager.Logger, args []string) error
+}
+
+var commands = []command{
+	{"serve", "run the service broker (the default)", serve},
+	{"catalog", "print the service catalog", printCatalog},
+	{"config", "print the configuration without secrets, or its schema with -schema", printConfig},
+	{"check-credentials", "check Cloudflare credentials, given or from the state", checkCredentials},
+	{"state", "export or import the broker state: state export|import [file]", state},
+	{"reconcile", "compare the state with Cloudflare and print the drift", reconcile},
+	{"migrate", "upgrade the state file to the current schema", migrate},
+	{"audit-verify", "check that no event of an audit file was changed or removed: audit-verify [file]", auditVerify},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: "+os.Args[0]+" [command] [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-18s %s\n", c.name, c.description)
+	}
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(v)
+}
+
+// newBroker builds the broker from cfg and loads the state file, if one is
+// configured.
+func newBroker(logger lager.Logger, cfg config.Config) (*broker.CloudflareBroker, error) {
+	serviceBroker := broker.New(logger, map[string]broker.Zone{})
+	if cfg.NSResolver != "" {
+		serviceBroker.Resolver = broker.NewNameServerResolver(cfg.NSResolver)
+	}
+	serviceBroker.DeletionPolicy = cfg.DeletionPolicy()
+	serviceBroker.ReconcileOptions = cfg.ReconcileOptions()
+	if cfg.PolicyFile != "" {
+		policies, err := broker.LoadPolicies(cfg.PolicyFile)
+		if err != nil {
+			return nil, errors.New("cannot load policies from " + cfg.PolicyFile + ": " + err.Error())
+		}
+		serviceBroker.Policies = policies
+	}
+	if cfg.CredHubURL != "" {
+		httpClient, err := credhub.HTTPClient(cfg.CredHubCAFile)
+		if err != nil {
+			return nil, errors.New("cannot read CREDHUB_CA_FILE: " + err.Error())
+		}
+		serviceBroker.CredHub = credhub.NewClient(cfg.CredHubURL, cfg.CredHubUAAURL, cfg.CredHubClientID, cfg.CredHubClientSecret, httpClient)
+		serviceBroker.CredHubClientName = cfg.CredHubClientName
+	}
+
+	if cfg.StateFile != "" {
+		store, err := stateStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := serviceBroker.LoadState(store); err != nil {
+			return nil, errors.New("cannot load state from " + cfg.StateFile + ": " + err.Error())
+		}
+	}
+
+	return &serviceBroker, nil
+}
+
+// stateStore returns the store of the state file, which encrypts its secrets
+// if encryption keys are configured.
+func stateStore(cfg config.Config) (broker.StateStore, error) {
+	store := broker.FileStateStore{Path: cfg.StateFile}
+	keyring, err := cfg.Keyring()
+	if err != nil || keyring == nil {
+		return store, err
+	}
+
+	return broker.NewEncryptedStateStore(store, keyring), nil
+}
+
+// newAuditLog opens the audit sink of cfg, or returns nil if nothing is to
+// be recorded.
+func newAuditLog(logger lager.Logger, cfg config.Config) (*audit.Log, error) {
+	var sink audit.Sink
+	var err error
+	switch cfg.AuditSink {
+	case "file":
+		sink, err = audit.NewFileSink(cfg.AuditFile)
+	case "syslog":
+		sink, err = audit.NewSyslogSink(cfg.AuditSyslogAddress)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("cannot open the audit log: " + err.Error())
+	}
+
+	return audit.NewLog(logger, sink)
+}
+
+func serve(logger lager.Logger, args []string) error {
+	cfg, err := config.LoadServer(os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	logger.Info("Loaded configuration", lager.Data{"config": cfg.Redacted()})
+	serviceBroker, err := newBroker(logger, cfg)
+	if err != nil {
+		return err
+	}
+
+	// Secrets are encrypted with the primary key in the background, after a
+	// key rotation or once encryption is set up
+	if store, ok := serviceBroker.Store.(*broker.EncryptedStateStore); ok && store.NeedsRotation() {
+		go func() {
+			encrypted, err := serviceBroker.RotateEncryptionKeys()
+			if err != nil {
+				logger.Error("Error encrypting the state with the primary key", err)
+				return
+			}
+			logger.Info("Encrypted the state with the primary key", lager.Data{"secrets": encrypted})
+		}()
+	}
+
+	auditLog, err := newAuditLog(logger, cfg)
+	if err != nil {
+		return err
+	}
+	if auditLog != nil {
+		audit.SetLog(auditLog)
+	}
+
+	if cfg.TracingOTLPEndpoint != "" {
+		headers, _ := cfg.OTLPHeaders()
+		tracing.SetExporter(tracing.NewOTLPExporter(logger, cfg.TracingOTLPEndpoint, headers, cfg.TracingServiceName, 5*time.Second, nil))
+	}
+
+	go serviceBroker.RunZoneDeletionJob(5*time.Minute, nil)
+	go serviceBroker.RunZoneRefreshJob(broker.ZONE_REFRESH_INTERVAL, nil)
+	if cfg.ReconcileInterval > 0 {
+		go serviceBroker.RunReconciler(time.Duration(cfg.ReconcileInterval), cfg.ReconcileOptions(), nil)
+	}
+
+	credentials := brokerapi.BrokerCredentials{
+		Username: cfg.Username,
+		Password: cfg.Password,
+	}
+
+	metrics.MustRegister(serviceBroker.InventoryMetrics()...)
+	brokerAPI := brokerapi.New(broker.NewInstrumentedBroker(broker.NewAuditedBroker(serviceBroker)), logger, credentials)
+
+	fmt.Println("Running Server on port " + strconv.Itoa(cfg.Port))
+	mux := http.NewServeMux()
+	mux.Handle("/", tracing.Middleware(logger, audit.Middleware(broker.NewErrorStatusHandler(broker.NewCatalogHandler(broker.NewAsyncBindHandler(serviceBroker, credentials, broker.NewFetchHandler(serviceBroker, credentials, brokerAPI)))))))
+	authWrapper := auth.NewWrapper(credentials.Username, credentials.Password)
+	mux.Handle("/status/", tracing.Middleware(logger, authWrapper.Wrap(broker.NewStatusHandler(serviceBroker))))
+	mux.Handle("/admin/", tracing.Middleware(logger, authWrapper.Wrap(broker.NewAdminHandler(serviceBroker))))
+	mux.Handle("/metrics", authWrapper.Wrap(metrics.Handler()))
+	mux.Handle(server.LIVENESS_PATH, health.LivenessHandler())
+	mux.Handle(server.READINESS_PATH, readiness(cfg).ReadinessHandler())
+
+	return server.ListenAndServe(logger, cfg, mux)
+}
+
+// readiness checks the dependencies of the broker: the state file, the
+// configuration, which is read again since the config file may have changed,
+// and the operator's Cloudflare credentials.
+func readiness(cfg config.Config) *health.Checker {
+	return health.NewChecker(
+		health.Check{
+			Name:    "state_store",
+			Timeout: READINESS_TIMEOUT,
+			Run: func() error {
+				if cfg.StateFile == "" {
+					return health.ErrSkipped
+				}
+				return broker.FileStateStore{Path: cfg.StateFile}.Check()
+			},
+		},
+		health.Check{
+			Name:    "config",
+			Timeout: READINESS_TIMEOUT,
+			Run: func() error {
+				_, err := config.LoadServer(os.LookupEnv)
+				return err
+			},
+		},
+		health.Check{
+			Name:     "cloudflare_credentials",
+			Timeout:  READINESS_TIMEOUT,
+			CacheFor: READINESS_CREDENTIALS_CACHE,
+			Run: func() error {
+				if cfg.CloudflareEmail == "" {
+					return health.ErrSkipped
+				}
+				return broker.CheckCloudflareCredentials(&api.CloudflareAPI{Timeout: READINESS_TIMEOUT}, cfg.OperatorCredentials())
+			},
+		},
+	)
+}
+
+func printCatalog(logger lager.Logger, args []string) error {
+	cfg, err := config.Load(os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	// The catalog does not depend on the state
+	cfg.StateFile = ""
+	serviceBroker, err := newBroker(logger, cfg)
+	if err != nil {
+		return err
+	}
+
+	catalog, err := broker.Catalog(serviceBroker.Services(context.Background()))
+	if err != nil {
+		return err
+	}
+
+	return printJSON(catalog)
+}
+
+func printConfig(logger lager.Logger, args []string) error {
+	flags := flag.NewFlagSet("config", flag.ContinueOnError)
+	schema := flags.Bool("schema", false, "print the JSON Schema of the configuration")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *schema {
+		return printJSON(config.Schema())
+	}
+
+	cfg, err := config.LoadServer(os.LookupEnv)
+	fmt.Println(cfg)
+
+	return err
+}
+
+// checkCredentials checks the credentials given with -email and -key, or
+// every set of credentials in the state.
+func checkCredentials(logger lager.Logger, args []string) error {
+	cfg, err := config.Load(os.LookupEnv)
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("check-credentials", flag.ContinueOnError)
+	email := flags.String("email", cfg.CloudflareEmail, "Cloudflare account email (CLOUDFLARE_EMAIL)")
+	key := flags.String("key", cfg.CloudflareAPIKey, "Cloudflare API key (CLOUDFLARE_API_KEY)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	serviceBroker, err := newBroker(logger, cfg)
+	if err != nil {
+		return err
+	}
+
+	credentials := serviceBroker.KnownCredentials()
+	if *email != "" || *key != "" {
+		credentials = []api.AuthHeaders{{XAuthEmail: *email, XAuthKey: *key}}
+	}
+	if len(credentials) == 0 {
+		return errors.New("no credentials given and none in the state")
+	}
+
+	failed := false
+	for _, authHeaders := range credentials {
+		if err := serviceBroker.CheckCredentials(authHeaders); err != nil {
+			fmt.Printf("%s: %v\n", authHeaders.XAuthEmail, err)
+			failed = true
+		} else {
+			fmt.Printf("%s: ok\n", authHeaders.XAuthEmail)
+		}
+	}
+	if failed {
+		return errors.New("some credentials were rejected")
+	}
+
+	return nil
+}
+
+// state exports the state file to stdout or a file, or imports a file into
+// it. The export holds Cloudflare API keys, decrypted; keep it safe.
+func state(logger lager.Logger, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("usage: state export [file] | state import file")
+	}
+
+	cfg, err := config.Load(os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	if cfg.StateFile == "" {
+		return errors.New(broker.BROKER_STATE_FILE + " is not set")
+	}
+	store, err := stateStore(cfg)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "export":
+		current, err := store.Load()
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 {
+			return printJSON(current)
+		}
+		return broker.FileStateStore{Path: args[1]}.Save(current)
+
+	case "import":
+		if len(args) != 2 {
+			return errors.New("usage: state import file")
+		}
+		data, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		imported, err := broker.DecodeState(data)
+		if err != nil {
+			return err
+		}
+		if len(imported.Secrets) > 0 {
+			return errors.New(args[1] + " has encrypted secrets; import a file written by state export")
+		}
+		return store.Save(imported)
+
+	default:
+		return errors.New("unknown state command " + args[0])
+	}
+}
+
+func reconcile(logger lager.Logger, args []string) error {
+	cfg, err := config.Load(os.LookupEnv)
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", cfg.ReconcileDryRun, "report orphans without deleting them")
+	orphanAge := flags.Duration("orphan-age", time.Duration(cfg.ReconcileOrphanAge), "delete orphans older than this")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	serviceBroker, err := newBroker(logger, cfg)
+	if err != nil {
+		return err
+	}
+
+	report := serviceBroker.Reconcile(broker.ReconcileOptions{DryRun: *dryRun, OrphanAge: *orphanAge})
+	if err := printJSON(report); err != nil {
+		return err
+	}
+	if len(report.Errors) > 0 {
+		return errors.New("reconcile finished with errors")
+	}
+
+	return nil
+}
+
+func migrate(logger lager.Logger, args []string) error {
+	cfg, err := config.Load(os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	if cfg.StateFile == "" {
+		return errors.New(broker.BROKER_STATE_FILE + " is not set")
+	}
+
+	data, err := ioutil.ReadFile(cfg.StateFile)
+	if os.IsNotExist(err) {
+		fmt.Println("no state file, nothing to migrate")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	migrated, version, err := broker.MigrateState(data)
+	if err != nil {
+		return err
+	}
+	if version == broker.STATE_SCHEMA_VERSION {
+		fmt.Printf("state is at schema version %d already\n", version)
+		return nil
+	}
+
+	current, err := broker.DecodeState(migrated)
+	if err != nil {
+		return err
+	}
+	store, err := stateStore(cfg)
+	if err != nil {
+		return err
+	}
+	if err := store.Save(current); err != nil {
+		return err
+	}
+	fmt.Printf("migrated state from schema version %d to %d\n", version, broker.STATE_SCHEMA_VERSION)
+
+	return nil
+}
+
+// auditVerify checks the hash chain of an audit file, AUDIT_FILE by default.
+func auditVerify(logger lager.Logger, args []string) error {
+	cfg, err := config.Load(os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	path := cfg.AuditFile
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if path == "" {
+		return errors.New("no audit file given and AUDIT_FILE is not set")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	events, err := audit.ReadEvents(file)
+	if err != nil {
+		return err
+	}
+	if err := audit.VerifyChain(events, true); err != nil {
+		return err
+	}
+	fmt.Println(strconv.Itoa(len(events)) + " audit events verified")
+
+	return nil
+}
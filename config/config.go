@@ -0,0 +1,509 @@
+// Package config loads the settings of the broker from the environment, an
+// optional JSON file and, on Cloud Foundry, from VCAP_SERVICES and
+// VCAP_APPLICATION.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/api"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/envelope"
+)
+
+// CONFIG_FILE names a JSON file with settings, keyed like the schema.
+const CONFIG_FILE = "CONFIG_FILE"
+
+// VCAP_SERVICE_TAG marks the user-provided service whose credentials hold
+// settings, keyed like the config file.
+const VCAP_SERVICE_TAG = "cloudflare-broker-config"
+
+const REDACTED = "[REDACTED]"
+
+// Config holds the settings of the broker. Every field is read from the
+// environment variable in its env tag, or from the key in its json tag in the
+// config file and VCAP_SERVICES. The environment wins over VCAP_SERVICES,
+// which wins over the file.
+type Config struct {
+	Username                string   `json:"security_user_name" env:"SECURITY_USER_NAME" required:"true" desc:"User name of the broker API"`
+	Password                string   `json:"security_user_password" env:"SECURITY_USER_PASSWORD" required:"true" secret:"true" desc:"Password of the broker API"`
+	Port                    int      `json:"port" env:"PORT" default:"8080" desc:"Port the broker listens on"`
+	CloudflareEmail         string   `json:"cloudflare_email" env:"CLOUDFLARE_EMAIL" desc:"Email of the operator's Cloudflare account, checked by /readyz and check-credentials"`
+	CloudflareAPIKey        string   `json:"cloudflare_api_key" env:"CLOUDFLARE_API_KEY" secret:"true" desc:"API key of the operator's Cloudflare account"`
+	NSResolver              string   `json:"ns_resolver" env:"NS_RESOLVER" desc:"Resolver (host:port) used to check the NS records of pending zones"`
+	ZoneDeletionPolicy      string   `json:"zone_deletion_policy" env:"ZONE_DELETION_POLICY" default:"delete" enum:"delete,retain,soft-delete" desc:"What unbind does with a zone"`
+	ZoneDeletionGracePeriod Duration `json:"zone_deletion_grace_period" env:"ZONE_DELETION_GRACE_PERIOD" default:"168h" desc:"How long soft-deleted zones are kept"`
+	ReconcileInterval       Duration `json:"reconcile_interval" env:"RECONCILE_INTERVAL" desc:"How often the reconciler runs; it does not run if empty"`
+	ReconcileOrphanAge      Duration `json:"reconcile_orphan_age" env:"RECONCILE_ORPHAN_AGE" default:"24h" desc:"Age after which the reconciler deletes orphans"`
+	ReconcileDryRun         bool     `json:"reconcile_dry_run" env:"RECONCILE_DRY_RUN" default:"true" desc:"Whether the reconciler only reports orphans"`
+	StateFile               string   `json:"state_file" env:"STATE_FILE" desc:"File the broker state is kept in across restarts"`
+	StateEncryptionKeys     string   `json:"state_encryption_keys" env:"STATE_ENCRYPTION_KEYS" secret:"true" desc:"Comma-separated id:key pairs of base64-encoded 256-bit keys the secrets in the state file are encrypted with; they are stored in plaintext if empty"`
+	StateEncryptionKeyID    string   `json:"state_encryption_key_id" env:"STATE_ENCRYPTION_KEY_ID" desc:"ID of the key secrets are encrypted with; the others only decrypt. The first key if empty"`
+	AuditSink               string   `json:"audit_sink" env:"AUDIT_SINK" default:"none" enum:"none,file,syslog" desc:"Where the audit log is written; nothing is recorded with none"`
+	AuditFile               string   `json:"audit_file" env:"AUDIT_FILE" desc:"File the audit log is appended to with the file sink"`
+	AuditSyslogAddress      string   `json:"audit_syslog_address" env:"AUDIT_SYSLOG_ADDRESS" desc:"Syslog server of the syslog sink, such as udp://syslog.example.com:514; the local syslog daemon if empty"`
+	PolicyFile              string   `json:"policy_file" env:"POLICY_FILE" desc:"JSON file of the org and space policies: instance and zone limits, allowed plans and domains; nothing is limited if empty"`
+	CredHubURL              string   `json:"credhub_url" env:"CREDHUB_URL" desc:"CredHub API URL app binding credentials are stored in, such as https://credhub.service.cf.internal:8844; they are returned inline if empty"`
+	CredHubUAAURL           string   `json:"credhub_uaa_url" env:"CREDHUB_UAA_URL" desc:"UAA URL the CredHub client gets tokens from; looked up in CredHub's /info if empty"`
+	CredHubClientID         string   `json:"credhub_client_id" env:"CREDHUB_CLIENT_ID" desc:"UAA client of the broker in CredHub, with credhub.write"`
+	CredHubClientSecret     string   `json:"credhub_client_secret" env:"CREDHUB_CLIENT_SECRET" secret:"true" desc:"Secret of the UAA client"`
+	CredHubCAFile           string   `json:"credhub_ca_file" env:"CREDHUB_CA_FILE" desc:"PEM CA certificates CredHub and UAA are trusted with, on top of the system ones"`
+	CredHubClientName       string   `json:"credhub_client_name" env:"CREDHUB_CLIENT_NAME" default:"cloudflare-broker" desc:"Broker name in the CredHub names of binding credentials, /c/<name>/<service>/<binding>/credentials"`
+	TracingOTLPEndpoint     string   `json:"tracing_otlp_endpoint" env:"TRACING_OTLP_ENDPOINT" desc:"OTLP/HTTP traces URL spans are exported to, such as http://collector:4318/v1/traces; spans are not exported if empty"`
+	TracingOTLPHeaders      string   `json:"tracing_otlp_headers" env:"TRACING_OTLP_HEADERS" secret:"true" desc:"Comma-separated name=value headers sent with exported spans, such as an API key"`
+	TracingServiceName      string   `json:"tracing_service_name" env:"TRACING_SERVICE_NAME" default:"cloudflare-broker" desc:"Service name of the exported spans"`
+	TLSCertFile             string   `json:"tls_cert_file" env:"TLS_CERT_FILE" desc:"PEM certificate (chain) the broker serves HTTPS with; it serves plain HTTP if empty"`
+	TLSKeyFile              string   `json:"tls_key_file" env:"TLS_KEY_FILE" desc:"PEM private key of the certificate"`
+	TLSClientCAFile         string   `json:"tls_client_ca_file" env:"TLS_CLIENT_CA_FILE" desc:"PEM CA certificates that client certificates must be signed by; client certificates are not asked for if empty"`
+	TLSClientNames          string   `json:"tls_client_names" env:"TLS_CLIENT_NAMES" desc:"Comma-separated common or DNS names a client certificate must have one of; any name is accepted if empty"`
+	TLSReloadInterval       Duration `json:"tls_reload_interval" env:"TLS_RELOAD_INTERVAL" default:"1m" desc:"How often the certificate, key and client CA files are checked for changes"`
+	ReadHeaderTimeout       Duration `json:"read_header_timeout" env:"READ_HEADER_TIMEOUT" default:"10s" desc:"How long the broker waits for request headers"`
+	ReadTimeout             Duration `json:"read_timeout" env:"READ_TIMEOUT" default:"30s" desc:"How long the broker waits for a whole request"`
+	WriteTimeout            Duration `json:"write_timeout" env:"WRITE_TIMEOUT" default:"2m" desc:"How long the broker takes at most to answer a request"`
+	IdleTimeout             Duration `json:"idle_timeout" env:"IDLE_TIMEOUT" default:"2m" desc:"How long idle keep-alive connections are kept open"`
+}
+
+// Duration is a time.Duration written as a string such as "90m".
+type Duration time.Duration
+
+func (d Duration) String() string {
+	if d == 0 {
+		return ""
+	}
+
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	return d.parse(value)
+}
+
+func (d *Duration) parse(value string) error {
+	if value == "" {
+		*d = 0
+		return nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+
+	return nil
+}
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// LoadServer reads the configuration for serving the broker, which also
+// needs the required settings. lookup is os.LookupEnv outside of tests.
+func LoadServer(lookup func(string) (string, bool)) (Config, error) {
+	config, problems := load(lookup)
+	problems = append(problems, config.missing()...)
+	if len(problems) > 0 {
+		return config, problems
+	}
+
+	return config, nil
+}
+
+// Load reads the configuration for the commands other than serve, which do
+// not need the broker credentials.
+func Load(lookup func(string) (string, bool)) (Config, error) {
+	config, problems := load(lookup)
+	if len(problems) > 0 {
+		return config, problems
+	}
+
+	return config, nil
+}
+
+func load(lookup func(string) (string, bool)) (Config, ValidationError) {
+	var problems ValidationError
+	config := Config{}
+
+	forEachField(&config, func(field reflect.StructField, value reflect.Value) {
+		if def, ok := field.Tag.Lookup("default"); ok {
+			if err := setField(value, def); err != nil {
+				panic("bad default for " + field.Name + ": " + err.Error())
+			}
+		}
+	})
+
+	if application, ok := lookup("VCAP_APPLICATION"); ok {
+		var vcap struct {
+			Port int `json:"port"`
+		}
+		if err := json.Unmarshal([]byte(application), &vcap); err != nil {
+			problems = append(problems, "VCAP_APPLICATION is not valid JSON: "+err.Error())
+		} else if vcap.Port != 0 {
+			config.Port = vcap.Port
+		}
+	}
+
+	if file, ok := lookup(CONFIG_FILE); ok && file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = decodeSettings(data, &config)
+		}
+		if err != nil {
+			problems = append(problems, CONFIG_FILE+" "+file+": "+err.Error())
+		}
+	}
+
+	if services, ok := lookup("VCAP_SERVICES"); ok {
+		if err := decodeVCAPServices([]byte(services), &config); err != nil {
+			problems = append(problems, "VCAP_SERVICES: "+err.Error())
+		}
+	}
+
+	forEachField(&config, func(field reflect.StructField, value reflect.Value) {
+		env := field.Tag.Get("env")
+		if raw, ok := lookup(env); ok && raw != "" {
+			if err := setField(value, raw); err != nil {
+				problems = append(problems, env+": "+err.Error())
+			}
+		}
+	})
+
+	problems = append(problems, config.validate()...)
+
+	return config, problems
+}
+
+// decodeSettings reads settings keyed like the schema, rejecting unknown keys
+// so that typos do not go unnoticed.
+func decodeSettings(data []byte, config *Config) error {
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(config)
+}
+
+func decodeVCAPServices(data []byte, config *Config) error {
+	var services map[string][]struct {
+		Name        string          `json:"name"`
+		Tags        []string        `json:"tags"`
+		Credentials json.RawMessage `json:"credentials"`
+	}
+	if err := json.Unmarshal(data, &services); err != nil {
+		return err
+	}
+
+	for _, instances := range services {
+		for _, instance := range instances {
+			tagged := instance.Name == VCAP_SERVICE_TAG
+			for _, tag := range instance.Tags {
+				tagged = tagged || tag == VCAP_SERVICE_TAG
+			}
+			if !tagged {
+				continue
+			}
+			if err := decodeSettings(instance.Credentials, config); err != nil {
+				return errors.New("service " + instance.Name + ": " + err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+func (config Config) missing() ValidationError {
+	var problems ValidationError
+
+	forEachField(&config, func(field reflect.StructField, value reflect.Value) {
+		if field.Tag.Get("required") == "true" && value.IsZero() {
+			problems = append(problems, field.Tag.Get("env")+" is required")
+		}
+	})
+
+	return problems
+}
+
+func (config Config) validate() ValidationError {
+	var problems ValidationError
+
+	forEachField(&config, func(field reflect.StructField, value reflect.Value) {
+		if enum, ok := field.Tag.Lookup("enum"); ok && !contains(strings.Split(enum, ","), value.String()) {
+			problems = append(problems, field.Tag.Get("env")+" must be one of "+enum+", not "+value.String())
+		}
+	})
+
+	if config.Port < 1 || config.Port > 65535 {
+		problems = append(problems, "PORT must be between 1 and 65535, not "+strconv.Itoa(config.Port))
+	}
+	if (config.CloudflareEmail == "") != (config.CloudflareAPIKey == "") {
+		problems = append(problems, "CLOUDFLARE_EMAIL and CLOUDFLARE_API_KEY must be set together")
+	}
+	if config.NSResolver != "" {
+		if _, _, err := net.SplitHostPort(config.NSResolver); err != nil {
+			problems = append(problems, "NS_RESOLVER must be host:port: "+err.Error())
+		}
+	}
+	if config.ZoneDeletionGracePeriod <= 0 {
+		problems = append(problems, "ZONE_DELETION_GRACE_PERIOD must be positive")
+	}
+	if config.ReconcileInterval < 0 {
+		problems = append(problems, "RECONCILE_INTERVAL must not be negative")
+	}
+	if config.ReconcileOrphanAge <= 0 {
+		problems = append(problems, "RECONCILE_ORPHAN_AGE must be positive")
+	}
+	if _, err := config.Keyring(); err != nil {
+		problems = append(problems, "STATE_ENCRYPTION_KEYS: "+err.Error())
+	}
+	if config.AuditSink == "file" && config.AuditFile == "" {
+		problems = append(problems, "AUDIT_FILE is required with AUDIT_SINK=file")
+	}
+	if config.AuditSyslogAddress != "" {
+		if address, err := url.Parse(config.AuditSyslogAddress); err != nil || (address.Scheme != "udp" && address.Scheme != "tcp") || address.Host == "" {
+			problems = append(problems, "AUDIT_SYSLOG_ADDRESS must be a udp:// or tcp:// URL")
+		}
+	}
+	if config.CredHubURL != "" {
+		if endpoint, err := url.Parse(config.CredHubURL); err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+			problems = append(problems, "CREDHUB_URL must be an https URL")
+		}
+		if config.CredHubClientID == "" || config.CredHubClientSecret == "" {
+			problems = append(problems, "CREDHUB_CLIENT_ID and CREDHUB_CLIENT_SECRET are required with CREDHUB_URL")
+		}
+	}
+	if config.TracingOTLPEndpoint != "" {
+		if endpoint, err := url.Parse(config.TracingOTLPEndpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			problems = append(problems, "TRACING_OTLP_ENDPOINT must be an http or https URL")
+		}
+	}
+	if _, err := config.OTLPHeaders(); err != nil {
+		problems = append(problems, "TRACING_OTLP_HEADERS: "+err.Error())
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		problems = append(problems, "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if config.TLSClientCAFile != "" && config.TLSCertFile == "" {
+		problems = append(problems, "TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if config.TLSClientNames != "" && config.TLSClientCAFile == "" {
+		problems = append(problems, "TLS_CLIENT_NAMES needs TLS_CLIENT_CA_FILE")
+	}
+	if config.TLSReloadInterval <= 0 {
+		problems = append(problems, "TLS_RELOAD_INTERVAL must be positive")
+	}
+	forEachField(&config, func(field reflect.StructField, value reflect.Value) {
+		if strings.HasSuffix(field.Name, "Timeout") && value.Int() <= 0 {
+			problems = append(problems, field.Tag.Get("env")+" must be positive")
+		}
+	})
+
+	return problems
+}
+
+// DeletionPolicy is the broker's default zone deletion policy.
+func (config Config) DeletionPolicy() broker.DeletionPolicy {
+	return broker.DeletionPolicy{
+		Policy:      config.ZoneDeletionPolicy,
+		GracePeriod: time.Duration(config.ZoneDeletionGracePeriod),
+	}
+}
+
+func (config Config) ReconcileOptions() broker.ReconcileOptions {
+	return broker.ReconcileOptions{
+		DryRun:    config.ReconcileDryRun,
+		OrphanAge: time.Duration(config.ReconcileOrphanAge),
+	}
+}
+
+// OperatorCredentials are the credentials of the operator's Cloudflare
+// account, if configured.
+func (config Config) OperatorCredentials() api.AuthHeaders {
+	return api.AuthHeaders{XAuthEmail: config.CloudflareEmail, XAuthKey: config.CloudflareAPIKey}
+}
+
+// Keyring parses StateEncryptionKeys, or returns nil if the state is not
+// encrypted.
+func (config Config) Keyring() (*envelope.Keyring, error) {
+	keys, first, err := envelope.ParseKeys(config.StateEncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		if config.StateEncryptionKeyID != "" {
+			return nil, errors.New("no keys for STATE_ENCRYPTION_KEY_ID")
+		}
+		return nil, nil
+	}
+
+	primary := config.StateEncryptionKeyID
+	if primary == "" {
+		primary = first
+	}
+
+	return envelope.NewKeyring(primary, keys)
+}
+
+// OTLPHeaders parses TracingOTLPHeaders, in the format of
+// OTEL_EXPORTER_OTLP_HEADERS.
+func (config Config) OTLPHeaders() (map[string]string, error) {
+	headers := map[string]string{}
+	for _, header := range strings.Split(config.TracingOTLPHeaders, ",") {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.New("not name=value: " + strings.TrimSpace(parts[0]))
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return headers, nil
+}
+
+// ClientNames splits TLSClientNames.
+func (config Config) ClientNames() []string {
+	var names []string
+	for _, name := range strings.Split(config.TLSClientNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// Redacted returns a copy of the configuration with secrets replaced by
+// REDACTED, for printing and logging.
+func (config Config) Redacted() Config {
+	forEachField(&config, func(field reflect.StructField, value reflect.Value) {
+		if field.Tag.Get("secret") == "true" && !value.IsZero() {
+			value.SetString(REDACTED)
+		}
+	})
+
+	return config
+}
+
+func (config Config) String() string {
+	data, _ := json.MarshalIndent(config.Redacted(), "", "  ")
+
+	return string(data)
+}
+
+// Schema describes the settings as a JSON Schema, for the tile and for
+// validating config files.
+func Schema() map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+
+	forEachField(&Config{}, func(field reflect.StructField, value reflect.Value) {
+		name := field.Tag.Get("json")
+		property := map[string]interface{}{
+			"description": field.Tag.Get("desc"),
+			"env":         field.Tag.Get("env"),
+		}
+
+		switch value.Interface().(type) {
+		case Duration:
+			property["type"] = "string"
+			property["format"] = "duration"
+		case int:
+			property["type"] = "integer"
+		case bool:
+			property["type"] = "boolean"
+		default:
+			property["type"] = "string"
+		}
+
+		if def, ok := field.Tag.Lookup("default"); ok {
+			var parsed interface{} = def
+			switch property["type"] {
+			case "integer":
+				parsed, _ = strconv.Atoi(def)
+			case "boolean":
+				parsed, _ = strconv.ParseBool(def)
+			}
+			property["default"] = parsed
+		}
+		if enum, ok := field.Tag.Lookup("enum"); ok {
+			property["enum"] = strings.Split(enum, ",")
+		}
+		if field.Tag.Get("secret") == "true" {
+			property["writeOnly"] = true
+		}
+		if field.Tag.Get("required") == "true" {
+			required = append(required, name)
+		}
+
+		properties[name] = property
+	})
+
+	return map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-07/schema#",
+		"title":                "Cloudflare service broker configuration",
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+func forEachField(config *Config, f func(field reflect.StructField, value reflect.Value)) {
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		f(value.Type().Field(i), value.Field(i))
+	}
+}
+
+func setField(value reflect.Value, raw string) error {
+	switch target := value.Addr().Interface().(type) {
+	case *Duration:
+		return target.parse(raw)
+	case *int:
+		number, err := strconv.Atoi(raw)
+		if err != nil {
+			return errors.New("not a number: " + raw)
+		}
+		*target = number
+	case *bool:
+		flag, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errors.New("not true or false: " + raw)
+		}
+		*target = flag
+	case *string:
+		*target = raw
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
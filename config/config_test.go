@@ -0,0 +1,129 @@
+package config_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/config"
+)
+
+func lookup(environment map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := environment[name]
+		return value, ok
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := config.Load(lookup(map[string]string{}))
+	if err != nil {
+		t.Fatalf("Load failed %v", err)
+	}
+
+	if cfg.Port != 8080 || cfg.ZoneDeletionPolicy != "delete" || !cfg.ReconcileDryRun || time.Duration(cfg.ReconcileOrphanAge) != 24*time.Hour {
+		t.Errorf("Load returned %+v", cfg)
+	}
+	if _, err := config.LoadServer(lookup(map[string]string{})); err == nil {
+		t.Errorf("LoadServer accepted a configuration without credentials")
+	}
+}
+
+func TestLoadSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudflare-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(file, []byte(`{
+		"security_user_name":   "file-user",
+		"zone_deletion_policy": "retain",
+		"reconcile_interval":   "1h"
+	}`), 0600)
+
+	cfg, err := config.LoadServer(lookup(map[string]string{
+		config.CONFIG_FILE:       file,
+		"VCAP_APPLICATION":       `{"port": 3000}`,
+		"VCAP_SERVICES":          `{"user-provided": [{"name": "settings", "tags": ["cloudflare-broker-config"], "credentials": {"security_user_name": "vcap-user", "security_user_password": "vcap-password"}}]}`,
+		"SECURITY_USER_PASSWORD": "env-password",
+	}))
+	if err != nil {
+		t.Fatalf("LoadServer failed %v", err)
+	}
+
+	if cfg.Username != "vcap-user" || cfg.Password != "env-password" || cfg.Port != 3000 ||
+		cfg.ZoneDeletionPolicy != "retain" || time.Duration(cfg.ReconcileInterval) != time.Hour {
+		t.Errorf("LoadServer did not layer its sources %+v", cfg)
+	}
+}
+
+func TestLoadListsEveryProblem(t *testing.T) {
+	_, err := config.LoadServer(lookup(map[string]string{
+		"PORT":                  "99999",
+		"NS_RESOLVER":           "1.1.1.1",
+		"ZONE_DELETION_POLICY":  "archive",
+		"RECONCILE_DRY_RUN":     "maybe",
+		"TLS_CERT_FILE":         "cert.pem",
+		"TLS_CLIENT_NAMES":      "cloud-controller",
+		"WRITE_TIMEOUT":         "0s",
+		"AUDIT_SINK":            "file",
+		"STATE_ENCRYPTION_KEYS": "nokey",
+		"CREDHUB_URL":           "http://credhub:8844",
+	}))
+
+	problems, ok := err.(config.ValidationError)
+	if !ok || len(problems) != 13 {
+		t.Errorf("LoadServer returned %v", err)
+	}
+}
+
+func TestLoadRejectsUnknownSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudflare-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(file, []byte(`{"prot": 3000}`), 0600)
+
+	if _, err := config.Load(lookup(map[string]string{config.CONFIG_FILE: file})); err == nil || !strings.Contains(err.Error(), "prot") {
+		t.Errorf("Load accepted an unknown setting %v", err)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := config.Config{Username: "username", Password: "s3cret"}
+
+	if cfg.Redacted().Password != config.REDACTED || cfg.Password != "s3cret" {
+		t.Errorf("Redacted returned %+v", cfg.Redacted())
+	}
+	if strings.Contains(cfg.String(), "s3cret") || !strings.Contains(cfg.String(), "username") {
+		t.Errorf("String printed a secret %s", cfg)
+	}
+}
+
+// TestSchemaFile keeps schema.json, which the tile is built from, in step
+// with Config.
+func TestSchemaFile(t *testing.T) {
+	data, err := ioutil.ReadFile("schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var file, schema interface{}
+	json.Unmarshal(data, &file)
+	generated, _ := json.Marshal(config.Schema())
+	json.Unmarshal(generated, &schema)
+
+	if !reflect.DeepEqual(file, schema) {
+		t.Errorf("schema.json is out of date; regenerate it with `cloudflare-broker config -schema`")
+	}
+}
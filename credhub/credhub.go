@@ -0,0 +1,299 @@
+// Package credhub stores binding credentials in CredHub, so that Cloud
+// Controller only keeps a reference to them and hands the credentials to the
+// bound app alone.
+package credhub
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// REF_KEY is the credential Cloud Controller resolves from CredHub.
+const REF_KEY = "credhub-ref"
+
+// APP_ACTOR_PREFIX makes the actor of an app from its GUID, as the app
+// authenticates to CredHub with its instance identity certificate.
+const APP_ACTOR_PREFIX = "mtls-app:"
+
+const OPERATION_READ = "read"
+
+// TOKEN_EXPIRY_MARGIN is how long before it expires a UAA token is renewed.
+const TOKEN_EXPIRY_MARGIN = 30 * time.Second
+
+// Store keeps credentials by name.
+type Store interface {
+	// Set stores value as a JSON credential, replacing any value of name.
+	Set(name string, value interface{}) error
+	// AddPermission allows actor the operations on the credential.
+	AddPermission(name string, actor string, operations ...string) error
+	// Delete removes a credential. A credential that does not exist is not
+	// an error, so that deletes can be retried.
+	Delete(name string) error
+}
+
+// BindingCredentialName is the name Cloud Foundry expects the credentials of
+// a binding under.
+func BindingCredentialName(clientName string, serviceID string, bindingID string) string {
+	return "/c/" + clientName + "/" + serviceID + "/" + bindingID + "/credentials"
+}
+
+// Client talks to the CredHub API, authenticated as a UAA client.
+type Client struct {
+	URL string
+	// UAAURL is the UAA the client gets tokens from. It is looked up in
+	// CredHub's /info if empty.
+	UAAURL       string
+	ClientID     string
+	ClientSecret string
+	HTTPClient   *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func NewClient(credhubURL string, uaaURL string, clientID string, clientSecret string, httpClient *http.Client) *Client {
+	return &Client{
+		URL:          strings.TrimRight(credhubURL, "/"),
+		UAAURL:       strings.TrimRight(uaaURL, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		HTTPClient:   httpClient,
+	}
+}
+
+// HTTPClient returns a client trusting the PEM CA certificates in caFile, on
+// top of the system ones, or the system ones alone if caFile is empty.
+func HTTPClient(caFile string) (*http.Client, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: config, Proxy: http.ProxyFromEnvironment},
+	}, nil
+}
+
+func (c *Client) Set(name string, value interface{}) error {
+	return c.do("PUT", "/api/v1/data", map[string]interface{}{"name": name, "type": "json", "value": value}, nil)
+}
+
+func (c *Client) AddPermission(name string, actor string, operations ...string) error {
+	err := c.do("POST", "/api/v2/permissions", map[string]interface{}{"path": name, "actor": actor, "operations": operations}, nil)
+	if status, ok := err.(StatusError); ok && status.Status == http.StatusConflict {
+		// The permission exists already, as on a retried bind
+		return nil
+	}
+
+	return err
+}
+
+func (c *Client) Delete(name string) error {
+	err := c.do("DELETE", "/api/v1/data?name="+url.QueryEscape(name), nil, nil)
+	if status, ok := err.(StatusError); ok && status.Status == http.StatusNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// StatusError is an error answer of CredHub or UAA.
+type StatusError struct {
+	Status  int
+	Message string
+}
+
+func (e StatusError) Error() string {
+	return "credhub answered " + http.StatusText(e.Status) + ": " + e.Message
+}
+
+func (c *Client) do(method string, path string, body interface{}, result interface{}) error {
+	token, err := c.accessToken()
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	request, err := http.NewRequest(method, c.URL+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	return c.send(request, result)
+}
+
+func (c *Client) send(request *http.Request, result interface{}) error {
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode/100 != 2 {
+		var answer struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		json.Unmarshal(data, &answer)
+		message := answer.Error
+		if answer.ErrorDescription != "" {
+			message = answer.ErrorDescription
+		}
+		return StatusError{Status: response.StatusCode, Message: message}
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(data, result)
+}
+
+// accessToken returns a UAA token for the client, renewed shortly before it
+// expires.
+func (c *Client) accessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.expiresAt) {
+		return c.token, nil
+	}
+
+	if c.UAAURL == "" {
+		uaaURL, err := c.authServer()
+		if err != nil {
+			return "", errors.New("cannot find the UAA of CredHub: " + err.Error())
+		}
+		c.UAAURL = uaaURL
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}, "response_type": {"token"}}
+	request, err := http.NewRequest("POST", c.UAAURL+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := c.send(request, &token); err != nil {
+		return "", errors.New("cannot get a UAA token: " + err.Error())
+	}
+
+	c.token = token.AccessToken
+	c.expiresAt = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - TOKEN_EXPIRY_MARGIN)
+
+	return c.token, nil
+}
+
+func (c *Client) authServer() (string, error) {
+	request, err := http.NewRequest("GET", c.URL+"/info", nil)
+	if err != nil {
+		return "", err
+	}
+
+	var info struct {
+		AuthServer struct {
+			URL string `json:"url"`
+		} `json:"auth-server"`
+	}
+	if err := c.send(request, &info); err != nil {
+		return "", err
+	}
+	if info.AuthServer.URL == "" {
+		return "", errors.New("/info has no auth-server")
+	}
+
+	return strings.TrimRight(info.AuthServer.URL, "/"), nil
+}
+
+// MemoryStore keeps credentials in memory, in place of CredHub in tests.
+type MemoryStore struct {
+	mu          sync.Mutex
+	Values      map[string]json.RawMessage
+	Permissions map[string][]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{Values: map[string]json.RawMessage{}, Permissions: map[string][]string{}}
+}
+
+func (s *MemoryStore) Set(name string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Values[name] = data
+
+	return nil
+}
+
+// AddPermission records actor:operation pairs by credential name.
+func (s *MemoryStore) AddPermission(name string, actor string, operations ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Values[name]; !ok {
+		return StatusError{Status: http.StatusNotFound, Message: "The request could not be completed because the credential does not exist or you do not have sufficient authorization."}
+	}
+	for _, operation := range operations {
+		s.Permissions[name] = append(s.Permissions[name], actor+":"+operation)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.Values, name)
+	delete(s.Permissions, name)
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package credhub_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/credhub"
+)
+
+func TestClient(t *testing.T) {
+	tokens := 0
+	credentials := map[string]json.RawMessage{}
+	permissions := []string{}
+
+	mux := http.NewServeMux()
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"auth-server": {"url": "` + server.URL + `/uaa"}}`))
+	})
+	mux.HandleFunc("/uaa/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "broker" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "unauthorized", "error_description": "Bad credentials"}`))
+			return
+		}
+		tokens++
+		w.Write([]byte(`{"access_token": "token", "expires_in": 3600}`))
+	})
+	mux.HandleFunc("/api/v1/data", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			var body struct {
+				Name  string          `json:"name"`
+				Type  string          `json:"type"`
+				Value json.RawMessage `json:"value"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.Type != "json" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			credentials[body.Name] = body.Value
+		case "DELETE":
+			if _, ok := credentials[r.URL.Query().Get("name")]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error": "The request could not be completed because the credential does not exist or you do not have sufficient authorization."}`))
+				return
+			}
+			delete(credentials, r.URL.Query().Get("name"))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("/api/v2/permissions", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Path       string   `json:"path"`
+			Actor      string   `json:"actor"`
+			Operations []string `json:"operations"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		permission := body.Path + " " + body.Actor + " " + body.Operations[0]
+		for _, existing := range permissions {
+			if existing == permission {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+		}
+		permissions = append(permissions, permission)
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	client := credhub.NewClient(server.URL, "", "broker", "secret", server.Client())
+	name := credhub.BindingCredentialName("cloudflare-broker", "service", "binding")
+
+	if err := client.Set(name, map[string]string{"zone_id": "1"}); err != nil {
+		t.Fatalf("Set failed %v", err)
+	}
+	if string(credentials[name]) != `{"zone_id":"1"}` {
+		t.Errorf("Set stored %s", credentials[name])
+	}
+	for i := 0; i < 2; i++ {
+		if err := client.AddPermission(name, credhub.APP_ACTOR_PREFIX+"app", credhub.OPERATION_READ); err != nil {
+			t.Errorf("AddPermission failed %v", err)
+		}
+	}
+	if len(permissions) != 1 || permissions[0] != name+" mtls-app:app read" {
+		t.Errorf("AddPermission granted %v", permissions)
+	}
+	for i := 0; i < 2; i++ {
+		if err := client.Delete(name); err != nil {
+			t.Errorf("Delete failed %v", err)
+		}
+	}
+	if tokens != 1 {
+		t.Errorf("The client got %d tokens instead of reusing one", tokens)
+	}
+
+	wrongSecret := credhub.NewClient(server.URL, server.URL+"/uaa", "broker", "wrong", server.Client())
+	if err := wrongSecret.Set(name, "value"); err == nil {
+		t.Errorf("Set succeeded without a token")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := credhub.NewMemoryStore()
+
+	if err := store.AddPermission("/c/b/s/1/credentials", "mtls-app:app", credhub.OPERATION_READ); err == nil {
+		t.Errorf("AddPermission succeeded for a missing credential")
+	}
+	store.Set("/c/b/s/1/credentials", map[string]string{"zone_id": "1"})
+	store.AddPermission("/c/b/s/1/credentials", "mtls-app:app", credhub.OPERATION_READ)
+	if string(store.Values["/c/b/s/1/credentials"]) != `{"zone_id":"1"}` || store.Permissions["/c/b/s/1/credentials"][0] != "mtls-app:app:read" {
+		t.Errorf("MemoryStore holds %v %v", store.Values, store.Permissions)
+	}
+	if err := store.Delete("/c/b/s/1/credentials"); err != nil || len(store.Values) != 0 {
+		t.Errorf("Delete returned %v", err)
+	}
+}
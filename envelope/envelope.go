@@ -0,0 +1,168 @@
+// Package envelope encrypts secrets with envelope encryption: every secret
+// is encrypted with a data key of its own, which is in turn encrypted with a
+// key-encryption key from the keyring. The keyring may hold several keys, so
+// that secrets encrypted with an older key can still be decrypted while they
+// are re-encrypted with the primary key.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KEY_SIZE is the size of key-encryption and data keys, for AES-256.
+const KEY_SIZE = 32
+
+// Envelope is an encrypted secret with its encrypted data key. Both are
+// prefixed with their GCM nonce.
+type Envelope struct {
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Keyring holds the key-encryption keys by ID. New secrets are encrypted with
+// the primary key.
+type Keyring struct {
+	keys    map[string][]byte
+	primary string
+}
+
+// NewKeyring returns a keyring of keys whose primary key is primary.
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, errors.New("primary key " + primary + " is not in the keyring")
+	}
+	for id, key := range keys {
+		if len(key) != KEY_SIZE {
+			return nil, errors.New("key " + id + " has " + strconv.Itoa(len(key)) + " bytes, not " + strconv.Itoa(KEY_SIZE))
+		}
+	}
+
+	return &Keyring{keys: keys, primary: primary}, nil
+}
+
+// ParseKeys reads comma-separated id:key pairs of base64-encoded keys, and
+// returns them with the ID of the first.
+func ParseKeys(spec string) (map[string][]byte, string, error) {
+	keys := map[string][]byte{}
+	first := ""
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, "", errors.New("keys must be id:key pairs")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, "", errors.New("key " + parts[0] + " is not base64: " + err.Error())
+		}
+		if _, ok := keys[parts[0]]; ok {
+			return nil, "", errors.New("key " + parts[0] + " is given twice")
+		}
+
+		keys[parts[0]] = key
+		if first == "" {
+			first = parts[0]
+		}
+	}
+
+	return keys, first, nil
+}
+
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// KeyIDs returns the IDs of every key, sorted.
+func (k *Keyring) KeyIDs() []string {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Seal encrypts plaintext with a new data key, wrapped with the primary key.
+// The same additionalData, such as where the secret is stored, must be given
+// to Open, so that an envelope cannot be moved to another record.
+func (k *Keyring) Seal(plaintext []byte, additionalData []byte) (Envelope, error) {
+	dataKey := make([]byte, KEY_SIZE)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return Envelope{}, err
+	}
+
+	ciphertext, err := seal(dataKey, plaintext, additionalData)
+	if err != nil {
+		return Envelope{}, err
+	}
+	wrappedKey, err := seal(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{KeyID: k.primary, WrappedKey: wrappedKey, Ciphertext: ciphertext}, nil
+}
+
+// Open decrypts an envelope sealed with any key of the keyring.
+func (k *Keyring) Open(e Envelope, additionalData []byte) ([]byte, error) {
+	key, ok := k.keys[e.KeyID]
+	if !ok {
+		return nil, errors.New("key " + e.KeyID + " is not in the keyring")
+	}
+
+	dataKey, err := open(key, e.WrappedKey, []byte(e.KeyID))
+	if err != nil {
+		return nil, errors.New("cannot unwrap the data key with key " + e.KeyID + ": " + err.Error())
+	}
+
+	return open(dataKey, e.Ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(key []byte, sealed []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+}
@@ -0,0 +1,71 @@
+package envelope_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/envelope"
+)
+
+func keyring(t *testing.T, primary string, ids ...string) *envelope.Keyring {
+	keys := map[string][]byte{}
+	for i, id := range ids {
+		keys[id] = bytes.Repeat([]byte{byte(i + 1)}, envelope.KEY_SIZE)
+	}
+
+	k, err := envelope.NewKeyring(primary, keys)
+	if err != nil {
+		t.Fatalf("NewKeyring failed %v", err)
+	}
+
+	return k
+}
+
+func TestSealAndOpen(t *testing.T) {
+	k := keyring(t, "1", "1")
+
+	sealed, err := k.Seal([]byte("mykey"), []byte("instances/1/auth"))
+	if err != nil || sealed.KeyID != "1" || bytes.Contains(sealed.Ciphertext, []byte("mykey")) {
+		t.Fatalf("Seal returned %+v %v", sealed, err)
+	}
+
+	plaintext, err := k.Open(sealed, []byte("instances/1/auth"))
+	if err != nil || string(plaintext) != "mykey" {
+		t.Errorf("Open returned %s %v", plaintext, err)
+	}
+	if _, err := k.Open(sealed, []byte("instances/2/auth")); err == nil {
+		t.Errorf("Open accepted an envelope of another record")
+	}
+}
+
+func TestOpenWithRotatedKeys(t *testing.T) {
+	sealed, _ := keyring(t, "1", "1").Seal([]byte("mykey"), nil)
+
+	rotated := keyring(t, "2", "1", "2")
+	if plaintext, err := rotated.Open(sealed, nil); err != nil || string(plaintext) != "mykey" {
+		t.Errorf("Open with an older key returned %s %v", plaintext, err)
+	}
+	if resealed, _ := rotated.Seal([]byte("mykey"), nil); resealed.KeyID != "2" {
+		t.Errorf("Seal did not use the primary key %+v", resealed)
+	}
+
+	if _, err := keyring(t, "2", "2").Open(sealed, nil); err == nil {
+		t.Errorf("Open succeeded without the key")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, first, err := envelope.ParseKeys("old:AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=, new:AgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgI=")
+	if err != nil || first != "old" || len(keys["new"]) != envelope.KEY_SIZE {
+		t.Errorf("ParseKeys returned %v %s %v", keys, first, err)
+	}
+
+	for _, spec := range []string{"nokey", "id:not base64", "a:AQ==,a:AQ=="} {
+		if _, _, err := envelope.ParseKeys(spec); err == nil {
+			t.Errorf("ParseKeys accepted %s", spec)
+		}
+	}
+	if _, err := envelope.NewKeyring("a", map[string][]byte{"a": []byte("short")}); err == nil {
+		t.Errorf("NewKeyring accepted a short key")
+	}
+}
@@ -0,0 +1,177 @@
+// Package health serves the liveness and readiness endpoints of the broker.
+// Readiness runs a check per dependency and reports each of them, so that
+// the platform stops routing to a broker that cannot do its work.
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const STATUS_OK = "ok"
+const STATUS_FAILING = "failing"
+const STATUS_SKIPPED = "skipped"
+
+// ErrSkipped is returned by checks of dependencies that are not configured.
+var ErrSkipped = errors.New("not configured")
+
+// Check probes one dependency. Run returns nil if the dependency works.
+type Check struct {
+	Name string
+	Run  func() error
+	// Timeout, if set, fails the check when Run takes longer.
+	Timeout time.Duration
+	// CacheFor, if set, reuses a result for that long, for checks that are
+	// slow or call rate-limited APIs.
+	CacheFor time.Duration
+}
+
+// Result is the outcome of a check.
+type Result struct {
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	CheckedAt  time.Time `json:"checked_at"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// Report is the body of the readiness endpoint.
+type Report struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Checker runs checks and caches their results.
+type Checker struct {
+	checks []Check
+
+	mu      sync.Mutex
+	results map[string]Result
+	running map[string]*sync.Mutex
+}
+
+func NewChecker(checks ...Check) *Checker {
+	running := map[string]*sync.Mutex{}
+	for _, check := range checks {
+		running[check.Name] = &sync.Mutex{}
+	}
+
+	return &Checker{checks: checks, results: map[string]Result{}, running: running}
+}
+
+// Report runs every check, or takes its cached result. The broker is ready
+// if no check is failing.
+func (c *Checker) Report() Report {
+	report := Report{Ready: true, Checks: map[string]Result{}}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range c.checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+			result := c.result(check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[check.Name] = result
+			if result.Status == STATUS_FAILING {
+				report.Ready = false
+			}
+		}(check)
+	}
+	wg.Wait()
+
+	return report
+}
+
+// result runs check unless its cached result is fresh. Concurrent probes of
+// the same check wait for one run instead of starting their own.
+func (c *Checker) result(check Check) Result {
+	running := c.running[check.Name]
+	running.Lock()
+	defer running.Unlock()
+
+	c.mu.Lock()
+	cached, ok := c.results[check.Name]
+	c.mu.Unlock()
+	if ok && check.CacheFor > 0 && time.Since(cached.CheckedAt) < check.CacheFor {
+		return cached
+	}
+
+	result := run(check)
+
+	c.mu.Lock()
+	c.results[check.Name] = result
+	c.mu.Unlock()
+
+	return result
+}
+
+func run(check Check) Result {
+	startedAt := time.Now()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- check.Run()
+	}()
+
+	var timeout <-chan time.Time
+	if check.Timeout > 0 {
+		timer := time.NewTimer(check.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case err = <-done:
+	case <-timeout:
+		err = errors.New("timed out after " + check.Timeout.String())
+	}
+
+	result := Result{
+		Status:     STATUS_OK,
+		CheckedAt:  startedAt,
+		DurationMS: time.Since(startedAt).Nanoseconds() / int64(time.Millisecond),
+	}
+	switch {
+	case err == ErrSkipped:
+		result.Status = STATUS_SKIPPED
+	case err != nil:
+		result.Status = STATUS_FAILING
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// LivenessHandler answers as long as the process serves requests.
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		respond(w, http.StatusOK, map[string]string{"status": STATUS_OK})
+	})
+}
+
+// ReadinessHandler answers 200 if the broker is ready and 503 if it is not,
+// with the result of every check.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		report := c.Report()
+
+		status := http.StatusOK
+		if !report.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		respond(w, status, report)
+	})
+}
+
+func respond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,79 @@
+package health_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/health"
+)
+
+func readiness(checker *health.Checker) (int, health.Report) {
+	recorder := httptest.NewRecorder()
+	checker.ReadinessHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+	var report health.Report
+	json.Unmarshal(recorder.Body.Bytes(), &report)
+
+	return recorder.Code, report
+}
+
+func TestReadiness(t *testing.T) {
+	checker := health.NewChecker(
+		health.Check{Name: "ok", Run: func() error { return nil }},
+		health.Check{Name: "skipped", Run: func() error { return health.ErrSkipped }},
+	)
+
+	status, report := readiness(checker)
+	if status != http.StatusOK || !report.Ready || report.Checks["ok"].Status != health.STATUS_OK || report.Checks["skipped"].Status != health.STATUS_SKIPPED {
+		t.Errorf("ReadinessHandler returned %d %+v", status, report)
+	}
+}
+
+func TestReadinessFailing(t *testing.T) {
+	checker := health.NewChecker(
+		health.Check{Name: "ok", Run: func() error { return nil }},
+		health.Check{Name: "failing", Run: func() error { return errors.New("unreachable") }},
+		health.Check{Name: "slow", Timeout: 10 * time.Millisecond, Run: func() error {
+			time.Sleep(time.Second)
+			return nil
+		}},
+	)
+
+	status, report := readiness(checker)
+	if status != http.StatusServiceUnavailable || report.Ready {
+		t.Errorf("ReadinessHandler returned %d %+v", status, report)
+	}
+	if result := report.Checks["failing"]; result.Status != health.STATUS_FAILING || result.Error != "unreachable" {
+		t.Errorf("Failing check returned %+v", result)
+	}
+	if result := report.Checks["slow"]; result.Status != health.STATUS_FAILING {
+		t.Errorf("Slow check returned %+v", result)
+	}
+}
+
+func TestReadinessCache(t *testing.T) {
+	runs := 0
+	checker := health.NewChecker(health.Check{Name: "cached", CacheFor: time.Minute, Run: func() error {
+		runs++
+		return nil
+	}})
+
+	checker.Report()
+	checker.Report()
+	if runs != 1 {
+		t.Errorf("Cached check ran %d times", runs)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	health.LivenessHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("LivenessHandler returned %d", recorder.Code)
+	}
+}
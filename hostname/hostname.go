@@ -0,0 +1,181 @@
+// Package hostname validates and normalizes the domains zones are added for:
+// lowercased, without a trailing dot, in punycode, and registrable under a
+// public suffix.
+package hostname
+
+import (
+	_ "embed"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// MAX_LENGTH and MAX_LABEL_LENGTH are the limits of RFC 1035 on names in
+// their ASCII form.
+const MAX_LENGTH = 253
+const MAX_LABEL_LENGTH = 63
+
+const ACE_PREFIX = "xn--"
+
+// publicSuffixList is the list of https://publicsuffix.org/list/, updated by
+// replacing public_suffix_list.dat.
+//
+//go:embed public_suffix_list.dat
+var publicSuffixList string
+
+// Error is a name that cannot be a zone.
+type Error struct {
+	Name   string
+	Reason string
+}
+
+func (e Error) Error() string {
+	return strconv.Quote(e.Name) + " " + e.Reason
+}
+
+// Normalize returns name lowercased, without a trailing dot and with its
+// internationalized labels in punycode. It fails if name is not a domain that
+// can be registered: IP addresses, wildcards, invalid hostnames and public
+// suffixes such as co.uk are refused.
+func Normalize(name string) (string, error) {
+	if name == "" {
+		return "", Error{Name: name, Reason: "is empty"}
+	}
+	if strings.Contains(name, "*") {
+		return "", Error{Name: name, Reason: "is a wildcard; give the domain itself"}
+	}
+	if net.ParseIP(strings.Trim(name, "[]")) != nil {
+		return "", Error{Name: name, Reason: "is an IP address, not a domain"}
+	}
+
+	ascii, err := ToASCII(name)
+	if err != nil {
+		return "", err
+	}
+
+	labels := strings.Split(ascii, ".")
+	if _, err := strconv.Atoi(labels[len(labels)-1]); err == nil {
+		return "", Error{Name: name, Reason: "has a numeric top-level domain"}
+	}
+	if suffix := PublicSuffix(ascii); suffix == ascii {
+		return "", Error{Name: name, Reason: "is a public suffix; give a domain registered under it"}
+	}
+
+	return ascii, nil
+}
+
+// ToASCII returns name lowercased, without a trailing dot and with its
+// internationalized labels in punycode, or an error if it is not a valid
+// hostname.
+func ToASCII(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", Error{Name: name, Reason: "is not valid UTF-8"}
+	}
+
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	for i, label := range labels {
+		if label == "" {
+			return "", Error{Name: name, Reason: "has an empty label"}
+		}
+
+		if !isASCII(label) {
+			encoded, err := encode(label)
+			if err != nil {
+				return "", Error{Name: name, Reason: "cannot be converted to punycode: " + err.Error()}
+			}
+			label = ACE_PREFIX + encoded
+		}
+		if len(label) > MAX_LABEL_LENGTH {
+			return "", Error{Name: name, Reason: "has a label longer than " + strconv.Itoa(MAX_LABEL_LENGTH) + " characters"}
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return "", Error{Name: name, Reason: "has a label starting or ending with a hyphen"}
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", Error{Name: name, Reason: "has the character " + strconv.QuoteRune(c) + ", not allowed in hostnames"}
+			}
+		}
+
+		labels[i] = label
+	}
+
+	ascii := strings.Join(labels, ".")
+	if len(ascii) > MAX_LENGTH {
+		return "", Error{Name: name, Reason: "is longer than " + strconv.Itoa(MAX_LENGTH) + " characters"}
+	}
+
+	return ascii, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rules holds the rules of the public suffix list in ASCII, without their
+// "*." or "!" prefix.
+type rules struct {
+	normal     map[string]bool
+	wildcards  map[string]bool
+	exceptions map[string]bool
+}
+
+var loadRules sync.Once
+var suffixRules rules
+
+func parseRules(list string) rules {
+	r := rules{normal: map[string]bool{}, wildcards: map[string]bool{}, exceptions: map[string]bool{}}
+
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+
+		rule := fields[0]
+		set := r.normal
+		if strings.HasPrefix(rule, "!") {
+			rule, set = rule[1:], r.exceptions
+		} else if strings.HasPrefix(rule, "*.") {
+			rule, set = rule[2:], r.wildcards
+		}
+
+		ascii, err := ToASCII(rule)
+		if err != nil {
+			continue
+		}
+		set[ascii] = true
+	}
+
+	return r
+}
+
+// PublicSuffix returns the public suffix of an ASCII name by the algorithm of
+// https://publicsuffix.org/list/: an exception rule wins, then the longest
+// matching rule, and the top-level domain if no rule matches.
+func PublicSuffix(name string) string {
+	loadRules.Do(func() { suffixRules = parseRules(publicSuffixList) })
+
+	labels := strings.Split(name, ".")
+	for i := range labels {
+		if suffixRules.exceptions[strings.Join(labels[i:], ".")] {
+			return strings.Join(labels[i+1:], ".")
+		}
+	}
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		if suffixRules.normal[candidate] || (i+1 < len(labels) && suffixRules.wildcards[strings.Join(labels[i+1:], ".")]) {
+			return candidate
+		}
+	}
+
+	return labels[len(labels)-1]
+}
@@ -0,0 +1,69 @@
+package hostname_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/hostname"
+)
+
+func TestNormalize(t *testing.T) {
+	for name, expected := range map[string]string{
+		"Domain.COM.":        "domain.com",
+		"example.co.uk":      "example.co.uk",
+		"www.example.co.uk":  "www.example.co.uk",
+		"münchen.de":         "xn--mnchen-3ya.de",
+		"bücher.example":     "xn--bcher-kva.example",
+		"例え.テスト":             "xn--r8jz45g.xn--zckzah",
+		"xn--mnchen-3ya.de":  "xn--mnchen-3ya.de",
+		"my-app.github.io":   "my-app.github.io",
+		"www.ck":             "www.ck",
+		"a1.b2.example.com.": "a1.b2.example.com",
+	} {
+		if normalized, err := hostname.Normalize(name); err != nil || normalized != expected {
+			t.Errorf("Normalize(%q) returned %q %v, not %q", name, normalized, err, expected)
+		}
+	}
+}
+
+func TestNormalizeRejects(t *testing.T) {
+	for name, reason := range map[string]string{
+		"":                                "empty",
+		"*.domain.com":                    "wildcard",
+		"1.2.3.4":                         "IP address",
+		"[2001:db8::1]":                   "IP address",
+		"1.2.3":                           "numeric",
+		"com":                             "public suffix",
+		"co.uk":                           "public suffix",
+		"github.io":                       "public suffix",
+		"anything.ck":                     "public suffix",
+		"localhost":                       "public suffix",
+		"domain..com":                     "empty label",
+		"-domain.com":                     "hyphen",
+		"under_score.com":                 "'_'",
+		"domain.com/path":                 "'/'",
+		`domain.com", "type": "full`:      "'\"'",
+		strings.Repeat("a", 64) + ".com":  "longer than 63",
+		strings.Repeat("a.", 127) + "com": "longer than 253",
+	} {
+		if normalized, err := hostname.Normalize(name); err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("Normalize(%q) returned %q %v, not an error about %s", name, normalized, err, reason)
+		}
+	}
+}
+
+func TestPublicSuffix(t *testing.T) {
+	for name, suffix := range map[string]string{
+		"example.com":        "com",
+		"www.example.co.uk":  "co.uk",
+		"a.b.anything.ck":    "anything.ck",
+		"www.ck":             "ck",
+		"example.unknowntld": "unknowntld",
+		"shop.xn--fiqs8s":    "xn--fiqs8s",
+		"app.herokuapp.com":  "herokuapp.com",
+	} {
+		if got := hostname.PublicSuffix(name); got != suffix {
+			t.Errorf("PublicSuffix(%q) returned %q, not %q", name, got, suffix)
+		}
+	}
+}
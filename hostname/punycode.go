@@ -0,0 +1,106 @@
+package hostname
+
+import (
+	"errors"
+	"math"
+)
+
+// The parameters of punycode in RFC 3492
+const PUNYCODE_BASE = 36
+const PUNYCODE_TMIN = 1
+const PUNYCODE_TMAX = 26
+const PUNYCODE_SKEW = 38
+const PUNYCODE_DAMP = 700
+const PUNYCODE_INITIAL_BIAS = 72
+const PUNYCODE_INITIAL_N = 128
+
+// encode returns the punycode of a label, without the ACE prefix.
+func encode(label string) (string, error) {
+	runes := []rune(label)
+
+	output := []byte{}
+	for _, r := range runes {
+		if r < 0x80 {
+			output = append(output, byte(r))
+		}
+	}
+	basic := len(output)
+	handled := basic
+	if basic > 0 {
+		output = append(output, '-')
+	}
+
+	n := rune(PUNYCODE_INITIAL_N)
+	delta := 0
+	bias := PUNYCODE_INITIAL_BIAS
+	for handled < len(runes) {
+		m := rune(math.MaxInt32)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		if int(m-n) > (math.MaxInt32-delta)/(handled+1) {
+			return "", errors.New("label is too long")
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+
+			q := delta
+			for k := PUNYCODE_BASE; ; k += PUNYCODE_BASE {
+				t := k - bias
+				if t < PUNYCODE_TMIN {
+					t = PUNYCODE_TMIN
+				} else if t > PUNYCODE_TMAX {
+					t = PUNYCODE_TMAX
+				}
+				if q < t {
+					break
+				}
+				output = append(output, punycodeDigit(t+(q-t)%(PUNYCODE_BASE-t)))
+				q = (q - t) / (PUNYCODE_BASE - t)
+			}
+			output = append(output, punycodeDigit(q))
+			bias = adapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+
+	return string(output), nil
+}
+
+func adapt(delta int, points int, first bool) int {
+	if first {
+		delta /= PUNYCODE_DAMP
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+
+	k := 0
+	for delta > ((PUNYCODE_BASE-PUNYCODE_TMIN)*PUNYCODE_TMAX)/2 {
+		delta /= PUNYCODE_BASE - PUNYCODE_TMIN
+		k += PUNYCODE_BASE
+	}
+
+	return k + (PUNYCODE_BASE-PUNYCODE_TMIN+1)*delta/(delta+PUNYCODE_SKEW)
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+
+	return byte('0' + d - 26)
+}
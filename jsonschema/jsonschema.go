@@ -0,0 +1,185 @@
+// Package jsonschema describes and validates JSON values with the subset of
+// JSON Schema draft-04 that the broker's parameters need: types, properties,
+// required properties, additionalProperties, items, enum, pattern, lengths
+// and bounds. Other keywords are not supported.
+package jsonschema
+
+import (
+	"encoding/json"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DRAFT is the $schema of the root schemas published in the catalog.
+const DRAFT = "http://json-schema.org/draft-04/schema#"
+
+const TYPE_OBJECT = "object"
+const TYPE_ARRAY = "array"
+const TYPE_STRING = "string"
+const TYPE_BOOLEAN = "boolean"
+const TYPE_INTEGER = "integer"
+const TYPE_NUMBER = "number"
+
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	Default              interface{}        `json:"default,omitempty"`
+}
+
+// Error is a value that does not match its schema. Path is where the value
+// is, such as "access.allowed_groups[0]", and empty for the root value.
+type Error struct {
+	Path    string
+	Message string
+}
+
+func (e Error) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+
+	return e.Path + " " + e.Message
+}
+
+// ValidateJSON validates a JSON document. An empty document is validated as
+// an empty object, as parameters are optional in requests.
+func (s *Schema) ValidateJSON(data []byte) []Error {
+	if len(strings.TrimSpace(string(data))) == 0 {
+		data = []byte("{}")
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return []Error{{Message: "is not valid JSON: " + err.Error()}}
+	}
+
+	return s.Validate(value)
+}
+
+// Validate returns every way value, as decoded by encoding/json into an
+// interface{}, does not match the schema, sorted by path.
+func (s *Schema) Validate(value interface{}) []Error {
+	errors := s.validate("", value)
+	sort.SliceStable(errors, func(i, j int) bool { return errors[i].Path < errors[j].Path })
+
+	return errors
+}
+
+func (s *Schema) validate(path string, value interface{}) []Error {
+	if s.Type != "" && !hasType(value, s.Type) {
+		return []Error{{Path: path, Message: "must be " + article(s.Type) + " " + s.Type}}
+	}
+
+	var errors []Error
+	if len(s.Enum) > 0 {
+		if text, _ := value.(string); !contains(s.Enum, text) {
+			errors = append(errors, Error{Path: path, Message: "must be one of " + strings.Join(s.Enum, ", ")})
+		}
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := value[name]; !ok {
+				errors = append(errors, Error{Path: join(path, name), Message: "is required"})
+			}
+		}
+		for name, property := range value {
+			if schema, ok := s.Properties[name]; ok {
+				errors = append(errors, schema.validate(join(path, name), property)...)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				errors = append(errors, Error{Path: join(path, name), Message: "is not a known parameter"})
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(value) < *s.MinItems {
+			errors = append(errors, Error{Path: path, Message: "must have at least " + strconv.Itoa(*s.MinItems) + " items"})
+		}
+		if s.Items != nil {
+			for i, item := range value {
+				errors = append(errors, s.Items.validate(path+"["+strconv.Itoa(i)+"]", item)...)
+			}
+		}
+	case string:
+		length := len([]rune(value))
+		if s.MinLength != nil && length < *s.MinLength {
+			errors = append(errors, Error{Path: path, Message: "must have at least " + strconv.Itoa(*s.MinLength) + " characters"})
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			errors = append(errors, Error{Path: path, Message: "must have at most " + strconv.Itoa(*s.MaxLength) + " characters"})
+		}
+		if s.Pattern != "" {
+			if pattern, err := regexp.Compile(s.Pattern); err == nil && !pattern.MatchString(value) {
+				errors = append(errors, Error{Path: path, Message: "must match " + s.Pattern})
+			}
+		}
+	case float64:
+		if s.Minimum != nil && value < *s.Minimum {
+			errors = append(errors, Error{Path: path, Message: "must be at least " + strconv.FormatFloat(*s.Minimum, 'f', -1, 64)})
+		}
+		if s.Maximum != nil && value > *s.Maximum {
+			errors = append(errors, Error{Path: path, Message: "must be at most " + strconv.FormatFloat(*s.Maximum, 'f', -1, 64)})
+		}
+	}
+
+	return errors
+}
+
+func hasType(value interface{}, schemaType string) bool {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return schemaType == TYPE_OBJECT
+	case []interface{}:
+		return schemaType == TYPE_ARRAY
+	case string:
+		return schemaType == TYPE_STRING
+	case bool:
+		return schemaType == TYPE_BOOLEAN
+	case float64:
+		return schemaType == TYPE_NUMBER || (schemaType == TYPE_INTEGER && value == math.Trunc(value))
+	}
+
+	return false
+}
+
+func article(schemaType string) string {
+	if schemaType == TYPE_OBJECT || schemaType == TYPE_ARRAY || schemaType == TYPE_INTEGER {
+		return "an"
+	}
+
+	return "a"
+}
+
+func join(path string, name string) string {
+	if path == "" {
+		return name
+	}
+
+	return path + "." + name
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,76 @@
+package jsonschema_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/jsonschema"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["domain", "access"],
+	"additionalProperties": false,
+	"properties": {
+		"domain": {"type": "string", "minLength": 1},
+		"adopt": {"type": "boolean"},
+		"policy": {"type": "string", "enum": ["delete", "retain"]},
+		"count": {"type": "integer", "minimum": 1, "maximum": 10},
+		"access": {
+			"type": "object",
+			"properties": {
+				"groups": {"type": "array", "minItems": 1, "items": {"type": "string", "pattern": "^[a-z]+$"}}
+			}
+		}
+	}
+}`
+
+func schema(t *testing.T) *jsonschema.Schema {
+	var s jsonschema.Schema
+	if err := json.Unmarshal([]byte(testSchema), &s); err != nil {
+		t.Fatal(err)
+	}
+
+	return &s
+}
+
+func TestValidate(t *testing.T) {
+	s := schema(t)
+
+	if errors := s.ValidateJSON([]byte(`{"domain": "domain.com", "adopt": true, "count": 3, "access": {"groups": ["admins"]}}`)); len(errors) != 0 {
+		t.Errorf("ValidateJSON of valid parameters returned %v", errors)
+	}
+
+	errors := s.ValidateJSON([]byte(`{"domain": "", "adopt": "yes", "policy": "archive", "count": 1.5, "access": {"groups": ["Admins", 1]}, "domian": "x"}`))
+	expected := []string{
+		"access.groups[0] must match ^[a-z]+$",
+		"access.groups[1] must be a string",
+		"adopt must be a boolean",
+		"count must be an integer",
+		"domain must have at least 1 characters",
+		"domian is not a known parameter",
+		"policy must be one of delete, retain",
+	}
+	if len(errors) != len(expected) {
+		t.Fatalf("ValidateJSON returned %v", errors)
+	}
+	for i, err := range errors {
+		if err.Error() != expected[i] {
+			t.Errorf("ValidateJSON returned %q, not %q", err.Error(), expected[i])
+		}
+	}
+}
+
+func TestValidateEmptyDocument(t *testing.T) {
+	errors := schema(t).ValidateJSON(nil)
+	if len(errors) != 2 || errors[0].Error() != "access is required" || errors[1].Error() != "domain is required" {
+		t.Errorf("ValidateJSON of no parameters returned %v", errors)
+	}
+
+	if errors := schema(t).ValidateJSON([]byte(`[]`)); len(errors) != 1 || errors[0].Path != "" {
+		t.Errorf("ValidateJSON of an array returned %v", errors)
+	}
+	if errors := schema(t).ValidateJSON([]byte(`{`)); len(errors) != 1 {
+		t.Errorf("ValidateJSON of invalid JSON returned %v", errors)
+	}
+}
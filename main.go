@@ -2,31 +2,32 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"net/http"
 	"os"
 
 	"code.cloudfoundry.org/lager"
-	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/broker"
-	"github.com/pivotal-cf/brokerapi"
 )
 
 func main() {
 	logger := lager.NewLogger("cloudflare-broker")
 	logger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.DEBUG))
 
-	serviceBroker := broker.New(logger, map[string]broker.Zone{})
-
-	credentials := brokerapi.BrokerCredentials{
-		Username: os.Getenv(broker.BROKER_USERNAME),
-		Password: os.Getenv(broker.BROKER_PASSWORD),
+	// Without a command the broker is served, as Cloud Foundry starts it
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
 	}
 
-	brokerAPI := brokerapi.New(&serviceBroker, logger, credentials)
-
-	fmt.Println("Running Server on port " + os.Getenv(broker.BROKER_PORT))
-	http.Handle("/", brokerAPI)
-	if err := http.ListenAndServe(":"+os.Getenv(broker.BROKER_PORT), nil); err != nil {
-		log.Fatal("ListenAndServe:", err)
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		if err := c.run(logger, args); err != nil {
+			fmt.Fprintln(os.Stderr, name+":", err)
+			os.Exit(1)
+		}
+		return
 	}
+
+	usage()
+	os.Exit(2)
 }
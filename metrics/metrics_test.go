@@ -0,0 +1,68 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/metrics"
+)
+
+func TestRegistryWritesTextFormat(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := metrics.NewCounterVec("test_total", "Test counter.", "outcome")
+	histogram := metrics.NewHistogramVec("test_seconds", "Test histogram.", []float64{0.1, 1}, "outcome")
+	gauge := metrics.NewGaugeFunc("test_things", "Test gauge.", func() []metrics.Sample {
+		return []metrics.Sample{{LabelValues: []string{"free"}, Value: 1}, {LabelValues: []string{"free"}, Value: 1}}
+	}, "plan")
+	registry.MustRegister(counter, histogram, gauge)
+
+	counter.Inc("success")
+	counter.Inc(`quote"d`)
+	histogram.Observe(0.5, "success")
+
+	var buffer bytes.Buffer
+	registry.Write(&buffer)
+	for _, line := range []string{
+		"# TYPE test_total counter",
+		`test_total{outcome="success"} 1`,
+		`test_total{outcome="quote\"d"} 1`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{outcome="success",le="0.1"} 0`,
+		`test_seconds_bucket{outcome="success",le="1"} 1`,
+		`test_seconds_bucket{outcome="success",le="+Inf"} 1`,
+		`test_seconds_sum{outcome="success"} 0.5`,
+		`test_seconds_count{outcome="success"} 1`,
+		"# TYPE test_things gauge",
+		`test_things{plan="free"} 2`,
+	} {
+		if !strings.Contains(buffer.String(), line+"\n") {
+			t.Errorf("Write did not write %s in\n%s", line, buffer.String())
+		}
+	}
+}
+
+func TestRegistryRejectsDuplicates(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.MustRegister(metrics.NewCounterVec("test_total", "Test counter."))
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("MustRegister accepted a duplicate metric")
+		}
+	}()
+	registry.MustRegister(metrics.NewCounterVec("test_total", "Test counter."))
+}
+
+func TestHandler(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.MustRegister(metrics.NewCounterVec("test_total", "Test counter."))
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") || !strings.Contains(recorder.Body.String(), "# HELP test_total Test counter.") {
+		t.Errorf("Handler returned %s %s", recorder.Header(), recorder.Body)
+	}
+}
@@ -0,0 +1,73 @@
+// Package server serves the broker over HTTP or, given a certificate, over
+// HTTPS, optionally accepting only clients with a certificate signed by a
+// given CA, such as Cloud Controller's.
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/config"
+)
+
+// LIVENESS_PATH and READINESS_PATH serve the health checks. They are answered
+// without a client certificate even when one is required, since health
+// checkers have none.
+const LIVENESS_PATH = "/healthz"
+const READINESS_PATH = "/readyz"
+
+// New returns a server for handler with the timeouts in cfg.
+func New(cfg config.Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":" + strconv.Itoa(cfg.Port),
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+	}
+}
+
+// ListenAndServe serves handler on the port in cfg until the server fails.
+func ListenAndServe(logger lager.Logger, cfg config.Config, handler http.Handler) error {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(cfg.Port))
+	if err != nil {
+		return err
+	}
+
+	return Serve(logger, cfg, handler, listener)
+}
+
+// Serve serves handler on listener until the server fails or listener is
+// closed. With a certificate in cfg it serves HTTPS and reloads the
+// certificate, key and client CA files when they change. With a client CA,
+// every request but the health checks needs a client certificate.
+func Serve(logger lager.Logger, cfg config.Config, handler http.Handler, listener net.Listener) error {
+	server := New(cfg, handler)
+	if cfg.TLSCertFile == "" {
+		logger.Info("Serving HTTP", lager.Data{"address": listener.Addr().String()})
+		return server.Serve(listener)
+	}
+
+	certificates, err := LoadCertificates(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile, cfg.ClientNames())
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go certificates.Watch(logger, time.Duration(cfg.TLSReloadInterval), stop)
+
+	server.TLSConfig = certificates.TLSConfig()
+	if cfg.TLSClientCAFile != "" {
+		server.Handler = requireClientCertificate(handler)
+	}
+	logger.Info("Serving HTTPS", lager.Data{
+		"address":             listener.Addr().String(),
+		"client_certificates": cfg.TLSClientCAFile != "",
+	})
+
+	return server.ServeTLS(listener, "", "")
+}
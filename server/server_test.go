@@ -0,0 +1,203 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/config"
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/server"
+)
+
+type authority struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+var serial int64
+
+// issue returns a certificate for name signed by ca, or self-signed as a CA
+// if ca is nil.
+func issue(t *testing.T, ca *authority, name string) (authority, tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent, signer = ca.certificate, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return authority{certificate, key}, pair, certPEM, keyPEM
+}
+
+// serve starts the server on a local port and returns its URL.
+func serve(t *testing.T, cfg config.Config) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	go server.Serve(lager.NewLogger("cloudflare-broker"), cfg, handler, listener)
+
+	return "https://" + listener.Addr().String(), func() { listener.Close() }
+}
+
+func client(ca authority, certificates ...tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates},
+		},
+	}
+}
+
+func tlsConfig(t *testing.T, dir string) (config.Config, authority) {
+	cfg, err := config.Load(func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, _, caPEM, _ := issue(t, nil, "ca")
+	_, _, certPEM, keyPEM := issue(t, &ca, "broker")
+	cfg.TLSCertFile = filepath.Join(dir, "cert.pem")
+	cfg.TLSKeyFile = filepath.Join(dir, "key.pem")
+	cfg.TLSClientCAFile = filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(cfg.TLSCertFile, certPEM, 0600)
+	ioutil.WriteFile(cfg.TLSKeyFile, keyPEM, 0600)
+	ioutil.WriteFile(cfg.TLSClientCAFile, caPEM, 0600)
+
+	return cfg, ca
+}
+
+func TestServeRequiresClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudflare-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, ca := tlsConfig(t, dir)
+	cfg.TLSClientNames = "cloud-controller"
+	url, stop := serve(t, cfg)
+	defer stop()
+
+	_, cloudController, _, _ := issue(t, &ca, "cloud-controller")
+	_, other, _, _ := issue(t, &ca, "other")
+	_, untrusted, _, _ := issue(t, nil, "cloud-controller")
+
+	if response, err := client(ca, cloudController).Get(url); err != nil || response.StatusCode != http.StatusOK {
+		t.Errorf("Request with the client certificate failed %v", err)
+	}
+	if response, err := client(ca).Get(url + "/v2/catalog"); err != nil || response.StatusCode != http.StatusForbidden {
+		t.Errorf("Request without a client certificate succeeded %v", err)
+	}
+	for _, path := range []string{server.LIVENESS_PATH, server.READINESS_PATH} {
+		if response, err := client(ca).Get(url + path); err != nil || response.StatusCode != http.StatusOK {
+			t.Errorf("Health check %s without a client certificate failed %v", path, err)
+		}
+	}
+	if _, err := client(ca, other).Get(url); err == nil {
+		t.Errorf("Request with a client certificate of another name succeeded")
+	}
+	// Clients only send a certificate of a CA the server names
+	if response, err := client(ca, untrusted).Get(url); err == nil && response.StatusCode != http.StatusForbidden {
+		t.Errorf("Request with an untrusted client certificate succeeded")
+	}
+}
+
+func TestServeReloadsCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudflare-broker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, ca := tlsConfig(t, dir)
+	cfg.TLSClientCAFile = ""
+	cfg.TLSReloadInterval = config.Duration(10 * time.Millisecond)
+	url, stop := serve(t, cfg)
+	defer stop()
+
+	if _, err := client(ca).Get(url); err != nil {
+		t.Fatalf("Request failed %v", err)
+	}
+
+	renewed, _, certPEM, keyPEM := issue(t, &ca, "broker")
+	ioutil.WriteFile(cfg.TLSCertFile, certPEM, 0600)
+	ioutil.WriteFile(cfg.TLSKeyFile, keyPEM, 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(cfg.TLSCertFile, later, later)
+	os.Chtimes(cfg.TLSKeyFile, later, later)
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		response, err := client(ca).Get(url)
+		if err != nil {
+			t.Fatalf("Request after renewal failed %v", err)
+		}
+		response.Body.Close()
+		if response.TLS.PeerCertificates[0].SerialNumber.Cmp(renewed.certificate.SerialNumber) == 0 {
+			return
+		}
+	}
+	t.Errorf("Serve did not reload the renewed certificate")
+}
+
+func TestNewSetsTimeouts(t *testing.T) {
+	cfg, err := config.Load(func(string) (string, bool) { return "", false })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := server.New(cfg, http.NotFoundHandler())
+	if s.ReadHeaderTimeout == 0 || s.ReadTimeout == 0 || s.WriteTimeout == 0 || s.IdleTimeout == 0 {
+		t.Errorf("New left timeouts unset %+v", s)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// Certificates holds the server certificate and the client CAs loaded from
+// files, and reloads them when the files change so that rotating a
+// certificate does not need a restart.
+type Certificates struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	// ClientNames, if not empty, lists the common or DNS names of which a
+	// client certificate must have one.
+	ClientNames []string
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	modified    map[string]time.Time
+}
+
+// LoadCertificates loads the certificate and key, and the client CAs if
+// clientCAFile is not empty.
+func LoadCertificates(certFile, keyFile, clientCAFile string, clientNames []string) (*Certificates, error) {
+	certificates := &Certificates{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: clientCAFile,
+		ClientNames:  clientNames,
+	}
+	if _, err := certificates.Reload(); err != nil {
+		return nil, err
+	}
+
+	return certificates, nil
+}
+
+func (c *Certificates) files() []string {
+	files := []string{c.CertFile, c.KeyFile}
+	if c.ClientCAFile != "" {
+		files = append(files, c.ClientCAFile)
+	}
+
+	return files
+}
+
+// Reload loads the files again if any of them changed since they were last
+// loaded, and reports whether it did. On error the loaded certificates are
+// kept, so that a half-written file does not take the broker down.
+func (c *Certificates) Reload() (bool, error) {
+	modified := map[string]time.Time{}
+	for _, file := range c.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modified[file] = info.ModTime()
+	}
+
+	c.mu.RLock()
+	changed := c.modified == nil
+	for file, modTime := range modified {
+		changed = changed || !modTime.Equal(c.modified[file])
+	}
+	c.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return false, errors.New("cannot load " + c.CertFile + " and " + c.KeyFile + ": " + err.Error())
+	}
+
+	var clientCAs *x509.CertPool
+	if c.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return false, err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return false, errors.New("no PEM certificates in " + c.ClientCAFile)
+		}
+	}
+
+	c.mu.Lock()
+	c.certificate = &certificate
+	c.clientCAs = clientCAs
+	c.modified = modified
+	c.mu.Unlock()
+
+	return true, nil
+}
+
+// Watch reloads the files every interval until stop is closed.
+func (c *Certificates) Watch(logger lager.Logger, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := c.Reload()
+			if err != nil {
+				logger.Error("Error reloading TLS certificates", err, lager.Data{"files": c.files()})
+			} else if reloaded {
+				logger.Info("Reloaded TLS certificates", lager.Data{"files": c.files()})
+			}
+		}
+	}
+}
+
+// TLSConfig returns a configuration that serves the current certificate and
+// verifies clients against the current client CAs.
+func (c *Certificates) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.certificate},
+				NextProtos:   []string{"http/1.1"},
+			}
+			// Clients without a certificate are refused per request by
+			// requireClientCertificate, so that health checkers can
+			// connect
+			if c.clientCAs != nil {
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				config.ClientCAs = c.clientCAs
+				config.VerifyPeerCertificate = c.verifyClientName
+			}
+
+			return config, nil
+		},
+	}
+}
+
+// verifyClientName accepts a verified client certificate whose common name or
+// one of whose DNS names is in ClientNames, and clients without a certificate.
+func (c *Certificates) verifyClientName(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(c.ClientNames) == 0 || len(rawCerts) == 0 {
+		return nil
+	}
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return errors.New("no verified client certificate")
+	}
+
+	client := verifiedChains[0][0]
+	for _, name := range append([]string{client.Subject.CommonName}, client.DNSNames...) {
+		for _, allowed := range c.ClientNames {
+			if strings.EqualFold(name, allowed) {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("client certificate " + client.Subject.CommonName + " is not one of " + strings.Join(c.ClientNames, ", "))
+}
+
+// requireClientCertificate refuses requests without a verified client
+// certificate, except for the health checks.
+func requireClientCertificate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != LIVENESS_PATH && r.URL.Path != READINESS_PATH && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			http.Error(w, "a client certificate is required", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,73 @@
+package tracing
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const TRACEPARENT_HEADER = "traceparent"
+
+// VCAP_REQUEST_ID_HEADER carries the ID Cloud Controller and the router log
+// requests with.
+const VCAP_REQUEST_ID_HEADER = "X-Vcap-Request-Id"
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Middleware starts a server span for every request. The span continues the
+// trace in traceparent or, without one, starts a trace whose ID is the
+// X-Vcap-Request-Id, so that a slow request in the Cloud Controller logs can
+// be looked up. Every request is logged with its trace ID.
+func Middleware(logger lager.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		requestID := req.Header.Get(VCAP_REQUEST_ID_HEADER)
+		if sc, ok := ParseTraceparent(req.Header.Get(TRACEPARENT_HEADER)); ok {
+			ctx = ContextWithRemoteSpanContext(ctx, sc)
+		} else if traceID, ok := TraceIDFromRequestID(requestID); ok {
+			ctx = ContextWithRemoteSpanContext(ctx, SpanContext{TraceID: traceID})
+		}
+
+		ctx, span := StartSpan(ctx, req.Method+" "+req.URL.Path, SPAN_KIND_SERVER)
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.target", req.URL.Path)
+		span.SetAttribute("cf.vcap_request_id", requestID)
+
+		startedAt := time.Now()
+		writer := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(writer, req.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", strconv.Itoa(writer.status))
+		var err error
+		if writer.status >= 500 {
+			err = statusError(writer.status)
+		}
+		span.Finish(err)
+
+		logger.Info("Request", lager.Data{
+			"method":          req.Method,
+			"path":            req.URL.Path,
+			"status":          writer.status,
+			"duration_ms":     time.Since(startedAt).Nanoseconds() / int64(time.Millisecond),
+			"trace_id":        span.Context.TraceID.String(),
+			"span_id":         span.Context.SpanID.String(),
+			"vcap_request_id": requestID,
+		})
+	})
+}
+
+type statusError int
+
+func (status statusError) Error() string {
+	return http.StatusText(int(status))
+}
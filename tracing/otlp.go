@@ -0,0 +1,236 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// OTLP_BATCH_SIZE is how many spans are sent at most in one export.
+const OTLP_BATCH_SIZE = 512
+
+// OTLP_QUEUE_SIZE is how many finished spans wait for export at most; more
+// are dropped rather than slowing the broker down.
+const OTLP_QUEUE_SIZE = 4096
+
+// Exporter takes finished spans.
+type Exporter interface {
+	Enqueue(span *Span)
+}
+
+type noopExporter struct{}
+
+func (noopExporter) Enqueue(*Span) {}
+
+var (
+	exporterMu      sync.RWMutex
+	currentExporter Exporter = noopExporter{}
+)
+
+// SetExporter sets where finished spans go. Spans are dropped until an
+// exporter is set, or if it is set to nil.
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+
+	if e == nil {
+		e = noopExporter{}
+	}
+	currentExporter = e
+}
+
+func exporter() Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+
+	return currentExporter
+}
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector with
+// OTLP over HTTP, encoded as JSON.
+type OTLPExporter struct {
+	// Endpoint is the traces URL, such as http://collector:4318/v1/traces.
+	Endpoint    string
+	Headers     map[string]string
+	ServiceName string
+	Interval    time.Duration
+	Client      *http.Client
+
+	logger lager.Logger
+	queue  chan *Span
+}
+
+// NewOTLPExporter returns an exporter that sends the queued spans every
+// interval, until stop is closed.
+func NewOTLPExporter(logger lager.Logger, endpoint string, headers map[string]string, serviceName string, interval time.Duration, stop <-chan struct{}) *OTLPExporter {
+	e := &OTLPExporter{
+		Endpoint:    endpoint,
+		Headers:     headers,
+		ServiceName: serviceName,
+		Interval:    interval,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		logger:      logger.Session("otlp-exporter"),
+		queue:       make(chan *Span, OTLP_QUEUE_SIZE),
+	}
+	go e.run(stop)
+
+	return e
+}
+
+func (e *OTLPExporter) Enqueue(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		e.logger.Debug("Dropped span, the export queue is full", lager.Data{"span": span.Name})
+	}
+}
+
+func (e *OTLPExporter) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.Export(batch); err != nil {
+			e.logger.Error("Error exporting spans", err, lager.Data{"spans": len(batch)})
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= OTLP_BATCH_SIZE {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-stop:
+			flush()
+			return
+		}
+	}
+}
+
+// Export sends spans to the collector.
+func (e *OTLPExporter) Export(spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", e.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range e.Headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := e.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode/100 != 2 {
+		return errors.New("collector answered " + response.Status)
+	}
+
+	return nil
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func attributes(values map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	list := make([]otlpAttribute, len(keys))
+	for i, key := range keys {
+		list[i].Key = key
+		list[i].Value.StringValue = values[key]
+	}
+
+	return list
+}
+
+// request builds an ExportTraceServiceRequest.
+func (e *OTLPExporter) request(spans []*Span) map[string]interface{} {
+	encoded := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		span.mu.Lock()
+		encoded[i] = otlpSpan{
+			TraceID:           span.Context.TraceID.String(),
+			SpanID:            span.Context.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        attributes(span.Attributes),
+		}
+		if span.Parent.IsValid() {
+			encoded[i].ParentSpanID = span.Parent.String()
+		}
+		if span.Err != nil {
+			// STATUS_CODE_ERROR
+			encoded[i].Status.Code = 2
+			encoded[i].Status.Message = span.Err.Error()
+		}
+		span.mu.Unlock()
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": attributes(map[string]string{"service.name": e.ServiceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
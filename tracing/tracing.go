@@ -0,0 +1,224 @@
+// Package tracing records spans of broker operations and Cloudflare API
+// calls, propagates W3C trace context and Cloud Foundry request IDs, and
+// exports spans with OTLP. It implements the small part of OpenTelemetry
+// the broker needs with the standard library.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of spans, as numbered by OTLP.
+const SPAN_KIND_INTERNAL = 1
+const SPAN_KIND_SERVER = 2
+const SPAN_KIND_CLIENT = 3
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Span is an operation being traced. Its methods are safe to call on a nil
+// span, so callers need not check whether tracing is set up.
+type Span struct {
+	Name       string
+	Kind       int
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Err        error
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// SetAttribute annotates the span, for example with the instance ID.
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil || value == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// Finish ends the span with the outcome of its operation and hands it to
+// the exporter. Only the first call counts.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.Err = err
+	s.mu.Unlock()
+
+	if s.Context.Sampled {
+		exporter().Enqueue(s)
+	}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// StartSpan starts a span as a child of the span or remote span context in
+// ctx, or as the root of a new trace, and returns a context holding it.
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+	}
+
+	parent := SpanContextFromContext(ctx)
+	if parent.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.Parent = parent.SpanID
+	} else {
+		if parent.TraceID.IsValid() {
+			span.Context.TraceID = parent.TraceID
+		} else {
+			rand.Read(span.Context.TraceID[:])
+		}
+		span.Context.Sampled = true
+	}
+	rand.Read(span.Context.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanFromContext returns the span in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+
+	return span
+}
+
+// SpanContextFromContext returns the context of the span in ctx, or of the
+// remote parent in ctx if no span was started yet.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.Context
+	}
+	if ctx == nil {
+		return SpanContext{}
+	}
+	remote, _ := ctx.Value(remoteKey{}).(SpanContext)
+
+	return remote
+}
+
+// ContextWithRemoteSpanContext returns a context whose next span continues
+// the trace of a caller.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Detach returns a context that continues the trace of ctx but is not
+// cancelled with it, for work that outlives a request.
+func Detach(ctx context.Context) context.Context {
+	detached := context.Background()
+	if span := SpanFromContext(ctx); span != nil {
+		detached = context.WithValue(detached, spanKey{}, span)
+	}
+
+	return detached
+}
+
+// ParseTraceparent reads a W3C traceparent header, such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func ParseTraceparent(header string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+
+	return sc, sc.IsValid()
+}
+
+// Traceparent formats sc as a W3C traceparent header.
+func Traceparent(sc SpanContext) string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// TraceIDFromRequestID turns a Cloud Foundry request ID, a UUID possibly
+// followed by "::" and another UUID, into a trace ID, so that a trace can
+// be found by the X-Vcap-Request-Id in the Cloud Controller logs.
+func TraceIDFromRequestID(requestID string) (TraceID, bool) {
+	var id TraceID
+	uuid := strings.Replace(strings.SplitN(requestID, "::", 2)[0], "-", "", -1)
+	if len(uuid) != 32 {
+		return id, false
+	}
+	if _, err := hex.Decode(id[:], []byte(uuid)); err != nil {
+		return id, false
+	}
+
+	return id, id.IsValid()
+}
@@ -0,0 +1,119 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"github.com/cloudflare/Cloudflare-Pivotal-Cloud-Foundry/tracing"
+)
+
+type recorder struct {
+	mu    sync.Mutex
+	spans []*tracing.Span
+}
+
+func (r *recorder) Enqueue(span *tracing.Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func TestTraceparent(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := tracing.ParseTraceparent(header)
+	if !ok || !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("ParseTraceparent returned %+v %v", sc, ok)
+	}
+	if tracing.Traceparent(sc) != header {
+		t.Errorf("Traceparent returned %s", tracing.Traceparent(sc))
+	}
+
+	for _, invalid := range []string{"", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "00-xyz-00f067aa0ba902b7-01"} {
+		if _, ok := tracing.ParseTraceparent(invalid); ok {
+			t.Errorf("ParseTraceparent accepted %s", invalid)
+		}
+	}
+}
+
+func TestTraceIDFromRequestID(t *testing.T) {
+	id, ok := tracing.TraceIDFromRequestID("6f2b7c1e-8d1e-4b8a-9b5e-3f0c2a1d4e5f::b1a2c3d4-e5f6-4a7b-8c9d-0e1f2a3b4c5d")
+	if !ok || id.String() != "6f2b7c1e8d1e4b8a9b5e3f0c2a1d4e5f" {
+		t.Errorf("TraceIDFromRequestID returned %s %v", id, ok)
+	}
+	if _, ok := tracing.TraceIDFromRequestID("not-a-uuid"); ok {
+		t.Errorf("TraceIDFromRequestID accepted a request ID that is not a UUID")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	spans := &recorder{}
+	tracing.SetExporter(spans)
+	defer tracing.SetExporter(nil)
+
+	var child *tracing.Span
+	handler := tracing.Middleware(lager.NewLogger("cloudflare-broker"), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, child = tracing.StartSpan(req.Context(), "child", tracing.SPAN_KIND_INTERNAL)
+		child.Finish(nil)
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	request := httptest.NewRequest("PUT", "/v2/service_instances/1", nil)
+	request.Header.Set(tracing.VCAP_REQUEST_ID_HEADER, "6f2b7c1e-8d1e-4b8a-9b5e-3f0c2a1d4e5f")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	if len(spans.spans) != 2 {
+		t.Fatalf("Middleware exported %d spans", len(spans.spans))
+	}
+	server := spans.spans[1]
+	if server.Context.TraceID.String() != "6f2b7c1e8d1e4b8a9b5e3f0c2a1d4e5f" || server.Attributes["http.status_code"] != "201" {
+		t.Errorf("Middleware traced %+v", server)
+	}
+	if child.Parent != server.Context.SpanID || child.Context.TraceID != server.Context.TraceID {
+		t.Errorf("Span %+v is not a child of %+v", child, server)
+	}
+
+	request = httptest.NewRequest("GET", "/v2/catalog", nil)
+	request.Header.Set(tracing.TRACEPARENT_HEADER, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	if server := spans.spans[3]; server.Parent.String() != "00f067aa0ba902b7" || server.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Middleware did not continue the trace of traceparent %+v", server)
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	var body map[string]interface{}
+	var header string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header.Get("Api-Key")
+		data, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(data, &body)
+	}))
+	defer collector.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	exporter := tracing.NewOTLPExporter(lager.NewLogger("cloudflare-broker"), collector.URL, map[string]string{"Api-Key": "secret"}, "cloudflare-broker", time.Hour, stop)
+
+	ctx, parent := tracing.StartSpan(context.Background(), "parent", tracing.SPAN_KIND_SERVER)
+	_, span := tracing.StartSpan(ctx, "cloudflare GET zones/:id", tracing.SPAN_KIND_CLIENT)
+	span.SetAttribute("cloudflare.ray", "7d1c2e3f4a5b6c7d-AMS")
+	span.Finish(nil)
+	parent.Finish(nil)
+
+	if err := exporter.Export([]*tracing.Span{span}); err != nil {
+		t.Fatalf("Export failed %v", err)
+	}
+
+	exported := body["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	if header != "secret" || exported["traceId"] != parent.Context.TraceID.String() || exported["parentSpanId"] != parent.Context.SpanID.String() || exported["kind"] != float64(tracing.SPAN_KIND_CLIENT) {
+		t.Errorf("Export sent %v with header %s", exported, header)
+	}
+}